@@ -0,0 +1,91 @@
+package simple_rpc
+
+import (
+	"fmt"
+	"sync"
+)
+
+// acl 记录方法级别的访问控制列表，键为 "Service.Method"。
+// 拒绝列表优先于允许列表；开启 defaultDeny 后，只有在允许列表中的方法才可以被调用。
+// 默认不做任何限制，保证已有的服务端行为不变。
+type acl struct {
+	mu          sync.RWMutex
+	allowed     map[string]bool
+	denied      map[string]bool
+	defaultDeny bool
+}
+
+// AllowMethods permits calls to the given "Service.Method"s,
+// it only matters if they were denied before or default deny is on.
+func (server *Server) AllowMethods(serviceMethod ...string) {
+	server.acl.mu.Lock()
+	defer server.acl.mu.Unlock()
+	if server.acl.allowed == nil {
+		server.acl.allowed = make(map[string]bool)
+	}
+	for _, m := range serviceMethod {
+		server.acl.allowed[m] = true
+		delete(server.acl.denied, m)
+	}
+}
+
+// DenyMethods rejects calls to the given "Service.Method"s without executing them.
+func (server *Server) DenyMethods(serviceMethod ...string) {
+	server.acl.mu.Lock()
+	defer server.acl.mu.Unlock()
+	if server.acl.denied == nil {
+		server.acl.denied = make(map[string]bool)
+	}
+	for _, m := range serviceMethod {
+		server.acl.denied[m] = true
+		delete(server.acl.allowed, m)
+	}
+}
+
+// SetDefaultDeny rejects all methods except the allowed ones if deny is true.
+func (server *Server) SetDefaultDeny(deny bool) {
+	server.acl.mu.Lock()
+	defer server.acl.mu.Unlock()
+	server.acl.defaultDeny = deny
+}
+
+// permitted reports whether serviceMethod is allowed to be called
+func (a *acl) permitted(serviceMethod string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.denied[serviceMethod] {
+		return false
+	}
+	return !a.defaultDeny || a.allowed[serviceMethod]
+}
+
+// SetMetadataAllowlist rejects requests carrying metadata keys not in keys with CodeNotPermitted,
+// the method isn't executed. Passing nil restores the default which accepts any metadata,
+// an empty non-nil slice rejects every request carrying metadata.
+// 严格模式可以防止中间件或有问题的客户端借助元数据夹带意料之外的上下文。
+// 服务端自身读取的键同样需要列出，例如开启 SetIdempotency 时的 IdempotencyKey，否则携带它的请求都会被拒绝；
+// 鉴权令牌、链路追踪 ID 等由方法或调用方自行约定的键也是如此。客户端的计时请求由 Header.Debug 携带，不受影响。
+func (server *Server) SetMetadataAllowlist(keys []string) {
+	var allowed map[string]bool
+	if keys != nil {
+		allowed = make(map[string]bool, len(keys))
+		for _, k := range keys {
+			allowed[k] = true
+		}
+	}
+	server.metaAllowlist.Store(allowed)
+}
+
+// checkMeta returns an error if meta carries a key not in the allowlist
+func (server *Server) checkMeta(meta map[string]string) error {
+	allowed, _ := server.metaAllowlist.Load().(map[string]bool)
+	if allowed == nil {
+		return nil
+	}
+	for k := range meta {
+		if !allowed[k] {
+			return newError(CodeNotPermitted, fmt.Sprintf("rpc server: metadata key %q is not allowed", k))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package simple_rpc
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// 方法的入参可以是接口类型（例如 func (b *Bus) Publish(e Event, reply *int) error），用于接收多种具体类型的消息。
+// 仅凭接口类型无法确定解码的目标，因此客户端用 Typed 包装入参，由请求头的 ArgType 携带具体类型的标签；
+// 服务端通过 RegisterType 预先登记可能出现的具体类型，按标签创建实例并解码，再赋值给接口类型的入参。
+// 这与 gob.Register 的作用类似，但不依赖编码方式本身对多态的支持，Gob 和 Msgpack 都适用。
+// 限制：HTTP 网关使用 JSON 编码且不携带类型标签，因此不支持接口类型的入参。
+
+// typeTag returns the tag of t carried in the header, eg, "*simple_rpc.Created"
+func typeTag(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		return "*" + typeTag(t.Elem())
+	}
+	if t.Name() != "" && t.PkgPath() != "" {
+		return t.PkgPath() + "." + t.Name()
+	}
+	return t.String()
+}
+
+// RegisterType registers the concrete type of sample, so that it can be decoded
+// into the args of methods whose ArgType is an interface.
+// sample 可以是值或指针，两者是不同的类型，客户端 Typed 包装的入参必须与登记的类型一致。
+func (server *Server) RegisterType(sample interface{}) {
+	t := reflect.TypeOf(sample)
+	server.types.Store(typeTag(t), t)
+}
+
+// RegisterType registers the concrete type of sample in the DefaultServer.
+func RegisterType(sample interface{}) { DefaultServer.RegisterType(sample) }
+
+// typedArgs is args with the tag of its concrete type
+type typedArgs struct {
+	tag  string
+	args interface{}
+}
+
+// Typed wraps args sent to a method whose ArgType is an interface,
+// the concrete type of args must be registered on the server by RegisterType.
+// eg, client.Call(ctx, "Bus.Publish", Typed(&Created{ID: 1}), &reply).
+func Typed(args interface{}) interface{} {
+	return typedArgs{tag: typeTag(reflect.TypeOf(args)), args: args}
+}
+
+// unwrapArgs returns the tag and the body to send of args
+func unwrapArgs(args interface{}) (string, interface{}) {
+	if t, ok := args.(typedArgs); ok {
+		return t.tag, t.args
+	}
+	return "", args
+}
+
+// newTypedArgV returns a new value of the concrete type registered as tag,
+// and the pointer to decode the body into.
+func (server *Server) newTypedArgV(argType reflect.Type, tag string) (argV reflect.Value, body interface{}, err error) {
+	if tag == "" {
+		return argV, nil, newError(CodeCodec, fmt.Sprintf("rpc server: arg of type %s requires a type tag", argType))
+	}
+	ti, ok := server.types.Load(tag)
+	if !ok {
+		return argV, nil, newError(CodeCodec, "rpc server: unregistered arg type "+tag)
+	}
+	t := ti.(reflect.Type)
+	if !t.Implements(argType) {
+		return argV, nil, newError(CodeCodec, fmt.Sprintf("rpc server: %s doesn't implement %s", tag, argType))
+	}
+	if t.Kind() == reflect.Ptr {
+		argV = reflect.New(t.Elem())
+		return argV, argV.Interface(), nil
+	}
+	argV = reflect.New(t)
+	return argV.Elem(), argV.Interface(), nil
+}
@@ -0,0 +1,72 @@
+package simple_rpc
+
+import (
+	"log"
+	"reflect"
+	"simple_rpc/codec"
+	"sync/atomic"
+	"time"
+)
+
+// AuditHook observes a request after it's handled, including the failed and timed out ones.
+// h 是请求头的副本，argv 和 replyv 是请求处理完成时拍摄的深拷贝（见 deepCopyValue），
+// 即使方法保留并在之后修改了它们，钩子也可以安全地读取和保留；流式的入参（io.Reader）不会被复制。
+// 超时的请求 replyv 为 nil，因为方法可能仍在执行。
+type AuditHook func(h *codec.Header, argv, replyv interface{}, err error, dur time.Duration)
+
+type auditEvent struct {
+	h            codec.Header
+	argv, replyv interface{}
+	err          error
+	dur          time.Duration
+}
+
+// auditQueueSize bounds the events waiting to be audited
+const auditQueueSize = 1024
+
+// SetAuditHook sets the hook called after each request is handled.
+// 与拦截器不同，审计钩子不能改变请求的处理结果：事件被放入有界队列，由单独的协程按顺序调用钩子，
+// 因此钩子不会阻塞请求的处理；队列满时事件会被丢弃并计入 AuditDropped。nil 表示关闭审计。
+func (server *Server) SetAuditHook(hook AuditHook) {
+	server.auditHook.Store(hook)
+	server.auditOnce.Do(func() {
+		server.auditQueue = make(chan auditEvent, auditQueueSize)
+		go server.auditLoop()
+	})
+}
+
+// AuditDropped returns the number of events dropped because the audit queue is full
+func (server *Server) AuditDropped() uint64 {
+	return atomic.LoadUint64(&server.auditDropped)
+}
+
+func (server *Server) audit(req *request, replyv interface{}, err error, start time.Time) {
+	hook, _ := server.auditHook.Load().(AuditHook)
+	if hook == nil {
+		return
+	}
+	// snapshot the values, the method may still hold them, see deepCopyValue
+	argv := req.argV.Interface()
+	if req.stream == nil {
+		argv = deepCopyValue(req.argV).Interface()
+	}
+	if replyv != nil {
+		replyv = deepCopyValue(reflect.ValueOf(replyv)).Interface()
+	}
+	e := auditEvent{h: *req.h, argv: argv, replyv: replyv, err: err, dur: server.now().Sub(start)}
+	select {
+	case server.auditQueue <- e:
+	default:
+		if atomic.AddUint64(&server.auditDropped, 1) == 1 {
+			log.Println("rpc server: audit queue is full, dropping events")
+		}
+	}
+}
+
+func (server *Server) auditLoop() {
+	for e := range server.auditQueue {
+		if hook, _ := server.auditHook.Load().(AuditHook); hook != nil {
+			hook(&e.h, e.argv, e.replyv, e.err, e.dur)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package simple_rpc
+
+import (
+	"context"
+	"simple_rpc/codec"
+)
+
+// Batch queues multiple calls and sends them on the connection at once.
+// 批量调用先把所有请求写入缓冲区，只 flush 一次后再等待响应，响应按 Seq 与各自的 Call 对应，
+// 因此 N 个调用只需要一次往返的等待，而不是 N 次。服务端本来就支持在一个连接上连续读取多个请求，这纯粹是客户端的优化。
+// 每个调用的错误单独记录在 Add 返回的 Call.Error 中。Batch 不是并发安全的。
+type Batch struct {
+	client *Client
+	calls  []*Call
+}
+
+// Batch returns an empty batch of the client
+func (client *Client) Batch() *Batch {
+	return &Batch{client: client}
+}
+
+// Add queues a call, it's sent when Do is called
+func (b *Batch) Add(serviceMethod string, args, reply interface{}) *Call {
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          make(chan *Call, 1),
+	}
+	b.calls = append(b.calls, call)
+	return call
+}
+
+// Do sends all queued calls and waits until all of them complete or ctx is done,
+// the batch is emptied so it can be reused. The error of each call is set in its Call.Error,
+// Do itself only returns an error if ctx is done, unfinished calls are abandoned then and completed with the error.
+// The metadata attached to ctx by WithMeta is sent with every call.
+func (b *Batch) Do(ctx context.Context) error {
+	calls := b.calls
+	b.calls = nil
+	if meta := outgoingMeta(ctx); meta != nil {
+		for _, call := range calls {
+			call.Meta = meta
+		}
+	}
+	b.client.sendBatch(calls)
+	for _, call := range calls {
+		select {
+		case <-ctx.Done():
+			err := ctxError(ctx)
+			for _, call := range calls {
+				if b.client.removeCall(call.Seq) != nil {
+					call.Error = err
+					call.done()
+				}
+			}
+			return err
+		case <-call.Done:
+		}
+	}
+	return nil
+}
+
+// sendBatch is like send, but all requests are written before flushing once
+func (client *Client) sendBatch(calls []*Call) {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	w, buffered := client.cc.(codec.BufferedWriter)
+	var sent []*Call
+	for _, call := range calls {
+		seq, err := client.registerCall(call)
+		if err != nil {
+			call.Error = err
+			call.done()
+			continue
+		}
+		client.header.ServiceMethod = call.ServiceMethod
+		client.header.Seq = seq
+		client.header.Error = ""
+		client.header.OneWay = false
+		client.header.Meta = call.Meta
+		client.header.Debug = call.Debug
+		var body interface{}
+		client.header.ArgType, body = unwrapArgs(call.Args)
+		if buffered {
+			err = w.WriteBuffered(&client.header, body)
+		} else {
+			err = client.cc.Write(&client.header, body)
+		}
+		if err != nil {
+			client.failCall(seq, err)
+			continue
+		}
+		sent = append(sent, call)
+	}
+	if !buffered {
+		return
+	}
+	if err := w.Flush(); err != nil {
+		for _, call := range sent {
+			client.failCall(call.Seq, err)
+		}
+	}
+}
+
+// failCall completes the pending call of seq with err, if it's still pending
+func (client *Client) failCall(seq uint64, err error) {
+	if call := client.removeCall(seq); call != nil {
+		call.Error = err
+		call.done()
+	}
+}
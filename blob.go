@@ -0,0 +1,141 @@
+package simple_rpc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+)
+
+// Blob 用于在已有的连接上传输大的二进制数据（模型文件、备份等），建立在 Stream 和 StreamTo 之上，两个方向都支持：
+//
+//   - 上传：客户端调用 client.Call(ctx, "Store.Put", Blob(f), &n)，方法的入参是 io.Reader，
+//     用 BlobReader 包装后读取，例如 io.Copy(dst, BlobReader(r))。
+//   - 下载：方法的返回值是 io.Writer，用 SendBlob(w, src) 写入数据，
+//     客户端调用 client.Call(ctx, "Store.Get", name, BlobTo(f))。
+//
+// 分块：数据按 Stream 的帧发送，每个数据块最大 32 KiB（streamChunkSize），同一个调用的所有帧使用相同的 Seq。
+// 背压：上传时服务端的读循环把数据块写入 io.Pipe，方法读多少，读循环才继续读多少；下载时客户端的读循环把数据块写入
+// 调用方的 io.Writer 后才读取下一帧，连接的缓冲区写满后服务端的写入阻塞。两端都不会把整个 blob 缓存在内存中。
+// 校验：数据之后紧跟 32 字节的 SHA-256 摘要，接收端边接收边计算，数据结束时比较摘要，
+// 不一致或者缺少摘要时返回 ErrBlobChecksum：上传时由 BlobReader 的 Read 返回，下载时作为 Call 的错误返回。
+// 接收端在校验之前已经把数据写出，校验失败时调用方应当丢弃已经写出的数据。
+
+// ErrBlobChecksum is returned if the checksum of a blob doesn't match its data, or the checksum is missing
+var ErrBlobChecksum = errors.New("rpc: blob checksum mismatch")
+
+// Blob wraps r as the arg of a method reading a blob with BlobReader,
+// r is sent in chunks followed by its checksum, see Stream.
+func Blob(r io.Reader) interface{} {
+	return Stream(&blobSource{r: r, h: sha256.New()})
+}
+
+// BlobReader reads the blob sent with Blob from r, the arg of the method,
+// it returns ErrBlobChecksum instead of io.EOF if the data is corrupted.
+func BlobReader(r io.Reader) io.Reader {
+	return &blobReader{r: r, h: sha256.New()}
+}
+
+// SendBlob writes the data read from r to w, the reply of the method, followed by its checksum,
+// the client receives it with BlobTo. It returns the size of the data.
+func SendBlob(w io.Writer, r io.Reader) (int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		return n, err
+	}
+	_, err = w.Write(h.Sum(nil))
+	return n, err
+}
+
+// BlobTo wraps w as the reply of a method sending a blob with SendBlob, the data is written to w as it arrives,
+// the call fails with ErrBlobChecksum if the data is corrupted, see StreamTo.
+func BlobTo(w io.Writer) interface{} {
+	sink := &blobSink{w: w, h: sha256.New()}
+	return &streamReply{w: sink, finish: sink.verify}
+}
+
+// blobSource reads r, then its checksum
+type blobSource struct {
+	r   io.Reader
+	h   hash.Hash
+	sum []byte // checksum left to read, nil until r is read
+}
+
+func (s *blobSource) Read(p []byte) (int, error) {
+	if s.sum == nil {
+		n, err := s.r.Read(p)
+		s.h.Write(p[:n])
+		if err != io.EOF {
+			return n, err
+		}
+		s.sum = s.h.Sum(nil)
+		if n > 0 {
+			return n, nil
+		}
+	}
+	if len(s.sum) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, s.sum)
+	s.sum = s.sum[n:]
+	return n, nil
+}
+
+// blobReader reads the data from r, the last sha256.Size bytes are held back as the checksum
+type blobReader struct {
+	r   io.Reader
+	h   hash.Hash
+	buf []byte // read from r but not returned yet
+	err error  // error of r
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	for len(b.buf) <= sha256.Size && b.err == nil {
+		chunk := make([]byte, streamChunkSize)
+		n, err := b.r.Read(chunk)
+		b.buf = append(b.buf, chunk[:n]...)
+		b.err = err
+	}
+	if len(b.buf) <= sha256.Size {
+		if b.err != io.EOF {
+			return 0, b.err
+		}
+		if !bytes.Equal(b.buf, b.h.Sum(nil)) {
+			return 0, ErrBlobChecksum
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, b.buf[:len(b.buf)-sha256.Size])
+	b.h.Write(p[:n])
+	b.buf = append(b.buf[:0], b.buf[n:]...)
+	return n, nil
+}
+
+// blobSink writes the data to w, the last sha256.Size bytes are held back as the checksum
+type blobSink struct {
+	w   io.Writer
+	h   hash.Hash
+	buf []byte // written but not passed to w yet
+}
+
+func (s *blobSink) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	if n := len(s.buf) - sha256.Size; n > 0 {
+		if _, err := s.w.Write(s.buf[:n]); err != nil {
+			return 0, err
+		}
+		s.h.Write(s.buf[:n])
+		s.buf = append(s.buf[:0], s.buf[n:]...)
+	}
+	return len(p), nil
+}
+
+// verify checks the checksum once all data is written
+func (s *blobSink) verify() error {
+	if !bytes.Equal(s.buf, s.h.Sum(nil)) {
+		return ErrBlobChecksum
+	}
+	return nil
+}
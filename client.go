@@ -3,16 +3,17 @@ package simple_rpc
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"reflect"
 	"simple_rpc/codec"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,11 +21,15 @@ import (
 // 支持异步调用，Call 结构体中添加了一个字段 Done，Done 的类型是 chan *Call，当调用结束时，会调用 call.done() 通知调用方。
 type Call struct {
 	Seq           uint64
-	ServiceMethod string      // format "<service>.<method>"
-	Args          interface{} // arguments to the function
-	Reply         interface{} // reply from the function
-	Error         error       // if error occurs, it will be set
-	Done          chan *Call  // Strobes when call is complete.
+	ServiceMethod string            // format "<service>.<method>"
+	Args          interface{}       // arguments to the function
+	Reply         interface{}       // reply from the function
+	Error         error             // if error occurs, it will be set
+	Meta          map[string]string // metadata sent with the request
+	Debug         bool              // ask the server to report its timing in Trace, see WithTrace
+	Trace         *codec.Trace      // server-side timing, set when the call completes if Debug is set
+	Warning       string            // warning sent with the response, eg, the method is deprecated, see Option.OnWarning
+	Done          chan *Call        // Strobes when call is complete.
 }
 
 func (call *Call) done() {
@@ -42,16 +47,25 @@ func (call *Call) done() {
 // seq 用于给发送的请求编号，每个请求拥有唯一编号。
 // pending 存储未处理完的请求，键是编号，值是 Call 实例。
 // closing 和 shutdown 任意一个值置为 true，则表示 Client 处于不可用的状态，但有些许的差别，closing 是用户主动关闭的，即调用 Close 方法，而 shutdown 置为 true 一般是有错误发生。
+// redial 不为 nil 时（Option.ReconnectBackoff 大于 0），连接断开后不会进入 shutdown 状态，而是重新建立连接，
+// 重连期间 reconnecting 记录断开的原因，新的调用会立即以该错误失败。
 type Client struct {
-	cc       codec.Codec
-	opt      *Option
-	sending  sync.Mutex // protect following
-	header   codec.Header
-	mu       sync.Mutex // protect following
-	seq      uint64
-	pending  map[uint64]*Call
-	closing  bool // user has called Close
-	shutdown bool // server has told us to stop
+	cc           codec.Codec
+	opt          *Option
+	redial       func() (codec.Codec, error)
+	closed       chan struct{} // closed by Close, wakes up the reconnecting backoff
+	sending      sync.Mutex    // protect following
+	header       codec.Header
+	lastSend     int64      // unix nano, read atomically by keepAlive
+	mu           sync.Mutex // protect following
+	seq          uint64
+	pending      map[uint64]*Call
+	warned       map[string]bool // methods whose warnings are logged
+	closing      bool            // user has called Close
+	shutdown     bool            // server has told us to stop
+	reconnecting error           // the connection is lost and being re-established
+	subs         map[string]*subscription
+	interceptors atomic.Value // []Interceptor, see Use
 }
 
 var _ io.Closer = (*Client)(nil)
@@ -66,27 +80,49 @@ func (client *Client) Close() error {
 		return ErrShutdown
 	}
 	client.closing = true
+	close(client.closed)
+	if client.reconnecting != nil {
+		// the lost connection is closed already
+		return nil
+	}
 	return client.cc.Close()
 }
 
-// IsAvailable return true if the client does work
+// IsAvailable return true if the client does work, it's false while the client is reconnecting.
 func (client *Client) IsAvailable() bool {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	return !client.shutdown && !client.closing
+	return client.unavailable() == nil
+}
+
+// unavailable returns the error of the calls made now, or nil if the client does work,
+// client.mu must be held.
+func (client *Client) unavailable() error {
+	if client.closing || client.shutdown {
+		return ErrShutdown
+	}
+	return client.reconnecting
 }
 
-// registerCall：将参数 call 添加到 client.pending 中，并更新 client.seq。
+// registerCall：将参数 call 添加到 client.pending 中，并更新 client.seq，设置了 Option.SeqFunc 时由它分配 seq。
 func (client *Client) registerCall(call *Call) (uint64, error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	if client.closing || client.shutdown {
-		return 0, ErrShutdown
+	if err := client.unavailable(); err != nil {
+		return 0, err
 	}
-	call.Seq = client.seq
-	client.pending[call.Seq] = call
-	client.seq++
-	return call.Seq, nil
+	seq := client.seq
+	if client.opt.SeqFunc != nil {
+		seq = client.opt.SeqFunc()
+		if _, ok := client.pending[seq]; ok || seq == 0 {
+			return 0, fmt.Errorf("rpc client: invalid seq %d allocated by SeqFunc", seq)
+		}
+	} else {
+		client.seq++
+	}
+	call.Seq = seq
+	client.pending[seq] = call
+	return seq, nil
 }
 
 // removeCall：根据 seq，从 client.pending 中移除对应的 call，并返回。
@@ -105,7 +141,13 @@ func (client *Client) terminateCalls(err error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 	client.shutdown = true
-	for _, call := range client.pending {
+	client.failPending(err)
+}
+
+// failPending completes all pending calls with err, client.mu must be held
+func (client *Client) failPending(err error) {
+	for seq, call := range client.pending {
+		delete(client.pending, seq)
 		call.Error = err
 		call.done()
 	}
@@ -128,16 +170,22 @@ func (client *Client) send(call *Call) {
 	client.header.ServiceMethod = call.ServiceMethod
 	client.header.Seq = seq
 	client.header.Error = ""
+	client.header.OneWay = false
+	client.header.Meta = call.Meta
+	client.header.Debug = call.Debug
+	if s, ok := call.Args.(streamArgs); ok {
+		client.sendStream(call, seq, s)
+		return
+	}
+	var body interface{}
+	client.header.ArgType, body = unwrapArgs(call.Args)
 
 	// encode and send the request
-	if err := client.cc.Write(&client.header, call.Args); err != nil {
-		call := client.removeCall(seq)
-		// call may be nil, it usually means that Write partially failed,
+	atomic.StoreInt64(&client.lastSend, time.Now().UnixNano())
+	if err := client.cc.Write(&client.header, body); err != nil {
+		// call may have been removed, it usually means that Write partially failed,
 		// client has received the response and handled
-		if call != nil {
-			call.Error = err
-			call.done()
-		}
+		client.failCall(seq, err)
 	}
 }
 
@@ -146,32 +194,137 @@ func (client *Client) send(call *Call) {
 // call 存在，但服务端处理出错，即 h.Error 不为空。
 // call 存在，服务端处理正常，那么需要从 body 中读取 Reply 的值。
 func (client *Client) receive() {
+	for {
+		err := client.readResponses()
+		// error occurs, so terminateCalls pending calls
+		err = newError(errorCode(err, CodeTransport), err.Error())
+		if client.redial == nil || errorCode(err, CodeTransport) != CodeTransport || !client.reconnect(err) {
+			client.terminateCalls(err)
+			return
+		}
+		// the subscriptions are lost with the connection
+		go client.resubscribe()
+	}
+}
+
+// readResponses reads the responses from the connection until it fails
+func (client *Client) readResponses() error {
 	var err error
 	for err == nil {
 		var h codec.Header
 		if err = client.cc.ReadHeader(&h); err != nil {
 			break
 		}
+		if h.Push {
+			err = client.dispatch(&h)
+			continue
+		}
+		if h.Stream {
+			err = client.readChunk(&h)
+			continue
+		}
 		call := client.removeCall(h.Seq)
+		if call != nil {
+			call.Trace = h.Trace
+			if call.Warning = h.Meta[DeprecationKey]; call.Warning != "" {
+				client.warn(call.ServiceMethod, call.Warning)
+			}
+		}
 		switch {
+		case h.Seq == 0 && ErrorCode(h.Code) == CodeUnsupportedVersion:
+			// the server rejects the connection
+			err = newError(ErrorCode(h.Code), h.Error)
+		case h.Seq == 0 && h.Error != "":
+			// not a reply of any call, eg, an older server fails a one-way call it doesn't know
+			log.Println("rpc client: server error:", h.Error)
+			err = client.cc.ReadBody(nil)
 		case call == nil:
 			// it usually means that Write partially failed
 			// and call was already removed.
 			err = client.cc.ReadBody(nil)
 		case h.Error != "":
-			call.Error = fmt.Errorf(h.Error)
+			e := newError(ErrorCode(h.Code), h.Error)
+			e.RetryAfter = h.RetryAfter
+			call.Error = e
 			err = client.cc.ReadBody(nil)
 			call.done()
 		default:
-			err = client.cc.ReadBody(call.Reply)
+			body := call.Reply
+			stream, streamed := body.(*streamReply)
+			if r, ok := body.(Replies); ok {
+				body = r.body()
+			} else if streamed {
+				// the response only ends the stream
+				body = nil
+			}
+			err = client.cc.ReadBody(body)
 			if err != nil {
-				call.Error = errors.New("reading body " + err.Error())
+				call.Error = newError(CodeCodec, "reading body "+err.Error())
+			} else if streamed && stream.finish != nil {
+				call.Error = stream.finish()
+			} else if client.opt.ValidateReplies {
+				call.Error = validateReply(call.Reply)
 			}
 			call.done()
 		}
 	}
-	// error occurs, so terminateCalls pending calls
-	client.terminateCalls(err)
+	return err
+}
+
+// defaultReconnectMaxBackoff caps the backoff between reconnections if Option.ReconnectMaxBackoff is 0
+const defaultReconnectMaxBackoff = time.Second * 30
+
+// reconnect fails the pending calls with the error of the lost connection, and re-dials the server
+// until it succeeds or the client is closed, it returns false if the client is closed.
+// 重连的间隔从 Option.ReconnectBackoff 开始，每次失败后加倍，最大为 Option.ReconnectMaxBackoff（默认 30s），
+// 即 b, 2b, 4b ... 直到上限。重连期间新的调用立即返回 CodeTransport 错误，提示正在重连，而不是阻塞等待，
+// 调用方可以稍后重试；已发送的调用无法得知服务端是否执行过，因此不会被自动重发。
+func (client *Client) reconnect(err error) bool {
+	client.sending.Lock()
+	client.mu.Lock()
+	if client.closing {
+		client.mu.Unlock()
+		client.sending.Unlock()
+		return false
+	}
+	client.reconnecting = newError(CodeTransport, "rpc client: reconnecting: "+err.Error())
+	client.failPending(err)
+	_ = client.cc.Close()
+	client.mu.Unlock()
+	client.sending.Unlock()
+
+	backoff, limit := client.opt.ReconnectBackoff, client.opt.ReconnectMaxBackoff
+	if limit <= 0 {
+		limit = defaultReconnectMaxBackoff
+	}
+	for {
+		select {
+		case <-client.closed:
+			return false
+		case <-time.After(backoff):
+		}
+		cc, err := client.redial()
+		if err != nil {
+			log.Println("rpc client: reconnect error:", err)
+			if backoff *= 2; backoff > limit {
+				backoff = limit
+			}
+			continue
+		}
+		client.sending.Lock()
+		client.mu.Lock()
+		closing := client.closing
+		if !closing {
+			client.cc = cc
+			client.reconnecting = nil
+		}
+		client.mu.Unlock()
+		client.sending.Unlock()
+		if closing {
+			_ = cc.Close()
+		}
+		return !closing
+	}
 }
 
 // Go invokes the function asynchronously.
@@ -193,21 +346,125 @@ func (client *Client) Go(serviceMethod string, args, reply interface{}, done cha
 	return call
 }
 
+// Replies receives the replies of a method with multiple reply parameters, in order,
+// eg, client.Call(ctx, "Calc.DivMod", args, Replies{&quo, &rem}).
+// 每个元素都必须是非 nil 的指针，类型与服务端方法的返回值参数一一对应。
+type Replies []interface{}
+
+// body returns the composite body the replies are decoded from
+func (r Replies) body() interface{} {
+	types := make([]reflect.Type, len(r))
+	for i, p := range r {
+		types[i] = reflect.TypeOf(p)
+	}
+	v := reflect.New(replyStructOf(types))
+	for i, p := range r {
+		v.Elem().Field(i).Set(reflect.ValueOf(p))
+	}
+	return v.Interface()
+}
+
 // Call invokes the named function, waits for it to complete,
 // and returns its error status.
 // Call 是对 Go 的封装，阻塞 call.Done，等待响应返回，是一个同步接口。
 // Client.Call 的超时处理机制，使用 context 包实现，控制权交给用户，控制更为灵活。
+// 如果 Option 设置了 CallTimeout，ctx 会被附加该超时，两者以先到者为准。
 func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	return client.CallWithTimeout(ctx, client.opt.CallTimeout, serviceMethod, args, reply)
+}
+
+// CallWithTimeout is like Call, but timeout overrides the CallTimeout of the Option,
+// it bounds the whole call, 0 means no limit other than ctx.
+func (client *Client) CallWithTimeout(ctx context.Context, timeout time.Duration, serviceMethod string, args, reply interface{}) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if chain, _ := client.interceptors.Load().([]Interceptor); len(chain) > 0 {
+		invoke := func(ctx context.Context) error {
+			return client.invoke(ctx, serviceMethod, args, reply)
+		}
+		if isStreamed(args, reply) {
+			invoke = invokeOnce(invoke)
+		}
+		return intercept(chain, ctx, serviceMethod, args, invoke)
+	}
+	return client.invoke(ctx, serviceMethod, args, reply)
+}
+
+// invoke sends a call and waits for its reply until ctx is done
+func (client *Client) invoke(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Meta:          outgoingMeta(ctx),
+		Done:          make(chan *Call, 1),
+	}
+	trace := traceFromContext(ctx)
+	call.Debug = trace != nil
+	if s, ok := args.(streamArgs); ok {
+		// the body is sent until the stream ends, stop sending once ctx is done
+		s.ctx = ctx
+		call.Args = s
+	}
+	client.send(call)
 	select {
 	case <-ctx.Done():
 		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		if r, ok := reply.(*streamReply); ok {
+			r.close()
+		}
+		return ctxError(ctx)
 	case call := <-call.Done:
+		if trace != nil && call.Trace != nil {
+			*trace = *call.Trace
+		}
 		return call.Error
 	}
 }
 
+// ctxError returns the error of a call abandoned because ctx is done
+func ctxError(ctx context.Context) error {
+	msg := "rpc client: call failed: " + ctx.Err().Error()
+	if ctx.Err() == context.DeadlineExceeded {
+		return newError(CodeTimeout, msg)
+	}
+	return errors.New(msg)
+}
+
+// Ping checks whether the server is still able to serve requests,
+// it calls a built-in method which is answered by the server without invoking any service.
+func (client *Client) Ping(ctx context.Context) error {
+	return client.Call(ctx, pingMethod, invalidRequest, nil)
+}
+
+// Notify sends a one-way call, it returns once the request is written,
+// without allocating a pending call or waiting for the reply.
+// 适用于上报指标、缓存失效等尽力而为的操作：服务端执行方法后不会回复，
+// 因此调用方无法得知方法是否执行成功，返回的错误仅表示请求没有发送出去。
+func (client *Client) Notify(serviceMethod string, args interface{}) error {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	client.mu.Lock()
+	err := client.unavailable()
+	client.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	client.header.ServiceMethod = serviceMethod
+	client.header.Seq = 0 // 0 means invalid call, the server never replies it anyway
+	client.header.Error = ""
+	client.header.OneWay = true
+	client.header.Meta = nil
+	client.header.Debug = false
+	var body interface{}
+	client.header.ArgType, body = unwrapArgs(args)
+	atomic.StoreInt64(&client.lastSend, time.Now().UnixNano())
+	return client.cc.Write(&client.header, body)
+}
+
 func parseOptions(opts ...*Option) (*Option, error) {
 	// if opts is nil or pass nil as parameter
 	if len(opts) == 0 || opts[0] == nil {
@@ -216,40 +473,92 @@ func parseOptions(opts ...*Option) (*Option, error) {
 	if len(opts) != 1 {
 		return nil, errors.New("number of options is more than 1")
 	}
-	opt := opts[0]
+	// copy the option, so it can be shared by concurrent dials
+	o := *opts[0]
+	opt := &o
 	opt.MagicNumber = DefaultOption.MagicNumber
+	if opt.Version == 0 {
+		opt.Version = DefaultOption.Version
+	}
+	if len(opt.CodecPreference) > 0 {
+		typ, err := preferredCodec(opt.CodecPreference)
+		if err != nil {
+			return nil, err
+		}
+		opt.CodecType = typ
+	}
 	if opt.CodecType == "" {
 		opt.CodecType = DefaultOption.CodecType
 	}
 	return opt, nil
 }
 
+// preferredCodec returns the first supported codec type in preference
+func preferredCodec(preference []codec.Type) (codec.Type, error) {
+	for _, typ := range preference {
+		if codec.NewCodecFuncMap[typ] != nil {
+			return typ, nil
+		}
+	}
+	return "", fmt.Errorf("rpc client: none of the codec types %v is supported", preference)
+}
+
 // NewClient 创建 Client 实例时，首先需要完成一开始的协议交换，即发送 Option 信息给服务端。
 // 协商好消息的编解码方式之后，再创建一个子协程调用 receive() 接收响应。
 func NewClient(conn net.Conn, opt *Option) (*Client, error) {
+	cc, err := handshake(conn, opt)
+	if err != nil {
+		return nil, err
+	}
+	return newClientCodec(cc, opt, nil), nil
+}
+
+// connectFunc sets up the RPC protocol on conn and returns the codec of the connection
+type connectFunc func(conn net.Conn, opt *Option) (codec.Codec, error)
+
+// handshake sends the Option to the server and returns the codec it chooses
+func handshake(conn net.Conn, opt *Option) (codec.Codec, error) {
+	setNoDelay(conn, opt.NoDelay)
 	f := codec.NewCodecFuncMap[opt.CodecType]
 	if f == nil {
 		err := fmt.Errorf("invalid codec type %s", opt.CodecType)
 		log.Println("rpc client: codec error:", err)
 		return nil, err
 	}
+	cc, err := withCompressor(f(conn), opt.Compressor)
+	if err != nil {
+		log.Println("rpc client: codec error:", err)
+		return nil, err
+	}
+	if opt.SkipHandshake {
+		// the server knows the Option already, see ServeConnWithOption
+		return cc, nil
+	}
 	// send options with server
-	if err := json.NewEncoder(conn).Encode(opt); err != nil {
+	if err := optionCodec.Encode(conn, opt); err != nil {
 		log.Println("rpc client: options error: ", err)
 		_ = conn.Close()
 		return nil, err
 	}
-	return newClientCodec(f(conn), opt), nil
+	return cc, nil
 }
 
-func newClientCodec(cc codec.Codec, opt *Option) *Client {
+// newClientCodec starts a client over cc, redial is set before the client starts receiving,
+// nil means the client is shut down once the connection is lost.
+func newClientCodec(cc codec.Codec, opt *Option, redial func() (codec.Codec, error)) *Client {
 	client := &Client{
 		seq:     1, // seq starts with 1, 0 means invalid call
 		cc:      cc,
 		opt:     opt,
+		redial:  redial,
+		closed:  make(chan struct{}),
 		pending: make(map[uint64]*Call),
 	}
+	client.lastSend = time.Now().UnixNano()
 	go client.receive()
+	if opt.KeepAlive > 0 {
+		go client.keepAlive(opt.KeepAlive)
+	}
 	return client
 }
 
@@ -260,15 +569,25 @@ type clientResult struct {
 
 type newClientFunc func(conn net.Conn, opt *Option) (client *Client, err error)
 
+// Dialer creates the connection to an RPC server, it makes the client able to
+// run over unix sockets, TLS, an in-memory pipe or any other transport.
+type Dialer func(network, address string) (net.Conn, error)
+
 // 超时处理的外壳 dialTimeout，这个壳将 NewClient 作为入参，在 2 个地方添加了超时处理的机制。
 // 将 net.Dial 替换为 net.DialTimeout，如果连接创建超时，将返回错误。
 // 使用子协程执行 NewClient，执行完成后则通过信道 ch 发送结果，如果 time.After() 信道先接收到消息，则说明 NewClient 执行超时，返回错误。
-func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (client *Client, err error) {
+// dial 为 nil 时使用 net.DialTimeout，否则由 dial 负责建立连接，此时建立连接本身的超时需要由 dial 自行处理。
+func dialTimeout(f newClientFunc, dial Dialer, network, address string, opts ...*Option) (client *Client, err error) {
 	opt, err := parseOptions(opts...)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.DialTimeout(network, address, opt.ConnectTimeout)
+	if dial == nil {
+		dial = func(network, address string) (net.Conn, error) {
+			return net.DialTimeout(network, address, opt.ConnectTimeout)
+		}
+	}
+	conn, err := dial(network, address)
 	if err != nil {
 		return nil, err
 	}
@@ -289,28 +608,69 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (cli
 	}
 	select {
 	case <-time.After(opt.ConnectTimeout):
-		return nil, fmt.Errorf("rpc client: connect timeout: expect within %s", opt.ConnectTimeout)
+		return nil, newError(CodeTimeout, fmt.Sprintf("rpc client: connect timeout: expect within %s", opt.ConnectTimeout))
 	case result := <-ch:
 		return result.client, result.err
 	}
 }
 
+// dial is dialTimeout for the protocol set up by connect,
+// the returned client re-dials in the same way when the connection is lost if Option.ReconnectBackoff is set.
+func dial(connect connectFunc, dialer Dialer, network, address string, opts ...*Option) (*Client, error) {
+	return dialTimeout(func(conn net.Conn, opt *Option) (*Client, error) {
+		cc, err := connect(conn, opt)
+		if err != nil {
+			return nil, err
+		}
+		var redial func() (codec.Codec, error)
+		if opt.ReconnectBackoff > 0 {
+			redial = func() (codec.Codec, error) {
+				c, err := dialTimeout(func(conn net.Conn, opt *Option) (*Client, error) {
+					cc, err := connect(conn, opt)
+					// the client isn't started, it only carries the codec
+					return &Client{cc: cc}, err
+				}, dialer, network, address, opt)
+				if err != nil {
+					return nil, err
+				}
+				return c.cc, nil
+			}
+		}
+		return newClientCodec(cc, opt, redial), nil
+	}, dialer, network, address, opts...)
+}
+
 // Dial connects to an RPC server at the specified network address
 // Dial 函数，便于用户传入服务端地址，创建 Client 实例。为了简化用户调用，通过 ...*Option 将 Option 实现为可选参数。
 func Dial(network, address string, opts ...*Option) (*Client, error) {
 	// 为 Dial 添加一层超时处理的外壳
-	return dialTimeout(NewClient, network, address, opts...)
+	return dial(handshake, nil, network, address, opts...)
+}
+
+// DialWith connects to an RPC server using the given dialer,
+// ConnectTimeout only bounds the handshake, the dialer should handle its own timeout.
+func DialWith(dialer Dialer, network, address string, opts ...*Option) (*Client, error) {
+	return dial(handshake, dialer, network, address, opts...)
 }
 
 // NewHTTPClient new a Client instance via HTTP as transport protocol
 func NewHTTPClient(conn net.Conn, opt *Option) (*Client, error) {
-	_, _ = io.WriteString(conn, fmt.Sprintf("CONNECT %s HTTP/1.0\n\n", defaultRPCPath))
+	cc, err := httpHandshake(conn, DefaultRPCPath, opt)
+	if err != nil {
+		return nil, err
+	}
+	return newClientCodec(cc, opt, nil), nil
+}
+
+// httpHandshake sends a CONNECT request for path, and speaks the RPC protocol once it's accepted
+func httpHandshake(conn net.Conn, path string, opt *Option) (codec.Codec, error) {
+	_, _ = io.WriteString(conn, fmt.Sprintf("CONNECT %s HTTP/1.0\n\n", path))
 
 	// Require successful HTTP response
 	// before switching to RPC protocol.
 	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
 	if err == nil && resp.Status == connected {
-		return NewClient(conn, opt)
+		return handshake(conn, opt)
 	}
 	if err == nil {
 		err = errors.New("unexpected HTTP response: " + resp.Status)
@@ -321,7 +681,15 @@ func NewHTTPClient(conn net.Conn, opt *Option) (*Client, error) {
 // DialHTTP connects to an HTTP RPC server at the specified network address
 // listening on the default HTTP RPC path.
 func DialHTTP(network, address string, opts ...*Option) (*Client, error) {
-	return dialTimeout(NewHTTPClient, network, address, opts...)
+	return DialHTTPPath(network, address, DefaultRPCPath, opts...)
+}
+
+// DialHTTPPath connects to an HTTP RPC server
+// at the specified network address and path.
+func DialHTTPPath(network, address, path string, opts ...*Option) (*Client, error) {
+	return dial(func(conn net.Conn, opt *Option) (codec.Codec, error) {
+		return httpHandshake(conn, path, opt)
+	}, nil, network, address, opts...)
 }
 
 // XDial calls different functions to connect to an RPC server
@@ -2,10 +2,17 @@ package simple_rpc
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"runtime"
+	"simple_rpc/codec"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -37,11 +44,11 @@ func TestClient_dialTimeout(t *testing.T) {
 		return nil, nil
 	}
 	t.Run("timeout", func(t *testing.T) {
-		_, err := dialTimeout(f, "tcp", l.Addr().String(), &Option{ConnectTimeout: time.Second})
+		_, err := dialTimeout(f, nil, "tcp", l.Addr().String(), &Option{ConnectTimeout: time.Second})
 		_assert(err != nil && strings.Contains(err.Error(), "connect timeout"), "expect a timeout error")
 	})
 	t.Run("0", func(t *testing.T) {
-		_, err := dialTimeout(f, "tcp", l.Addr().String(), &Option{ConnectTimeout: 0})
+		_, err := dialTimeout(f, nil, "tcp", l.Addr().String(), &Option{ConnectTimeout: 0})
 		_assert(err == nil, "0 means no limit")
 	})
 }
@@ -69,7 +76,7 @@ func TestClient_Call(t *testing.T) {
 		})
 		var reply int
 		err := client.Call(context.Background(), "Bar.Timeout", 1, &reply)
-		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
+		_assert(errors.Is(err, ErrServerTimeout) && errors.Is(err, ErrTimeout), "expect a server timeout error, got %v", err)
 	})
 }
 
@@ -93,3 +100,650 @@ func TestXDial(t *testing.T) {
 		_assert(err == nil, "failed to connect unix socket")
 	}
 }
+
+func TestClient_CallTimeout(t *testing.T) {
+	var b Bar
+	server := NewServer()
+	_ = server.Register(&b)
+	client, err := NewClient(pipe(server), &Option{
+		MagicNumber: MagicNumber,
+		CodecType:   codec.GobType,
+		CallTimeout: time.Millisecond * 100,
+	})
+	_assert(err == nil, "failed to create client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	t.Run("client default", func(t *testing.T) {
+		var reply int
+		err := client.Call(context.Background(), "Bar.Timeout", 1, &reply)
+		_assert(errors.Is(err, ErrTimeout), "expect a timeout error, got %v", err)
+	})
+	t.Run("per call", func(t *testing.T) {
+		var reply int
+		start := time.Now()
+		err := client.CallWithTimeout(context.Background(), time.Millisecond*200, "Bar.Timeout", 1, &reply)
+		_assert(errors.Is(err, ErrTimeout) && time.Since(start) < time.Second, "expect a timeout error, got %v", err)
+		_assert(!errors.Is(err, ErrServerTimeout), "client timeout isn't a server timeout")
+	})
+	t.Run("server", func(t *testing.T) {
+		client, _ := NewClient(pipe(server), &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, HandleTimeout: time.Millisecond * 100})
+		defer func() { _ = client.Close() }()
+		var reply int
+		err := client.Call(context.Background(), "Bar.Timeout", 1, &reply)
+		_assert(errors.Is(err, ErrServerTimeout) && errors.Is(err, ErrTimeout), "expect a server timeout error, got %v", err)
+	})
+	client.mu.Lock()
+	pending := len(client.pending)
+	client.mu.Unlock()
+	_assert(pending == 0, "timed out calls should be abandoned, %d pending", pending)
+}
+
+type Sink chan int
+
+func (s Sink) Put(n int, _ *struct{}) error {
+	s <- n
+	return nil
+}
+
+func TestClient_Notify(t *testing.T) {
+	sink := make(Sink, 1)
+	server := NewServer()
+	_ = server.Register(sink)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	_assert(client.Notify("Sink.Put", 7) == nil, "failed to notify")
+	select {
+	case n := <-sink:
+		_assert(n == 7, "expect 7, got %d", n)
+	case <-time.After(time.Second):
+		t.Fatal("one-way call is not executed")
+	}
+	// errors of one-way calls are not replied, so the connection keeps working
+	_assert(client.Notify("Sink.Nope", 1) == nil, "failed to notify")
+	_assert(client.Ping(context.Background()) == nil && client.IsAvailable(), "client should be available after one-way calls")
+}
+
+func TestClient_Batch(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	b := client.Batch()
+	replies := make([]int, 10)
+	var calls []*Call
+	for i := range replies {
+		calls = append(calls, b.Add("Foo.Sum", &Args{Num1: i, Num2: i}, &replies[i]))
+	}
+	var missing int
+	bad := b.Add("Foo.Nope", &Args{}, &missing)
+	_assert(b.Do(context.Background()) == nil, "failed to do batch")
+	for i, call := range calls {
+		_assert(call.Error == nil && replies[i] == i*2, "expect %d, got %d: %v", i*2, replies[i], call.Error)
+	}
+	_assert(errors.Is(bad.Error, ErrMethodNotFound), "expect method not found, got %v", bad.Error)
+	_assert(b.Do(context.Background()) == nil, "an empty batch should succeed")
+
+	// the abandoned calls are completed
+	_ = server.Register(new(Slow))
+	slow := b.Add("Slow.Sleep", 1000, new(int))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_assert(errors.Is(b.Do(ctx), ErrTimeout), "expect the batch to time out")
+	select {
+	case <-slow.Done:
+		_assert(errors.Is(slow.Error, ErrTimeout), "expect the abandoned call to time out, got %v", slow.Error)
+	case <-time.After(time.Second):
+		t.Fatal("the abandoned call should be done")
+	}
+}
+
+func BenchmarkClient_Call(b *testing.B) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 100; j++ {
+			var reply int
+			_ = client.Call(context.Background(), "Foo.Sum", &Args{Num1: j, Num2: j}, &reply)
+		}
+	}
+}
+
+func BenchmarkClient_Batch(b *testing.B) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		batch := client.Batch()
+		replies := make([]int, 100)
+		for j := range replies {
+			batch.Add("Foo.Sum", &Args{Num1: j, Num2: j}, &replies[j])
+		}
+		_ = batch.Do(context.Background())
+	}
+}
+
+// 通过 DialWith 传入自定义的 Dialer，使用 net.Pipe 在内存中完成通信，不需要监听真实的端口。
+func TestDialWith(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	dialer := func(network, address string) (net.Conn, error) {
+		return pipe(server), nil
+	}
+	client, err := DialWith(dialer, "pipe", "")
+	_assert(err == nil, "failed to dial with pipe: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum over pipe: %v", err)
+}
+
+func TestDialHTTPPath(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	mux := http.NewServeMux()
+	mux.Handle("/_test_rpc_", server)
+	mux.Handle("/debug/_test_rpc_", debugHTTP{server})
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go func() { _ = http.Serve(l, mux) }()
+
+	client, err := DialHTTPPath("tcp", l.Addr().String(), "/_test_rpc_")
+	_assert(err == nil, "failed to dial http: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect 3, got %d: %v", reply, err)
+
+	// plain http requests are served on the same listener
+	resp, err := http.Get("http://" + l.Addr().String() + "/debug/_test_rpc_")
+	_assert(err == nil && resp.StatusCode == http.StatusOK, "failed to get debug page: %v", err)
+	_ = resp.Body.Close()
+
+	_, err = DialHTTPPath("tcp", l.Addr().String(), "/nope")
+	_assert(err != nil, "expect an error when dialing an unknown path")
+}
+
+func TestNewInProcess(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err := client.Call(context.Background(), "Foo.Sum", Args{Num1: 2, Num2: 3}, &reply)
+	_assert(err == nil && reply == 5, "failed to call Foo.Sum in process: %v", err)
+	_assert(client.Ping(context.Background()) == nil, "failed to ping in process")
+}
+
+func TestSetOptionCodec(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	SetOptionCodec(BinaryOptionCodec)
+	defer SetOptionCodec(JSONOptionCodec)
+
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err := client.Call(context.Background(), "Foo.Sum", Args{Num1: 4, Num2: 5}, &reply)
+	_assert(err == nil && reply == 9, "failed to call Foo.Sum with binary option: %v", err)
+}
+
+func TestClient_UnsupportedVersion(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	// a server which rejects the connection once the call is sent
+	go func() {
+		var opt Option
+		_, _ = readOption(srvConn, &opt)
+		cc := codec.NewGobCodec(srvConn)
+		var h codec.Header
+		_ = cc.ReadHeader(&h)
+		_ = cc.ReadBody(nil)
+		_ = cc.Write(&codec.Header{Error: "unsupported", Code: int(CodeUnsupportedVersion)}, invalidRequest)
+	}()
+
+	client, err := NewClient(cliConn, DefaultOption)
+	_assert(err == nil, "failed to create client: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(errors.Is(err, ErrUnsupportedVersion), "expect unsupported protocol version, got %v", err)
+}
+
+func TestClient_connectionError(t *testing.T) {
+	cliConn, srvConn := net.Pipe()
+	// a server which fails the one-way call with seq 0 before replying the call
+	go func() {
+		var opt Option
+		_, _ = readOption(srvConn, &opt)
+		cc := codec.NewGobCodec(srvConn)
+		var h codec.Header
+		_ = cc.ReadHeader(&h)
+		_ = cc.ReadBody(nil)
+		_ = cc.Write(&codec.Header{Error: "method not found", Code: int(CodeMethodNotFound)}, invalidRequest)
+		_ = cc.Write(&codec.Header{ServiceMethod: h.ServiceMethod, Seq: h.Seq}, 3)
+	}()
+
+	client, err := NewClient(cliConn, DefaultOption)
+	_assert(err == nil, "failed to create client: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "an error of no call shouldn't fail the connection: %v", err)
+	_assert(client.IsAvailable(), "client should be available")
+}
+
+func TestClient_Compressor(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	for _, typ := range []codec.Type{codec.GobType, codec.MsgpackType} {
+		for _, c := range []codec.CompressorType{codec.GzipCompressor, codec.SnappyCompressor} {
+			client, err := NewClient(pipe(server), &Option{MagicNumber: MagicNumber, CodecType: typ, Compressor: c})
+			_assert(err == nil, "failed to create client: %v", err)
+			var reply int
+			err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+			_assert(err == nil && reply == 3, "failed to call with %s/%s: %v", typ, c, err)
+			_assert(client.Ping(context.Background()) == nil, "failed to ping with %s/%s", typ, c)
+			_ = client.Close()
+		}
+	}
+	_, err := NewClient(pipe(server), &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, Compressor: "lz4"})
+	_assert(err != nil, "expect an error for unknown compressor")
+}
+
+func TestParseOptions_CodecPreference(t *testing.T) {
+	opt, err := parseOptions(&Option{CodecPreference: []codec.Type{"application/protobuf", codec.MsgpackType}})
+	_assert(err == nil && opt.CodecType == codec.MsgpackType, "expect msgpack, but got %s: %v", opt.CodecType, err)
+	_, err = parseOptions(&Option{CodecPreference: []codec.Type{"application/protobuf"}})
+	_assert(err != nil, "expect an error if no preferred codec is supported")
+}
+
+func TestClient_Bind(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	type Foo struct {
+		Sum     func(ctx context.Context, args Args, reply *int) error
+		Add     func(ctx context.Context, args Args) (int, error) `rpc:"Foo.Sum"`
+		Missing func(ctx context.Context, args Args) (int, error)
+	}
+	var stub Foo
+	_assert(client.Bind(&stub) == nil, "failed to bind stub")
+	var reply int
+	err := stub.Sum(context.Background(), Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum by stub: %v", err)
+	n, err := stub.Add(context.Background(), Args{Num1: 3, Num2: 4})
+	_assert(err == nil && n == 7, "failed to call Foo.Sum by tagged stub: %v", err)
+	_, err = stub.Missing(context.Background(), Args{})
+	_assert(errors.Is(err, ErrMethodNotFound), "expect method not found, got %v", err)
+
+	var bad struct {
+		Sum func(args Args, reply *int) error
+	}
+	_assert(client.Bind(&bad) != nil, "expect an error for unsupported signature")
+	_assert(client.Bind(stub) != nil, "expect an error for non-pointer stub")
+}
+
+func TestClient_WithTrace(t *testing.T) {
+	var s Slow
+	server := NewServer()
+	_ = server.Register(&s)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	call := client.Go("Slow.Sleep", 0, &reply, nil)
+	<-call.Done
+	_assert(call.Error == nil && call.Trace == nil, "normal calls shouldn't be traced: %v", call.Error)
+
+	var trace codec.Trace
+	ctx := WithTrace(context.Background(), &trace)
+	err := client.Call(ctx, "Slow.Sleep", 50, &reply)
+	_assert(err == nil, "failed to call: %v", err)
+	_assert(trace.Handle >= 50*time.Millisecond, "expect handle time >= 50ms, got %s", trace.Handle)
+	_assert(trace.Decode > 0 && trace.Encode > 0, "expect decode and encode time, got %+v", trace)
+
+	b := client.Batch()
+	call = b.Add("Slow.Sleep", 0, &reply)
+	call.Debug = true
+	_ = b.Do(context.Background())
+	_assert(call.Error == nil && call.Trace != nil, "batch call should be traced: %v", call.Error)
+}
+
+func TestOption_SeqFunc(t *testing.T) {
+	var s Slow
+	server := NewServer()
+	_ = server.Register(&s)
+	seqs := []uint64{7, 7, 0, 9}
+	opt := *DefaultOption
+	opt.SeqFunc = func() uint64 {
+		seq := seqs[0]
+		seqs = seqs[1:]
+		return seq
+	}
+	client, err := NewClient(pipe(server), &opt)
+	_assert(err == nil, "failed to create client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var r1, r2, r3, r4 int
+	slow := client.Go("Slow.Sleep", 100, &r1, nil)
+	_assert(slow.Seq == 7, "expect seq 7, got %d", slow.Seq)
+	dup := client.Go("Slow.Sleep", 0, &r2, nil)
+	<-dup.Done
+	_assert(dup.Error != nil && strings.Contains(dup.Error.Error(), "invalid seq 7"), "expect seq collision, got %v", dup.Error)
+	zero := client.Go("Slow.Sleep", 0, &r3, nil)
+	<-zero.Done
+	_assert(zero.Error != nil, "seq 0 should be rejected")
+	fast := client.Go("Slow.Sleep", 0, &r4, nil)
+	<-fast.Done
+	<-slow.Done
+	_assert(fast.Seq == 9 && fast.Error == nil && slow.Error == nil, "failed to call: %v %v", fast.Error, slow.Error)
+}
+
+func TestOption_ReconnectBackoff(t *testing.T) {
+	var s Slow
+	server := NewServer()
+	_ = server.Register(&s)
+	lis := NewPipeListener()
+	go server.Accept(lis)
+	defer func() { _ = lis.Close() }()
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	var down bool
+	dialer := func(network, address string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			return nil, errors.New("server is down")
+		}
+		conn, err := lis.Dial(network, address)
+		conns = append(conns, conn)
+		return conn, err
+	}
+	opt := *DefaultOption
+	opt.ReconnectBackoff = time.Millisecond * 20
+	client, err := DialWith(dialer, "pipe", "", &opt)
+	_assert(err == nil, "failed to dial: %v", err)
+
+	var reply int
+	pending := client.Go("Slow.Sleep", 200, &reply, nil)
+	time.Sleep(time.Millisecond * 50)
+	mu.Lock()
+	down = true
+	_ = conns[0].Close()
+	mu.Unlock()
+	<-pending.Done
+	_assert(errors.Is(pending.Error, ErrTransport), "pending call should fail with the lost connection, got %v", pending.Error)
+	err = client.Call(context.Background(), "Slow.Sleep", 0, &reply)
+	_assert(errors.Is(err, ErrTransport) && strings.Contains(err.Error(), "reconnecting"), "expect reconnecting, got %v", err)
+	_assert(!client.IsAvailable(), "client shouldn't be available while reconnecting")
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	time.Sleep(time.Millisecond * 200)
+	err = client.Call(context.Background(), "Slow.Sleep", 0, &reply)
+	_assert(err == nil && client.IsAvailable(), "client should be reconnected: %v", err)
+	mu.Lock()
+	_assert(len(conns) == 2, "expect 2 connections, got %d", len(conns))
+	down = true
+	_ = conns[1].Close()
+	mu.Unlock()
+
+	time.Sleep(time.Millisecond * 50)
+	_assert(client.Close() == nil, "failed to close while reconnecting")
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	time.Sleep(time.Millisecond * 100)
+	mu.Lock()
+	defer mu.Unlock()
+	_assert(len(conns) == 2, "closed client shouldn't reconnect, got %d connections", len(conns))
+	err = client.Call(context.Background(), "Slow.Sleep", 0, &reply)
+	_assert(err == ErrShutdown, "expect ErrShutdown after Close, got %v", err)
+}
+
+func TestOption_ReconnectBackoff_lostAtOnce(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Slow))
+	opt := *DefaultOption
+	opt.SkipHandshake = true
+	opt.ReconnectBackoff = time.Millisecond * 10
+	var dials int32
+	dialer := func(network, address string) (net.Conn, error) {
+		conn, peer := net.Pipe()
+		if atomic.AddInt32(&dials, 1) == 1 {
+			// the first connection is lost before the client is returned
+			_ = peer.Close()
+		} else {
+			go server.ServeConnWithOption(peer, &opt)
+		}
+		return conn, nil
+	}
+	client, err := DialWith(dialer, "pipe", "", &opt)
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	for i := 0; i < 100 && (atomic.LoadInt32(&dials) < 2 || !client.IsAvailable()); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	err = client.Call(context.Background(), "Slow.Sleep", 0, &reply)
+	_assert(err == nil, "the connection lost at once should be reconnected: %v", err)
+}
+
+type Quote struct{ Price int }
+
+func (q *Quote) Validate() error {
+	if q.Price < 0 {
+		return errors.New("negative price")
+	}
+	return nil
+}
+
+type Quotes int
+
+func (q Quotes) Get(price int, reply *Quote) error {
+	reply.Price = price
+	return nil
+}
+
+func TestOption_ValidateReplies(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Quotes))
+	var q Quote
+	client := NewInProcess(server)
+	err := client.Call(context.Background(), "Quotes.Get", -1, &q)
+	_assert(err == nil && q.Price == -1, "replies shouldn't be validated by default: %v", err)
+	_ = client.Close()
+
+	opt := *DefaultOption
+	opt.ValidateReplies = true
+	client, _ = NewClient(pipe(server), &opt)
+	defer func() { _ = client.Close() }()
+	err = client.Call(context.Background(), "Quotes.Get", 3, &q)
+	_assert(err == nil && q.Price == 3, "valid reply should be accepted: %v", err)
+	err = client.Call(context.Background(), "Quotes.Get", -1, &q)
+	_assert(errors.Is(err, ErrInvalidReply) && strings.Contains(err.Error(), "negative price"), "expect invalid reply, got %v", err)
+}
+
+// capturingListener sends the connections it accepts to conns
+type capturingListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l capturingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.conns <- conn
+	}
+	return conn, err
+}
+
+func TestOption_NoDelay(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	server.SetNoDelay(NoDelayOff)
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	_assert(err == nil, "failed to listen: %v", err)
+	lis := capturingListener{Listener: tcp, conns: make(chan net.Conn, 1)}
+	defer func() { _ = lis.Close() }()
+	go func() { _ = server.Accept(lis) }()
+
+	// 拨号时先开启 Nagle 算法，NoDelayDefault 保持不变，其他模式覆盖它
+	for mode, want := range map[NoDelay]bool{NoDelayDefault: false, NoDelayOn: true, NoDelayOff: false} {
+		opt := *DefaultOption
+		opt.NoDelay = mode
+		var conn net.Conn
+		client, err := DialWith(func(network, address string) (net.Conn, error) {
+			c, err := net.Dial(network, address)
+			if err == nil {
+				_ = c.(*net.TCPConn).SetNoDelay(false)
+				conn = c
+			}
+			return c, err
+		}, "tcp", lis.Addr().String(), &opt)
+		_assert(err == nil, "failed to dial: %v", err)
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "mode %d: failed to call: %v", mode, err)
+		_assert(noDelayOf(t, conn) == want, "mode %d: expect TCP_NODELAY %v on the client", mode, want)
+		_assert(!noDelayOf(t, <-lis.conns), "mode %d: expect TCP_NODELAY off on the server", mode)
+		_ = client.Close()
+	}
+
+	// TLS 连接设置的是底层的 TCP 连接
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	ts.Close()
+	cert := ts.TLS.Certificates[0]
+	tcp, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	_assert(err == nil, "failed to listen: %v", err)
+	secure := capturingListener{Listener: tcp, conns: make(chan net.Conn, 1)}
+	defer func() { _ = secure.Close() }()
+	go func() { _ = server.Accept(secure) }()
+	opt := *DefaultOption
+	opt.NoDelay = NoDelayOff
+	var conn net.Conn
+	client, err := DialWith(func(network, address string) (net.Conn, error) {
+		c, err := tls.Dial(network, address, ts.Client().Transport.(*http.Transport).TLSClientConfig)
+		conn = c
+		return c, err
+	}, "tcp", secure.Addr().String(), &opt)
+	_assert(err == nil, "failed to dial with TLS: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call over TLS: %v", err)
+	_assert(!noDelayOf(t, conn), "expect TCP_NODELAY off on the TLS client")
+	_assert(!noDelayOf(t, <-secure.conns), "expect TCP_NODELAY off on the TLS server")
+}
+
+func TestClient_Use(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Ledger))
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var order []string
+	record := func(name string) Interceptor {
+		return func(ctx context.Context, serviceMethod string, args interface{}, invoke func(ctx context.Context) error) error {
+			order = append(order, name+" "+serviceMethod)
+			err := invoke(WithMeta(ctx, "user", name))
+			order = append(order, name+" done")
+			return err
+		}
+	}
+	client.Use(record("a"), record("b"))
+
+	var meta string
+	err := client.Call(context.Background(), "Ledger.Meta", "user", &meta)
+	_assert(err == nil, "failed to call: %v", err)
+	_assert(strings.Join(order, ",") == "a Ledger.Meta,b Ledger.Meta,b done,a done", "unexpected order %v", order)
+	_assert(meta == "b", "metadata of the inner interceptor should be sent, got %q", meta)
+
+	attempts := 0
+	client.Use(func(ctx context.Context, serviceMethod string, args interface{}, invoke func(ctx context.Context) error) error {
+		attempts++
+		if err := invoke(ctx); err != nil {
+			return err
+		}
+		attempts++
+		return invoke(ctx)
+	})
+	var total int
+	err = client.Call(context.Background(), "Ledger.Add", 2, &total)
+	_assert(err == nil && attempts == 2 && total == 4, "expect the call to be invoked twice, got %d attempts, total %d: %v", attempts, total, err)
+
+	// 流式的参数已经被读取，不能重新发送
+	var store Store
+	_ = server.Register(&store)
+	attempts = 0
+	var n int64
+	err = client.Call(context.Background(), "Store.Put", Stream(strings.NewReader("hello")), &n)
+	_assert(errors.Is(err, ErrStreamInvoked) && attempts == 2 && n == 5, "expect the streamed call to be sent once, got %d attempts, %d bytes: %v", attempts, n, err)
+}
+
+// oldServer serves conn like a server which doesn't know one-way calls, it fails them with seq 0,
+// the ServiceMethod of each request is sent to methods.
+func oldServer(conn net.Conn, methods chan<- string) {
+	var opt Option
+	_, _ = readOption(conn, &opt)
+	cc := codec.NewGobCodec(conn)
+	for {
+		var h codec.Header
+		if cc.ReadHeader(&h) != nil {
+			return
+		}
+		_ = cc.ReadBody(nil)
+		methods <- h.ServiceMethod
+		if h.Seq == 0 {
+			_ = cc.Write(&codec.Header{ServiceMethod: h.ServiceMethod, Error: "rpc server: can't find method " + h.ServiceMethod}, invalidRequest)
+			continue
+		}
+		_ = cc.Write(&codec.Header{ServiceMethod: h.ServiceMethod, Seq: h.Seq}, 3)
+	}
+}
+
+func TestOption_KeepAlive(t *testing.T) {
+	for _, keepAlive := range []time.Duration{0, 10 * time.Millisecond} {
+		cliConn, srvConn := net.Pipe()
+		methods := make(chan string, 100)
+		go oldServer(srvConn, methods)
+		opt := *DefaultOption
+		opt.KeepAlive = keepAlive
+		client, err := NewClient(cliConn, &opt)
+		_assert(err == nil, "failed to create client: %v", err)
+
+		time.Sleep(50 * time.Millisecond)
+		var reply int
+		err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "keep-alive %s: client should survive the idle time: %v", keepAlive, err)
+		_ = client.Close()
+		var frames int
+		for len(methods) > 0 {
+			if <-methods == keepAliveMethod {
+				frames++
+			}
+		}
+		_assert(keepAlive > 0 == (frames > 0), "keep-alive %s: unexpected %d keep-alive frames", keepAlive, frames)
+	}
+}
@@ -0,0 +1,43 @@
+package simple_rpc
+
+import "time"
+
+// 可替换的时钟：HandleTimeout 的超时判定、请求的开始时间和耗时（Inflight、审计）、空闲连接的判定（SetIdleTimeout）以及注册中心的过期判定都通过 Clock 获取时间，
+// 测试中可以换成手动推进的时钟，不需要真实地等待就能确定性地验证超时和过期的行为，见 rpctest.Clock。
+// 默认使用 time 包，未设置时只多一次原子读取。方法执行耗时的统计（Stats）和 Trace 不受影响，始终使用真实时间。
+
+// Clock tells the time, see SetClock
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is the Clock of the time package, it's used unless another one is set
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SetClock replaces the clock of the server, nil means RealClock, it should be called before serving.
+func (server *Server) SetClock(clock Clock) {
+	if clock == nil {
+		clock = RealClock
+	}
+	server.clock.Store(&clock)
+}
+
+func (server *Server) now() time.Time {
+	if c, _ := server.clock.Load().(*Clock); c != nil {
+		return (*c).Now()
+	}
+	return time.Now()
+}
+
+func (server *Server) after(d time.Duration) <-chan time.Time {
+	if c, _ := server.clock.Load().(*Clock); c != nil {
+		return (*c).After(d)
+	}
+	return time.After(d)
+}
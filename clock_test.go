@@ -0,0 +1,91 @@
+package simple_rpc_test
+
+import (
+	"context"
+	"errors"
+	"simple_rpc"
+	"simple_rpc/rpctest"
+	"testing"
+	"time"
+)
+
+// the tests of the clock use rpctest.Clock, which imports simple_rpc, so they are in the external package
+
+// waitFor polls cond until it's true, or fails t after a while
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition isn't met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// dialPipe starts server on an in-memory listener and returns a client connected to it with opt
+func dialPipe(t *testing.T, server *simple_rpc.Server, opt *simple_rpc.Option) *simple_rpc.Client {
+	lis := simple_rpc.NewPipeListener()
+	go func() { _ = server.Accept(lis) }()
+	t.Cleanup(func() { _ = lis.Close() })
+	client, err := simple_rpc.DialWith(lis.Dial, "pipe", "", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+// Gate blocks the calls until it's closed
+type Gate chan struct{}
+
+func (g Gate) Wait(_ int, reply *int) error {
+	<-g
+	return nil
+}
+
+func TestServer_SetClock(t *testing.T) {
+	gate := make(Gate)
+	defer close(gate)
+	server := simple_rpc.NewServer()
+	_ = server.Register(gate)
+	clock := rpctest.NewClock(time.Unix(1000, 0))
+	server.SetClock(clock)
+	opt := *simple_rpc.DefaultOption
+	opt.HandleTimeout = time.Hour
+	client := dialPipe(t, server, &opt)
+
+	call := client.Go("Gate.Wait", 0, new(int), nil)
+	// the server waits for the handle timeout, and the method is started concurrently
+	waitFor(t, func() bool { return clock.Waiters() == 1 && len(server.Inflight()) == 1 })
+	inflight := server.Inflight()
+	if !inflight[0].Start.Equal(clock.Now()) || inflight[0].Elapsed != 0 {
+		t.Fatalf("the request should be timed by the clock: %+v", inflight)
+	}
+	clock.Advance(time.Hour)
+	<-call.Done
+	if !errors.Is(call.Error, simple_rpc.ErrServerTimeout) {
+		t.Fatalf("expect the handle timeout without waiting, got %v", call.Error)
+	}
+}
+
+func TestServer_SetClock_idle(t *testing.T) {
+	server := simple_rpc.NewServer()
+	clock := rpctest.NewClock(time.Unix(1000, 0))
+	server.SetClock(clock)
+	server.SetIdleTimeout(time.Minute)
+	client := dialPipe(t, server, simple_rpc.DefaultOption)
+
+	waitFor(t, func() bool { return clock.Waiters() == 1 })
+	clock.Advance(time.Second * 30)
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// idle for 30s when the timeout is checked, so it's checked again 30s later
+	clock.Advance(time.Second * 30)
+	waitFor(t, func() bool { return clock.Waiters() == 1 })
+	if !client.IsAvailable() {
+		t.Fatal("the connection isn't idle for the timeout yet")
+	}
+	clock.Advance(time.Second * 30)
+	waitFor(t, func() bool { return !client.IsAvailable() })
+}
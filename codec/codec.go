@@ -1,14 +1,41 @@
 package codec
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 // Header ServiceMethod 是服务名和方法名，通常与 Go 语言中的结构体和方法相映射。
 // Seq 是请求的序号，也可以认为是某个请求的 ID，用来区分不同的请求。
 // Error 是错误信息，客户端置为空，服务端如果如果发生错误，将错误信息置于 Error 中。
+// Code 是错误的类别，仅在 Error 不为空时有意义，0 表示业务方法返回的错误。
+// OneWay 表示请求不需要响应，服务端执行方法后不会回复。
+// RetryAfter 是服务端建议的退避时间，仅在服务端过载拒绝请求时设置，0 表示没有建议。
+// ArgType 是入参具体类型的标签，仅当方法的入参为接口类型时由客户端设置，服务端据此选择解码的目标类型。
+// Meta 是请求的元数据，由客户端通过 context 附加，例如幂等键，服务端不会在响应中回传。
+// Debug 表示客户端请求服务端各阶段的耗时，服务端将其写入响应的 Trace 中，普通请求不会测量。
+// Stream 表示请求的 body 按块发送，同一个 Seq 的后续帧依次携带数据块，见 simple_rpc.Stream。
+// Push 表示这是服务端主动推送的通知而不是某个调用的响应，此时 Seq 为 0，ServiceMethod 是通知的主题，见 simple_rpc.Publish。
 type Header struct {
 	ServiceMethod string // format "Service.Method"
 	Seq           uint64 // sequence number chosen by client
 	Error         string
+	Code          int               // error code, see simple_rpc.ErrorCode
+	OneWay        bool              // the server doesn't reply
+	RetryAfter    time.Duration     // suggested backoff before retrying
+	ArgType       string            // tag of the concrete type of the body, see simple_rpc.Typed
+	Meta          map[string]string // metadata of the request
+	Debug         bool              // the server reports its timing in Trace
+	Trace         *Trace            // server-side timing, only set in the response of a Debug request
+	Stream        bool              // the body is sent in chunks, see simple_rpc.Stream
+	Push          bool              // a notification pushed by the server, see simple_rpc.Publish
+}
+
+// Trace is the time spent by the server in each phase of a request
+type Trace struct {
+	Decode time.Duration // decoding the body into the argument
+	Handle time.Duration // executing the method
+	Encode time.Duration // encoding the reply, measured by marshaling it once more before writing
 }
 
 type Codec interface {
@@ -18,14 +45,22 @@ type Codec interface {
 	Write(*Header, interface{}) error
 }
 
+// BufferedWriter is implemented by codecs which buffer the messages written,
+// so that multiple messages can be sent in one flush.
+type BufferedWriter interface {
+	WriteBuffered(*Header, interface{}) error
+	Flush() error
+}
+
 type NewCodecFunc func(io.ReadWriteCloser) Codec
 
 type Type string
 
-// 定义 2 种 Codec，Gob 和 Json，但是实际代码中只实现了 Gob 一种，事实上，2 者的实现非常接近，甚至只需要把 gob 换成 json 即可。
+// 定义 3 种 Codec，Gob、Json 和 Msgpack，但是实际代码中只实现了 Gob 和 Msgpack，事实上，它们的实现非常接近，甚至只需要把 gob 换成 json 即可。
 const (
-	GobType  Type = "application/gob"
-	JsonType Type = "application/json" // not implemented
+	GobType     Type = "application/gob"
+	JsonType    Type = "application/json" // not implemented
+	MsgpackType Type = "application/msgpack"
 )
 
 var NewCodecFuncMap map[Type]NewCodecFunc
@@ -33,4 +68,5 @@ var NewCodecFuncMap map[Type]NewCodecFunc
 func init() {
 	NewCodecFuncMap = make(map[Type]NewCodecFunc)
 	NewCodecFuncMap[GobType] = NewGobCodec
+	NewCodecFuncMap[MsgpackType] = NewMsgpackCodec
 }
@@ -0,0 +1,169 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+
+	"github.com/golang/snappy"
+)
+
+// Compressor compresses and decompresses the body of messages.
+type Compressor interface {
+	Compress([]byte) ([]byte, error)
+	Decompress([]byte) ([]byte, error)
+}
+
+// BodyMarshaler is implemented by codecs which can marshal a body into bytes on its own,
+// it's required by NewCompressingCodec.
+type BodyMarshaler interface {
+	MarshalBody(body interface{}) ([]byte, error)
+	UnmarshalBody(data []byte, body interface{}) error
+}
+
+type CompressorType string
+
+// 和 Codec 一样，通过 CompressorType 得到对应的 Compressor，客户端在 Option 中指定，服务端据此包装 Codec。
+const (
+	GzipCompressor   CompressorType = "gzip"
+	SnappyCompressor CompressorType = "snappy"
+)
+
+var CompressorMap = map[CompressorType]Compressor{
+	GzipCompressor:   gzipCompressor{},
+	SnappyCompressor: snappyCompressor{},
+}
+
+// CompressingCodec 是一个装饰器，Header 仍由内部的 Codec 原样编码，
+// 而 body 先由内部 Codec 序列化为字节，压缩后再作为 []byte 写出，读取时按相反的顺序处理。
+// 这样任何实现了 BodyMarshaler 的 Codec 都可以获得压缩能力，而不需要修改其实现。
+type CompressingCodec struct {
+	inner      Codec
+	marshaler  BodyMarshaler
+	compressor Compressor
+}
+
+var _ Codec = (*CompressingCodec)(nil)
+var _ Counter = (*CompressingCodec)(nil)
+var _ BufferedWriter = (*CompressingCodec)(nil)
+var _ HeaderLimiter = (*CompressingCodec)(nil)
+
+// NewCompressingCodec wraps inner to compress the bodies with compressor,
+// inner must implement BodyMarshaler.
+func NewCompressingCodec(inner Codec, compressor Compressor) Codec {
+	m, ok := inner.(BodyMarshaler)
+	if !ok {
+		log.Panicf("rpc codec: %T doesn't implement BodyMarshaler", inner)
+	}
+	return &CompressingCodec{inner: inner, marshaler: m, compressor: compressor}
+}
+
+func (c *CompressingCodec) ReadHeader(h *Header) error {
+	return c.inner.ReadHeader(h)
+}
+
+// SetMaxHeaderSize limits the headers read by inner if it's a HeaderLimiter
+func (c *CompressingCodec) SetMaxHeaderSize(n int64) {
+	if l, ok := c.inner.(HeaderLimiter); ok {
+		l.SetMaxHeaderSize(n)
+	}
+}
+
+func (c *CompressingCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		return c.inner.ReadBody(nil)
+	}
+	var data []byte
+	if err := c.inner.ReadBody(&data); err != nil {
+		return err
+	}
+	data, err := c.compressor.Decompress(data)
+	if err != nil {
+		return err
+	}
+	return c.marshaler.UnmarshalBody(data, body)
+}
+
+func (c *CompressingCodec) Write(h *Header, body interface{}) error {
+	if err := c.WriteBuffered(h, body); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// WriteBuffered compresses the body and writes the message without flushing,
+// if inner is not a BufferedWriter, the message is written directly.
+func (c *CompressingCodec) WriteBuffered(h *Header, body interface{}) error {
+	data, err := c.marshaler.MarshalBody(body)
+	if err == nil {
+		data, err = c.compressor.Compress(data)
+	}
+	if err != nil {
+		log.Println("rpc: compressing codec error encoding body:", err)
+		_ = c.Close()
+		return err
+	}
+	if w, ok := c.inner.(BufferedWriter); ok {
+		return w.WriteBuffered(h, data)
+	}
+	return c.inner.Write(h, data)
+}
+
+func (c *CompressingCodec) Flush() error {
+	if w, ok := c.inner.(BufferedWriter); ok {
+		return w.Flush()
+	}
+	return nil
+}
+
+func (c *CompressingCodec) BytesRead() int64 {
+	if cnt, ok := c.inner.(Counter); ok {
+		return cnt.BytesRead()
+	}
+	return 0
+}
+
+func (c *CompressingCodec) BytesWritten() int64 {
+	if cnt, ok := c.inner.(Counter); ok {
+		return cnt.BytesWritten()
+	}
+	return 0
+}
+
+func (c *CompressingCodec) Close() error {
+	return c.inner.Close()
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	return io.ReadAll(r)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCompressor) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
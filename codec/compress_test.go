@@ -0,0 +1,49 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressingCodec_RoundTrip(t *testing.T) {
+	for typ, c := range CompressorMap {
+		conn := new(buffer)
+		cc := NewCompressingCodec(NewGobCodec(conn), c)
+		body := args{Num1: 1, Num2: 2}
+		if err := cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, body); err != nil {
+			t.Fatal(err)
+		}
+		if err := cc.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, body); err != nil {
+			t.Fatal(err)
+		}
+		var h Header
+		var got args
+		if err := cc.ReadHeader(&h); err != nil || h.Seq != 1 {
+			t.Fatalf("%s: wrong header %+v: %v", typ, h, err)
+		}
+		// discarding a body keeps the stream in sync
+		if err := cc.ReadBody(nil); err != nil {
+			t.Fatalf("%s: failed to discard body: %v", typ, err)
+		}
+		if err := cc.ReadHeader(&h); err != nil || h.Seq != 2 {
+			t.Fatalf("%s: wrong header %+v: %v", typ, h, err)
+		}
+		if err := cc.ReadBody(&got); err != nil || got != body {
+			t.Fatalf("%s: wrong body %+v: %v", typ, got, err)
+		}
+	}
+}
+
+func TestCompressor_Shrinks(t *testing.T) {
+	data := bytes.Repeat([]byte("simple rpc "), 100)
+	for typ, c := range CompressorMap {
+		compressed, err := c.Compress(data)
+		if err != nil || len(compressed) >= len(data) {
+			t.Fatalf("%s: expect compressed data, got %d bytes: %v", typ, len(compressed), err)
+		}
+		got, err := c.Decompress(compressed)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: failed to decompress: %v", typ, err)
+		}
+	}
+}
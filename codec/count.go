@@ -0,0 +1,73 @@
+package codec
+
+import (
+	"bufio"
+	"io"
+)
+
+// Counter is implemented by codecs which count the bytes they have read and written,
+// the server uses it to account the size of requests and replies per method.
+// 计数只有一次整数加法的开销，写操作在发送锁内完成，读操作只在读循环中进行，因此不需要原子操作。
+type Counter interface {
+	BytesRead() int64
+	BytesWritten() int64
+}
+
+// countingReader implements io.ByteScanner so that decoders reading from it
+// don't wrap it in another buffer, thus only the bytes actually decoded are counted.
+// It also enforces the header size limit, see limit.go.
+type countingReader struct {
+	r     *bufio.Reader
+	n     int64
+	limit headerLimit
+}
+
+func newCountingReader(r io.Reader) *countingReader {
+	return &countingReader{r: bufio.NewReader(r)}
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.limit.active {
+		if err := c.checkLimit(); err != nil {
+			return 0, err
+		}
+		if int64(len(p)) > c.limit.budget {
+			p = p[:c.limit.budget]
+		}
+	}
+	n, err := c.r.Read(p)
+	c.consume(int64(n))
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	if c.limit.active {
+		if err := c.checkLimit(); err != nil {
+			return 0, err
+		}
+	}
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.consume(1)
+	}
+	return b, err
+}
+
+func (c *countingReader) UnreadByte() error {
+	err := c.r.UnreadByte()
+	if err == nil {
+		c.consume(-1)
+	}
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -2,6 +2,7 @@ package codec
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/gob"
 	"io"
 	"log"
@@ -13,35 +14,62 @@ import (
 type GobCodec struct {
 	conn io.ReadWriteCloser
 	buf  *bufio.Writer
+	r    *countingReader
+	w    *countingWriter
 	dec  *gob.Decoder
 	enc  *gob.Encoder
+	max  int64 // max size of a header, 0 means no limit
 }
 
 var _ Codec = (*GobCodec)(nil)
+var _ Counter = (*GobCodec)(nil)
+var _ BufferedWriter = (*GobCodec)(nil)
+var _ BodyMarshaler = (*GobCodec)(nil)
+var _ HeaderLimiter = (*GobCodec)(nil)
 
 // NewGobCodec 抽象出 Codec 的构造函数，客户端和服务端可以通过 Codec 的 Type 得到构造函数，从而创建 Codec 实例。
 // 这部分代码和工厂模式类似，与工厂模式不同的是，返回的是构造函数，而非实例。
 func NewGobCodec(conn io.ReadWriteCloser) Codec {
 	buf := bufio.NewWriter(conn)
+	r := newCountingReader(conn)
+	w := &countingWriter{w: buf}
 	return &GobCodec{
 		conn: conn,
 		buf:  buf,
-		dec:  gob.NewDecoder(conn),
-		enc:  gob.NewEncoder(buf),
+		r:    r,
+		w:    w,
+		dec:  gob.NewDecoder(r),
+		enc:  gob.NewEncoder(w),
 	}
 }
 
 func (c *GobCodec) ReadHeader(h *Header) error {
+	if c.max > 0 {
+		c.r.limitHeader(c.max, true)
+		defer c.r.unlimitHeader()
+	}
 	return c.dec.Decode(h)
 }
 
+// SetMaxHeaderSize makes ReadHeader fail with ErrHeaderTooLarge if a header exceeds n bytes
+func (c *GobCodec) SetMaxHeaderSize(n int64) {
+	c.max = n
+}
+
 func (c *GobCodec) ReadBody(body interface{}) error {
 	return c.dec.Decode(body)
 }
 
 func (c *GobCodec) Write(h *Header, body interface{}) (err error) {
+	if err = c.WriteBuffered(h, body); err == nil {
+		err = c.Flush()
+	}
+	return
+}
+
+// WriteBuffered encodes the message into the buffer without flushing it
+func (c *GobCodec) WriteBuffered(h *Header, body interface{}) (err error) {
 	defer func() {
-		_ = c.buf.Flush()
 		if err != nil {
 			_ = c.Close()
 		}
@@ -57,6 +85,36 @@ func (c *GobCodec) Write(h *Header, body interface{}) (err error) {
 	return
 }
 
+func (c *GobCodec) Flush() error {
+	err := c.buf.Flush()
+	if err != nil {
+		_ = c.Close()
+	}
+	return err
+}
+
+// MarshalBody encodes body with a new encoder, so the bytes carry the type information
+// and can be decoded on their own.
+func (c *GobCodec) MarshalBody(body interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *GobCodec) UnmarshalBody(data []byte, body interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(body)
+}
+
+func (c *GobCodec) BytesRead() int64 {
+	return c.r.n
+}
+
+func (c *GobCodec) BytesWritten() int64 {
+	return c.w.n
+}
+
 func (c *GobCodec) Close() error {
 	return c.conn.Close()
 }
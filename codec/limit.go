@@ -0,0 +1,83 @@
+package codec
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrHeaderTooLarge is returned by ReadHeader if the header exceeds the limit set by SetMaxHeaderSize,
+// the rest of the header is left unread, so the connection can't be used anymore.
+var ErrHeaderTooLarge = errors.New("rpc codec: header too large")
+
+// HeaderLimiter is implemented by codecs which can limit the size of the headers they read,
+// so that a malicious peer can't make them allocate a huge ServiceMethod or Error. 0 means no limit.
+type HeaderLimiter interface {
+	SetMaxHeaderSize(n int64)
+}
+
+// headerLimit 记录读取 header 时剩余的字节预算。仅限制读取的字节数并不足以阻止 gob 分配内存：
+// gob 的每条消息以长度为前缀，解码器先按前缀分配整条消息的缓冲区再读取，
+// 因此对 gob 需要在每条消息开始时检查前缀，超出预算的消息在分配之前就被拒绝。
+// msgpack 的解码器按实际读到的字节逐步增长缓冲区，限制读取的字节数即可。
+type headerLimit struct {
+	active bool
+	framed bool  // messages are prefixed by their length in gob's format
+	budget int64 // bytes left for the header
+	frame  int64 // bytes left in the current message, only used if framed
+}
+
+// limitHeader makes the following reads fail with ErrHeaderTooLarge beyond n bytes until unlimitHeader
+func (c *countingReader) limitHeader(n int64, framed bool) {
+	c.limit = headerLimit{active: true, framed: framed, budget: n}
+}
+
+func (c *countingReader) unlimitHeader() {
+	c.limit = headerLimit{}
+}
+
+func (c *countingReader) consume(n int64) {
+	c.n += n
+	if c.limit.active {
+		c.limit.budget -= n
+		c.limit.frame -= n
+	}
+}
+
+// checkLimit returns ErrHeaderTooLarge if the budget is used up, or the next message is too large
+func (c *countingReader) checkLimit() error {
+	if c.limit.budget <= 0 {
+		return ErrHeaderTooLarge
+	}
+	if !c.limit.framed || c.limit.frame > 0 {
+		return nil
+	}
+	// a new message starts, peek its length, see encoding/gob's decodeUintReader
+	b, err := c.r.Peek(1)
+	if err != nil {
+		return err
+	}
+	width, size := 1, int64(b[0])
+	if b[0] >= 0x80 {
+		width = 1 + int(-int8(b[0]))
+		if width > 9 {
+			// let gob report the ill-formed length
+			c.limit.frame = c.limit.budget
+			return nil
+		}
+		if b, err = c.r.Peek(width); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		size = 0
+		for _, x := range b[1:] {
+			size = size<<8 | int64(x)
+		}
+	}
+	if size < 0 || int64(width)+size > c.limit.budget {
+		return ErrHeaderTooLarge
+	}
+	c.limit.frame = int64(width) + size
+	return nil
+}
@@ -0,0 +1,38 @@
+package codec
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestHeaderLimiter(t *testing.T) {
+	for name, newCodec := range map[string]NewCodecFunc{"gob": NewGobCodec, "msgpack": NewMsgpackCodec} {
+		conn := new(buffer)
+		c := newCodec(conn)
+		c.(HeaderLimiter).SetMaxHeaderSize(1 << 10)
+		huge := strings.Repeat("x", 1<<20)
+		for _, h := range []*Header{{ServiceMethod: "Foo.Sum", Seq: 1}, {ServiceMethod: "Foo.Sum", Seq: 2}, {ServiceMethod: huge, Seq: 3}} {
+			if err := c.Write(h, huge[:1<<12]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for seq := uint64(1); seq <= 2; seq++ {
+			var h Header
+			var body string
+			if err := c.ReadHeader(&h); err != nil || h.Seq != seq {
+				t.Fatalf("%s: failed to read header %d within the limit: %v", name, seq, err)
+			}
+			if err := c.ReadBody(&body); err != nil || len(body) != 1<<12 {
+				t.Fatalf("%s: body isn't limited: %v", name, err)
+			}
+		}
+		var h Header
+		if err := c.ReadHeader(&h); !errors.Is(err, ErrHeaderTooLarge) {
+			t.Fatalf("%s: expect ErrHeaderTooLarge, got %v", name, err)
+		}
+		if conn.Len() < 1<<19 {
+			t.Fatalf("%s: the oversized header shouldn't be read, only %d bytes left", name, conn.Len())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package codec
+
+import (
+	"bufio"
+	"io"
+	"log"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackCodec 与 GobCodec 的结构相同，只是将 gob 换成了 MessagePack。
+// MessagePack 是跨语言的紧凑二进制格式，Header 按字段名编码为 map，其他语言的客户端可以直接解析。
+type MsgpackCodec struct {
+	conn io.ReadWriteCloser
+	buf  *bufio.Writer
+	r    *countingReader
+	w    *countingWriter
+	dec  *msgpack.Decoder
+	enc  *msgpack.Encoder
+	max  int64 // max size of a header, 0 means no limit
+}
+
+var _ Codec = (*MsgpackCodec)(nil)
+var _ Counter = (*MsgpackCodec)(nil)
+var _ BufferedWriter = (*MsgpackCodec)(nil)
+var _ BodyMarshaler = (*MsgpackCodec)(nil)
+var _ HeaderLimiter = (*MsgpackCodec)(nil)
+
+func NewMsgpackCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	r := newCountingReader(conn)
+	w := &countingWriter{w: buf}
+	return &MsgpackCodec{
+		conn: conn,
+		buf:  buf,
+		r:    r,
+		w:    w,
+		dec:  msgpack.NewDecoder(r),
+		enc:  msgpack.NewEncoder(w),
+	}
+}
+
+func (c *MsgpackCodec) ReadHeader(h *Header) error {
+	if c.max > 0 {
+		c.r.limitHeader(c.max, false)
+		defer c.r.unlimitHeader()
+	}
+	return c.dec.Decode(h)
+}
+
+// SetMaxHeaderSize makes ReadHeader fail with ErrHeaderTooLarge if a header exceeds n bytes
+func (c *MsgpackCodec) SetMaxHeaderSize(n int64) {
+	c.max = n
+}
+
+func (c *MsgpackCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		// discard the body
+		return c.dec.Skip()
+	}
+	return c.dec.Decode(body)
+}
+
+func (c *MsgpackCodec) Write(h *Header, body interface{}) (err error) {
+	if err = c.WriteBuffered(h, body); err == nil {
+		err = c.Flush()
+	}
+	return
+}
+
+// WriteBuffered encodes the message into the buffer without flushing it
+func (c *MsgpackCodec) WriteBuffered(h *Header, body interface{}) (err error) {
+	defer func() {
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if err = c.enc.Encode(h); err != nil {
+		log.Println("rpc: msgpack error encoding header:", err)
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		log.Println("rpc: msgpack error encoding body:", err)
+		return
+	}
+	return
+}
+
+func (c *MsgpackCodec) Flush() error {
+	err := c.buf.Flush()
+	if err != nil {
+		_ = c.Close()
+	}
+	return err
+}
+
+func (c *MsgpackCodec) MarshalBody(body interface{}) ([]byte, error) {
+	return msgpack.Marshal(body)
+}
+
+func (c *MsgpackCodec) UnmarshalBody(data []byte, body interface{}) error {
+	return msgpack.Unmarshal(data, body)
+}
+
+func (c *MsgpackCodec) BytesRead() int64 {
+	return c.r.n
+}
+
+func (c *MsgpackCodec) BytesWritten() int64 {
+	return c.w.n
+}
+
+func (c *MsgpackCodec) Close() error {
+	return c.conn.Close()
+}
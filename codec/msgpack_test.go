@@ -0,0 +1,64 @@
+package codec
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type buffer struct {
+	bytes.Buffer
+}
+
+func (b *buffer) Close() error { return nil }
+
+type args struct{ Num1, Num2 int }
+
+func TestMsgpackCodec_RoundTrip(t *testing.T) {
+	conn := new(buffer)
+	c := NewMsgpackCodec(conn)
+	h := &Header{ServiceMethod: "Foo.Sum", Seq: 7, Error: "oops", Code: 3, Meta: map[string]string{"k": "v"}}
+	if err := c.Write(h, args{Num1: 1, Num2: 2}); err != nil {
+		t.Fatal(err)
+	}
+	var gotH Header
+	var gotBody args
+	if err := c.ReadHeader(&gotH); err != nil || !reflect.DeepEqual(gotH, *h) {
+		t.Fatalf("expect header %+v, but got %+v: %v", *h, gotH, err)
+	}
+	if err := c.ReadBody(&gotBody); err != nil || gotBody != (args{Num1: 1, Num2: 2}) {
+		t.Fatalf("wrong body %+v: %v", gotBody, err)
+	}
+}
+
+// 模拟其他语言的客户端：不依赖 Header 结构体，直接按 MessagePack 的 map 读写报文。
+func TestMsgpackCodec_Interop(t *testing.T) {
+	conn := new(buffer)
+	c := NewMsgpackCodec(conn)
+	if err := c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, args{Num1: 1, Num2: 2}); err != nil {
+		t.Fatal(err)
+	}
+	dec := msgpack.NewDecoder(conn)
+	var h, body map[string]interface{}
+	if err := dec.Decode(&h); err != nil || h["ServiceMethod"] != "Foo.Sum" {
+		t.Fatalf("foreign client can't read header %v: %v", h, err)
+	}
+	if err := dec.Decode(&body); err != nil || len(body) != 2 {
+		t.Fatalf("foreign client can't read body %v: %v", body, err)
+	}
+
+	conn.Reset()
+	enc := msgpack.NewEncoder(conn)
+	_ = enc.Encode(map[string]interface{}{"ServiceMethod": "Foo.Sum", "Seq": 2})
+	_ = enc.Encode(map[string]interface{}{"Num1": 3, "Num2": 4})
+	var gotH Header
+	var gotBody args
+	if err := c.ReadHeader(&gotH); err != nil || gotH.ServiceMethod != "Foo.Sum" || gotH.Seq != 2 {
+		t.Fatalf("can't read header from foreign client %+v: %v", gotH, err)
+	}
+	if err := c.ReadBody(&gotBody); err != nil || gotBody != (args{Num1: 3, Num2: 4}) {
+		t.Fatalf("can't read body from foreign client %+v: %v", gotBody, err)
+	}
+}
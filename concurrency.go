@@ -0,0 +1,50 @@
+package simple_rpc
+
+// 有的服务背后是稀缺的资源（例如只能串行访问的遗留系统），不能被无限并发地调用，而其他服务则可以自由并行。
+// SetServiceConcurrency 为单个服务设置并发上限，与其他限制的关系如下：
+// SetMaxConns 限制连接数，工作池限制整个服务端同时处理的请求数，服务并发上限只限制该服务自己的请求数，三者同时生效。
+// 排队等待的请求已经占用了处理它的协程或 worker，因此工作池较小时，应当避免大量请求排队等待受限的服务；
+// 工作池设置为 shed 时，超过上限的请求与工作池满时一样，直接以 ErrOverloaded 拒绝，不再排队。
+// 排队的时间不计入 HandleTimeout。Gateway 的调用不受服务并发上限的限制。
+
+// serviceLimit is a semaphore bounding the requests of a service being handled
+type serviceLimit struct {
+	sem chan struct{}
+}
+
+// acquire takes a slot of l, it returns false if all slots are taken and shed is true,
+// otherwise it waits until a slot is released.
+func (l *serviceLimit) acquire(shed bool) bool {
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+	}
+	if shed {
+		return false
+	}
+	l.sem <- struct{}{}
+	return true
+}
+
+func (l *serviceLimit) release() {
+	<-l.sem
+}
+
+// SetServiceConcurrency bounds the requests of the service handled at the same time to max, 0 means no limit.
+// Requests over the limit wait for a slot, or are rejected with ErrOverloaded if the worker pool sheds the load,
+// see SetWorkerPool. The limit covers all versions of the service registered by RegisterVersion.
+func (server *Server) SetServiceConcurrency(serviceName string, max int) {
+	if max <= 0 {
+		server.serviceLimits.Delete(serviceName)
+		return
+	}
+	server.serviceLimits.Store(serviceName, &serviceLimit{sem: make(chan struct{}, max)})
+}
+
+// serviceLimit returns the concurrency limit of svc, or nil if it's not limited
+func (server *Server) serviceLimit(svc *service) *serviceLimit {
+	l, _ := server.serviceLimits.Load(baseName(svc.name))
+	limit, _ := l.(*serviceLimit)
+	return limit
+}
@@ -0,0 +1,42 @@
+package simple_rpc
+
+import (
+	"io"
+	"net"
+)
+
+// ConnState represents the state of a connection served by the server.
+type ConnState int
+
+// 与 net/http.Server.ConnState 类似，但只报告连接的建立和关闭：
+// StateNew 在 ServeConn 开始时报告，此时还没有读取 Option，超出 SetMaxConns 限制的连接同样会先报告 StateNew；
+// StateClosed 在 ServeConn 返回、连接被关闭时报告。
+// 为了不给每个请求增加开销，不报告连接在活跃与空闲之间的切换，需要时可以通过 ConnInflightRequests 获取。
+const (
+	StateNew ConnState = iota
+	StateClosed
+)
+
+var connStateNames = map[ConnState]string{
+	StateNew:    "new",
+	StateClosed: "closed",
+}
+
+func (c ConnState) String() string {
+	return connStateNames[c]
+}
+
+// SetConnStateHook sets the hook called when a connection is opened or closed, nil removes it.
+// 钩子在 ServeConn 所在的协程中同步调用，应当尽快返回，否则会延迟连接的处理；
+// 只有 net.Conn 类型的连接会被报告。
+func (server *Server) SetConnStateHook(hook func(conn net.Conn, state ConnState)) {
+	server.connStateHook.Store(hook)
+}
+
+// setConnState calls the hook of connection state if it's set and conn is a net.Conn
+func (server *Server) setConnState(conn io.ReadWriteCloser, state ConnState) {
+	hook, _ := server.connStateHook.Load().(func(net.Conn, ConnState))
+	if nc, ok := conn.(net.Conn); ok && hook != nil {
+		hook(nc, state)
+	}
+}
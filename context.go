@@ -0,0 +1,131 @@
+package simple_rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"simple_rpc/codec"
+)
+
+// 服务端在处理请求时会为方法构造一个 context，携带与本次请求相关的信息。
+// 方法只需要将第一个参数声明为 context.Context，即可通过下面的辅助函数读取这些信息。
+type peerKey struct{}
+
+// withPeer returns a copy of ctx carrying the remote address of the caller
+func withPeer(ctx context.Context, addr net.Addr) context.Context {
+	if addr == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerKey{}, addr)
+}
+
+type metaKey struct{}
+type outgoingMetaKey struct{}
+
+// withIncomingMeta returns a copy of ctx carrying the metadata of the request being handled
+func withIncomingMeta(ctx context.Context, meta map[string]string) context.Context {
+	if len(meta) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, metaKey{}, meta)
+}
+
+// MetaFromContext returns the metadata of the request being handled, it must not be modified.
+func MetaFromContext(ctx context.Context) map[string]string {
+	meta, _ := ctx.Value(metaKey{}).(map[string]string)
+	return meta
+}
+
+// WithMeta returns a copy of ctx carrying the metadata sent with the calls made with it,
+// kv are key value pairs merged into the metadata ctx already carries.
+// 客户端附加的元数据与服务端收到的元数据使用不同的 key，因此服务端方法把 ctx 传给下游调用时，不会把收到的元数据原样转发。
+func WithMeta(ctx context.Context, kv ...string) context.Context {
+	if len(kv)%2 == 1 {
+		panic("rpc: WithMeta got an odd number of arguments")
+	}
+	old := outgoingMeta(ctx)
+	meta := make(map[string]string, len(old)+len(kv)/2)
+	for k, v := range old {
+		meta[k] = v
+	}
+	for i := 0; i < len(kv); i += 2 {
+		meta[kv[i]] = kv[i+1]
+	}
+	return context.WithValue(ctx, outgoingMetaKey{}, meta)
+}
+
+// outgoingMeta returns the metadata attached to ctx by WithMeta
+func outgoingMeta(ctx context.Context) map[string]string {
+	meta, _ := ctx.Value(outgoingMetaKey{}).(map[string]string)
+	return meta
+}
+
+type requestKey struct{}
+
+// requestInfo identifies the request being handled
+type requestInfo struct {
+	seq           uint64
+	serviceMethod string
+}
+
+// withRequest returns a copy of ctx carrying the Seq and ServiceMethod of h
+func withRequest(ctx context.Context, h *codec.Header) context.Context {
+	return context.WithValue(ctx, requestKey{}, requestInfo{seq: h.Seq, serviceMethod: h.ServiceMethod})
+}
+
+// SeqFromContext returns the Seq of the request being handled, 0 if ctx isn't the context of a request.
+// Seq 只在一个连接内唯一，跨连接关联日志时可以与 PeerFromContext 返回的地址一起使用。
+func SeqFromContext(ctx context.Context) uint64 {
+	info, _ := ctx.Value(requestKey{}).(requestInfo)
+	return info.seq
+}
+
+// MethodFromContext returns the "Service.Method" called by the request being handled,
+// empty if ctx isn't the context of a request.
+func MethodFromContext(ctx context.Context) string {
+	info, _ := ctx.Value(requestKey{}).(requestInfo)
+	return info.serviceMethod
+}
+
+// PeerFromContext returns the remote address of the caller,
+// ok is false if the transport doesn't provide one (eg, an in-memory pipe)
+func PeerFromContext(ctx context.Context) (addr net.Addr, ok bool) {
+	addr, ok = ctx.Value(peerKey{}).(net.Addr)
+	return
+}
+
+type connKey struct{}
+type tlsKey struct{}
+
+// withConn returns a copy of ctx carrying conn, unless conn is an in-memory pipe
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	if addr := conn.RemoteAddr(); addr == nil || addr.Network() == "pipe" {
+		return ctx
+	}
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// ConnFromContext returns the connection the request being handled is read from,
+// ok is false if the transport isn't a network connection (eg, an in-memory pipe or the HTTP gateway).
+// 方法可以据此检查对端的证书或设置 socket 选项，但连接归服务端所有，方法不能读写或关闭它。
+func ConnFromContext(ctx context.Context) (conn net.Conn, ok bool) {
+	conn, ok = ctx.Value(connKey{}).(net.Conn)
+	return
+}
+
+// TLSFromContext returns the TLS state of the connection of the request being handled,
+// eg, the certificates of the peer for mTLS authorization, ok is false if the connection isn't TLS.
+// 通过 HTTP 网关调用时返回 HTTP 请求的 TLS 状态。
+func TLSFromContext(ctx context.Context) (state *tls.ConnectionState, ok bool) {
+	if state, ok = ctx.Value(tlsKey{}).(*tls.ConnectionState); ok {
+		return state, true
+	}
+	conn, _ := ConnFromContext(ctx)
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, false
+	}
+	// the handshake is completed before the first request is read
+	cs := tc.ConnectionState()
+	return &cs, cs.HandshakeComplete
+}
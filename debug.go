@@ -1,24 +1,43 @@
 package simple_rpc
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 const debugText = `<html>
 	<body>
 	<title>Simple RPC Services</title>
-	{{range .}}
+	Inflight requests: {{.Inflight}}
+	{{if .Requests}}
+		<table>
+		<th align=center>Method</th><th align=center>Seq</th><th align=center>Remote</th><th align=center>Elapsed</th>
+		{{range .Requests}}
+			<tr>
+			<td align=left font=fixed>{{.ServiceMethod}}</td>
+			<td align=center>{{.Seq}}</td>
+			<td align=center>{{.Remote}}</td>
+			<td align=center>{{.Elapsed}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
+	{{range .Services}}
 	<hr>
 	Service {{.Name}}
 	<hr>
 		<table>
-		<th align=center>Method</th><th align=center>Calls</th>
-		{{range $name, $mType := .Method}}
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Errors</th>
+		{{range .Method}}
 			<tr>
-			<td align=left font=fixed>{{$name}}({{$mType.ArgType}}, {{$mType.ReplyType}}) error</td>
-			<td align=center>{{$mType.NumCalls}}</td>
+			<td align=left font=fixed>{{.Name}}({{.ArgType}}, {{.ReplyType}}) error</td>
+			<td align=center>{{.Calls}}</td>
+			<td align=center>{{.Errors}}</td>
 			</tr>
 		{{end}}
 		</table>
@@ -28,28 +47,75 @@ const debugText = `<html>
 
 var debug = template.Must(template.New("RPC debug").Parse(debugText))
 
+// debugHTTP 渲染已注册的服务、方法以及调用次数、错误次数和当前正在处理的请求数，以及正在执行的请求列表，
+// 请求带有 ?format=json 或 Accept: application/json 时以 JSON 返回，便于脚本采集。
+// 它只在调用 HandleHTTP 时注册，也可以通过 DebugHandler 单独绑定到另一个端口，避免对外暴露。
 type debugHTTP struct {
 	*Server
 }
 
+type debugPage struct {
+	Inflight int               `json:"inflight"`
+	Requests []InflightRequest `json:"requests"`
+	Services []debugService    `json:"services"`
+}
+
 type debugService struct {
-	Name   string
-	Method map[string]*methodType
+	Name   string        `json:"name"`
+	Method []debugMethod `json:"methods"`
+}
+
+type debugMethod struct {
+	Name      string `json:"name"`
+	ArgType   string `json:"arg_type"`
+	ReplyType string `json:"reply_type"`
+	Calls     uint64 `json:"calls"`
+	Errors    uint64 `json:"errors"`
+}
+
+// typeNames returns the names of types separated by comma
+func typeNames(types []reflect.Type) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = t.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// DebugHandler returns the handler of the debug page,
+// eg, go http.ListenAndServe("localhost:6060", server.DebugHandler()).
+func (server *Server) DebugHandler() http.Handler {
+	return debugHTTP{server}
 }
 
 // Runs at /debug/simple_rpc
 func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// Build a sorted version of the data.
-	var services []debugService
+	page := debugPage{Inflight: server.InflightRequests(), Requests: server.Inflight()}
 	server.serviceMap.Range(func(name, sci interface{}) bool {
 		svc := sci.(*service)
-		services = append(services, debugService{
-			Name:   name.(string),
-			Method: svc.method,
-		})
+		ds := debugService{Name: name.(string)}
+		for mName, m := range svc.method {
+			ds.Method = append(ds.Method, debugMethod{
+				Name:      mName,
+				ArgType:   m.ArgType.String(),
+				ReplyType: typeNames(m.ReplyTypes),
+				Calls:     m.NumCalls(),
+				Errors:    m.NumErrors(),
+			})
+		}
+		sort.Slice(ds.Method, func(i, j int) bool { return ds.Method[i].Name < ds.Method[j].Name })
+		page.Services = append(page.Services, ds)
 		return true
 	})
-	err := debug.Execute(w, services)
+	sort.Slice(page.Services, func(i, j int) bool { return page.Services[i].Name < page.Services[j].Name })
+
+	if req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(page)
+		return
+	}
+	err := debug.Execute(w, page)
 	if err != nil {
 		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
 	}
@@ -0,0 +1,118 @@
+package simple_rpc
+
+import (
+	"reflect"
+	"sync"
+)
+
+// deepCopyValue 为交给异步观察者（例如审计钩子）的 argv 和 reply 拍摄快照：方法可能保留了 reply 中的 slice 或 map 并在之后修改，
+// 幂等缓存也会把同一个 reply 交给多个请求，直接把它们交给另一个协程读取会产生数据竞争。
+// 快照递归复制指针、slice、map、数组、接口和结构体的导出字段，共享同一个指针的地方在副本中仍然共享，因此环形的值也能复制。
+// 不支持的情况：chan、func 和 unsafe.Pointer 按原样共享；反射无法设置结构体的未导出字段，它们被浅拷贝，
+// 其中的指针、slice 和 map 仍与原值共享。不含引用的类型（数字、字符串以及只由它们组成的结构体和数组）直接按值复制，
+// 结果按类型缓存，常见的 reply 几乎没有额外开销。
+
+// deepCopyValue returns a copy of v which shares no mutable memory with v, except in the cases above
+func deepCopyValue(v reflect.Value) reflect.Value {
+	if !v.IsValid() {
+		return v
+	}
+	dst := reflect.New(v.Type()).Elem()
+	copyValue(dst, v, make(map[copiedPointer]reflect.Value))
+	return dst
+}
+
+// copiedPointer identifies a copied pointer, a struct and its first field have the same address
+type copiedPointer struct {
+	p uintptr
+	t reflect.Type
+}
+
+func copyValue(dst, src reflect.Value, seen map[copiedPointer]reflect.Value) {
+	if !hasReferences(src.Type()) {
+		dst.Set(src)
+		return
+	}
+	switch src.Kind() {
+	case reflect.Ptr:
+		if src.IsNil() {
+			return
+		}
+		key := copiedPointer{src.Pointer(), src.Type()}
+		if p, ok := seen[key]; ok {
+			dst.Set(p)
+			return
+		}
+		p := reflect.New(src.Type().Elem())
+		seen[key] = p
+		copyValue(p.Elem(), src.Elem(), seen)
+		dst.Set(p)
+	case reflect.Interface:
+		if src.IsNil() {
+			return
+		}
+		e := reflect.New(src.Elem().Type()).Elem()
+		copyValue(e, src.Elem(), seen)
+		dst.Set(e)
+	case reflect.Struct:
+		dst.Set(src) // unexported fields can't be set, they are shared
+		for i := 0; i < src.NumField(); i++ {
+			if f := dst.Field(i); f.CanSet() {
+				copyValue(f, src.Field(i), seen)
+			}
+		}
+	case reflect.Slice:
+		if src.IsNil() {
+			return
+		}
+		s := reflect.MakeSlice(src.Type(), src.Len(), src.Len())
+		if !hasReferences(src.Type().Elem()) {
+			reflect.Copy(s, src)
+		} else {
+			for i := 0; i < src.Len(); i++ {
+				copyValue(s.Index(i), src.Index(i), seen)
+			}
+		}
+		dst.Set(s)
+	case reflect.Array:
+		for i := 0; i < src.Len(); i++ {
+			copyValue(dst.Index(i), src.Index(i), seen)
+		}
+	case reflect.Map:
+		if src.IsNil() {
+			return
+		}
+		m := reflect.MakeMapWithSize(src.Type(), src.Len())
+		kt, vt := src.Type().Key(), src.Type().Elem()
+		iter := src.MapRange()
+		for iter.Next() {
+			k, v := reflect.New(kt).Elem(), reflect.New(vt).Elem()
+			copyValue(k, iter.Key(), seen)
+			copyValue(v, iter.Value(), seen)
+			m.SetMapIndex(k, v)
+		}
+		dst.Set(m)
+	}
+}
+
+var referenceTypes sync.Map // reflect.Type -> bool, see hasReferences
+
+// hasReferences reports whether values of t refer to memory which copyValue has to copy
+func hasReferences(t reflect.Type) bool {
+	if r, ok := referenceTypes.Load(t); ok {
+		return r.(bool)
+	}
+	var r bool
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+		r = true
+	case reflect.Array:
+		r = hasReferences(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField() && !r; i++ {
+			r = hasReferences(t.Field(i).Type)
+		}
+	}
+	referenceTypes.Store(t, r)
+	return r
+}
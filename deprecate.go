@@ -0,0 +1,60 @@
+package simple_rpc
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// DeprecationKey is the metadata key of the warning sent with the responses of a deprecated method.
+const DeprecationKey = "deprecation"
+
+// 接口演进时，可以先通过 Deprecate 标记即将下线的方法，调用仍然正常执行，
+// 但每个响应的 Header.Meta 中都会携带 DeprecationKey 警告，为调用方提供迁移的信号。
+// 客户端收到警告后将其记录在 Call.Warning 中，并交给 Option.OnWarning 处理；
+// 没有设置 OnWarning 时，每个客户端对每个方法只打印一次日志，避免刷屏。
+// 通过 Gateway 调用时，警告以 HTTP 的 Warning 响应头返回。
+
+// Deprecate marks serviceMethod deprecated, the responses of its calls carry message as a warning,
+// empty message removes the mark. serviceMethod is matched as it's called, eg, an alias set by RenameMethods
+// or a versioned name has to be marked on its own.
+func (server *Server) Deprecate(serviceMethod, message string) {
+	if message == "" {
+		server.deprecations.Delete(serviceMethod)
+		return
+	}
+	server.deprecations.Store(serviceMethod, message)
+}
+
+// deprecation returns the metadata of the responses of serviceMethod, nil if it's not deprecated
+func (server *Server) deprecation(serviceMethod string) map[string]string {
+	if msg, ok := server.deprecations.Load(serviceMethod); ok {
+		return map[string]string{DeprecationKey: msg.(string)}
+	}
+	return nil
+}
+
+// setGatewayWarning sets the Warning header of a gateway response if serviceMethod is deprecated
+func (server *Server) setGatewayWarning(w http.ResponseWriter, serviceMethod string) {
+	if msg, ok := server.deprecations.Load(serviceMethod); ok {
+		w.Header().Set("Warning", "299 - "+strconv.Quote(msg.(string)))
+	}
+}
+
+// warn reports the warning received with the response of serviceMethod
+func (client *Client) warn(serviceMethod, warning string) {
+	if client.opt.OnWarning != nil {
+		client.opt.OnWarning(serviceMethod, warning)
+		return
+	}
+	client.mu.Lock()
+	if client.warned == nil {
+		client.warned = make(map[string]bool)
+	}
+	logged := client.warned[serviceMethod]
+	client.warned[serviceMethod] = true
+	client.mu.Unlock()
+	if !logged {
+		log.Printf("rpc client: %s is deprecated: %s", serviceMethod, warning)
+	}
+}
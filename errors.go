@@ -0,0 +1,106 @@
+package simple_rpc
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrorCode 用于区分错误的类别，服务端将其写入 Header.Code 随响应一起返回，
+// 客户端据此还原出 *Error，调用方可以通过 errors.Is/errors.As 判断错误类型，从而决定是否重试。
+type ErrorCode int
+
+const (
+	CodeApplication        ErrorCode = iota // returned by the handler
+	CodeTransport                           // connection is broken
+	CodeCodec                               // failed to encode or decode a message
+	CodeServiceNotFound                     // service doesn't exist or ill-formed service method
+	CodeMethodNotFound                      // method doesn't exist
+	CodeTimeout                             // call or handle timeout
+	CodeNotPermitted                        // method is denied by the server
+	CodeOverloaded                          // server is overloaded, retry elsewhere
+	CodeUnsupportedVersion                  // protocol version of the client is not supported
+	CodeInvalidArgument                     // arg is rejected by its Validate method
+	CodeServerTimeout                       // server gave up handling the request, see Option.HandleTimeout
+	CodeInvalidReply                        // reply is rejected by its Validate method on the client
+	CodeInternal                            // method panicked, see SetPanicHandler
+)
+
+// Error is a structured rpc error, Code tells which kind of failure it is.
+// RetryAfter 是服务端建议的退避时间，目前只有 CodeOverloaded 会携带，通过 SetRetryAfter 设置。
+type Error struct {
+	Code       ErrorCode
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether target is an *Error with the same Code,
+// so errors.Is(err, ErrServiceNotFound) works whatever the message is.
+// A server timeout is a timeout as well, so errors.Is(err, ErrTimeout) is true for it.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && (t.Code == e.Code || t.Code == CodeTimeout && e.Code == CodeServerTimeout)
+}
+
+var (
+	ErrTransport          = &Error{Code: CodeTransport, Message: "rpc: transport error"}
+	ErrCodec              = &Error{Code: CodeCodec, Message: "rpc: codec error"}
+	ErrServiceNotFound    = &Error{Code: CodeServiceNotFound, Message: "rpc: service not found"}
+	ErrMethodNotFound     = &Error{Code: CodeMethodNotFound, Message: "rpc: method not found"}
+	ErrTimeout            = &Error{Code: CodeTimeout, Message: "rpc: timeout"}
+	ErrNotPermitted       = &Error{Code: CodeNotPermitted, Message: "rpc: method not permitted"}
+	ErrOverloaded         = &Error{Code: CodeOverloaded, Message: "rpc: server overloaded"}
+	ErrUnsupportedVersion = &Error{Code: CodeUnsupportedVersion, Message: "rpc: unsupported protocol version"}
+	ErrInvalidArgument    = &Error{Code: CodeInvalidArgument, Message: "rpc: invalid argument"}
+	// ErrServerTimeout means the server didn't finish the method within HandleTimeout,
+	// unlike an error returned by the method, the call may succeed if it's retried,
+	// but the method may still be running, so only idempotent methods should be retried.
+	ErrServerTimeout = &Error{Code: CodeServerTimeout, Message: "rpc: server handle timeout"}
+	ErrInvalidReply  = &Error{Code: CodeInvalidReply, Message: "rpc: invalid reply"}
+	ErrInternal      = &Error{Code: CodeInternal, Message: "rpc: internal error"}
+)
+
+func newError(code ErrorCode, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+// errorCode returns the code carried by err, or def if err is not an *Error
+func errorCode(err error, def ErrorCode) ErrorCode {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return def
+}
+
+// RetryAfter returns the backoff suggested by the server, ok is false if there is no suggestion.
+// 客户端重试前应当至少等待这段时间，而不是立即重试加重服务端的负担。
+func RetryAfter(err error) (d time.Duration, ok bool) {
+	var e *Error
+	if errors.As(err, &e) && e.RetryAfter > 0 {
+		return e.RetryAfter, true
+	}
+	return 0, false
+}
+
+// RegisterError is returned by RegisterAll, it holds one error for each receiver failed to register.
+type RegisterError struct {
+	Errors []error
+}
+
+func (e *RegisterError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the errors of the receivers, so errors.Is and errors.As examine them since Go 1.20.
+func (e *RegisterError) Unwrap() []error {
+	return e.Errors
+}
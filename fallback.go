@@ -0,0 +1,70 @@
+package simple_rpc
+
+import (
+	"errors"
+	"reflect"
+	"simple_rpc/codec"
+	"sync"
+)
+
+// 调用不存在的服务或方法时，默认返回 CodeServiceNotFound 或 CodeMethodNotFound 错误。
+// 设置 DefaultHandler 后，这类调用转交给它处理，由它返回 reply 或错误，例如转发到另一个后端，或者返回自定义的错误，
+// 被 SetACL 拒绝的方法不会转交。服务端不知道未知方法的入参类型，因此只有客户端用 Typed 包装、
+// 且类型已经通过 RegisterType 登记的入参会被解码后交给 DefaultHandler，否则 body 被丢弃，argv 为 nil。
+// DefaultHandler 在独立的 goroutine 中执行，不受 HandleTimeout、工作池和方法统计的约束。
+// HTTP 网关不会把未知方法转交给 DefaultHandler。
+
+// DefaultHandler handles the calls to unknown methods, the reply it returns is sent to the client.
+type DefaultHandler func(h *codec.Header, argv interface{}) (interface{}, error)
+
+var typeOfAny = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// SetDefaultHandler makes handler handle the calls to unknown methods, nil means replying not found.
+func (server *Server) SetDefaultHandler(handler DefaultHandler) {
+	server.fallbackFunc.Store(handler)
+}
+
+func (server *Server) fallback() DefaultHandler {
+	handler, _ := server.fallbackFunc.Load().(DefaultHandler)
+	return handler
+}
+
+// isNotFound reports whether err means the service or the method doesn't exist
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrServiceNotFound) || errors.Is(err, ErrMethodNotFound)
+}
+
+// readFallbackArg decodes the body of a call to an unknown method, it's nil unless the arg is typed
+func (server *Server) readFallbackArg(cc codec.Codec, h *codec.Header) (interface{}, error) {
+	if h.ArgType == "" || h.Stream {
+		return nil, discardBody(cc, h)
+	}
+	argV, body, err := server.newTypedArgV(typeOfAny, h.ArgType)
+	if err != nil {
+		_ = cc.ReadBody(nil)
+		return nil, err
+	}
+	if err = cc.ReadBody(body); err != nil {
+		return nil, err
+	}
+	h.ArgType = "" // the tag isn't echoed in the response
+	return argV.Interface(), nil
+}
+
+// handleFallback calls the default handler of req and sends its reply
+func (server *Server) handleFallback(c *serverConn, cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup) {
+	defer wg.Done()
+	reply, err := server.callFallback(req)
+	if err != nil {
+		setError(req.h, err, CodeApplication)
+		reply = invalidRequest
+	}
+	server.sendResponse(cc, req.h, reply, sending)
+	closeOnPanic(c, err)
+}
+
+// callFallback calls the default handler of req, a panic is recovered like the panic of a method
+func (server *Server) callFallback(req *request) (reply interface{}, err error) {
+	defer server.recoverPanic(req.h, nil, &err)
+	return req.fallback(req.h, req.fallbackArg)
+}
@@ -0,0 +1,148 @@
+package simple_rpc
+
+import (
+	"log"
+	"simple_rpc/codec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 响应的刷新策略：Codec 把每个响应编码进缓冲区后默认立即 Flush，即每个响应一次系统调用，延迟最低，
+// 但高并发时大量小响应的系统调用会成为吞吐的瓶颈。合并刷新把多个响应攒在缓冲区中一次写出，代价是单个响应的延迟变大。
+//
+//   - FlushEachResponse：每个响应立即刷新，与之前的行为一致，适合 QPS 低、对延迟敏感的服务。
+//   - FlushOnIdle：该连接上没有其他正在处理的请求时才刷新，并发的请求的响应被合并写出，
+//     空闲连接上的单个请求仍然立即刷新，适合同一连接上有大量并发请求的服务。
+//   - FlushOnThreshold：缓冲的响应数达到 MaxCount 或字节数达到 MaxBytes 时刷新，适合批量吞吐型的服务，
+//     字节数需要 Codec 实现 codec.Counter 才能统计。
+//
+// 后两种策略下，响应在缓冲区中最多停留 MaxDelay（默认 DefaultFlushDelay），避免没有后续响应时迟迟不写出。
+// 策略只对实现了 codec.BufferedWriter 的 Codec 生效，内置的 Codec 都实现了它。
+// 刷新失败时缓冲区中的响应已经无法送达，与同步写入失败时一样关闭连接，之后的写入直接返回该错误，
+// 由定时器触发的刷新没有调用方接收错误，因此还会记录日志。
+
+// FlushMode decides when the buffered responses of a connection are written out
+type FlushMode int32
+
+const (
+	FlushEachResponse FlushMode = iota // flush after each response, the default
+	FlushOnIdle                        // flush once no other request of the connection is being handled
+	FlushOnThreshold                   // flush once MaxCount responses or MaxBytes bytes are buffered
+)
+
+// DefaultFlushDelay is the longest a response is buffered if FlushPolicy.MaxDelay is 0
+const DefaultFlushDelay = time.Millisecond
+
+// FlushPolicy configures how the responses are flushed, see SetFlushPolicy
+type FlushPolicy struct {
+	Mode     FlushMode
+	MaxCount int           // FlushOnThreshold: responses buffered before a flush, 0 means no limit
+	MaxBytes int64         // FlushOnThreshold: bytes buffered before a flush, 0 means no limit
+	MaxDelay time.Duration // the longest a response is buffered, 0 means DefaultFlushDelay
+}
+
+// SetFlushPolicy sets how the responses are flushed on the connections established after it.
+func (server *Server) SetFlushPolicy(policy FlushPolicy) {
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = DefaultFlushDelay
+	}
+	server.flushPolicy.Store(policy)
+}
+
+// withFlushPolicy wraps cc of c to flush the responses as the policy of the server says
+func (server *Server) withFlushPolicy(c *serverConn, cc codec.Codec) codec.Codec {
+	policy, _ := server.flushPolicy.Load().(FlushPolicy)
+	w, ok := cc.(codec.BufferedWriter)
+	if policy.Mode == FlushEachResponse || !ok {
+		return cc
+	}
+	return &flushingCodec{Codec: cc, w: w, policy: policy, conn: c}
+}
+
+// flushingCodec buffers the responses written and flushes them as policy says
+type flushingCodec struct {
+	codec.Codec
+	w      codec.BufferedWriter
+	policy FlushPolicy
+	conn   *serverConn
+	mu     sync.Mutex // protect following
+	count  int        // responses buffered
+	since  int64      // bytes written by the last flush
+	timer  *time.Timer
+	err    error // the first failed flush, the connection is closed
+}
+
+func (c *flushingCodec) Write(h *codec.Header, body interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if err := c.w.WriteBuffered(h, body); err != nil {
+		return err
+	}
+	if c.count++; c.full() {
+		return c.flush()
+	}
+	if c.count == 1 {
+		c.timer = time.AfterFunc(c.policy.MaxDelay, c.flushBuffered)
+	}
+	return nil
+}
+
+// full reports whether the buffered responses should be flushed now, c.mu must be held
+func (c *flushingCodec) full() bool {
+	if c.policy.Mode == FlushOnIdle {
+		// the request being replied is still counted
+		return atomic.LoadInt64(&c.conn.inflight) <= 1
+	}
+	return c.policy.MaxCount > 0 && c.count >= c.policy.MaxCount ||
+		c.policy.MaxBytes > 0 && bytesWritten(c.Codec)-c.since >= c.policy.MaxBytes
+}
+
+// flush writes out the buffered responses, the connection is closed if it fails, c.mu must be held
+func (c *flushingCodec) flush() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.count = 0
+	if err := c.w.Flush(); err != nil {
+		c.err = err
+		_ = c.Codec.Close()
+		return err
+	}
+	c.since = bytesWritten(c.Codec)
+	return nil
+}
+
+// flushBuffered flushes the responses buffered longer than MaxDelay
+func (c *flushingCodec) flushBuffered() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.count > 0 && c.err == nil {
+		if err := c.flush(); err != nil {
+			log.Println("rpc server: flush responses error:", err)
+		}
+	}
+}
+
+func (c *flushingCodec) Close() error {
+	c.flushBuffered()
+	c.mu.Lock()
+	closed := c.err != nil
+	c.mu.Unlock()
+	if closed {
+		return nil
+	}
+	return c.Codec.Close()
+}
+
+// unwrapCodec returns the codec wrapped by the flush policy, so its optional interfaces can be used
+func unwrapCodec(cc codec.Codec) codec.Codec {
+	if f, ok := cc.(*flushingCodec); ok {
+		return f.Codec
+	}
+	return cc
+}
@@ -0,0 +1,181 @@
+package simple_rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"simple_rpc/codec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultGatewayPath 是 HTTP 网关默认挂载的路径前缀。
+const defaultGatewayPath = "/rpc/"
+
+// gatewayHTTP 将 POST /rpc/{Service}/{Method} 形式的 REST 请求转换为内部的 RPC 调用，
+// 请求体按 JSON 解码为方法的 ArgType，返回值同样以 JSON 编码写回，便于浏览器和 curl 直接访问，
+// 它复用 findService 和 service.call，绕过了 codec 和连接层，因此不受 Option 中超时等设置的影响。
+// JSON 请求体不携带类型标签，因此 ArgType 为接口类型的方法（见 RegisterType）无法通过网关调用。
+//
+// 错误以 {"error": "...", "code": n} 的形式返回，code 即 ErrorCode，HTTP 状态码对应关系如下：
+//
+//	405 Method Not Allowed      请求方法不是 POST
+//	404 Not Found               路径格式错误、服务或方法不存在
+//	403 Forbidden               方法被 ACL 拒绝
+//	400 Bad Request             请求体无法解码为 ArgType，或者入参没有通过 Validate 检查
+//	503 Service Unavailable     服务端过载，如果设置了 SetRetryAfter，会带上 Retry-After（秒）
+//	504 Gateway Timeout         方法返回了超时错误或请求被取消
+//	500 Internal Server Error   方法返回的其他错误
+type gatewayHTTP struct {
+	*Server
+}
+
+// gatewayError is the JSON body of a failed gateway call
+type gatewayError struct {
+	Error string    `json:"error"`
+	Code  ErrorCode `json:"code"`
+}
+
+// Gateway returns an http.Handler that translates REST calls to RPC,
+// the service and method are taken from the last two segments of the path,
+// so it works under any prefix, eg, http.Handle("/rpc/", server.Gateway()).
+func (server *Server) Gateway() http.Handler {
+	return gatewayHTTP{server}
+}
+
+// HandleGateway registers the HTTP gateway of the server on /rpc/.
+func (server *Server) HandleGateway() {
+	http.Handle(defaultGatewayPath, server.Gateway())
+}
+
+// HandleGateway is a convenient approach for default server to register the HTTP gateway
+func HandleGateway() {
+	DefaultServer.HandleGateway()
+}
+
+func (gateway gatewayHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeGatewayError(w, http.StatusMethodNotAllowed, newError(CodeMethodNotFound, "rpc gateway: must POST"))
+		return
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) < 2 {
+		writeGatewayError(w, http.StatusNotFound, newError(CodeServiceNotFound, "rpc gateway: path must be /{Service}/{Method}"))
+		return
+	}
+	serviceMethod := parts[len(parts)-2] + "." + parts[len(parts)-1]
+	svc, mType, err := gateway.findService(serviceMethod)
+	if err != nil {
+		writeGatewayError(w, gatewayStatus(err), err)
+		return
+	}
+	if gateway.isOverloaded() {
+		if d := time.Duration(atomic.LoadInt64(&gateway.retryAfter)); d > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+		}
+		writeGatewayError(w, http.StatusServiceUnavailable, ErrOverloaded)
+		return
+	}
+
+	argV, replyV := mType.newArgV(), mType.newReplyV()
+	argVI := argV.Interface()
+	if argV.Type().Kind() != reflect.Ptr {
+		argVI = argV.Addr().Interface()
+	}
+	var stream *gatewayStream
+	if mType.streamsReply() {
+		// the response is written as the method writes it, see StreamTo
+		stream = &gatewayStream{w: w}
+		replyV = reflect.ValueOf(stream)
+	}
+	if mType.ArgType == typeOfReader {
+		// the body is consumed by the method as it arrives, see Stream
+		argV.Set(reflect.ValueOf(req.Body))
+	} else if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(argVI); err != nil {
+			writeGatewayError(w, http.StatusBadRequest, newError(CodeCodec, "rpc gateway: decode body err: "+err.Error()))
+			return
+		}
+	}
+
+	ctx := req.Context()
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		ctx = withPeer(ctx, addr)
+	}
+	if req.TLS != nil {
+		ctx = context.WithValue(ctx, tlsKey{}, req.TLS)
+	}
+	if err := gateway.validate(argV); err != nil {
+		writeGatewayError(w, gatewayStatus(err), err)
+		return
+	}
+	gateway.setGatewayWarning(w, serviceMethod)
+	atomic.AddInt64(&gateway.inflight, 1)
+	err = gateway.callMethod(ctx, &codec.Header{ServiceMethod: serviceMethod}, svc, mType, argV, replyV)
+	atomic.AddInt64(&gateway.inflight, -1)
+	if stream != nil && stream.wrote {
+		if err != nil {
+			// the status is sent already, abort the response so the client sees it's truncated
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+	if err != nil {
+		writeGatewayError(w, gatewayStatus(err), err)
+		return
+	}
+	if stream != nil {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(replyV.Interface())
+}
+
+// gatewayStream writes the streamed reply of a method as the body of the response
+type gatewayStream struct {
+	w     http.ResponseWriter
+	wrote bool
+}
+
+func (s *gatewayStream) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if !s.wrote {
+		s.w.Header().Set("Content-Type", "application/octet-stream")
+		s.wrote = true
+	}
+	return s.w.Write(p)
+}
+
+// gatewayStatus maps err to the HTTP status code of the gateway response
+func gatewayStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrServiceNotFound), errors.Is(err, ErrMethodNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNotPermitted):
+		return http.StatusForbidden
+	case errors.Is(err, ErrCodec), errors.Is(err, ErrInvalidArgument):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrOverloaded):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeGatewayError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(gatewayError{Error: err.Error(), Code: errorCode(err, CodeApplication)})
+}
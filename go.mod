@@ -1,3 +1,10 @@
 module simple_rpc
 
 go 1.19
+
+require (
+	github.com/golang/snappy v0.0.4
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+)
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
@@ -0,0 +1,130 @@
+package simple_rpc
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// IdempotencyKey is the metadata key of the idempotency key of a request,
+// eg, client.Call(WithMeta(ctx, IdempotencyKey, "order-42"), "Order.Create", args, &reply).
+const IdempotencyKey = "idempotency-key"
+
+// 开启幂等缓存后，服务端以 (ServiceMethod, 幂等键) 为键缓存方法的执行结果（包括方法有意返回的业务错误），
+// 在 ttl 内收到相同键的请求时直接回复缓存的结果，不再执行方法，因此重试非幂等的写操作是安全的。
+// 超时、panic（CodeInternal）、过载等暂时性的失败不会被缓存，结果随即被移除，下一次重试会重新执行方法。
+// 相同键的请求并发到达时，后到的请求等待先到的请求执行完成，共享其结果。
+// 内存上界：最多缓存 size 个结果，超出时淘汰最久未使用的，每个结果持有一个 reply 实例，
+// 因此占用的内存约为 size 乘以 reply 的大小；过期的结果在再次访问或被淘汰时释放。
+// 缓存只在单个服务端进程内有效，重启或请求被路由到其他实例时，方法仍会被再次执行。
+
+// SetIdempotencyCache enables the deduplication of requests by IdempotencyKey,
+// at most size results are cached for ttl. size 0 disables it.
+func (server *Server) SetIdempotencyCache(size int, ttl time.Duration) {
+	var c *idempotencyCache
+	if size > 0 {
+		c = &idempotencyCache{size: size, ttl: ttl, now: server.now, entries: make(map[string]*list.Element), lru: list.New()}
+	}
+	server.idempotency.Store(c)
+}
+
+// call invokes the method of req, args are validated first if SetValidateArgs is enabled,
+// the reply nil policy is applied after the method, requests with the same idempotency key share the result.
+func (server *Server) call(ctx context.Context, req *request) error {
+	if err := server.validate(req.argV); err != nil {
+		return err
+	}
+	c, _ := server.idempotency.Load().(*idempotencyCache)
+	key := req.h.Meta[IdempotencyKey]
+	if c == nil || key == "" || req.mType.streamsReply() {
+		// a streamed reply is sent as it's written, it can't be replayed
+		return server.callMethod(ctx, req.h, req.svc, req.mType, req.argV, req.replyV)
+	}
+	replyV, err := c.do(req.h.ServiceMethod+"\x00"+key, func() (reflect.Value, error) {
+		return req.replyV, server.callMethod(ctx, req.h, req.svc, req.mType, req.argV, req.replyV)
+	})
+	req.replyV = replyV
+	return err
+}
+
+// idempotencyCache is a LRU cache of results, the front of lru is the most recently used
+type idempotencyCache struct {
+	size    int
+	ttl     time.Duration
+	now     func() time.Time
+	mu      sync.Mutex // protect following
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type idempotentResult struct {
+	key    string
+	done   chan struct{} // closed once the result is set
+	replyV reflect.Value
+	err    error
+	expire time.Time
+}
+
+// do returns the cached result of key, or calls f and caches its result,
+// a transient failure is only shared with the concurrent requests, the next one calls f again.
+func (c *idempotencyCache) do(key string, f func() (reflect.Value, error)) (reflect.Value, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		r := el.Value.(*idempotentResult)
+		if !r.expired(c.now()) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			<-r.done
+			return r.replyV, r.err
+		}
+		c.remove(el)
+	}
+	r := &idempotentResult{key: key, done: make(chan struct{})}
+	c.entries[key] = c.lru.PushFront(r)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+	c.mu.Unlock()
+
+	r.replyV, r.err = f()
+	c.mu.Lock()
+	if transient(r.err) {
+		if el, ok := c.entries[key]; ok && el.Value.(*idempotentResult) == r {
+			c.remove(el)
+		}
+	} else {
+		r.expire = c.now().Add(c.ttl)
+	}
+	c.mu.Unlock()
+	close(r.done)
+	return r.replyV, r.err
+}
+
+// expired reports whether r is done and out of date at now, c.mu must be held
+func (r *idempotentResult) expired(now time.Time) bool {
+	return !r.expire.IsZero() && now.After(r.expire)
+}
+
+// transient reports whether err is a failure which may not happen again, such as a timeout,
+// a panic or an overload, rather than an error returned by the method on purpose.
+func transient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	switch errorCode(err, CodeApplication) {
+	case CodeTransport, CodeCodec, CodeTimeout, CodeServerTimeout, CodeOverloaded, CodeInternal:
+		return true
+	}
+	return false
+}
+
+func (c *idempotencyCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*idempotentResult).key)
+}
@@ -0,0 +1,50 @@
+package simple_rpc
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// InflightRequest is a request whose method is being executed.
+// Remote 是客户端的地址，连接没有地址时（例如 net.Pipe）是连接的标识，与 ConnInflightRequests 的键一致。
+type InflightRequest struct {
+	ServiceMethod string        `json:"service_method"`
+	Seq           uint64        `json:"seq"`
+	Remote        string        `json:"remote"`
+	Start         time.Time     `json:"start"`
+	Elapsed       time.Duration `json:"elapsed"`
+}
+
+// run executes the method of req, the request is listed by Inflight until the method returns,
+// and the slot of its service is released then.
+func (server *Server) run(ctx context.Context, c *serverConn, req *request, start time.Time) error {
+	server.requests.Store(req, &InflightRequest{
+		ServiceMethod: req.h.ServiceMethod,
+		Seq:           req.h.Seq,
+		Remote:        c.name,
+		Start:         start,
+	})
+	defer server.requests.Delete(req)
+	if req.limit != nil {
+		defer req.limit.release()
+	}
+	return server.traceCall(ctx, req)
+}
+
+// Inflight returns the requests whose methods are being executed, the longest running comes first.
+// 当服务端看起来卡住时，可以据此找出正在执行（或卡住）的方法，相当于 RPC 层面的线程转储。
+// 超过 HandleTimeout 的请求虽然已经回复了超时错误，但只要方法仍在执行，就仍然会被列出。
+// 每个请求在开始和结束时各有一次 sync.Map 的写入。
+func (server *Server) Inflight() []InflightRequest {
+	now := server.now()
+	var requests []InflightRequest
+	server.requests.Range(func(_, v interface{}) bool {
+		r := *v.(*InflightRequest)
+		r.Elapsed = now.Sub(r.Start)
+		requests = append(requests, r)
+		return true
+	})
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Start.Before(requests[j].Start) })
+	return requests
+}
@@ -0,0 +1,79 @@
+package simple_rpc
+
+import (
+	"log"
+	"net"
+	"sync"
+)
+
+// NewInProcess returns a client connected to server through an in-memory pipe.
+// 服务端通过 ServeConn 直接驱动 net.Pipe 的另一端，不需要监听真实的端口，便于编写快速且隔离的测试。
+func NewInProcess(server *Server) *Client {
+	client, err := NewClient(pipe(server), DefaultOption)
+	if err != nil {
+		// it never happens with the default option unless the pipe is broken
+		log.Panic("rpc client: in-process error: ", err)
+	}
+	return client
+}
+
+// pipe returns the client side of an in-memory connection served by server
+func pipe(server *Server) net.Conn {
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	return clientConn
+}
+
+// PipeListener is an in-memory net.Listener, each Dial creates a net.Pipe whose other end is returned by Accept.
+// 与 NewInProcess 不同，它可以像真实的监听器一样交给 Accept 或 Serve，因此连接同样受 SetMaxConns、Shutdown 等管理，
+// 客户端通过 DialWith(l.Dial, "pipe", "") 建立连接。
+type PipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+var _ net.Listener = (*PipeListener)(nil)
+
+// NewPipeListener returns a new in-memory listener
+func NewPipeListener() *PipeListener {
+	return &PipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// Accept waits for the next Dial, it returns net.ErrClosed once l is closed
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close makes Accept and Dial fail, connections already accepted are not closed
+func (l *PipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial connects to l, it's a Dialer, network and address are ignored
+func (l *PipeListener) Dial(network, address string) (net.Conn, error) {
+	clientConn, serverConn := net.Pipe()
+	select {
+	case l.conns <- serverConn:
+		return clientConn, nil
+	case <-l.done:
+		_ = clientConn.Close()
+		_ = serverConn.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,60 @@
+package simple_rpc
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// 客户端拦截器：在每次同步调用（Call 和 CallWithTimeout）外包装一层逻辑，统一实现注入认证信息、追踪信息、重试、熔断和日志，
+// 而不是分散在每个调用点。
+//
+// 顺序：先通过 Use 添加的拦截器在最外层，即 Use(a, b) 后一次调用的执行顺序为 a → b → 发送请求并等待响应 → b 返回 → a 返回。
+// invoke 发送请求并等待响应，拦截器可以不调用它（例如熔断时直接返回错误），也可以多次调用它（例如重试），
+// 每次调用 invoke 都是一个新的请求，有新的 Seq，响应会解码到同一个 reply 中。
+// 例外是流式的调用：Stream 的 io.Reader 在第一次发送时已经被读取，StreamTo 的 io.Writer 已经写入了部分数据，
+// 重新发送无法恢复，因此参数为 Stream 或者 reply 为 StreamTo/BlobTo 的调用再次调用 invoke 时返回 ErrStreamInvoked，不会发送请求。
+// Option.CallTimeout 和 CallWithTimeout 的 timeout 限制的是整个调用，包括拦截器的重试在内。
+//
+// 元数据：请求携带的元数据来自传给 invoke 的 ctx，拦截器通过 WithMeta 附加元数据后把新的 ctx 传给 invoke 即可，
+// 例如 invoke(WithMeta(ctx, "authorization", token))；通过 MetaFromContext 读取的是服务端收到的元数据，不能用于这里。
+//
+// 拦截器只包装 Call 和 CallWithTimeout：异步的 Go、单向的 Notify 以及 Batch 直接发送请求，不经过拦截器，
+// 需要拦截的调用应当使用 Call，例如在单独的协程中调用 Call 代替 Go。
+
+// ErrStreamInvoked is returned if an interceptor invokes a streamed call again, the stream can't be sent twice.
+var ErrStreamInvoked = errors.New("rpc client: a streamed call can't be invoked again")
+
+// Interceptor wraps a call of serviceMethod, invoke sends the call with ctx and waits for the reply.
+type Interceptor func(ctx context.Context, serviceMethod string, args interface{}, invoke func(ctx context.Context) error) error
+
+// Use appends interceptors to the client, the first one added is the outermost.
+// It should be called before the client is used.
+// Only Call and CallWithTimeout go through the interceptors, Go, Notify and Batch don't.
+func (client *Client) Use(interceptors ...Interceptor) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	chain, _ := client.interceptors.Load().([]Interceptor)
+	client.interceptors.Store(append(chain[:len(chain):len(chain)], interceptors...))
+}
+
+// invokeOnce makes invoke of a streamed call fail with ErrStreamInvoked after the first time
+func invokeOnce(invoke func(ctx context.Context) error) func(ctx context.Context) error {
+	var invoked int32
+	return func(ctx context.Context) error {
+		if !atomic.CompareAndSwapInt32(&invoked, 0, 1) {
+			return ErrStreamInvoked
+		}
+		return invoke(ctx)
+	}
+}
+
+// intercept calls the interceptors in chain in order, the last one calls invoke
+func intercept(chain []Interceptor, ctx context.Context, serviceMethod string, args interface{}, invoke func(ctx context.Context) error) error {
+	if len(chain) == 0 {
+		return invoke(ctx)
+	}
+	return chain[0](ctx, serviceMethod, args, func(ctx context.Context) error {
+		return intercept(chain[1:], ctx, serviceMethod, args, invoke)
+	})
+}
@@ -0,0 +1,83 @@
+package simple_rpc
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// 服务端可以通过 SetIdleTimeout 关闭长时间没有请求的连接，回收空闲连接占用的资源，
+// 但调用稀疏的长连接客户端也会因此被断开。为此客户端可以设置 Option.KeepAlive（例如 DefaultKeepAlive 即 30s），
+// 在这段时间没有发送任何请求时，自动发送一个保活帧：ServiceMethod 为 "__keepalive"、body 为空的单向调用（OneWay），
+// 服务端像 "__ping" 一样直接处理，不调用任何方法，也不回复，只重置连接的空闲计时。
+// 保活默认关闭，只应当对认识保活帧的服务端开启：不认识单向调用的旧服务端会回复一个 Seq 为 0 的错误，
+// 客户端只记录日志并丢弃它，但这类服务端不会读取保活帧的 body，之后的请求都会被错误解码。
+// 服务端的空闲超时应当大于客户端的保活间隔，例如 2 倍以上，避免保活帧还没有到达连接就被关闭。
+// 有请求正在处理的连接不视为空闲，即使方法执行的时间超过了空闲超时。
+
+// keepAliveMethod is a built-in one-way method, it only tells the server the connection is still wanted.
+const keepAliveMethod = "__keepalive"
+
+// DefaultKeepAlive is a suggested Option.KeepAlive for servers closing idle connections
+const DefaultKeepAlive = time.Second * 30
+
+// SetIdleTimeout closes the connections which send no request within timeout,
+// connections with requests being handled are not idle. 0 means no limit.
+func (server *Server) SetIdleTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&server.idleTimeout, int64(timeout))
+}
+
+// touch marks c active now
+func (server *Server) touch(c *serverConn) {
+	atomic.StoreInt64(&c.active, server.now().UnixNano())
+}
+
+// watchIdle closes c once it's idle for the idle timeout, the returned func stops watching
+func (server *Server) watchIdle(c *serverConn) (stop func()) {
+	timeout := time.Duration(atomic.LoadInt64(&server.idleTimeout))
+	if timeout <= 0 {
+		return func() {}
+	}
+	server.touch(c)
+	done := make(chan struct{})
+	go func() {
+		wait := timeout
+		for {
+			select {
+			case <-done:
+				return
+			case <-server.after(wait):
+			}
+			idle := server.now().Sub(time.Unix(0, atomic.LoadInt64(&c.active)))
+			if atomic.LoadInt64(&c.inflight) > 0 || idle < timeout {
+				wait = timeout - idle%timeout
+				continue
+			}
+			log.Printf("rpc server: close idle connection %s after %s", c.name, idle)
+			_ = c.rwc.Close()
+			return
+		}
+	}()
+	return func() { close(done) }
+}
+
+// keepAlive sends a keep-alive frame whenever no request is sent within interval, until the client is closed
+func (client *Client) keepAlive(interval time.Duration) {
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-client.closed:
+			return
+		case <-t.C:
+		}
+		quiet := time.Since(time.Unix(0, atomic.LoadInt64(&client.lastSend)))
+		if quiet >= interval {
+			if err := client.Notify(keepAliveMethod, invalidRequest); err == ErrShutdown {
+				return
+			}
+			quiet = 0
+		}
+		t.Reset(interval - quiet)
+	}
+}
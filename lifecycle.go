@@ -0,0 +1,71 @@
+package simple_rpc
+
+import "errors"
+
+// 服务可以选择实现以下接口，将初始化和清理与服务端的生命周期绑定，而不需要在 init 函数中临时处理：
+// RpcInit 在 Register 时调用，返回错误时服务不会被注册；
+// RpcClose 在 Unregister 时调用，Shutdown 排空所有连接后，会按注册的相反顺序注销所有服务，
+// 即后注册的服务先关闭，因此后注册的服务可以依赖先注册的服务。
+// 两个接口都是可选的，普通的结构体不需要任何修改。
+
+// RpcIniter is implemented by services which need to be set up when registered.
+type RpcIniter interface {
+	RpcInit() error
+}
+
+// RpcCloser is implemented by services which need to be torn down when unregistered.
+type RpcCloser interface {
+	RpcClose() error
+}
+
+// initService calls RpcInit of s if it's implemented
+func initService(s *service) error {
+	if i, ok := s.rcv.Interface().(RpcIniter); ok {
+		return i.RpcInit()
+	}
+	return nil
+}
+
+// closeService calls RpcClose of s if it's implemented
+func closeService(s *service) error {
+	if c, ok := s.rcv.Interface().(RpcCloser); ok {
+		return c.RpcClose()
+	}
+	return nil
+}
+
+// Unregister removes the service from the server and calls its RpcClose,
+// requests being handled by the service are not interrupted.
+func (server *Server) Unregister(name string) error {
+	server.svcMu.Lock()
+	defer server.svcMu.Unlock()
+	sci, ok := server.serviceMap.LoadAndDelete(name)
+	if !ok {
+		return errors.New("rpc: can't find service " + name)
+	}
+	server.invalidateMethods()
+	for i, n := range server.services {
+		if n == name {
+			server.services = append(server.services[:i], server.services[i+1:]...)
+			break
+		}
+	}
+	return closeService(sci.(*service))
+}
+
+// Unregister removes the service from the DefaultServer.
+func Unregister(name string) error { return DefaultServer.Unregister(name) }
+
+// unregisterAll unregisters all services in the reverse order of registration,
+// it returns the first error of RpcClose.
+func (server *Server) unregisterAll() (err error) {
+	server.svcMu.Lock()
+	names := append([]string(nil), server.services...)
+	server.svcMu.Unlock()
+	for i := len(names) - 1; i >= 0; i-- {
+		if e := server.Unregister(names[i]); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
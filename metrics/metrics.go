@@ -0,0 +1,114 @@
+// Package metrics exports the statistics of a simple_rpc.Server in the Prometheus text format.
+// 指标按 Prometheus 的文本格式（0.0.4）输出，Prometheus 可以直接抓取 Handler 的地址，
+// 不需要依赖 Prometheus 的客户端库，核心包也因此保持零依赖。输出的指标如下：
+//
+//	simple_rpc_calls_total{method}                 counter    方法的调用次数
+//	simple_rpc_errors_total{method}                counter    方法返回错误的次数
+//	simple_rpc_read_bytes_total{method}            counter    请求 body 的累计字节数
+//	simple_rpc_written_bytes_total{method}         counter    响应报文的累计字节数
+//	simple_rpc_call_duration_seconds{method}       histogram  方法的执行耗时
+//	simple_rpc_call_duration_quantile_seconds{method,quantile}  gauge  方法执行耗时的估算分位数（0.5、0.9、0.99）
+//	simple_rpc_inflight_requests                   gauge      正在处理的请求数
+//	simple_rpc_connections                         gauge      正在服务的连接数
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"simple_rpc"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WritePrometheus writes the metrics of server to w in the Prometheus text format
+func WritePrometheus(w io.Writer, server *simple_rpc.Server) error {
+	bw := bufio.NewWriter(w)
+	stats := server.Stats()
+	methods := make([]string, 0, len(stats))
+	for method := range stats {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	counters := []struct {
+		name, help string
+		value      func(simple_rpc.MethodStats) uint64
+	}{
+		{"simple_rpc_calls_total", "Number of calls of the method.", func(s simple_rpc.MethodStats) uint64 { return s.Calls }},
+		{"simple_rpc_errors_total", "Number of errors returned by the method.", func(s simple_rpc.MethodStats) uint64 { return s.Errors }},
+		{"simple_rpc_read_bytes_total", "Bytes of the request bodies of the method.", func(s simple_rpc.MethodStats) uint64 { return s.BytesRead }},
+		{"simple_rpc_written_bytes_total", "Bytes of the responses of the method.", func(s simple_rpc.MethodStats) uint64 { return s.BytesWritten }},
+	}
+	for _, c := range counters {
+		writeMeta(bw, c.name, c.help, "counter")
+		for _, method := range methods {
+			fmt.Fprintf(bw, "%s{method=%s} %d\n", c.name, quote(method), c.value(stats[method]))
+		}
+	}
+
+	const histogram = "simple_rpc_call_duration_seconds"
+	writeMeta(bw, histogram, "Time spent executing the method.", "histogram")
+	buckets := simple_rpc.LatencyBuckets()
+	for _, method := range methods {
+		s, m := stats[method], quote(method)
+		var count uint64
+		for i, n := range s.Latency {
+			count += n // buckets of Prometheus are cumulative
+			le := "+Inf"
+			if i < len(buckets) {
+				le = seconds(buckets[i])
+			}
+			fmt.Fprintf(bw, "%s_bucket{method=%s,le=%q} %d\n", histogram, m, le, count)
+		}
+		fmt.Fprintf(bw, "%s_sum{method=%s} %s\n", histogram, m, seconds(s.LatencySum))
+		fmt.Fprintf(bw, "%s_count{method=%s} %d\n", histogram, m, count)
+	}
+
+	const quantiles = "simple_rpc_call_duration_quantile_seconds"
+	writeMeta(bw, quantiles, "Estimated quantiles of the time spent executing the method.", "gauge")
+	for _, method := range methods {
+		s, m := stats[method], quote(method)
+		for _, q := range []struct {
+			quantile string
+			value    time.Duration
+		}{{"0.5", s.P50}, {"0.9", s.P90}, {"0.99", s.P99}} {
+			fmt.Fprintf(bw, "%s{method=%s,quantile=%q} %s\n", quantiles, m, q.quantile, seconds(q.value))
+		}
+	}
+
+	writeMeta(bw, "simple_rpc_inflight_requests", "Number of requests being handled.", "gauge")
+	fmt.Fprintf(bw, "simple_rpc_inflight_requests %d\n", server.InflightRequests())
+	writeMeta(bw, "simple_rpc_connections", "Number of connections being served.", "gauge")
+	fmt.Fprintf(bw, "simple_rpc_connections %d\n", server.NumConns())
+	return bw.Flush()
+}
+
+// Handler returns an http.Handler serving the metrics of server, it can be scraped by Prometheus directly
+func Handler(server *simple_rpc.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		if err := WritePrometheus(w, server); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+func writeMeta(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
+
+// quote quotes a label value, see the escaping rules of the text format
+func quote(v string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(v) + `"`
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"simple_rpc"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type Foo int
+
+type Args struct{ Num1, Num2 int }
+
+func (f Foo) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func TestWritePrometheus(t *testing.T) {
+	server := simple_rpc.NewServer()
+	if err := server.Register(new(Foo)); err != nil {
+		t.Fatal(err)
+	}
+	client := simple_rpc.NewInProcess(server)
+	defer func() { _ = client.Close() }()
+	for i := 0; i < 3; i++ {
+		var reply int
+		if err := client.Call(context.Background(), "Foo.Sum", Args{Num1: i, Num2: 1}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, server); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# HELP simple_rpc_calls_total ",
+		"# TYPE simple_rpc_calls_total counter\n",
+		`simple_rpc_calls_total{method="Foo.Sum"} 3` + "\n",
+		`simple_rpc_errors_total{method="Foo.Sum"} 0` + "\n",
+		"# TYPE simple_rpc_call_duration_seconds histogram\n",
+		`simple_rpc_call_duration_seconds_bucket{method="Foo.Sum",le="+Inf"} 3` + "\n",
+		`simple_rpc_call_duration_seconds_sum{method="Foo.Sum"} `,
+		`simple_rpc_call_duration_seconds_count{method="Foo.Sum"} 3` + "\n",
+		"# TYPE simple_rpc_call_duration_quantile_seconds gauge\n",
+		"# TYPE simple_rpc_inflight_requests gauge\n",
+		"# TYPE simple_rpc_connections gauge\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+
+	// 直方图的桶是累加的：每个桶的计数不小于前一个桶，最后是 le="+Inf"
+	prefix := `simple_rpc_call_duration_seconds_bucket{method="Foo.Sum",le=`
+	var buckets []string
+	last := -1
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		le, count, _ := strings.Cut(strings.TrimPrefix(line, prefix), "} ")
+		n, err := strconv.Atoi(count)
+		if err != nil || n < last {
+			t.Fatalf("bucket %s is not cumulative: %q", le, line)
+		}
+		last = n
+		buckets = append(buckets, le)
+	}
+	if want := len(simple_rpc.LatencyBuckets()) + 1; len(buckets) != want {
+		t.Fatalf("expect %d buckets, got %d: %v", want, len(buckets), buckets)
+	}
+	if buckets[len(buckets)-1] != `"+Inf"` {
+		t.Fatalf("expect the last bucket to be +Inf, got %s", buckets[len(buckets)-1])
+	}
+}
+
+func TestWritePrometheus_escape(t *testing.T) {
+	server := simple_rpc.NewServer()
+	if err := server.RegisterName("A\\b\"c\nd", new(Foo)); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, server); err != nil {
+		t.Fatal(err)
+	}
+	if want := `simple_rpc_calls_total{method="A\\b\"c\nd.Sum"} 0` + "\n"; !strings.Contains(buf.String(), want) {
+		t.Fatalf("missing %q in:\n%s", want, buf.String())
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"Foo.Sum": `"Foo.Sum"`,
+		`a\b`:     `"a\\b"`,
+		`a"b`:     `"a\"b"`,
+		"a\nb":    `"a\nb"`,
+		"\\\"\n":  `"\\\"\n"`,
+		"":        `""`,
+	} {
+		if got := quote(in); got != want {
+			t.Fatalf("quote(%q) = %s, expect %s", in, got, want)
+		}
+	}
+}
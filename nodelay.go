@@ -0,0 +1,43 @@
+package simple_rpc
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// TCP_NODELAY：Nagle 算法把小的写操作攒在一起发送，与对端的延迟确认（delayed ACK）叠加时，
+// 小请求或小响应可能被额外推迟几十毫秒。Go 的运行时默认已经为 TCP 连接关闭了 Nagle 算法（即开启 TCP_NODELAY），
+// 因此 NoDelayDefault 下小而对延迟敏感的调用本来就会立即发送；NoDelayOn 显式地保证这一点，
+// 适用于连接由自定义 Dialer 或监听器建立、可能修改过该设置的场景；NoDelayOff 重新开启 Nagle 算法，
+// 在大量小消息、吞吐优先而不在乎单次延迟的链路上可以减少报文数量。只对 *net.TCPConn 生效，
+// TLS 连接取其底层的 TCP 连接，其他连接被忽略。
+
+// NoDelay controls TCP_NODELAY of the connections, ie, whether Nagle's algorithm is disabled
+type NoDelay int32
+
+const (
+	NoDelayDefault NoDelay = iota // keep the setting of the connection, Go disables Nagle's algorithm by default
+	NoDelayOn                     // disable Nagle's algorithm, small messages are sent at once
+	NoDelayOff                    // enable Nagle's algorithm, small messages may be coalesced
+)
+
+// SetNoDelay sets TCP_NODELAY of the connections accepted after it, see NoDelay.
+func (server *Server) SetNoDelay(mode NoDelay) {
+	atomic.StoreInt32(&server.noDelay, int32(mode))
+}
+
+// setNoDelay applies mode to conn if it's a TCP connection or a TLS connection over TCP
+func setNoDelay(conn interface{}, mode NoDelay) {
+	if c, ok := conn.(*tls.Conn); ok {
+		conn = c.NetConn()
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if mode == NoDelayDefault || !ok {
+		return
+	}
+	if err := tc.SetNoDelay(mode == NoDelayOn); err != nil {
+		log.Println("rpc: set TCP_NODELAY error:", err)
+	}
+}
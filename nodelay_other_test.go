@@ -0,0 +1,14 @@
+//go:build !unix
+
+package simple_rpc
+
+import (
+	"net"
+	"testing"
+)
+
+// noDelayOf can't read TCP_NODELAY back on this platform
+func noDelayOf(t *testing.T, _ net.Conn) bool {
+	t.Skip("TCP_NODELAY can't be read back on this platform")
+	return false
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package simple_rpc
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// noDelayOf reads TCP_NODELAY of conn back from the socket
+func noDelayOf(t *testing.T, conn net.Conn) bool {
+	if c, ok := conn.(*tls.Conn); ok {
+		conn = c.NetConn()
+	}
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	_assert(err == nil, "failed to get the raw connection: %v", err)
+	var v int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		v, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	})
+	_assert(err == nil && sockErr == nil, "failed to read TCP_NODELAY: %v %v", err, sockErr)
+	return v != 0
+}
@@ -0,0 +1,265 @@
+package simple_rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"simple_rpc/codec"
+	"time"
+)
+
+// OptionCodec encodes the Option at the beginning of a connection.
+// 默认使用 JSON 编码 Option，对带宽敏感的场景可以通过 SetOptionCodec 切换为紧凑的二进制格式。
+// 服务端根据报文开头是否为 MagicNumber 自动识别格式，因此只需要在客户端设置即可。
+type OptionCodec interface {
+	Encode(w io.Writer, opt *Option) error
+	Decode(r io.Reader, opt *Option) error
+}
+
+var (
+	JSONOptionCodec   OptionCodec = jsonOptionCodec{}
+	BinaryOptionCodec OptionCodec = binaryOptionCodec{}
+)
+
+var optionCodec = JSONOptionCodec
+
+// SetOptionCodec sets the codec used by clients to send the Option,
+// it should be called before any connection is established.
+func SetOptionCodec(c OptionCodec) {
+	optionCodec = c
+}
+
+// jsonOptionCodec 从协议版本 2 开始，将 JSON 编码的 Option 作为一个带长度前缀的帧发送：
+// | length uint32 | JSON |，长度为大端序。服务端读取确切的字节数后再解码，不会多读属于第一个请求的字节，
+// 代理和多路复用器也可以据此干净地切分出 Option。版本 1（或不携带版本号）的客户端仍然发送不带前缀的 JSON，
+// 以便与旧版本的服务端通信，新的服务端两种格式都可以识别。
+type jsonOptionCodec struct{}
+
+// framedOptionVersion is the first protocol version sending the JSON Option in a frame
+const framedOptionVersion = 2
+
+func (jsonOptionCodec) Encode(w io.Writer, opt *Option) error {
+	if opt.Version < framedOptionVersion {
+		return json.NewEncoder(w).Encode(opt)
+	}
+	b, err := json.Marshal(opt)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	_, err = w.Write(append(frame, b...))
+	return err
+}
+
+func (jsonOptionCodec) Decode(r io.Reader, opt *Option) error {
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return err
+	}
+	_, err := decodeJSONOption(prefix, r, opt)
+	return err
+}
+
+// binaryOptionCodec 的报文格式如下，整数均为大端序，flags 的每一位对应 Option 中的一个 bool 字段：
+// | MagicNumber uint32 | len(CodecType) uint8 | CodecType | ConnectTimeout int64 | HandleTimeout int64 | flags uint8 | Version uint8 |
+// | len(Compressor) uint8 | Compressor | WriteTimeout int64 |
+type binaryOptionCodec struct{}
+
+const (
+	flagOrderedResponses = 1 << iota
+	flagInlineFastPath
+)
+
+func (binaryOptionCodec) Encode(w io.Writer, opt *Option) error {
+	if len(opt.CodecType) > 0xff || len(opt.Compressor) > 0xff {
+		return errors.New("rpc: codec type is too long")
+	}
+	if opt.Version < 0 || opt.Version > 0xff {
+		return errors.New("rpc: invalid protocol version")
+	}
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, uint32(opt.MagicNumber))
+	buf.WriteByte(byte(len(opt.CodecType)))
+	buf.WriteString(string(opt.CodecType))
+	_ = binary.Write(&buf, binary.BigEndian, int64(opt.ConnectTimeout))
+	_ = binary.Write(&buf, binary.BigEndian, int64(opt.HandleTimeout))
+	var flags uint8
+	if opt.OrderedResponses {
+		flags |= flagOrderedResponses
+	}
+	if opt.InlineFastPath {
+		flags |= flagInlineFastPath
+	}
+	buf.WriteByte(flags)
+	buf.WriteByte(byte(opt.Version))
+	buf.WriteByte(byte(len(opt.Compressor)))
+	buf.WriteString(string(opt.Compressor))
+	_ = binary.Write(&buf, binary.BigEndian, int64(opt.WriteTimeout))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (binaryOptionCodec) Decode(r io.Reader, opt *Option) error {
+	var magic uint32
+	if err := binary.Read(r, binary.BigEndian, &magic); err != nil {
+		return err
+	}
+	var n uint8
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return err
+	}
+	typ := make([]byte, n)
+	if _, err := io.ReadFull(r, typ); err != nil {
+		return err
+	}
+	var timeouts [2]int64
+	if err := binary.Read(r, binary.BigEndian, &timeouts); err != nil {
+		return err
+	}
+	var flags, version uint8
+	if err := binary.Read(r, binary.BigEndian, &flags); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return err
+	}
+	compressor := make([]byte, n)
+	if _, err := io.ReadFull(r, compressor); err != nil {
+		return err
+	}
+	var writeTimeout int64
+	if err := binary.Read(r, binary.BigEndian, &writeTimeout); err != nil {
+		return err
+	}
+	opt.MagicNumber = int(magic)
+	opt.CodecType = codec.Type(typ)
+	opt.ConnectTimeout = time.Duration(timeouts[0])
+	opt.HandleTimeout = time.Duration(timeouts[1])
+	opt.OrderedResponses = flags&flagOrderedResponses != 0
+	opt.InlineFastPath = flags&flagInlineFastPath != 0
+	opt.Version = int(version)
+	opt.Compressor = codec.CompressorType(compressor)
+	opt.WriteTimeout = time.Duration(writeTimeout)
+	return nil
+}
+
+// maxOptionSize bounds the bytes read to decode the Option,
+// optionSnippetSize bounds the bytes logged when the Option can't be decoded.
+const (
+	maxOptionSize     = 4096
+	optionSnippetSize = 64
+)
+
+// readOption detects the format of the Option by the MagicNumber prefix and decodes it,
+// the requests following the Option must be read from rest.
+// 解码失败时，返回的错误中附带收到的前若干个字节（十六进制），便于排查协议不匹配的问题，
+// 例如客户端没有发送 Option 就直接发送了 gob 编码的请求。
+// 不带长度前缀的 JSON 由 json.Decoder 解码，它会预读超出 Option 的字节，这些字节属于第一个请求，
+// 因此 rest 会先返回这部分字节，再继续读取 conn，否则第一个请求会被截断。
+func readOption(conn io.Reader, opt *Option) (rest io.Reader, err error) {
+	r := &recordingReader{r: io.LimitReader(conn, maxOptionSize)}
+	buffered, err := decodeOption(r, opt)
+	if err != nil {
+		return nil, fmt.Errorf("%v, received % x", err, r.snippet)
+	}
+	if buffered == nil {
+		return conn, nil
+	}
+	// json.Encoder ends the Option with a newline, which doesn't belong to the request
+	return &newlineSkipper{r: io.MultiReader(buffered, conn)}, nil
+}
+
+// decodeOption tells the formats apart by the first 4 bytes: the MagicNumber starts a binary Option,
+// a frame length is less than maxOptionSize so it starts with a 0 byte, which never starts a JSON value.
+// buffered holds the bytes read beyond an unframed JSON Option, it's nil for the other formats.
+func decodeOption(conn io.Reader, opt *Option) (buffered io.Reader, err error) {
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(prefix) == MagicNumber {
+		return nil, BinaryOptionCodec.Decode(io.MultiReader(bytes.NewReader(prefix), conn), opt)
+	}
+	return decodeJSONOption(prefix, conn, opt)
+}
+
+// decodeJSONOption decodes a JSON Option starting with prefix, framed or not, the rest is read from conn
+func decodeJSONOption(prefix []byte, conn io.Reader, opt *Option) (buffered io.Reader, err error) {
+	if prefix[0] == 0 {
+		n := binary.BigEndian.Uint32(prefix)
+		if n > maxOptionSize-4 {
+			return nil, fmt.Errorf("rpc: option frame of %d bytes is too large", n)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		return nil, json.Unmarshal(b, opt)
+	}
+	dec := json.NewDecoder(io.MultiReader(bytes.NewReader(prefix), conn))
+	if err := dec.Decode(opt); err != nil {
+		return nil, err
+	}
+	return dec.Buffered(), nil
+}
+
+// newlineSkipper drops the newline at the beginning of r, if any
+type newlineSkipper struct {
+	r       io.Reader
+	skipped bool
+}
+
+func (s *newlineSkipper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if !s.skipped && n > 0 {
+		s.skipped = true
+		if p[0] == '\n' {
+			n = copy(p, p[1:n])
+		}
+	}
+	return n, err
+}
+
+// recordingReader keeps the first optionSnippetSize bytes read from r
+type recordingReader struct {
+	r       io.Reader
+	snippet []byte
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if room := optionSnippetSize - len(r.snippet); room > 0 {
+		if room > n {
+			room = n
+		}
+		r.snippet = append(r.snippet, p[:room]...)
+	}
+	return n, err
+}
+
+// 跳过握手：在版本同步升级、受信任的内部链路上，每个连接开头的 Option 只是开销，
+// 双方可以在带外约定好 Option（主要是 CodecType 和 Compressor），客户端设置 SkipHandshake 后不再发送 Option，
+// 服务端通过 ServeConnWithOption 或 AcceptWithOption 直接以约定的 Option 服务连接，省去一次 Option 的编码和解码。
+//
+// 风险：这同时去掉了 MagicNumber 和协议版本的检查。连到该监听器的任何流量都会被直接当作约定编码的请求解码，
+// 发送了 Option 的普通客户端、其他协议的流量或者编码不一致的客户端不会被明确拒绝，
+// 而是以解码错误断开，或者更糟地被错误解读。因此双方必须同时启用，且这类监听器不应暴露给不受控的客户端。
+
+// ServeConnWithOption serves conn like ServeConn, but the Option isn't read from conn,
+// opt is used as if the client had sent it, the client must be created with Option.SkipHandshake.
+func (server *Server) ServeConnWithOption(conn io.ReadWriteCloser, opt *Option) {
+	server.serveConn(conn, opt)
+}
+
+// AcceptWithOption accepts connections on lis like Accept, and serves each one with ServeConnWithOption.
+func (server *Server) AcceptWithOption(lis net.Listener, opt *Option) error {
+	return server.accept(lis, opt)
+}
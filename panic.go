@@ -0,0 +1,73 @@
+package simple_rpc
+
+import (
+	"errors"
+	"log"
+	"runtime"
+	"simple_rpc/codec"
+	"sync/atomic"
+)
+
+// 方法（以及 DefaultHandler）panic 时，服务端会恢复它，计入方法的错误数，并以错误回复该请求，连接和其他请求不受影响。
+// 默认只记录 panic 的值和调用栈，回复给客户端的是不含细节的 CodeInternal 错误，避免泄露服务端的内部信息。
+// 设置 PanicHandler 后由它决定回复的错误，例如用自己的日志记录、上报指标，或者把 panic 的信息返回给客户端；
+// 返回 CloseConn 包装的错误时，回复发送后连接会像 Shutdown 一样被排空关闭：不再读取新的请求，
+// 等待已读取的请求处理完成，适用于认为 panic 可能破坏了该连接相关状态的场景。HTTP 网关会忽略关闭连接的要求。
+
+// PanicHandler handles a panic recovered from the method called by h,
+// the error it returns is replied to the client, nil means the default internal error.
+type PanicHandler func(h *codec.Header, recovered interface{}) (replyErr error)
+
+// SetPanicHandler sets the handler of panics recovered from the methods, nil means the default behavior,
+// which logs the panic with the stack and replies ErrInternal.
+func (server *Server) SetPanicHandler(handler PanicHandler) {
+	server.panicHandler.Store(handler)
+}
+
+// closeConnError asks the server to close the connection after the reply is sent
+type closeConnError struct {
+	error
+}
+
+func (e closeConnError) Unwrap() error {
+	return e.error
+}
+
+// CloseConn wraps err returned by a PanicHandler, so the connection is closed once err is replied.
+// The client receives err as it is.
+func CloseConn(err error) error {
+	if err == nil {
+		err = newError(CodeInternal, "rpc server: internal error")
+	}
+	return closeConnError{err}
+}
+
+// recoverPanic turns a panic into *err, it must be deferred directly, mType may be nil
+func (server *Server) recoverPanic(h *codec.Header, mType *methodType, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if mType != nil {
+		atomic.AddUint64(&mType.numErrors, 1)
+	}
+	handler, _ := server.panicHandler.Load().(PanicHandler)
+	if handler == nil {
+		buf := make([]byte, 64<<10)
+		buf = buf[:runtime.Stack(buf, false)]
+		log.Printf("rpc server: panic calling %s: %v\n%s", h.ServiceMethod, r, buf)
+		*err = newError(CodeInternal, "rpc server: internal error")
+		return
+	}
+	if *err = handler(h, r); *err == nil {
+		*err = newError(CodeInternal, "rpc server: internal error")
+	}
+}
+
+// closeOnPanic drains c if err asks the connection to be closed, see CloseConn
+func closeOnPanic(c *serverConn, err error) {
+	var e closeConnError
+	if errors.As(err, &e) {
+		c.drain()
+	}
+}
@@ -0,0 +1,87 @@
+package simple_rpc
+
+import "sync"
+
+// 默认情况下服务端为每个请求创建一个协程，突发流量下所有连接加起来可能同时存在数万个协程，调度器的开销随之上升。
+// 设置工作池后，所有连接的请求都交给固定数量的 worker 处理，从而限制整个服务端的并发数，而不仅仅是单个连接的。
+// worker 都在忙时，读循环或者阻塞等待空闲的 worker（同时停止读取该连接上的后续请求，形成背压），
+// 或者直接以 ErrOverloaded 拒绝请求，与 SetOverloadPredicate 的行为一致，客户端可以在 RetryAfter 之后换一个服务实例重试。
+// OrderedResponses 和 InlineFastPath 的请求本来就在读循环中处理，不经过工作池。
+// 再次调用 SetWorkerPool 时旧的工作池被停止：旧的 worker 处理完手上的请求后退出，
+// 仍然持有旧工作池的读循环提交的请求改为各自创建协程处理，不会丢失也不会阻塞。
+
+// workerPool is a fixed number of goroutines handling the requests of all connections
+type workerPool struct {
+	tasks   chan func()
+	shed    bool          // reject the request instead of waiting if all workers are busy
+	quit    chan struct{} // closed by stop
+	once    sync.Once
+	running sync.WaitGroup // the workers
+}
+
+func newWorkerPool(size int, shed bool) *workerPool {
+	p := &workerPool{tasks: make(chan func()), shed: shed, quit: make(chan struct{})}
+	p.running.Add(size)
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	defer p.running.Done()
+	for {
+		select {
+		case task := <-p.tasks:
+			task()
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// stop makes the workers exit once their tasks are done, tasks submitted afterwards run in their own goroutines.
+func (p *workerPool) stop() {
+	p.once.Do(func() { close(p.quit) })
+}
+
+// submit hands task to an idle worker, it returns false if all workers are busy and p sheds the load,
+// otherwise it waits until a worker is idle.
+func (p *workerPool) submit(task func()) bool {
+	select {
+	case p.tasks <- task:
+		return true
+	case <-p.quit:
+		go task()
+		return true
+	default:
+	}
+	if p.shed {
+		return false
+	}
+	select {
+	case p.tasks <- task:
+	case <-p.quit:
+		go task()
+	}
+	return true
+}
+
+// SetWorkerPool makes the requests of all connections handled by size workers, 0 means a goroutine per request.
+// If shed is true, requests arriving while all workers are busy are rejected with ErrOverloaded,
+// otherwise the read loop of the connection waits for an idle worker.
+// Calling it again replaces the pool, the workers of the old pool exit once their requests are done.
+func (server *Server) SetWorkerPool(size int, shed bool) {
+	p := (*workerPool)(nil)
+	if size > 0 {
+		p = newWorkerPool(size, shed)
+	}
+	if old, _ := server.pool.Swap(p).(*workerPool); old != nil {
+		old.stop()
+	}
+}
+
+func (server *Server) workers() *workerPool {
+	p, _ := server.pool.Load().(*workerPool)
+	return p
+}
@@ -0,0 +1,199 @@
+package simple_rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"simple_rpc/codec"
+)
+
+// 服务端推送：客户端通过 Subscribe 在当前连接上订阅一个主题，服务端之后可以通过 Publish 把通知推送给所有订阅了该主题的连接，
+// 用于缓存失效、配置下发等场景，方向与普通调用相反。
+//
+// 订阅和取消订阅是服务端内置的方法（__subscribe 和 __unsubscribe），入参是主题，不经过任何服务。
+// 通知的帧与响应共用同一个连接和编码：Header.Push 为 true，Seq 为 0，ServiceMethod 是主题，body 是通知的内容。
+// 客户端的读循环根据 Push 区分通知和响应，通知按主题分发给订阅时注册的 handler，不会被当作某个调用的响应。
+// 不认识 Push 的旧客户端会把它当作 Seq 为 0 的未知响应丢弃，不认识订阅方法的旧服务端会让 Subscribe 返回 CodeMethodNotFound。
+//
+// 订阅属于连接，连接断开后即失效；客户端重连成功后会自动重新订阅，断开期间的通知会丢失。
+// 通知是尽力而为的：每个订阅有一个长度为 notificationQueue 的队列，handler 处理不过来时新的通知被丢弃并记录日志。
+
+const (
+	subscribeMethod   = "__subscribe"
+	unsubscribeMethod = "__unsubscribe"
+)
+
+// notificationQueue is the number of notifications buffered for a slow handler
+const notificationQueue = 64
+
+// subscribe updates the topics of c if req is a subscription, other built-in methods are ignored
+func (c *serverConn) subscribe(req *request) {
+	switch req.h.ServiceMethod {
+	case subscribeMethod:
+		c.topics.Store(req.topic, struct{}{})
+	case unsubscribeMethod:
+		c.topics.Delete(req.topic)
+	}
+}
+
+// Publish pushes body to the connections subscribed to topic, it returns the number of connections it's sent to.
+// body is encoded for each connection with its codec, writes to a connection are serialized with its responses,
+// so Publish waits for slow connections, up to the write timeout, see SetWriteTimeout.
+func (server *Server) Publish(topic string, body interface{}) int {
+	var conns []*serverConn
+	server.mu.Lock()
+	for c := range server.activeConns {
+		if _, ok := c.topics.Load(topic); ok {
+			conns = append(conns, c)
+		}
+	}
+	server.mu.Unlock()
+	n := 0
+	for _, c := range conns {
+		if err := c.push(topic, body); err != nil {
+			log.Printf("rpc server: publish %s to %s error: %v", topic, c.name, err)
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// Publish is a convenient approach for default server to push notifications
+func Publish(topic string, body interface{}) int {
+	return DefaultServer.Publish(topic, body)
+}
+
+func (c *serverConn) push(topic string, body interface{}) error {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	return c.cc.Write(&codec.Header{ServiceMethod: topic, Push: true}, body)
+}
+
+// subscription is a topic subscribed by the client
+type subscription struct {
+	topic   string
+	newBody func() interface{}
+	handler func(body interface{})
+	queue   chan interface{}
+}
+
+// Subscribe asks the server to push the notifications of topic to this client, see Server.Publish.
+// Each notification is decoded into the value returned by newBody, which must be a pointer,
+// then passed to handler, handler is called in order in its own goroutine, so it may call the client.
+// A notification which can't be decoded into the value is logged and dropped, the connection goes on.
+func (client *Client) Subscribe(ctx context.Context, topic string, newBody func() interface{}, handler func(body interface{})) error {
+	if newBody == nil || handler == nil {
+		return errors.New("rpc client: Subscribe needs both newBody and handler")
+	}
+	sub := &subscription{topic: topic, newBody: newBody, handler: handler, queue: make(chan interface{}, notificationQueue)}
+	client.mu.Lock()
+	if _, ok := client.subs[topic]; ok {
+		client.mu.Unlock()
+		return errors.New("rpc client: already subscribed to " + topic)
+	}
+	if client.subs == nil {
+		client.subs = make(map[string]*subscription)
+	}
+	// registered before the call, so the notifications pushed right after the subscription aren't missed
+	client.subs[topic] = sub
+	client.mu.Unlock()
+	go client.notify(sub)
+	if err := client.Call(ctx, subscribeMethod, topic, nil); err != nil {
+		client.removeSubscription(sub)
+		return err
+	}
+	return nil
+}
+
+// Unsubscribe stops the notifications of topic, the handler isn't called once it returns.
+func (client *Client) Unsubscribe(ctx context.Context, topic string) error {
+	client.mu.Lock()
+	sub := client.subs[topic]
+	client.mu.Unlock()
+	if sub == nil {
+		return errors.New("rpc client: not subscribed to " + topic)
+	}
+	client.removeSubscription(sub)
+	return client.Call(ctx, unsubscribeMethod, topic, nil)
+}
+
+func (client *Client) removeSubscription(sub *subscription) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.subs[sub.topic] == sub {
+		delete(client.subs, sub.topic)
+		close(sub.queue)
+	}
+}
+
+// notify calls the handler of sub with the notifications in order, until it's unsubscribed or the client is closed
+func (client *Client) notify(sub *subscription) {
+	for {
+		select {
+		case body, ok := <-sub.queue:
+			if !ok {
+				return
+			}
+			sub.handler(body)
+		case <-client.closed:
+			return
+		}
+	}
+}
+
+// dispatch reads the notification of h and queues it to the subscription of its topic
+func (client *Client) dispatch(h *codec.Header) error {
+	client.mu.Lock()
+	sub := client.subs[h.ServiceMethod]
+	client.mu.Unlock()
+	if sub == nil {
+		// unsubscribed while the notification is on the way
+		return client.cc.ReadBody(nil)
+	}
+	body := sub.newBody()
+	if err := client.cc.ReadBody(body); err != nil {
+		if brokenStream(err) {
+			return err
+		}
+		// eg, the server publishes another type to the topic, the frame is consumed,
+		// so the calls on the connection go on
+		log.Printf("rpc client: notification of %s dropped, decode error: %v", h.ServiceMethod, err)
+		return nil
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.subs[h.ServiceMethod] != sub {
+		return nil
+	}
+	select {
+	case sub.queue <- body:
+	default:
+		log.Printf("rpc client: notification of %s dropped, the handler is too slow", h.ServiceMethod)
+	}
+	return nil
+}
+
+// brokenStream reports whether err of reading a body means the connection can't be read any more,
+// rather than the body doesn't fit the value it's decoded into.
+func brokenStream(err error) bool {
+	var ne net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe) || errors.As(err, &ne)
+}
+
+// resubscribe subscribes the topics again on the re-established connection
+func (client *Client) resubscribe() {
+	client.mu.Lock()
+	topics := make([]string, 0, len(client.subs))
+	for topic := range client.subs {
+		topics = append(topics, topic)
+	}
+	client.mu.Unlock()
+	for _, topic := range topics {
+		if err := client.Call(context.Background(), subscribeMethod, topic, nil); err != nil {
+			log.Printf("rpc client: resubscribe %s error: %v", topic, err)
+		}
+	}
+}
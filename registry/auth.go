@@ -0,0 +1,58 @@
+package registry
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"net/http"
+	"strings"
+)
+
+// 注册中心默认接受任何 POST 和 DELETE，能访问到它的主机都可以注册虚假的地址或注销正常的服务，从而污染所有客户端的服务列表。
+// 通过 SetToken 设置共享的 bearer token 后，注册（包括心跳）和注销必须在 Authorization 中携带该 token，否则返回 401；
+// GET 不需要认证，服务发现不受影响。心跳通过 WithToken 携带 token。
+// token 以明文在 HTTP 头中传输，应当配合 TLS 使用：SimpleRegistry 是一个 http.Handler，
+// 可以交给 http.ListenAndServeTLS 提供 https 服务，心跳通过 WithTLSConfig 指定信任的证书，
+// 服务发现使用 https 地址时依赖系统信任的证书。不设置 token 时行为与之前一致。
+
+// SetToken makes the registry require the bearer token on POST and DELETE, empty means no authentication.
+// It should be called before the registry starts serving.
+func (r *SimpleRegistry) SetToken(token string) {
+	r.token = token
+}
+
+// authorized reports whether req carries the token of the registry
+func (r *SimpleRegistry) authorized(req *http.Request) bool {
+	if r.token == "" {
+		return true
+	}
+	const prefix = "Bearer "
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(r.token)) == 1
+}
+
+// WithToken makes Heartbeat send the bearer token required by the registry, see SimpleRegistry.SetToken
+func WithToken(token string) HeartbeatOption {
+	return func(o *heartbeatOptions) {
+		o.token = token
+	}
+}
+
+// WithTLSConfig makes Heartbeat use config to connect to a registry served over https,
+// eg, to trust the certificate of a private CA. nil means the default config.
+func WithTLSConfig(config *tls.Config) HeartbeatOption {
+	return func(o *heartbeatOptions) {
+		o.transport = &http.Transport{TLSClientConfig: config}
+	}
+}
+
+// do sends req to the registry with the token, the TLS config and the timeout of o
+func (o *heartbeatOptions) do(req *http.Request) (*http.Response, error) {
+	if o.token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.token)
+	}
+	client := &http.Client{Transport: o.transport, Timeout: o.timeout}
+	return client.Do(req)
+}
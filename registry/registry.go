@@ -1,9 +1,17 @@
 package registry
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"simple_rpc"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,14 +21,32 @@ import (
 // add a server and receive heartbeat to keep it alive.
 // returns all alive servers and delete dead servers sync simultaneously.
 // 定义 SimpleRegistry 结构体，默认超时时间设置为 5 min，也就是说，任何注册的服务超过 5 min，即视为不可用状态。
+// OnRegister 和 OnEvict 是可选的回调，分别在新服务首次注册和服务超时或主动注销被删除时调用，便于记录服务的上下线。
+// 回调在锁外执行，因此可以在回调中再次访问注册中心，它们应当在注册中心开始服务前设置。
+// maxServers 限制注册的服务数量，达到上限后拒绝新地址的注册，但已注册地址的心跳不受影响，
+// 避免部署脚本的 bug 注册大量无效地址耗尽注册中心的内存。
+// services 是按服务名建立的索引，记录每个服务由哪些地址提供，来源于元数据中的 service，见 WithServices。
+// headers 是承载注册信息的 HTTP Header 名称，默认为 DefaultHeaders，见 SetHeaders。
+// token 不为空时，注册和注销必须携带该 bearer token，见 SetToken。
+// clock 提供判定过期使用的时间，默认为真实时间，测试中可以替换，见 SetClock。
 type SimpleRegistry struct {
-	timeout time.Duration
-	mu      sync.Mutex // protect following
-	servers map[string]*ServerItem
+	OnRegister func(addr string)
+	OnEvict    func(addr string)
+	timeout    time.Duration
+	maxServers int
+	headers    Headers
+	token      string
+	clock      simple_rpc.Clock
+	mu         sync.Mutex // protect following
+	servers    map[string]*ServerItem
+	services   map[string]map[string]bool // service name -> addresses hosting it
 }
 
+// ServerItem 中的 Meta 是服务端通过 X-SimpleRpc-Meta 上报的元数据（URL query 格式），例如 weight=3，
+// 注册中心不解释其含义，只负责保存并在返回服务列表时原样带回。
 type ServerItem struct {
 	Addr  string
+	Meta  url.Values
 	start time.Time
 }
 
@@ -29,62 +55,249 @@ const (
 	defaultTimeout = time.Minute * 5
 )
 
-// New create a registry instance with timeout setting
-func New(timeout time.Duration) *SimpleRegistry {
+// Headers are the names of the HTTP headers carrying the registry messages.
+// 在有自己命名规范的环境中，或者经过会改写 Header 的代理时，可以替换默认的名称，
+// 注册中心、心跳（WithHeaders）和服务发现（xclient 的 SetHeaders）必须使用相同的名称。
+type Headers struct {
+	Server  string // address of the server sending a heartbeat or deregistering
+	Servers string // alive servers returned by GET
+	Meta    string // metadata of a server
+}
+
+// DefaultHeaders are the header names used unless they are configured
+var DefaultHeaders = Headers{
+	Server:  "X-SimpleRpc-Server",
+	Servers: "X-SimpleRpc-Servers",
+	Meta:    "X-SimpleRpc-Meta",
+}
+
+// WithDefaults returns h with the empty names replaced by the default ones
+func (h Headers) WithDefaults() Headers {
+	if h.Server == "" {
+		h.Server = DefaultHeaders.Server
+	}
+	if h.Servers == "" {
+		h.Servers = DefaultHeaders.Servers
+	}
+	if h.Meta == "" {
+		h.Meta = DefaultHeaders.Meta
+	}
+	return h
+}
+
+// New create a registry instance with timeout setting,
+// at most maxServers servers can be registered, 0 means no limit.
+func New(timeout time.Duration, maxServers int) *SimpleRegistry {
 	return &SimpleRegistry{
-		servers: make(map[string]*ServerItem),
-		timeout: timeout,
+		servers:    make(map[string]*ServerItem),
+		services:   make(map[string]map[string]bool),
+		timeout:    timeout,
+		maxServers: maxServers,
+		headers:    DefaultHeaders,
+		clock:      simple_rpc.RealClock,
 	}
 }
 
-var DefaultGeeRegister = New(defaultTimeout)
+// SetHeaders sets the names of the headers carrying the registry messages, empty names keep the default ones.
+// It should be called before the registry starts serving.
+func (r *SimpleRegistry) SetHeaders(h Headers) {
+	r.headers = h.WithDefaults()
+}
+
+// SetClock replaces the clock deciding whether a server is expired, nil means simple_rpc.RealClock.
+// It should be called before the registry starts serving.
+func (r *SimpleRegistry) SetClock(clock simple_rpc.Clock) {
+	if clock == nil {
+		clock = simple_rpc.RealClock
+	}
+	r.clock = clock
+}
+
+var DefaultGeeRegister = New(defaultTimeout, 0)
 
 // 为 SimpleRegistry 实现添加服务实例和返回服务列表的方法。
-// putServer：添加服务实例，如果服务已经存在，则更新 start。
+// putServer：添加服务实例，如果服务已经存在，则更新 start；服务数量达到上限时拒绝新的服务，返回 false。
 // aliveServers：返回可用的服务列表，如果存在超时的服务，则删除。
-func (r *SimpleRegistry) putServer(addr string) {
+func (r *SimpleRegistry) putServer(addr string, meta url.Values) bool {
+	added, ok := r.storeServer(addr, meta)
+	if !ok {
+		// timeout servers are only swept by GET, sweep them before rejecting
+		r.aliveServers()
+		added, ok = r.storeServer(addr, meta)
+	}
+	if added && r.OnRegister != nil {
+		r.OnRegister(addr)
+	}
+	return ok
+}
+
+// storeServer returns added as true if addr is a new server,
+// ok is false if addr is rejected because the registry is full.
+func (r *SimpleRegistry) storeServer(addr string, meta url.Values) (added, ok bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	s := r.servers[addr]
 	if s == nil {
-		r.servers[addr] = &ServerItem{Addr: addr, start: time.Now()}
-	} else {
-		s.start = time.Now() // if exists, update start time to keep alive
+		if r.maxServers > 0 && len(r.servers) >= r.maxServers {
+			return false, false
+		}
+		r.servers[addr] = &ServerItem{Addr: addr, Meta: meta, start: r.clock.Now()}
+		r.indexServer(addr, meta)
+		return true, true
+	}
+	s.start = r.clock.Now() // if exists, update start time to keep alive
+	r.unindexServer(addr, s.Meta)
+	s.Meta = meta
+	r.indexServer(addr, meta)
+	return false, true
+}
+
+// indexServer adds addr to the index of the services it hosts, r.mu must be held
+func (r *SimpleRegistry) indexServer(addr string, meta url.Values) {
+	for _, name := range meta["service"] {
+		if r.services[name] == nil {
+			r.services[name] = make(map[string]bool)
+		}
+		r.services[name][addr] = true
+	}
+}
+
+// unindexServer removes addr from the index of the services it hosts, r.mu must be held
+func (r *SimpleRegistry) unindexServer(addr string, meta url.Values) {
+	for _, name := range meta["service"] {
+		delete(r.services[name], addr)
+		if len(r.services[name]) == 0 {
+			delete(r.services, name)
+		}
+	}
+}
+
+// filterServers returns the servers hosting service
+func (r *SimpleRegistry) filterServers(servers []string, service string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hosts := r.services[service]
+	filtered := make([]string, 0, len(hosts))
+	for _, addr := range servers {
+		if hosts[addr] {
+			filtered = append(filtered, addr)
+		}
+	}
+	return filtered
+}
+
+// serversMeta returns the metadata of servers which have any, each one is
+// encoded as a URL query with the address in the addr key
+func (r *SimpleRegistry) serversMeta(servers []string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var metas []string
+	for _, addr := range servers {
+		s := r.servers[addr]
+		if s == nil || len(s.Meta) == 0 {
+			continue
+		}
+		meta := url.Values{"addr": {addr}}
+		for k, v := range s.Meta {
+			if k != "addr" {
+				meta[k] = v
+			}
+		}
+		metas = append(metas, meta.Encode())
 	}
+	return metas
 }
 
 func (r *SimpleRegistry) aliveServers() []string {
+	alive, evicted := r.sweepServers()
+	if r.OnEvict != nil {
+		for _, addr := range evicted {
+			r.OnEvict(addr)
+		}
+	}
+	return alive
+}
+
+func (r *SimpleRegistry) removeServer(addr string) {
+	r.mu.Lock()
+	s, ok := r.servers[addr]
+	if ok {
+		r.unindexServer(addr, s.Meta)
+		delete(r.servers, addr)
+	}
+	r.mu.Unlock()
+	if ok && r.OnEvict != nil {
+		r.OnEvict(addr)
+	}
+}
+
+// sweepServers deletes timeout servers, returns the alive and the deleted ones
+func (r *SimpleRegistry) sweepServers() (alive, evicted []string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	var alive []string
 	for addr, s := range r.servers {
-		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
+		if r.timeout == 0 || s.start.Add(r.timeout).After(r.clock.Now()) {
 			alive = append(alive, addr)
 		} else {
+			r.unindexServer(addr, s.Meta)
 			delete(r.servers, addr)
+			evicted = append(evicted, addr)
 		}
 	}
 	sort.Strings(alive)
-	return alive
+	return
 }
 
 // Runs at /_simple_rpc_/registry
 // SimpleRegistry 采用 HTTP 协议提供服务，且所有的有用信息都承载在 HTTP Header 中。
-// Get：返回所有可用的服务列表，通过自定义字段 X-SimpleRpc-Servers 承载。
-// Post：添加服务实例或发送心跳，通过自定义字段 X-SimpleRpc-Server 承载。
+// 以下是默认的 Header 名称，可以通过 SetHeaders 修改。
+// Get：返回所有可用的服务列表，通过自定义字段 X-SimpleRpc-Servers 承载，
+// 带有元数据的服务，每个对应一个 X-SimpleRpc-Meta，格式为 addr=<addr>&weight=3。
+// 带有 ?service=<name> 参数时只返回上报了提供该服务的地址，没有上报服务名的地址不会返回。
+// Post：添加服务实例或发送心跳，通过自定义字段 X-SimpleRpc-Server 承载，可选的 X-SimpleRpc-Meta 承载元数据，
+// 服务数量达到上限时，新地址的注册返回 503。
+// Delete：注销服务实例，服务退出时调用，通过自定义字段 X-SimpleRpc-Server 承载。
+// 三者都支持 JSON 格式，见 ServerInfo。
 func (r *SimpleRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET":
 		// keep it simple, server is in req.Header
-		w.Header().Set("X-SimpleRpc-Servers", strings.Join(r.aliveServers(), ","))
-	case "POST":
-		// keep it simple, server is in req.Header
-		addr := req.Header.Get("X-SimpleRpc-Server")
+		alive := r.aliveServers()
+		if service := req.URL.Query().Get("service"); service != "" {
+			alive = r.filterServers(alive, service)
+		}
+		if r.writeServersJSON(w, req, alive) {
+			return
+		}
+		w.Header().Set(r.headers.Servers, strings.Join(alive, ","))
+		for _, meta := range r.serversMeta(alive) {
+			w.Header().Add(r.headers.Meta, meta)
+		}
+	case "POST", "DELETE":
+		if !r.authorized(req) {
+			log.Printf("rpc registry: reject unauthenticated %s from %s", req.Method, req.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="simple_rpc registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// server is in req.Header, or in the JSON body
+		addr, meta, err := r.readServer(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		if addr == "" {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		r.putServer(addr)
+		if req.Method == "POST" {
+			if !r.putServer(addr, meta) {
+				log.Printf("rpc registry: reject %s, the number of servers reaches the limit %d", addr, r.maxServers)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		} else {
+			r.removeServer(addr)
+		}
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
@@ -100,34 +313,263 @@ func HandleHTTP() {
 	DefaultGeeRegister.HandleHTTP(defaultPath)
 }
 
+// HeartbeatOption configures the behaviour of Heartbeat
+type HeartbeatOption func(*heartbeatOptions)
+
+type heartbeatOptions struct {
+	healthCheck   bool
+	healthTimeout time.Duration
+	meta          url.Values // reported to the registry with each heartbeat
+	jitter        float64    // fraction of the interval randomly added or subtracted
+	headers       Headers
+	token         string            // bearer token required by the registry, see WithToken
+	transport     http.RoundTripper // trusts the certificate of the registry, see WithTLSConfig
+	timeout       time.Duration     // of each request sent to the registry, see WithRequestTimeout
+	clock         simple_rpc.Clock
+}
+
+const (
+	defaultHealthTimeout  = time.Second * 5
+	defaultRequestTimeout = time.Second * 5
+)
+
+// WithRequestTimeout limits each heartbeat and each attempt of the deregistration,
+// so a registry which accepts the connection but never answers can't block the heartbeats or the shutdown.
+// 0 means using the default timeout.
+func WithRequestTimeout(timeout time.Duration) HeartbeatOption {
+	return func(o *heartbeatOptions) {
+		if timeout == 0 {
+			timeout = defaultRequestTimeout
+		}
+		o.timeout = timeout
+	}
+}
+
+// WithHealthCheck makes Heartbeat ping the rpc server before each heartbeat,
+// the server is reported as alive only if the ping succeeds within timeout.
+// 0 means using the default timeout.
+func WithHealthCheck(timeout time.Duration) HeartbeatOption {
+	return func(o *heartbeatOptions) {
+		if timeout == 0 {
+			timeout = defaultHealthTimeout
+		}
+		o.healthCheck = true
+		o.healthTimeout = timeout
+	}
+}
+
+// WithWeight reports the capacity weight of the server to the registry,
+// discoveries using WeightedRoundRobinSelect send traffic in proportion to it.
+func WithWeight(weight int) HeartbeatOption {
+	return func(o *heartbeatOptions) {
+		if o.meta == nil {
+			o.meta = make(url.Values)
+		}
+		o.meta.Set("weight", strconv.Itoa(weight))
+	}
+}
+
+// WithJitter randomizes each heartbeat interval by up to ±fraction of it, eg, 0.1 for ±10%,
+// so servers started together don't send heartbeats to the registry at the same moments.
+// fraction is clamped to [0, 1), 0 means no jitter.
+func WithJitter(fraction float64) HeartbeatOption {
+	return func(o *heartbeatOptions) {
+		if fraction < 0 {
+			fraction = 0
+		}
+		if fraction >= 1 {
+			fraction = 0.99
+		}
+		o.jitter = fraction
+	}
+}
+
+// interval returns the duration until the next heartbeat
+func (o *heartbeatOptions) interval(duration time.Duration) time.Duration {
+	if o.jitter == 0 {
+		return duration
+	}
+	return duration + time.Duration((rand.Float64()*2-1)*o.jitter*float64(duration))
+}
+
+// WithClock makes Heartbeat wait for the intervals with clock, so tests can advance the time instead of sleeping.
+func WithClock(clock simple_rpc.Clock) HeartbeatOption {
+	return func(o *heartbeatOptions) {
+		if clock != nil {
+			o.clock = clock
+		}
+	}
+}
+
+// WithHeaders makes Heartbeat use the header names configured on the registry, see SimpleRegistry.SetHeaders
+func WithHeaders(h Headers) HeartbeatOption {
+	return func(o *heartbeatOptions) {
+		o.headers = h.WithDefaults()
+	}
+}
+
+// WithLabels reports labels of the server to the registry, eg, the build or the region,
+// they are kept as the metadata of the server and returned to the discoveries.
+// The keys addr, weight, zone and service are reserved, labels with them are dropped, use the other options to report them.
+func WithLabels(labels map[string]string) HeartbeatOption {
+	return func(o *heartbeatOptions) {
+		if o.meta == nil {
+			o.meta = make(url.Values)
+		}
+		for k, v := range labels {
+			if isReserved(k) {
+				log.Printf("rpc registry: label %q is reserved, dropped", k)
+				continue
+			}
+			o.meta.Set(k, v)
+		}
+	}
+}
+
+// WithZone reports the zone of the server to the registry,
+// discoveries using LocalityAwareSelect prefer servers in the same zone as the client.
+func WithZone(zone string) HeartbeatOption {
+	return func(o *heartbeatOptions) {
+		if o.meta == nil {
+			o.meta = make(url.Values)
+		}
+		o.meta.Set("zone", zone)
+	}
+}
+
+// WithServices reports the names of the services hosted by the server to the registry,
+// discoveries filtering by a service name only get the servers hosting it.
+func WithServices(names ...string) HeartbeatOption {
+	return func(o *heartbeatOptions) {
+		if o.meta == nil {
+			o.meta = make(url.Values)
+		}
+		o.meta["service"] = append(o.meta["service"], names...)
+	}
+}
+
 // Heartbeat send a heartbeat message every once in a while
 // it's a helper function for a server to register or send heartbeat
 // 便于服务启动时定时向注册中心发送心跳，默认周期比注册中心设置的过期时间少 1 min。
-func Heartbeat(registry, addr string, duration time.Duration) {
+// addr 采用 protocol@addr 的格式，开启 WithHealthCheck 后，每次发送心跳前会先调用服务端内置的 ping 方法，
+// 只有服务端确实能够处理请求时才向注册中心报告存活，避免 HTTP 可达但 RPC 已经卡死的服务继续被发现。
+// 开启 WithJitter 后每次的间隔在 duration 上下随机浮动，浮动后的上限仍应小于注册中心的过期时间。
+func Heartbeat(registry, addr string, duration time.Duration, opts ...HeartbeatOption) {
+	HeartbeatContext(context.Background(), registry, addr, duration, opts...)
+}
+
+// HeartbeatContext is like Heartbeat, but it deregisters addr from the registry once ctx is done,
+// so clients stop routing to the server without waiting for the registry timeout.
+// The returned channel is closed after the deregistration is sent (or heartbeat stopped due to errors),
+// the server should wait for it before exiting.
+func HeartbeatContext(ctx context.Context, registry, addr string, duration time.Duration, opts ...HeartbeatOption) <-chan struct{} {
 	if duration == 0 {
 		// make sure there is enough time to send heart beat
 		// before it's removed from registry
 		duration = defaultTimeout - time.Duration(1)*time.Minute
 	}
+	o := &heartbeatOptions{headers: DefaultHeaders, timeout: defaultRequestTimeout, clock: simple_rpc.RealClock}
+	for _, opt := range opts {
+		opt(o)
+	}
+	done := make(chan struct{})
 	var err error
-	err = sendHeartbeat(registry, addr)
+	err = heartbeat(registry, addr, o)
 	go func() {
-		t := time.NewTicker(duration)
+		defer close(done)
 		for err == nil {
-			<-t.C
-			err = sendHeartbeat(registry, addr)
+			select {
+			case <-ctx.Done():
+				_ = deregister(registry, addr, o)
+				return
+			case <-o.clock.After(o.interval(duration)):
+				err = heartbeat(registry, addr, o)
+			}
 		}
 	}()
+	return done
+}
+
+func heartbeat(registry, addr string, o *heartbeatOptions) error {
+	if o.healthCheck {
+		if err := ping(addr, o.healthTimeout); err != nil {
+			// skip this round, the registry will evict the server if it keeps failing
+			log.Println("rpc server: health check err:", err)
+			return nil
+		}
+	}
+	return sendHeartbeat(registry, addr, o)
+}
+
+// ping dials the rpc server and calls its built-in ping method
+func ping(addr string, timeout time.Duration) error {
+	client, err := simple_rpc.XDial(addr, &simple_rpc.Option{ConnectTimeout: timeout})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = client.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return client.Ping(ctx)
 }
 
-func sendHeartbeat(registry, addr string) error {
+func sendHeartbeat(registry, addr string, o *heartbeatOptions) error {
 	log.Println(addr, "send heart beat to registry", registry)
-	httpClient := &http.Client{}
-	req, _ := http.NewRequest("POST", registry, nil)
-	req.Header.Set("X-SimpleRpc-Server", addr)
-	if _, err := httpClient.Do(req); err != nil {
+	// send both formats, the registry prefers the JSON body, an old one only reads the headers
+	body, _ := json.Marshal(newServerInfo(addr, o.meta))
+	req, _ := http.NewRequest("POST", registry, bytes.NewReader(body))
+	req.Header.Set("Content-Type", ContentTypeJSON)
+	req.Header.Set(o.headers.Server, addr)
+	if len(o.meta) > 0 {
+		req.Header.Set(o.headers.Meta, o.meta.Encode())
+	}
+	resp, err := o.do(req)
+	if err != nil {
 		log.Println("rpc server: heart beat err:", err)
 		return err
 	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// keep sending heartbeats, the registry may accept it once other servers are evicted
+		log.Println("rpc server: heart beat rejected by registry:", resp.Status)
+	}
+	return nil
+}
+
+const (
+	deregisterRetries = 3
+	deregisterBackoff = time.Millisecond * 100
+)
+
+// deregister removes addr from the registry, it retries with backoff
+// in case the registry is briefly unreachable during shutdown.
+func deregister(registry, addr string, o *heartbeatOptions) (err error) {
+	backoff := deregisterBackoff
+	for i := 0; i < deregisterRetries; i++ {
+		if err = sendDeregister(registry, addr, o); err == nil {
+			return nil
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
+
+func sendDeregister(registry, addr string, o *heartbeatOptions) error {
+	log.Println(addr, "deregister from registry", registry)
+	req, _ := http.NewRequest("DELETE", registry, nil)
+	req.Header.Set(o.headers.Server, addr)
+	resp, err := o.do(req)
+	if err != nil {
+		log.Println("rpc server: deregister err:", err)
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// eg, 401 if the token is wrong, the server is still registered
+		err = errors.New("rpc server: deregister rejected by registry: " + resp.Status)
+		log.Println(err)
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,460 @@
+package registry_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"simple_rpc"
+	"simple_rpc/registry"
+	"simple_rpc/rpctest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// send sends a registry message of method for addr, with the bearer token if it's not empty
+func send(t *testing.T, method, url, addr, token string) *http.Response {
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Set(registry.DefaultHeaders.Server, addr)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp
+}
+
+// aliveServers returns the servers listed by the registry at url in the header format
+func aliveServers(t *testing.T, client *http.Client, url string) string {
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.Header.Get(registry.DefaultHeaders.Servers)
+}
+
+func TestSimpleRegistry_SetToken(t *testing.T) {
+	r := registry.New(0, 0)
+	r.SetToken("secret")
+	var deletes int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodDelete {
+			atomic.AddInt32(&deletes, 1)
+		}
+		r.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	for _, token := range []string{"", "wrong"} {
+		for _, method := range []string{http.MethodPost, http.MethodDelete} {
+			resp := send(t, method, ts.URL, "tcp@a", token)
+			if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+				t.Fatalf("%s with token %q: expect 401 with a challenge, got %s", method, token, resp.Status)
+			}
+		}
+	}
+	if servers := aliveServers(t, http.DefaultClient, ts.URL); servers != "" {
+		t.Fatalf("unauthenticated servers shouldn't be registered, got %q", servers)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := registry.HeartbeatContext(ctx, ts.URL, "tcp@a", time.Hour, registry.WithToken("secret"))
+	if servers := aliveServers(t, http.DefaultClient, ts.URL); servers != "tcp@a" {
+		t.Fatalf("heartbeat with the token should register the server, got %q", servers)
+	}
+	cancel()
+	<-done
+	if servers := aliveServers(t, http.DefaultClient, ts.URL); servers != "" {
+		t.Fatalf("the server should be deregistered with the token, got %q", servers)
+	}
+
+	// a rejected deregistration is retried, and the server stays registered
+	send(t, http.MethodPost, ts.URL, "tcp@b", "secret")
+	atomic.StoreInt32(&deletes, 0)
+	ctx, cancel = context.WithCancel(context.Background())
+	done = registry.HeartbeatContext(ctx, ts.URL, "tcp@b", time.Hour, registry.WithToken("wrong"))
+	cancel()
+	<-done
+	if n := atomic.LoadInt32(&deletes); n < 2 {
+		t.Fatalf("a rejected deregistration should be retried, sent %d times", n)
+	}
+	if servers := aliveServers(t, http.DefaultClient, ts.URL); servers != "tcp@b" {
+		t.Fatalf("the server should stay registered, got %q", servers)
+	}
+}
+
+func TestWithTLSConfig(t *testing.T) {
+	r := registry.New(0, 0)
+	r.SetToken("secret")
+	ts := httptest.NewTLSServer(r)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the certificate of the registry isn't trusted by default
+	<-registry.HeartbeatContext(ctx, ts.URL, "tcp@untrusted", time.Hour, registry.WithToken("secret"))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	done := registry.HeartbeatContext(ctx, ts.URL, "tcp@a", time.Hour,
+		registry.WithToken("secret"), registry.WithTLSConfig(&tls.Config{RootCAs: pool}))
+	if servers := aliveServers(t, ts.Client(), ts.URL); servers != "tcp@a" {
+		t.Fatalf("heartbeat over TLS should register the server, got %q", servers)
+	}
+	cancel()
+	<-done
+	if servers := aliveServers(t, ts.Client(), ts.URL); servers != "" {
+		t.Fatalf("the server should be deregistered over TLS, got %q", servers)
+	}
+}
+
+func TestNew_maxServers(t *testing.T) {
+	ts := httptest.NewServer(registry.New(time.Hour, 2))
+	defer ts.Close()
+
+	for _, addr := range []string{"tcp@a", "tcp@b"} {
+		if resp := send(t, http.MethodPost, ts.URL, addr, ""); resp.StatusCode != http.StatusOK {
+			t.Fatalf("failed to register %s: %s", addr, resp.Status)
+		}
+	}
+	if resp := send(t, http.MethodPost, ts.URL, "tcp@c", ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("a new address should be rejected once the limit is reached, got %s", resp.Status)
+	}
+	if resp := send(t, http.MethodPost, ts.URL, "tcp@a", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("registered addresses should keep sending heartbeats at the limit, got %s", resp.Status)
+	}
+	if servers := aliveServers(t, http.DefaultClient, ts.URL); servers != "tcp@a,tcp@b" {
+		t.Fatalf("expect the servers registered before the limit, got %q", servers)
+	}
+
+	send(t, http.MethodDelete, ts.URL, "tcp@b", "")
+	if resp := send(t, http.MethodPost, ts.URL, "tcp@c", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("a new address should be accepted once a server leaves, got %s", resp.Status)
+	}
+}
+
+func TestWithHealthCheck(t *testing.T) {
+	ts := httptest.NewServer(registry.New(0, 0))
+	defer ts.Close()
+
+	server := simple_rpc.NewServer()
+	lis, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = lis.Close() }()
+	go func() { _ = server.Accept(lis) }()
+	// a wedged server accepts connections, but never handles the requests
+	wedged, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = wedged.Close() }()
+	go func() {
+		for {
+			conn, err := wedged.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, addr := range []string{"tcp@" + lis.Addr().String(), "tcp@" + wedged.Addr().String()} {
+		registry.HeartbeatContext(ctx, ts.URL, addr, time.Hour, registry.WithHealthCheck(100*time.Millisecond))
+	}
+	if servers := aliveServers(t, http.DefaultClient, ts.URL); servers != "tcp@"+lis.Addr().String() {
+		t.Fatalf("only the server answering the ping should be registered, got %q", servers)
+	}
+}
+
+func TestSimpleRegistry_callbacks(t *testing.T) {
+	clock := rpctest.NewClock(time.Unix(1000, 0))
+	r := registry.New(time.Minute, 0)
+	r.SetClock(clock)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	var mu sync.Mutex
+	var events []string
+	r.OnRegister = func(addr string) {
+		// the callbacks are called without the lock, so they can use the registry
+		aliveServers(t, http.DefaultClient, ts.URL)
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, "register "+addr)
+	}
+	r.OnEvict = func(addr string) {
+		aliveServers(t, http.DefaultClient, ts.URL)
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, "evict "+addr)
+	}
+
+	send(t, http.MethodPost, ts.URL, "tcp@a", "")
+	send(t, http.MethodPost, ts.URL, "tcp@a", "") // heartbeats of a registered server aren't reported
+	send(t, http.MethodPost, ts.URL, "tcp@b", "")
+	send(t, http.MethodDelete, ts.URL, "tcp@a", "")
+	clock.Advance(time.Minute)
+	aliveServers(t, http.DefaultClient, ts.URL)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := "register tcp@a,register tcp@b,evict tcp@a,evict tcp@b"
+	if got := strings.Join(events, ","); got != want {
+		t.Fatalf("expect events %s, got %s", want, got)
+	}
+}
+
+func TestHeartbeatContext(t *testing.T) {
+	r := registry.New(0, 0)
+	var deletes int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the registry is briefly unreachable during the shutdown
+		if req.Method == http.MethodDelete && atomic.AddInt32(&deletes, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := registry.HeartbeatContext(ctx, ts.URL, "tcp@a", time.Hour)
+	if servers := aliveServers(t, http.DefaultClient, ts.URL); servers != "tcp@a" {
+		t.Fatalf("expect the server registered, got %q", servers)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("heartbeat should stop once ctx is done")
+	}
+	if n := atomic.LoadInt32(&deletes); n != 2 {
+		t.Fatalf("expect the deregistration to be retried once, sent %d times", n)
+	}
+	if servers := aliveServers(t, http.DefaultClient, ts.URL); servers != "" {
+		t.Fatalf("the server should be deregistered once ctx is done, got %q", servers)
+	}
+}
+
+func TestWithRequestTimeout(t *testing.T) {
+	r := registry.New(0, 0)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodDelete {
+			// the registry accepts the connection but never answers
+			<-release
+			return
+		}
+		r.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := registry.HeartbeatContext(ctx, ts.URL, "tcp@a", time.Hour, registry.WithRequestTimeout(time.Millisecond*20))
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("the deregistration should give up once each attempt times out")
+	}
+}
+
+// recordingClock sends the duration of each After to waits, and fires it at once
+type recordingClock struct {
+	waits chan time.Duration
+}
+
+func (c *recordingClock) Now() time.Time { return time.Now() }
+
+func (c *recordingClock) After(d time.Duration) <-chan time.Time {
+	c.waits <- d
+	ch := make(chan time.Time, 1)
+	ch <- time.Now()
+	return ch
+}
+
+func TestWithJitter(t *testing.T) {
+	ts := httptest.NewServer(registry.New(0, 0))
+	defer ts.Close()
+
+	for _, fraction := range []float64{0, 0.1} {
+		clock := &recordingClock{waits: make(chan time.Duration)}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := registry.HeartbeatContext(ctx, ts.URL, "tcp@a", time.Minute, registry.WithJitter(fraction), registry.WithClock(clock))
+		lo, hi := time.Duration(float64(time.Minute)*(1-fraction)), time.Duration(float64(time.Minute)*(1+fraction))
+		distinct := make(map[time.Duration]bool)
+		for i := 0; i < 20; i++ {
+			d := <-clock.waits
+			if d < lo || d > hi {
+				t.Fatalf("jitter %v: interval %s is out of [%s, %s]", fraction, d, lo, hi)
+			}
+			distinct[d] = true
+		}
+		if fraction == 0 && len(distinct) != 1 || fraction > 0 && len(distinct) == 1 {
+			t.Fatalf("jitter %v: got %d distinct intervals", fraction, len(distinct))
+		}
+		cancel()
+		for stopped := false; !stopped; {
+			select {
+			case <-clock.waits:
+			case <-done:
+				stopped = true
+			}
+		}
+	}
+}
+
+func TestWithServices(t *testing.T) {
+	ts := httptest.NewServer(registry.New(0, 0))
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry.HeartbeatContext(ctx, ts.URL, "tcp@a", time.Hour, registry.WithServices("UserService", "OrderService"))
+	registry.HeartbeatContext(ctx, ts.URL, "tcp@b", time.Hour, registry.WithServices("OrderService"))
+	registry.HeartbeatContext(ctx, ts.URL, "tcp@c", time.Hour)
+
+	for service, want := range map[string]string{
+		"":             "tcp@a,tcp@b,tcp@c",
+		"UserService":  "tcp@a",
+		"OrderService": "tcp@a,tcp@b",
+		"Unknown":      "",
+	} {
+		if got := aliveServers(t, http.DefaultClient, ts.URL+"?service="+service); got != want {
+			t.Fatalf("service %q: expect %q, got %q", service, want, got)
+		}
+	}
+
+	// the index follows the services reported by the latest heartbeat
+	registry.HeartbeatContext(ctx, ts.URL, "tcp@a", time.Hour, registry.WithServices("OrderService"))
+	if got := aliveServers(t, http.DefaultClient, ts.URL+"?service=UserService"); got != "" {
+		t.Fatalf("tcp@a doesn't host UserService any more, got %q", got)
+	}
+	if got := aliveServers(t, http.DefaultClient, ts.URL+"?service=OrderService"); got != "tcp@a,tcp@b" {
+		t.Fatalf("expect both servers hosting OrderService, got %q", got)
+	}
+}
+
+func TestWithLabels_reserved(t *testing.T) {
+	ts := httptest.NewServer(registry.New(0, 0))
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry.HeartbeatContext(ctx, ts.URL, "tcp@a", time.Hour, registry.WithZone("z1"), registry.WithServices("Foo"),
+		registry.WithLabels(map[string]string{"zone": "z2", "service": "Bar", "addr": "tcp@b", "weight": "9", "build": "42"}))
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	req.Header.Set("Accept", registry.ContentTypeJSON)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info registry.ServersInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	_ = resp.Body.Close()
+	if err != nil || len(info.Servers) != 1 {
+		t.Fatalf("expect 1 server, got %+v: %v", info, err)
+	}
+	a := info.Servers[0]
+	if a.Addr != "tcp@a" || a.Zone != "z1" || a.Weight != 0 || len(a.Services) != 1 || a.Services[0] != "Foo" ||
+		len(a.Labels) != 1 || a.Labels["build"] != "42" {
+		t.Fatalf("labels shouldn't override the reserved keys, got %+v", a)
+	}
+
+	meta := registry.ServerInfo{Addr: "tcp@a", Labels: map[string]string{"zone": "z2", "build": "42"}}.Meta()
+	if meta.Get("zone") != "" || meta.Get("build") != "42" {
+		t.Fatalf("labels with reserved keys should be dropped, got %q", meta.Encode())
+	}
+}
+
+func TestSimpleRegistry_SetClock(t *testing.T) {
+	clock := rpctest.NewClock(time.Unix(1000, 0))
+	r := registry.New(time.Minute, 0)
+	r.SetClock(clock)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	send(t, http.MethodPost, ts.URL, "tcp@a", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := registry.HeartbeatContext(ctx, ts.URL, "tcp@b", time.Second*30, registry.WithClock(clock))
+	for i := 0; i < 4; i++ {
+		// wait until the next heartbeat is scheduled, so it's sent once the clock is advanced
+		for clock.Waiters() != 1 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(time.Second * 30)
+		if i == 0 {
+			if servers := aliveServers(t, http.DefaultClient, ts.URL); servers != "tcp@a,tcp@b" {
+				t.Fatalf("servers shouldn't expire within the timeout, got %q", servers)
+			}
+		}
+	}
+	for clock.Waiters() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if servers := aliveServers(t, http.DefaultClient, ts.URL); servers != "tcp@b" {
+		t.Fatalf("only the server sending heartbeats should be alive after 2 minutes, got %q", servers)
+	}
+	cancel()
+	<-done
+}
+
+func TestSimpleRegistry_JSON(t *testing.T) {
+	ts := httptest.NewServer(registry.New(0, 0))
+	defer ts.Close()
+
+	body := `{"addr":"tcp@a","weight":3,"zone":"z1","services":["Foo"],"labels":{"build":"42"}}`
+	resp, err := http.Post(ts.URL, registry.ContentTypeJSON, strings.NewReader(body))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to register in JSON: %v", err)
+	}
+	_ = resp.Body.Close()
+	send(t, http.MethodPost, ts.URL, "tcp@b", "")
+
+	// a JSON client gets the servers in the body
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	req.Header.Set("Accept", registry.ContentTypeJSON)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info registry.ServersInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	_ = resp.Body.Close()
+	if err != nil || !registry.IsJSON(resp.Header.Get("Content-Type")) || len(info.Servers) != 2 {
+		t.Fatalf("expect 2 servers in JSON, got %+v: %v", info, err)
+	}
+	a := info.Servers[0]
+	if a.Addr != "tcp@a" || a.Weight != 3 || a.Zone != "z1" || len(a.Services) != 1 || a.Labels["build"] != "42" {
+		t.Fatalf("unexpected server %+v", a)
+	}
+	if b := info.Servers[1]; b.Addr != "tcp@b" || b.Weight != 0 || b.Labels != nil {
+		t.Fatalf("unexpected server %+v", b)
+	}
+
+	// a header-only client gets the same servers in the headers
+	resp, err = http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if servers := resp.Header.Get(registry.DefaultHeaders.Servers); servers != "tcp@a,tcp@b" {
+		t.Fatalf("expect the servers in the header, got %q", servers)
+	}
+	metas := resp.Header.Values(registry.DefaultHeaders.Meta)
+	if len(metas) != 1 {
+		t.Fatalf("expect the metadata of tcp@a, got %q", metas)
+	}
+	meta, _ := url.ParseQuery(metas[0])
+	if meta.Get("addr") != "tcp@a" || meta.Get("weight") != "3" || meta.Get("zone") != "z1" || meta.Get("build") != "42" {
+		t.Fatalf("unexpected metadata %q", metas[0])
+	}
+}
@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 注册中心最初的消息全部由 HTTP Header 承载，元数据只能编码为 URL query，难以表达结构化的信息。
+// 现在 POST 和 DELETE 可以携带 Content-Type 为 application/json 的 body，即一个 ServerInfo，
+// 此时忽略 Header 中的地址和元数据；GET 请求的 Accept 包含 application/json 时，返回 ServersInfo 格式的 body。
+// 旧的客户端不发送 JSON，仍然使用 Header 格式；心跳同时发送 Header 和 JSON body，因此旧的注册中心同样能够识别。
+// 两种格式描述的是同一个模型：weight、zone 和 service 之外的元数据即 Labels。
+
+// ContentTypeJSON is the content type of the JSON registry messages
+const ContentTypeJSON = "application/json"
+
+// ServerInfo is a server in the JSON registry messages
+type ServerInfo struct {
+	Addr     string            `json:"addr"`
+	Weight   int               `json:"weight,omitempty"`
+	Zone     string            `json:"zone,omitempty"`
+	Services []string          `json:"services,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// ServersInfo is the JSON body returned by GET
+type ServersInfo struct {
+	Servers []ServerInfo `json:"servers"`
+}
+
+// newServerInfo converts the metadata of the server at addr to ServerInfo
+func newServerInfo(addr string, meta url.Values) ServerInfo {
+	info := ServerInfo{Addr: addr, Zone: meta.Get("zone"), Services: meta["service"]}
+	info.Weight, _ = strconv.Atoi(meta.Get("weight"))
+	for k := range meta {
+		if isReserved(k) {
+			continue
+		}
+		if info.Labels == nil {
+			info.Labels = make(map[string]string)
+		}
+		info.Labels[k] = meta.Get(k)
+	}
+	return info
+}
+
+// isReserved reports whether key is the metadata of a field of ServerInfo rather than a label
+func isReserved(key string) bool {
+	switch key {
+	case "addr", "weight", "zone", "service":
+		return true
+	}
+	return false
+}
+
+// Meta converts info to the metadata reported in the header format, labels with reserved keys are dropped
+func (info ServerInfo) Meta() url.Values {
+	meta := make(url.Values)
+	for k, v := range info.Labels {
+		if !isReserved(k) {
+			meta.Set(k, v)
+		}
+	}
+	if info.Weight != 0 {
+		meta.Set("weight", strconv.Itoa(info.Weight))
+	}
+	if info.Zone != "" {
+		meta.Set("zone", info.Zone)
+	}
+	if len(info.Services) > 0 {
+		meta["service"] = info.Services
+	}
+	return meta
+}
+
+// IsJSON reports whether the media type of contentType is ContentTypeJSON
+func IsJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == ContentTypeJSON
+}
+
+// readServer reads the address and the metadata of the server sending req, in either format
+func (r *SimpleRegistry) readServer(req *http.Request) (addr string, meta url.Values, err error) {
+	if IsJSON(req.Header.Get("Content-Type")) {
+		var info ServerInfo
+		if err = json.NewDecoder(req.Body).Decode(&info); err != nil {
+			return "", nil, err
+		}
+		return info.Addr, info.Meta(), nil
+	}
+	meta, err = url.ParseQuery(req.Header.Get(r.headers.Meta))
+	return req.Header.Get(r.headers.Server), meta, err
+}
+
+// writeServersJSON writes the alive servers in the JSON format if req accepts it, it returns false otherwise
+func (r *SimpleRegistry) writeServersJSON(w http.ResponseWriter, req *http.Request, alive []string) bool {
+	if !strings.Contains(req.Header.Get("Accept"), ContentTypeJSON) {
+		return false
+	}
+	body := ServersInfo{Servers: make([]ServerInfo, 0, len(alive))}
+	r.mu.Lock()
+	for _, addr := range alive {
+		if s := r.servers[addr]; s != nil {
+			body.Servers = append(body.Servers, newServerInfo(addr, s.Meta))
+		}
+	}
+	r.mu.Unlock()
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	_ = json.NewEncoder(w).Encode(body)
+	return true
+}
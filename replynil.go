@@ -0,0 +1,93 @@
+package simple_rpc
+
+import (
+	"context"
+	"reflect"
+	"simple_rpc/codec"
+	"strconv"
+	"sync/atomic"
+)
+
+// ReplyNilPolicy controls how nil slices, maps and pointers in replies are handled, see SetReplyNilPolicy.
+// 多个策略可以按位组合，例如 EmptyNilCollections | RejectNilPointers。
+type ReplyNilPolicy int32
+
+const (
+	PreserveNil         ReplyNilPolicy = 0      // replies are sent as they are, the default
+	EmptyNilCollections ReplyNilPolicy = 1 << 0 // nil slices and maps are replaced with empty ones
+	RejectNilPointers   ReplyNilPolicy = 1 << 1 // a nil pointer in the reply is an error
+)
+
+// SetReplyNilPolicy sets how nil values left in replies by the methods are handled before the reply is sent.
+// newReplyV 只会初始化最外层的 map 和 slice，方法留下的 nil 字段会被编码为 null（JSON）或被省略，
+// 区分 null 和空集合的客户端（例如通过 JSON codec 或 Gateway 调用的客户端）会因此得到不一致的结果。
+// EmptyNilCollections 递归地把导出字段、slice 元素中的 nil slice 和 nil map 替换为空值；
+// RejectNilPointers 把 reply 中的 nil 指针视为方法的错误，以 CodeApplication 回复，而不是发送不完整的 reply。
+// map 的值无法原地修改，不会被处理。默认为 PreserveNil，即保持原样，与之前的行为一致。
+func (server *Server) SetReplyNilPolicy(policy ReplyNilPolicy) {
+	atomic.StoreInt32(&server.replyNil, int32(policy))
+}
+
+// callMethod calls the method and applies the nil policy to the reply if the method succeeds,
+// a panic of the method is recovered and turned into the error, see SetPanicHandler.
+func (server *Server) callMethod(ctx context.Context, h *codec.Header, svc *service, mType *methodType, argV, replyV reflect.Value) (err error) {
+	defer server.recoverPanic(h, mType, &err)
+	if err := svc.call(ctx, mType, argV, replyV); err != nil {
+		return err
+	}
+	policy := ReplyNilPolicy(atomic.LoadInt32(&server.replyNil))
+	if policy == PreserveNil || mType.streamsReply() {
+		return nil
+	}
+	return normalizeReply(replyV.Elem(), policy, "reply", make(map[uintptr]bool))
+}
+
+// normalizeReply walks v and applies policy, path names v in the error,
+// seen holds the visited pointers so cyclic replies terminate.
+func normalizeReply(v reflect.Value, policy ReplyNilPolicy, path string, seen map[uintptr]bool) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			if policy&RejectNilPointers != 0 {
+				return newError(CodeApplication, "rpc server: nil pointer at "+path)
+			}
+			return nil
+		}
+		if seen[v.Pointer()] {
+			return nil
+		}
+		seen[v.Pointer()] = true
+		return normalizeReply(v.Elem(), policy, path, seen)
+	case reflect.Map:
+		if v.IsNil() && policy&EmptyNilCollections != 0 && v.CanSet() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case reflect.Slice:
+		if v.IsNil() {
+			if policy&EmptyNilCollections != 0 && v.CanSet() {
+				v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+			}
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := normalizeReply(v.Index(i), policy, path+"["+strconv.Itoa(i)+"]", seen); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := normalizeReply(v.Index(i), policy, path+"["+strconv.Itoa(i)+"]", seen); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Type().Field(i); f.PkgPath == "" {
+				if err := normalizeReply(v.Field(i), policy, path+"."+f.Name, seen); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package rpctest
+
+import (
+	"simple_rpc"
+	"sync"
+	"time"
+)
+
+// Clock is a simple_rpc.Clock whose time only moves when Advance is called,
+// so timeouts and expirations can be tested without sleeping, see simple_rpc.Server.SetClock.
+// 例如设置 HandleTimeout 后，等待 Waiters 变为 1（即服务端开始等待超时），再 Advance 超过 HandleTimeout，请求立即超时。
+type Clock struct {
+	mu      sync.Mutex // protect following
+	now     time.Time
+	waiters []clockWaiter
+}
+
+type clockWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+var _ simple_rpc.Clock = (*Clock)(nil)
+
+// NewClock returns a Clock starting at start
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel receiving the time once the clock is advanced by d, at once if d <= 0
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, clockWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d and fires the channels of After which are due
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+// Waiters returns the number of channels of After which haven't fired,
+// tests can wait for it before advancing the clock, so the code under test is already waiting.
+func (c *Clock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
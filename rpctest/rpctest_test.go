@@ -0,0 +1,44 @@
+package rpctest_test
+
+import (
+	"context"
+	"simple_rpc/rpctest"
+	"simple_rpc/xclient"
+	"testing"
+)
+
+type Arith int
+
+type Args struct{ A, B int }
+
+func (a *Arith) Add(args Args, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+func TestNewXClient(t *testing.T) {
+	var xc *xclient.XClient
+	t.Run("call", func(t *testing.T) {
+		var cleanup func()
+		var err error
+		xc, cleanup, err = rpctest.NewXClient(new(Arith))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(cleanup)
+		var reply int
+		addr, err := xc.CallWithServer(context.Background(), "Arith.Add", Args{A: 1, B: 2}, &reply)
+		if err != nil || reply != 3 || addr != rpctest.Addr {
+			t.Fatalf("expect 3 from %s, got %d from %s: %v", rpctest.Addr, reply, addr, err)
+		}
+	})
+	// the server is stopped by the cleanup
+	var reply int
+	if err := xc.Call(context.Background(), "Arith.Add", Args{A: 1, B: 2}, &reply); err == nil {
+		t.Fatal("expect an error calling after the cleanup")
+	}
+
+	if _, _, err := rpctest.NewXClient(nil); err == nil {
+		t.Fatal("expect an error registering an invalid receiver")
+	}
+}
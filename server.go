@@ -1,7 +1,7 @@
 package simple_rpc
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -10,35 +10,84 @@ import (
 	"net/http"
 	"reflect"
 	"simple_rpc/codec"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const MagicNumber = 0x3bef5c
 
+// ProtocolVersion 是当前的协议版本。MagicNumber 用于拒绝非 Simple RPC 的流量，
+// Version 则用于协议演进：客户端在 Option 中携带版本号，服务端不支持时会回复一个 Seq 为 0 的错误后关闭连接，
+// 客户端据此以 ErrUnsupportedVersion 结束所有调用，而不是因为报文格式不兼容而静默出错。
+// 不携带版本号（即 0）的旧客户端按版本 1 处理。
+// 版本 2 起 JSON 编码的 Option 带有长度前缀，见 jsonOptionCodec，需要与旧版本的服务端通信时将 Version 设置为 1。
+const ProtocolVersion = 2
+
 // Option 消息的编解码方式
 // 一般来说，涉及协议协商的这部分信息，需要设计固定的字节来传输的。
-// 但是为了实现上更简单，Simple RPC 客户端固定采用 JSON 编码 Option，
+// 但是为了实现上更简单，Simple RPC 客户端默认采用 JSON 编码 Option（可以通过 SetOptionCodec 切换为二进制格式），
 // 后续的 header 和 body 的编码方式由 Option 中的 CodeType 指定，
-// 服务端首先使用 JSON 解码 Option，然后通过 Option 的 CodeType 解码剩余的内容。
+// 服务端首先根据开头是否为 MagicNumber 识别格式并解码 Option，然后通过 Option 的 CodeType 解码剩余的内容。
 // 即报文将以这样的形式发送：
 //
 //	Option{MagicNumber: xxx, CodecType: xxx} | Header{ServiceMethod ...} | Body interface{} |
 //
-// | <------      固定 JSON 编码      ------>  | <-------   编码方式由 CodeType 决定   ------->|
+// | <------      默认 JSON 编码      ------>  | <-------   编码方式由 CodeType 决定   ------->|
 // 在一次连接中，Option 固定在报文的最开始，Header 和 Body 可以有多个，即报文可能是这样的。
 // | Option | Header1 | Body1 | Header2 | Body2 | ...
+// OrderedResponses 为 true 时，服务端在该连接上逐个处理请求，响应的顺序与请求的顺序（即 Seq 的顺序）一致，
+// 代价是慢请求会阻塞其后的所有请求，延迟和吞吐都会变差，因此默认并发处理。
+// InlineFastPath 为 true 且 HandleTimeout 为 0 时，服务端直接在读循环中处理请求，不再为每个请求创建协程，
+// 适用于非常轻量的方法：省去了协程调度的开销，代价是同一连接上的请求串行处理，效果上与 OrderedResponses 相同。
+// CodecPreference 仅在客户端使用，不会发送给服务端：按优先级列出期望的编码方式，拨号时选择第一个本地支持的作为 CodecType。
+// 目前没有与服务端协商编码方式的能力，因此选中的编码方式必须被服务端支持，否则服务端会直接关闭连接；
+// 待支持能力交换后，客户端可以沿着该列表选择第一个服务端也支持的编码方式。
+// CallTimeout 同样仅在客户端使用，限制一次调用的总耗时（发送、服务端处理和接收响应），与服务端的 HandleTimeout 相互独立，
+// 超时后客户端放弃对应的 Seq 并返回 ErrTimeout，迟到的响应会被丢弃。
+// Compressor 指定 body 的压缩方式，服务端和客户端都会用 CompressingCodec 包装各自的 Codec，为空表示不压缩。
+// WriteTimeout 限制服务端在该连接上写一个响应的时间，不为 0 时覆盖服务端通过 SetWriteTimeout 设置的默认值。
+// SeqFunc 仅在客户端使用，为每个请求分配 Seq，便于测试中精确控制 Seq 以复现响应错配等问题，为 nil 时使用从 1 开始递增的计数器。
+// 分配出的 Seq 不能为 0，也不能与尚未完成的调用重复，否则该调用直接失败。
 type Option struct {
-	MagicNumber    int           // MagicNumber marks this a simple rpc request
-	CodecType      codec.Type    // client may choose different Codec to encode body
-	ConnectTimeout time.Duration // 0 means no limit
-	HandleTimeout  time.Duration
+	MagicNumber      int           // MagicNumber marks this a simple rpc request
+	Version          int           // protocol version, 0 means 1, see ProtocolVersion
+	CodecType        codec.Type    // client may choose different Codec to encode body
+	ConnectTimeout   time.Duration // 0 means no limit
+	HandleTimeout    time.Duration
+	OrderedResponses bool          // reply requests on the connection in the order they are sent
+	InlineFastPath   bool          // handle requests in the read loop if HandleTimeout is 0
+	CodecPreference  []codec.Type  `json:"-"` // overrides CodecType if not empty
+	CallTimeout      time.Duration `json:"-"` // default timeout of each call, 0 means no limit
+	// OnWarning is called in the receiving goroutine with the warning sent with a response, eg, the method is deprecated,
+	// so it must not block. nil means the warning of each method is logged once.
+	OnWarning    func(serviceMethod, warning string) `json:"-"`
+	Compressor   codec.CompressorType                // compress the bodies if not empty
+	WriteTimeout time.Duration                       // limit of writing a response on the server, 0 means the server's default
+	SeqFunc      func() uint64                       `json:"-"` // allocates the Seq of each call, nil means a counter
+	// ReconnectBackoff makes the client re-dial the server when the connection is lost, 0 means no reconnection,
+	// the backoff doubles after each failed attempt up to ReconnectMaxBackoff, 0 means 30s.
+	ReconnectBackoff    time.Duration `json:"-"`
+	ReconnectMaxBackoff time.Duration `json:"-"`
+	// KeepAlive is the interval of the keep-alive frames sent when there are no calls,
+	// so the server doesn't close the connection as idle. 0 or negative means no keep-alive, see DefaultKeepAlive.
+	KeepAlive time.Duration `json:"-"`
+	// ValidateReplies makes the client call Validate of the decoded reply if it implements Validator,
+	// the call fails with CodeInvalidReply if it returns an error, see Validator.
+	ValidateReplies bool `json:"-"`
+	// SkipHandshake makes the client start with the first request without sending the Option,
+	// the server must serve the connection with ServeConnWithOption or AcceptWithOption, see ServeConnWithOption.
+	SkipHandshake bool `json:"-"`
+	// NoDelay sets TCP_NODELAY of the connection of the client, see NoDelay.
+	NoDelay NoDelay `json:"-"`
 }
 
 // DefaultOption 将超时设定放在了 Option 中。ConnectTimeout 默认值为 10s，HandleTimeout 默认值为 0，即不设限。
 var DefaultOption = &Option{
 	MagicNumber:    MagicNumber,
+	Version:        ProtocolVersion,
 	CodecType:      codec.GobType,
 	ConnectTimeout: time.Second * 10,
 }
@@ -48,13 +97,137 @@ var DefaultOption = &Option{
 // 第一步，根据入参类型，将请求的 body 反序列化；
 // 第二步，调用 service.call，完成方法调用；
 // 第三步，将 reply 序列化为字节流，构造响应报文，返回。
+// conns 记录当前活跃的连接数，maxConns 为允许的最大连接数，0 表示不设限。
 type Server struct {
-	serviceMap sync.Map
+	serviceMap    sync.Map
+	acl           acl
+	conns         int64
+	maxConns      int64
+	maxRequests   int64
+	noSizeStats   int32
+	writeTimeout  int64
+	idleTimeout   int64
+	noDelay       int32 // NoDelay
+	maxHeaderSize int64
+	retryAfter    int64
+	inShutdown    int32
+	inflight      int64
+	auditDropped  uint64
+	methodGen     uint64
+	methodCache   sync.Map     // ServiceMethod -> cachedMethod
+	requests      sync.Map     // *request -> *InflightRequest, see Inflight
+	serviceLimits sync.Map     // service name -> *serviceLimit
+	deprecations  sync.Map     // ServiceMethod -> warning, see Deprecate
+	types         sync.Map     // type tag -> reflect.Type, see RegisterType
+	idempotency   atomic.Value // *idempotencyCache
+	validateArgs  int32
+	replyNil      int32        // ReplyNilPolicy
+	metaAllowlist atomic.Value // map[string]bool, nil if any metadata is accepted
+	connStateHook atomic.Value // func(net.Conn, ConnState)
+	overloaded    atomic.Value // func() bool
+	pool          atomic.Value // *workerPool
+	auditHook     atomic.Value // AuditHook
+	fallbackFunc  atomic.Value // DefaultHandler
+	panicHandler  atomic.Value // PanicHandler
+	flushPolicy   atomic.Value // FlushPolicy
+	clock         atomic.Value // *Clock
+	auditOnce     sync.Once
+	auditQueue    chan auditEvent
+	svcMu         sync.Mutex // serialize Register and Unregister, protect services
+	services      []string   // names of services in the order of registration
+	mu            sync.Mutex // protect following
+	listeners     map[net.Listener]struct{}
+	activeConns   map[*serverConn]struct{}
 }
 
 // NewServer returns a new Server.
 func NewServer() *Server {
-	return &Server{}
+	return &Server{maxHeaderSize: DefaultMaxHeaderSize}
+}
+
+// DefaultMaxHeaderSize is the default limit of the size of a request header, see SetMaxHeaderSize
+const DefaultMaxHeaderSize = 64 << 10
+
+// SetMaxHeaderSize limits the size of a request header in bytes, 0 means no limit.
+// 恶意的客户端可以在 ServiceMethod 或 Meta 中放入巨大的字符串，使编解码器分配大量内存，
+// 超出限制的 header 在分配之前就会被拒绝，服务端回复一个错误后关闭连接。默认限制为 DefaultMaxHeaderSize，
+// 仅对实现了 codec.HeaderLimiter 的 Codec 生效，新的限制对之后建立的连接生效。
+func (server *Server) SetMaxHeaderSize(n int) {
+	atomic.StoreInt64(&server.maxHeaderSize, int64(n))
+}
+
+// SetMaxConns limits the number of simultaneous connections,
+// connections beyond the limit are closed immediately. 0 means no limit.
+func (server *Server) SetMaxConns(n int) {
+	atomic.StoreInt64(&server.maxConns, int64(n))
+}
+
+// SetMaxRequestsPerConn limits the number of requests served over one connection, 0 means no limit.
+// 达到上限后服务端不再读取该连接上的请求，等待已读取的请求处理完成并回复后关闭连接，与 Shutdown 对单个连接的处理相同；
+// 客户端需要重新连接（例如设置 Option.ReconnectBackoff 或使用 XClient），新的连接可能落到扩容后的其他服务实例上，
+// 也避免了单个客户端无限期地占用一个连接发送请求。被拒绝的请求（方法不存在、metadata 无效、ACL 拒绝等）同样计入，
+// 只有内置的 ping 和 keep-alive 不计入。
+// 客户端在连接关闭前发出而服务端没有读取的请求会以 CodeTransport 失败，新的限制对之后建立的连接生效。
+func (server *Server) SetMaxRequestsPerConn(n int) {
+	atomic.StoreInt64(&server.maxRequests, int64(n))
+}
+
+// SetOverloadPredicate sets a function reporting whether the server is overloaded,
+// it's checked before handling each request, and the request is rejected with
+// ErrOverloaded immediately if it returns true, so the client can retry elsewhere
+// rather than timing out. InflightRequests may be used to inform the predicate.
+func (server *Server) SetOverloadPredicate(overloaded func() bool) {
+	server.overloaded.Store(overloaded)
+}
+
+// SetRetryAfter sets the backoff suggested to clients whose requests are rejected
+// because the server is overloaded, 0 means no suggestion.
+// 建议值通过 Header.RetryAfter 返回给客户端，XClient 会在等待这段时间后重新选择服务实例重试一次。
+func (server *Server) SetRetryAfter(d time.Duration) {
+	atomic.StoreInt64(&server.retryAfter, int64(d))
+}
+
+func (server *Server) isOverloaded() bool {
+	f, _ := server.overloaded.Load().(func() bool)
+	return f != nil && f()
+}
+
+// rejectOverloaded replies req with ErrOverloaded and the suggested backoff
+func (server *Server) rejectOverloaded(cc codec.Codec, req *request, sending *sync.Mutex) {
+	setError(req.h, ErrOverloaded, CodeOverloaded)
+	req.h.RetryAfter = time.Duration(atomic.LoadInt64(&server.retryAfter))
+	server.sendResponse(cc, req.h, invalidRequest, sending)
+}
+
+// SetWriteTimeout limits the time spent writing a response, 0 means no limit.
+// 如果客户端不再读取响应，写操作会一直阻塞并持有 sending 锁，同一连接上所有等待回复的 handleRequest 协程都会堆积。
+// 设置写超时后，超时的写操作会返回错误，Codec 随即关闭连接，排队中的响应也会立即失败，不会无限期挂起。
+// 仅对支持 SetWriteDeadline 的连接（例如 net.Conn）生效。
+func (server *Server) SetWriteTimeout(d time.Duration) {
+	atomic.StoreInt64(&server.writeTimeout, int64(d))
+}
+
+// InflightRequests returns the number of requests being handled across all connections
+func (server *Server) InflightRequests() int {
+	return int(atomic.LoadInt64(&server.inflight))
+}
+
+// NumConns returns the number of connections being served
+func (server *Server) NumConns() int {
+	return int(atomic.LoadInt64(&server.conns))
+}
+
+// ConnInflightRequests returns the number of requests being handled on each connection,
+// keyed by the remote address, or by an opaque id if the connection doesn't provide one.
+// 连接列表的快照需要短暂持有 mu，但每个连接的计数仍然是原子读取，不会与请求的处理竞争。
+func (server *Server) ConnInflightRequests() map[string]int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	inflight := make(map[string]int, len(server.activeConns))
+	for c := range server.activeConns {
+		inflight[c.name] = int(atomic.LoadInt64(&c.inflight))
+	}
+	return inflight
 }
 
 // DefaultServer is the default instance of *Server.
@@ -64,16 +237,52 @@ var DefaultServer = NewServer()
 // ServeConn runs the server on a single connection.
 // ServeConn blocks, serving the connection until the client hangs up.
 // ServeConn 的实现就和之前讨论的通信过程紧密相关了
-// 首先使用 json.NewDecoder 反序列化得到 Option 实例，检查 MagicNumber 和 CodeType 的值是否正确。
+// 首先通过 readOption 反序列化得到 Option 实例，检查 MagicNumber 和 CodeType 的值是否正确。
 // 然后根据 CodeType 得到对应的消息编解码器，接下来的处理交给 serverCodec。
 func (server *Server) ServeConn(conn io.ReadWriteCloser) {
-	defer func() { _ = conn.Close() }()
+	server.serveConn(conn, nil)
+}
+
+// serveConn serves conn, the Option is read from conn unless preset is given, see ServeConnWithOption
+func (server *Server) serveConn(conn io.ReadWriteCloser, preset *Option) {
+	server.setConnState(conn, StateNew)
+	defer func() {
+		_ = conn.Close()
+		server.setConnState(conn, StateClosed)
+	}()
+	n := atomic.AddInt64(&server.conns, 1)
+	defer atomic.AddInt64(&server.conns, -1)
+	if max := atomic.LoadInt64(&server.maxConns); max > 0 && n > max {
+		log.Printf("rpc server: too many connections, limit %d", max)
+		return
+	}
+	setNoDelay(conn, NoDelay(atomic.LoadInt32(&server.noDelay)))
+	c := &serverConn{rwc: conn, ctx: context.Background()}
+	c.name = fmt.Sprintf("%p", c)
+	// conn may be a net.Conn, expose the address of the caller to handlers
+	if nc, ok := conn.(net.Conn); ok {
+		c.ctx = withConn(c.ctx, nc)
+	}
+	if nc, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		c.ctx = withPeer(c.ctx, nc.RemoteAddr())
+		if addr := nc.RemoteAddr(); addr != nil && addr.Network() != "pipe" {
+			c.name = addr.String()
+		}
+	}
+	if !server.trackConn(c, true) {
+		return
+	}
+	defer server.trackConn(c, false)
 	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	var rest io.Reader = conn
+	var err error
+	if preset != nil {
+		// agreed out-of-band, there is no magic number to check
+		opt = *preset
+	} else if rest, err = readOption(conn, &opt); err != nil {
 		log.Println("rpc server: options error: ", err)
 		return
-	}
-	if opt.MagicNumber != MagicNumber {
+	} else if opt.MagicNumber != MagicNumber {
 		log.Printf("rpc server: invalid magic number %x", opt.MagicNumber)
 		return
 	}
@@ -82,12 +291,98 @@ func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 		log.Printf("rpc server: invalid codec type %s", opt.CodecType)
 		return
 	}
-	server.serveCodec(f(conn), &opt)
+	writeTimeout := opt.WriteTimeout
+	if writeTimeout == 0 {
+		writeTimeout = time.Duration(atomic.LoadInt64(&server.writeTimeout))
+	}
+	rwc := withWriteTimeout(conn, writeTimeout)
+	if rest != conn {
+		rwc = &restConn{ReadWriteCloser: rwc, rest: rest}
+	}
+	cc, err := withCompressor(f(rwc), opt.Compressor)
+	if err != nil {
+		log.Println("rpc server: options error: ", err)
+		return
+	}
+	if l, ok := cc.(codec.HeaderLimiter); ok {
+		l.SetMaxHeaderSize(atomic.LoadInt64(&server.maxHeaderSize))
+	}
+	if opt.Version > ProtocolVersion {
+		// tell the client why the connection is closed, seq 0 means it's not a reply of any call
+		err := newError(CodeUnsupportedVersion, fmt.Sprintf("rpc server: unsupported protocol version %d, expect <= %d", opt.Version, ProtocolVersion))
+		log.Println(err)
+		h := &codec.Header{}
+		setError(h, err, CodeUnsupportedVersion)
+		server.writeResponse(cc, h, invalidRequest, nil)
+		return
+	}
+	server.serveCodec(c, server.withFlushPolicy(c, cc), &opt)
+}
+
+// restConn reads the requests from rest, which starts with the bytes read beyond the Option
+type restConn struct {
+	io.ReadWriteCloser
+	rest io.Reader
+}
+
+func (c *restConn) Read(p []byte) (int, error) { return c.rest.Read(p) }
+
+// withCompressor wraps cc to compress the bodies if typ is not empty
+func withCompressor(cc codec.Codec, typ codec.CompressorType) (codec.Codec, error) {
+	if typ == "" {
+		return cc, nil
+	}
+	c := codec.CompressorMap[typ]
+	if c == nil {
+		return nil, fmt.Errorf("invalid compressor %s", typ)
+	}
+	if _, ok := cc.(codec.BodyMarshaler); !ok {
+		return nil, fmt.Errorf("codec %T doesn't support compression", cc)
+	}
+	return codec.NewCompressingCodec(cc, c), nil
+}
+
+// deadlineWriter sets the write deadline before each write, so a peer which stops reading can't block the writer forever.
+// Once a write times out, the connection is broken: it's closed so that serveCodec exits,
+// and the following writes fail immediately instead of waiting for the deadline again.
+type deadlineWriter struct {
+	io.ReadWriteCloser
+	d       interface{ SetWriteDeadline(time.Time) error }
+	timeout time.Duration
+	broken  int32
+}
+
+var errBrokenConn = errors.New("rpc server: connection is broken by a write timeout")
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&w.broken) == 1 {
+		return 0, errBrokenConn
+	}
+	_ = w.d.SetWriteDeadline(time.Now().Add(w.timeout))
+	n, err := w.ReadWriteCloser.Write(p)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && atomic.CompareAndSwapInt32(&w.broken, 0, 1) {
+		log.Println("rpc server: write timeout, closing the connection")
+		_ = w.ReadWriteCloser.Close()
+	}
+	return n, err
+}
+
+// withWriteTimeout wraps conn with a deadlineWriter if timeout is set and conn supports write deadlines
+func withWriteTimeout(conn io.ReadWriteCloser, timeout time.Duration) io.ReadWriteCloser {
+	d, ok := conn.(interface{ SetWriteDeadline(time.Time) error })
+	if timeout <= 0 || !ok {
+		return conn
+	}
+	return &deadlineWriter{ReadWriteCloser: conn, d: d, timeout: timeout}
 }
 
 // invalidRequest is a placeholder for response argv when error occurs
 var invalidRequest = struct{}{}
 
+// pingMethod is a built-in method answered by the server itself,
+// it tells the caller that the server is still able to serve requests.
+const pingMethod = "__ping"
+
 // serveCodec 的过程非常简单。主要包含三个阶段
 // 读取请求 readRequest
 // 处理请求 handleRequest
@@ -95,22 +390,74 @@ var invalidRequest = struct{}{}
 // 在一次连接中，允许接收多个请求，即多个 request header 和 request body，因此这里使用了 for 无限制地等待请求的到来，直到发生错误（例如连接被关闭，接收到的报文有问题等），这里需要注意的点有三个：
 // handleRequest 使用了协程并发执行请求。
 // 处理请求是并发的，但是回复请求的报文必须是逐个发送的，并发容易导致多个回复报文交织在一起，客户端无法解析。在这里使用锁(sending)保证。
-// 尽力而为，只有在 header 解析失败时，才终止循环。
-func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
+// 尽力而为，只有在 header 解析失败或连接被 Shutdown 排空时，才终止循环。
+func (server *Server) serveCodec(c *serverConn, cc codec.Codec, opt *Option) {
 	sending := new(sync.Mutex) // make sure to send a complete response
 	wg := new(sync.WaitGroup)  // wait until all request are handled
-	for {
+	c.cc, c.sending = cc, sending
+	defer server.watchIdle(c)()
+	limit := atomic.LoadInt64(&server.maxRequests)
+	var served int64 // requests read, see SetMaxRequestsPerConn
+	for !c.isDraining() && (limit <= 0 || served < limit) {
 		req, err := server.readRequest(cc)
+		server.touch(c)
+		if req != nil && req.h.ServiceMethod != pingMethod && req.h.ServiceMethod != keepAliveMethod {
+			served++
+		}
 		if err != nil {
 			if req == nil {
+				if msg := headerErrorMessage(err); msg != "" {
+					// seq 0 means it's not a reply of any call
+					h := &codec.Header{}
+					setError(h, newError(CodeCodec, msg), CodeCodec)
+					server.sendResponse(cc, h, invalidRequest, sending)
+				}
 				break // it's not possible to recover, so close the connection
 			}
-			req.h.Error = err.Error()
+			setError(req.h, err, CodeCodec)
 			server.sendResponse(cc, req.h, invalidRequest, sending)
 			continue
 		}
+		if req.fallback != nil {
+			wg.Add(1)
+			go server.handleFallback(c, cc, req, sending, wg)
+			continue
+		}
+		if req.svc == nil {
+			// built-in method, reply directly without invoking any service
+			c.subscribe(req)
+			server.sendResponse(cc, req.h, invalidRequest, sending)
+			continue
+		}
+		if req.stream != nil {
+			if err := server.serveStream(c, cc, req, sending, wg, opt); err != nil {
+				log.Println("rpc server: read stream err:", err)
+				break
+			}
+			continue
+		}
+		if server.isOverloaded() {
+			// shed the load, don't queue work that can't be served in time
+			server.rejectOverloaded(cc, req, sending)
+			continue
+		}
 		wg.Add(1)
-		go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
+		if opt.OrderedResponses || (opt.InlineFastPath && opt.HandleTimeout == 0) {
+			// handle requests one by one in the read loop, so responses are sent in order
+			server.handleRequest(c, cc, req, sending, wg, opt.HandleTimeout)
+			continue
+		}
+		if p := server.workers(); p != nil {
+			if !p.submit(func() { server.handleRequest(c, cc, req, sending, wg, opt.HandleTimeout) }) {
+				wg.Done()
+				server.rejectOverloaded(cc, req, sending)
+			}
+			continue
+		}
+		go server.handleRequest(c, cc, req, sending, wg, opt.HandleTimeout)
+	}
+	if limit > 0 && served >= limit {
+		log.Printf("rpc server: %s reaches the limit of %d requests, closing the connection", c.name, limit)
 	}
 	wg.Wait()
 	_ = cc.Close()
@@ -121,37 +468,176 @@ func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
 // 第一部分是 Service 的名称，第二部分即方法名。
 // 先在 serviceMap 中找到对应的 service 实例，再从 service 实例的 method 中，找到对应的 methodType。
 func (server *Server) findService(serviceMethod string) (svc *service, mType *methodType, err error) {
+	gen := atomic.LoadUint64(&server.methodGen)
+	if e, ok := server.methodCache.Load(serviceMethod); ok && e.(cachedMethod).gen == gen {
+		svc, mType = e.(cachedMethod).svc, e.(cachedMethod).mType
+	} else {
+		if svc, mType, err = server.lookupMethod(serviceMethod); err != nil {
+			return
+		}
+		server.methodCache.Store(serviceMethod, cachedMethod{gen: gen, svc: svc, mType: mType})
+	}
+	if !server.acl.permitted(serviceMethod) {
+		err = newError(CodeNotPermitted, "rpc server: method not permitted "+serviceMethod)
+	}
+	return
+}
+
+// cachedMethod 缓存 findService 解析的结果，以完整的 ServiceMethod 为键，
+// 重复调用同一个方法时省去字符串切分和两次 map 查找。只缓存找到的方法，避免错误的名称占用内存。
+// Register 和 Unregister 时递增 methodGen，代数不同的缓存项视为失效。
+// 先读取代数再查找服务，因此与 Unregister 并发时写入的缓存项总是带着旧的代数，不会复活已注销的服务。
+type cachedMethod struct {
+	gen   uint64
+	svc   *service
+	mType *methodType
+}
+
+// invalidateMethods drops the cached methods, it's called after the services change
+func (server *Server) invalidateMethods() {
+	atomic.AddUint64(&server.methodGen, 1)
+	server.methodCache.Range(func(key, _ interface{}) bool {
+		server.methodCache.Delete(key)
+		return true
+	})
+}
+
+// lookupMethod parses serviceMethod and finds the method without the cache
+func (server *Server) lookupMethod(serviceMethod string) (svc *service, mType *methodType, err error) {
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
-		err = errors.New("rpc server: service/method request ill-formed: " + serviceMethod)
+		err = newError(CodeServiceNotFound, "rpc server: service/method request ill-formed: "+serviceMethod)
 		return
 	}
 	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
-	sci, ok := server.serviceMap.Load(serviceName)
-	if !ok {
-		err = errors.New("rpc server: can't find service " + serviceName)
+	var candidates []*service
+	if sci, ok := server.serviceMap.Load(serviceName); ok {
+		candidates = append(candidates, sci.(*service))
+	}
+	candidates = append(candidates, server.versionsOf(serviceName)...)
+	if len(candidates) == 0 {
+		var names []string
+		server.serviceMap.Range(func(name, _ interface{}) bool {
+			names = append(names, name.(string))
+			return true
+		})
+		msg := "rpc server: can't find service " + serviceName
+		if similar := similarNames(serviceName, names); len(similar) > 0 {
+			msg += "; did you mean: " + strings.Join(similar, ", ")
+		}
+		err = newError(CodeServiceNotFound, msg)
 		return
 	}
-	svc = sci.(*service)
-	mType = svc.method[methodName]
-	if mType == nil {
-		err = errors.New("rpc server: can't find method " + methodName)
+	var names []string
+	for _, svc = range candidates {
+		if mType = svc.method[methodName]; mType != nil {
+			return
+		}
+		for name := range svc.method {
+			names = append(names, name)
+		}
 	}
+	svc = nil
+	err = newError(CodeMethodNotFound, "rpc server: can't find method "+methodName+"; available: "+listNames(names))
 	return
 }
 
+// maxListedNames bounds the names listed in the errors of findService
+const maxListedNames = 10
+
+// listNames returns the sorted names joined by comma, at most maxListedNames are listed
+func listNames(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	sort.Strings(names)
+	if len(names) > maxListedNames {
+		return strings.Join(names[:maxListedNames], ", ") + fmt.Sprintf(" and %d more", len(names)-maxListedNames)
+	}
+	return strings.Join(names, ", ")
+}
+
+// similarNames returns the names which are close to name, ignoring case,
+// 即忽略大小写后编辑距离不超过 2 的名字，用于在服务名拼写错误时给出提示。
+func similarNames(name string, names []string) []string {
+	var similar []string
+	for _, n := range names {
+		if editDistance(strings.ToLower(name), strings.ToLower(n)) <= 2 {
+			similar = append(similar, n)
+		}
+	}
+	sort.Strings(similar)
+	if len(similar) > maxListedNames {
+		similar = similar[:maxListedNames]
+	}
+	return similar
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
 // request stores all information of a call
 type request struct {
 	h            *codec.Header // header of request
 	argV, replyV reflect.Value // argv and reply of request
 	mType        *methodType
 	svc          *service
+	trace        *codec.Trace   // nil unless the client asks for the timing
+	limit        *serviceLimit  // the slot of the service taken by the request, see SetServiceConcurrency
+	fallback     DefaultHandler // handles the unknown method, see SetDefaultHandler
+	fallbackArg  interface{}    // arg decoded for fallback
+	stream       *argStream     // feeds the streamed body to the method, see Stream
+	replyStream  *replyStream   // sends the response written by the method, see StreamTo
+	topic        string         // topic of a subscription, see Subscribe
 }
 
+// headerErrorMessage returns the message told to the client before closing the connection
+// because of err returned by readRequestHeader, empty if the client isn't told.
+func headerErrorMessage(err error) string {
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		// the client may still be reading if it only closed its write side
+		return "rpc server: truncated request header"
+	case errors.Is(err, codec.ErrHeaderTooLarge):
+		return "rpc server: request header too large"
+	}
+	return ""
+}
+
+// readRequestHeader 返回 io.EOF 表示客户端在两个请求之间正常断开，不记录日志；
+// 返回 io.ErrUnexpectedEOF 表示连接在一个 header 的中间断开，即收到了截断的报文，属于协议错误。
 func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 	var h codec.Header
 	if err := cc.ReadHeader(&h); err != nil {
-		if err != io.EOF && err != io.ErrUnexpectedEOF {
+		if err != io.EOF {
 			log.Println("rpc server: read header error:", err)
 		}
 		return nil, err
@@ -168,10 +654,30 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 		return nil, err
 	}
 	req := &request{h: h}
+	if h.ServiceMethod == pingMethod || h.ServiceMethod == keepAliveMethod {
+		return req, discardBody(cc, h)
+	}
+	if h.ServiceMethod == subscribeMethod || h.ServiceMethod == unsubscribeMethod {
+		return req, cc.ReadBody(&req.topic)
+	}
+	if err = server.checkMeta(h.Meta); err != nil {
+		_ = discardBody(cc, h)
+		return req, err
+	}
 	req.svc, req.mType, err = server.findService(h.ServiceMethod)
+	if handler := server.fallback(); err != nil && handler != nil && isNotFound(err) {
+		req.fallback = handler
+		req.fallbackArg, err = server.readFallbackArg(cc, h)
+		return req, err
+	}
 	if err != nil {
+		// discard the body, so the next request can be read correctly
+		_ = discardBody(cc, h)
 		return req, err
 	}
+	if h.Stream {
+		return req, server.readStream(cc, req)
+	}
 	req.argV = req.mType.newArgV()
 	req.replyV = req.mType.newReplyV()
 
@@ -180,16 +686,77 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	if req.argV.Type().Kind() != reflect.Ptr {
 		argVI = req.argV.Addr().Interface()
 	}
+	var typedV reflect.Value
+	if req.mType.ArgType.Kind() == reflect.Interface {
+		// decode into the concrete type tagged in the header, then assign it to the interface
+		if typedV, argVI, err = server.newTypedArgV(req.mType.ArgType, h.ArgType); err != nil {
+			_ = cc.ReadBody(nil)
+			return req, err
+		}
+	}
+	var start time.Time
+	if h.Debug {
+		req.trace = new(codec.Trace)
+		start = time.Now()
+	}
+	n := bytesRead(cc)
 	if err = cc.ReadBody(argVI); err != nil {
 		log.Println("rpc server: read body err:", err)
 		return req, err
 	}
+	if req.trace != nil {
+		req.trace.Decode = time.Since(start)
+	}
+	if typedV.IsValid() {
+		req.argV.Set(typedV)
+		h.ArgType = "" // the tag isn't echoed in the response
+	}
+	if server.sizeStats() {
+		atomic.AddUint64(&req.mType.bytesRead, uint64(bytesRead(cc)-n))
+	}
 	return req, nil
 }
 
+// setError fills the error of the response header,
+// the code is taken from err if it's an *Error, otherwise def is used.
+func setError(h *codec.Header, err error, def ErrorCode) {
+	h.Error = err.Error()
+	h.Code = int(errorCode(err, def))
+}
+
 func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}, sending *sync.Mutex) {
 	sending.Lock()
 	defer sending.Unlock()
+	server.writeResponse(cc, h, body, nil)
+}
+
+// sendReply sends the response of req and accounts its size to the method
+func (server *Server) sendReply(cc codec.Codec, req *request, body interface{}, sending *sync.Mutex) {
+	sending.Lock()
+	defer sending.Unlock()
+	if req.h.Trace != nil {
+		req.h.Trace.Encode = encodeTime(cc, body)
+	}
+	n := bytesWritten(cc)
+	server.writeResponse(cc, req.h, body, server.deprecation(req.h.ServiceMethod))
+	if server.sizeStats() {
+		atomic.AddUint64(&req.mType.bytesWritten, uint64(bytesWritten(cc)-n))
+	}
+}
+
+// writeResponse writes the response of h, meta is the metadata of the response,
+// the metadata and the Stream flag of the request aren't echoed, a response is never a chunk of a stream.
+func (server *Server) writeResponse(cc codec.Codec, h *codec.Header, body interface{}, meta map[string]string) {
+	if h.OneWay {
+		// nobody waits for the reply of a one-way call, even if it fails
+		return
+	}
+	if len(h.Meta) > 0 || meta != nil || h.Stream {
+		resp := *h
+		resp.Meta = meta
+		resp.Stream = false
+		h = &resp
+	}
 	if err := cc.Write(h, body); err != nil {
 		log.Println("rpc server: write response error:", err)
 	}
@@ -198,56 +765,150 @@ func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interfa
 // handleRequest 的实现非常简单，通过 req.svc.call 完成方法调用，将 replyV 传递给 sendResponse 完成序列化即可。
 // 需要确保 sendResponse 仅调用一次，因此将整个过程拆分为 called 和 sent 两个阶段，在这段代码中只会发生如下两种情况：
 // called 信道接收到消息，代表处理没有超时，继续执行 sendResponse。
-// time.After() 先于 called 接收到消息，说明处理已经超时，called 和 sent 都将被阻塞。
-// 在 case <-time.After(timeout) 处调用 sendResponse。
-func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
+// server.after() 先于 called 接收到消息，说明处理已经超时，called 和 sent 都将被阻塞。
+// 在 case <-server.after(timeout) 处调用 sendResponse，server.after 默认即 time.After，见 SetClock。
+// 不设超时时不需要上述两个阶段，直接在当前协程中调用方法并回复，省去额外的协程和信道。
+func (server *Server) handleRequest(c *serverConn, cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
 	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
-	go func() {
-		err := req.svc.call(req.mType, req.argV, req.replyV)
-		called <- struct{}{}
-		if err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
-			sent <- struct{}{}
+	atomic.AddInt64(&server.inflight, 1)
+	defer atomic.AddInt64(&server.inflight, -1)
+	atomic.AddInt64(&c.inflight, 1)
+	defer func() {
+		server.touch(c)
+		atomic.AddInt64(&c.inflight, -1)
+	}()
+	if req.stream != nil {
+		defer req.stream.close()
+	}
+	if l := server.serviceLimit(req.svc); l != nil {
+		p := server.workers()
+		if !l.acquire(p != nil && p.shed) {
+			server.rejectOverloaded(cc, req, sending)
 			return
 		}
-		server.sendResponse(cc, req.h, req.replyV.Interface(), sending)
+		// released by run once the method returns, which may be after the handle timeout
+		req.limit = l
+	}
+	if req.mType.streamsReply() && !req.h.OneWay {
+		req.replyStream = &replyStream{server: server, cc: cc, req: req, sending: sending}
+		req.replyV = reflect.ValueOf(req.replyStream)
+	}
+	ctx := c.ctx
+	if req.mType.withCtx {
+		// only methods taking a context can read it, don't pay for the others
+		ctx = withRequest(withIncomingMeta(ctx, req.h.Meta), req.h)
+	}
+	start := server.now()
+	if timeout == 0 {
+		err := server.run(ctx, c, req, start)
+		server.reply(cc, req, err, sending)
+		server.audit(req, req.replyV.Interface(), err, start)
+		closeOnPanic(c, err)
+		return
+	}
+	called := make(chan error)
+	sent := make(chan struct{})
+	go func() {
+		err := server.run(ctx, c, req, start)
+		called <- err
+		server.reply(cc, req, err, sending)
 		sent <- struct{}{}
 	}()
 
-	if timeout == 0 {
-		<-called
+	select {
+	case <-server.after(timeout):
+		err := newError(CodeServerTimeout, fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout))
+		setError(req.h, err, CodeServerTimeout)
+		if req.trace != nil {
+			// the method is still running, so only the time waited is known
+			req.h.Trace = &codec.Trace{Decode: req.trace.Decode, Handle: timeout}
+		}
+		if req.replyStream != nil {
+			req.replyStream.end()
+		}
+		server.sendReply(cc, req, invalidRequest, sending)
+		// the method may still be writing the reply, so it's not audited
+		server.audit(req, nil, err, start)
+	case err := <-called:
 		<-sent
+		server.audit(req, req.replyV.Interface(), err, start)
+		closeOnPanic(c, err)
+	}
+}
+
+// reply sends the reply of req, or err if the method fails,
+// the response of a streamed reply only ends the stream, its body is empty.
+func (server *Server) reply(cc codec.Codec, req *request, err error, sending *sync.Mutex) {
+	req.h.Trace = req.trace
+	if req.replyStream != nil {
+		req.replyStream.end()
+	}
+	if err != nil {
+		setError(req.h, err, CodeApplication)
+		server.sendReply(cc, req, invalidRequest, sending)
 		return
 	}
-	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sending)
-	case <-called:
-		<-sent
+	if req.mType.streamsReply() {
+		server.sendReply(cc, req, invalidRequest, sending)
+		return
 	}
+	server.sendReply(cc, req, req.replyV.Interface(), sending)
 }
 
 // Accept accepts connections on the listener and serves requests
 // for each incoming connection.
 // 实现了 Accept 方式，net.Listener 作为参数，for 循环等待 socket 连接建立，并开启子协程处理，处理过程交给了 ServerConn 方法。
-func (server *Server) Accept(lis net.Listener) {
+// Accept always returns a non-nil error: ErrServerClosed after Shutdown, otherwise the error of lis.Accept,
+// eg, net.ErrClosed if lis is closed by the caller, so a supervisor can tell a deliberate stop from a failure.
+func (server *Server) Accept(lis net.Listener) error {
+	return server.accept(lis, nil)
+}
+
+func (server *Server) accept(lis net.Listener, preset *Option) error {
+	if !server.trackListener(lis, true) {
+		_ = lis.Close()
+		return ErrServerClosed
+	}
+	defer server.trackListener(lis, false)
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
+			if server.shuttingDown() {
+				return ErrServerClosed
+			}
 			log.Println("rpc server: accept error:", err)
-			return
+			return err
 		}
-		go server.ServeConn(conn)
+		go server.serveConn(conn, preset)
 	}
 }
 
 // Accept accepts connections on the listener and serves requests
 // for each incoming connection.
-func Accept(lis net.Listener) { DefaultServer.Accept(lis) }
+func Accept(lis net.Listener) error { return DefaultServer.Accept(lis) }
+
+// Serve accepts connections on all listeners concurrently, eg, a TCP port and a Unix socket for local sidecars,
+// it blocks until all listeners are closed. Connections of all listeners share the services and the statistics
+// of the server, and Shutdown stops all of them.
+// 返回最先结束的 Accept 返回的错误，其余监听器不受影响，仍然继续服务直到关闭。
+func (server *Server) Serve(listeners ...net.Listener) error {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+	for _, lis := range listeners {
+		wg.Add(1)
+		go func(lis net.Listener) {
+			defer wg.Done()
+			err := server.Accept(lis)
+			once.Do(func() { first = err })
+		}(lis)
+	}
+	wg.Wait()
+	return first
+}
+
+// Serve accepts connections on all listeners for the DefaultServer.
+func Serve(listeners ...net.Listener) error { return DefaultServer.Serve(listeners...) }
 
 // Register publishes in the server the set of methods of the
 // receiver value that satisfy the following conditions:
@@ -255,22 +916,108 @@ func Accept(lis net.Listener) { DefaultServer.Accept(lis) }
 //   - two arguments, both of exported type
 //   - the second argument is a pointer
 //   - one return value, of type error
+//
+// If the receiver implements RpcIniter, RpcInit is called before the service is published.
 func (server *Server) Register(rcv interface{}) error {
-	s := newService(rcv)
-	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
-		return errors.New("rpc: service already defined: " + s.name)
+	s, err := buildService(rcv)
+	if err != nil {
+		return err
 	}
-	return nil
+	return server.register(s.name, s, false)
 }
 
 // Register publishes the receiver's methods in the DefaultServer.
 func Register(rcv interface{}) error { return DefaultServer.Register(rcv) }
 
-// defaultDebugPath 是为后续 DEBUG 页面预留的地址。
+// RegisterName is like Register but uses the provided name for the service instead of the type name of rcv.
+func (server *Server) RegisterName(name string, rcv interface{}) error {
+	if name == "" || strings.ContainsAny(name, "."+versionSep) {
+		return errors.New("rpc: invalid service name: " + name)
+	}
+	s := newNamedService(rcv, name)
+	return server.register(name, s, false)
+}
+
+// RegisterName publishes the receiver's methods in the DefaultServer under the name.
+func RegisterName(name string, rcv interface{}) error { return DefaultServer.RegisterName(name, rcv) }
+
+// RegisterWithMethods is like Register, but only the named methods of rcv are exposed,
+// so helpers which happen to have the signature of an rpc method aren't published by accident.
+// 名称是方法对外的名称（通过 RpcMethodMapper 改名后即新名称），不存在或签名不符合要求的名称会返回错误；
+// 不传入任何名称时与 Register 相同，即公开所有符合条件的方法。
+func (server *Server) RegisterWithMethods(rcv interface{}, methods ...string) error {
+	s, err := buildService(rcv)
+	if err != nil {
+		return err
+	}
+	if len(methods) > 0 {
+		exposed := make(map[string]*methodType, len(methods))
+		for _, name := range methods {
+			m := s.method[name]
+			if m == nil {
+				return fmt.Errorf("rpc: %s.%s is not an eligible method", s.name, name)
+			}
+			exposed[name] = m
+		}
+		s.method = exposed
+	}
+	return server.register(s.name, s, false)
+}
+
+// RegisterWithMethods publishes the named methods of rcv in the DefaultServer.
+func RegisterWithMethods(rcv interface{}, methods ...string) error {
+	return DefaultServer.RegisterWithMethods(rcv, methods...)
+}
+
+// RegisterAll registers each receiver like Register, instead of stopping at the first failure,
+// it goes on with the rest and returns a *RegisterError listing every receiver failed and why,
+// so all the registration problems of a startup are reported at once. nil means all are registered.
+func (server *Server) RegisterAll(rcvs ...interface{}) error {
+	var errs []error
+	for i, rcv := range rcvs {
+		if err := server.Register(rcv); err != nil {
+			errs = append(errs, fmt.Errorf("rpc: register receiver #%d (%T): %w", i, rcv, err))
+		}
+	}
+	if len(errs) > 0 {
+		return &RegisterError{Errors: errs}
+	}
+	return nil
+}
+
+// RegisterAll registers the receivers in the DefaultServer.
+func RegisterAll(rcvs ...interface{}) error { return DefaultServer.RegisterAll(rcvs...) }
+
+// register publishes s, whose methods are exposed under the service name base,
+// if extend is true, the service base must be registered already, see RegisterExtend.
+func (server *Server) register(base string, s *service, extend bool) error {
+	server.svcMu.Lock()
+	defer server.svcMu.Unlock()
+	if _, ok := server.serviceMap.Load(base); extend && !ok {
+		return errors.New("rpc: can't find service " + base)
+	}
+	if _, dup := server.serviceMap.Load(s.name); dup {
+		return errors.New("rpc: service already defined: " + s.name)
+	}
+	if err := server.checkVersionConflict(base, s); err != nil {
+		return err
+	}
+	if err := initService(s); err != nil {
+		return fmt.Errorf("rpc: init service %s: %w", s.name, err)
+	}
+	server.serviceMap.Store(s.name, s)
+	server.services = append(server.services, s.name)
+	server.invalidateMethods()
+	return nil
+}
+
+// DefaultRPCPath 和 DefaultDebugPath 是 HandleHTTP 默认注册的地址，与 net/rpc 的约定一致：
+// 服务端在 rpcPath 上接受 CONNECT 请求，劫持（Hijack）底层连接后交给 ServeConn，
+// 因此 RPC 可以与普通的 HTTP 服务共用同一个端口，也可以穿过只放行 HTTP 的代理。
 const (
 	connected        = "200 Connected to Simple RPC"
-	defaultRPCPath   = "/_simple_rpc_"
-	defaultDebugPath = "/debug/simple_rpc"
+	DefaultRPCPath   = "/_simple_rpc_"
+	DefaultDebugPath = "/debug/simple_rpc"
 )
 
 // ServeHTTP implements a http.Handler that answers RPC requests.
@@ -293,13 +1040,13 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 // HandleHTTP registers an HTTP handler for RPC messages on rpcPath,
 // and a debugging handler on debugPath.
 // It is still necessary to invoke http.Serve(), typically in a go statement.
-func (server *Server) HandleHTTP() {
-	http.Handle(defaultRPCPath, server)
-	http.Handle(defaultDebugPath, debugHTTP{server})
-	log.Println("rpc server debug path:", defaultDebugPath)
+func (server *Server) HandleHTTP(rpcPath, debugPath string) {
+	http.Handle(rpcPath, server)
+	http.Handle(debugPath, debugHTTP{server})
+	log.Println("rpc server debug path:", debugPath)
 }
 
-// HandleHTTP is a convenient approach for default server to register HTTP handlers
+// HandleHTTP registers HTTP handlers for the DefaultServer on DefaultRPCPath and DefaultDebugPath.
 func HandleHTTP() {
-	DefaultServer.HandleHTTP()
+	DefaultServer.HandleHTTP(DefaultRPCPath, DefaultDebugPath)
 }
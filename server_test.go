@@ -0,0 +1,1865 @@
+package simple_rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"simple_rpc/codec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServer_findService(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+
+	_, _, err := server.findService("Foo.Sum")
+	_assert(err == nil, "failed to find Foo.Sum")
+	_, _, err = server.findService("Bar.Sum")
+	_assert(errors.Is(err, ErrServiceNotFound), "expect service not found, but got %v", err)
+	_, _, err = server.findService("Foo.Mul")
+	_assert(errors.Is(err, ErrMethodNotFound), "expect method not found, but got %v", err)
+	_assert(!errors.Is(err, ErrServiceNotFound), "method not found shouldn't be service not found")
+	_assert(strings.HasSuffix(err.Error(), "available: Sum"), "expect available methods listed, but got %v", err)
+	_, _, err = server.findService("Fo.Sum")
+	_assert(strings.HasSuffix(err.Error(), "did you mean: Foo"), "expect Foo suggested, but got %v", err)
+	_assert(listNames([]string{"c", "b", "a"}) == "a, b, c", "names should be sorted")
+	many := make([]string, 15)
+	for i := range many {
+		many[i] = fmt.Sprintf("M%02d", i)
+	}
+	_assert(strings.HasSuffix(listNames(many), "M09 and 5 more"), "names should be bounded, got %s", listNames(many))
+}
+
+func TestServer_findServiceCache(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	svc, _, err := server.findService("Foo.Sum")
+	_assert(err == nil, "failed to find Foo.Sum")
+	cached, _, _ := server.findService("Foo.Sum")
+	_assert(cached == svc, "expect the cached service")
+
+	_ = server.Unregister("Foo")
+	_, _, err = server.findService("Foo.Sum")
+	_assert(errors.Is(err, ErrServiceNotFound), "unregistered service shouldn't be found in the cache, got %v", err)
+	_ = server.Register(new(Foo))
+	svc2, _, err := server.findService("Foo.Sum")
+	_assert(err == nil && svc2 != svc, "expect the service registered again: %v", err)
+}
+
+func BenchmarkServer_findService(b *testing.B) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	_ = server.Register(new(Fail))
+	_ = server.Register(new(Slow))
+	_ = server.Register(new(Calc))
+	methods := []string{"Foo.Sum", "Foo.Sum", "Fail.Do", "Calc.DivMod", "Foo.Sum", "Slow.Sleep", "Calc.Split", "Foo.Sum"}
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _, _ = server.lookupMethod(methods[i%len(methods)])
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _, _ = server.findService(methods[i%len(methods)])
+		}
+	})
+}
+
+func TestServer_SetMaxConns(t *testing.T) {
+	server := NewServer()
+	server.SetMaxConns(2)
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	var refused int
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		_assert(err == nil, "failed to dial: %v", err)
+		defer func() { _ = conn.Close() }()
+		// the server closes excess connections immediately,
+		// while others are waiting for the Option.
+		_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+		if _, err = conn.Read(make([]byte, 1)); err == io.EOF {
+			refused++
+		}
+	}
+	_assert(refused == 1, "expect 1 connection refused, but got %d", refused)
+}
+
+func TestServer_DenyMethods(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	server.DenyMethods("Foo.Sum")
+	err := client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(errors.Is(err, ErrNotPermitted), "expect method not permitted, but got %v", err)
+
+	server.AllowMethods("Foo.Sum")
+	server.SetDefaultDeny(true)
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call allowed Foo.Sum: %v", err)
+	_, _, err = server.findService("Foo.Mul")
+	_assert(errors.Is(err, ErrMethodNotFound), "unknown method should still be not found")
+}
+
+func TestBinaryOptionCodec(t *testing.T) {
+	var buf bytes.Buffer
+	opt := &Option{MagicNumber: MagicNumber, Version: ProtocolVersion, CodecType: codec.GobType, ConnectTimeout: time.Second,
+		HandleTimeout: time.Minute, OrderedResponses: true, InlineFastPath: true, Compressor: codec.SnappyCompressor,
+		WriteTimeout: time.Second * 3}
+	_assert(BinaryOptionCodec.Encode(&buf, opt) == nil, "failed to encode option")
+	buf.WriteString("rest")
+
+	var got Option
+	_, err := readOption(&buf, &got)
+	_assert(err == nil && reflect.DeepEqual(got, *opt), "expect %+v, but got %+v: %v", *opt, got, err)
+	_assert(buf.String() == "rest", "binary option shouldn't over-read, left %q", buf.String())
+}
+
+func TestJSONOptionCodec_frame(t *testing.T) {
+	var buf bytes.Buffer
+	opt := &Option{MagicNumber: MagicNumber, Version: ProtocolVersion, CodecType: codec.GobType, HandleTimeout: time.Minute}
+	_assert(JSONOptionCodec.Encode(&buf, opt) == nil, "failed to encode option")
+	_assert(buf.Bytes()[0] == 0, "option should be framed since version %d", framedOptionVersion)
+	buf.WriteString("rest")
+	var got Option
+	_, err := readOption(&buf, &got)
+	_assert(err == nil && reflect.DeepEqual(got, *opt), "expect %+v, but got %+v: %v", *opt, got, err)
+	_assert(buf.String() == "rest", "framed option shouldn't over-read, left %q", buf.String())
+
+	// version 1 clients send the JSON as it is, so old servers can read it
+	buf.Reset()
+	_ = JSONOptionCodec.Encode(&buf, &Option{MagicNumber: MagicNumber, Version: 1, CodecType: codec.GobType})
+	_assert(buf.Bytes()[0] == '{', "option of version 1 shouldn't be framed, got % x", buf.Bytes())
+	_, err = readOption(&buf, &got)
+	_assert(err == nil && got.Version == 1, "failed to read option of version 1: %v", err)
+
+	_, err = readOption(bytes.NewReader([]byte{0, 0, 0xff, 0xff}), &got)
+	_assert(err != nil && strings.Contains(err.Error(), "too large"), "expect a too large frame error, got %v", err)
+}
+
+func TestOptionCodec_roundTrip(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		for name, c := range map[string]OptionCodec{"json": JSONOptionCodec, "binary": BinaryOptionCodec} {
+			var buf bytes.Buffer
+			opt := &Option{MagicNumber: MagicNumber, Version: version, CodecType: codec.GobType, HandleTimeout: time.Minute}
+			_assert(c.Encode(&buf, opt) == nil, "%s: failed to encode option of version %d", name, version)
+			var got Option
+			err := c.Decode(&buf, &got)
+			_assert(err == nil && reflect.DeepEqual(got, *opt), "%s: expect %+v, but got %+v: %v", name, *opt, got, err)
+		}
+	}
+}
+
+func TestReadOption_Garbage(t *testing.T) {
+	var opt Option
+	_, err := readOption(bytes.NewReader([]byte{0x1f, 0xff, 0x81, 0x03, 0x01}), &opt)
+	_assert(err != nil && strings.Contains(err.Error(), "received 1f ff 81 03"), "expect the received bytes in the error, got %v", err)
+
+	// an endless JSON string is not read beyond the limit, and the snippet is bounded
+	garbage := append([]byte(`{"MagicNumber":"`), bytes.Repeat([]byte("a"), 1<<20)...)
+	r := bytes.NewReader(garbage)
+	_, err = readOption(r, &opt)
+	_assert(err != nil && r.Len() >= len(garbage)-maxOptionSize, "expect at most %d bytes read, %d left", maxOptionSize, r.Len())
+	_assert(strings.Count(err.Error(), " 61") <= optionSnippetSize, "snippet should be bounded: %v", err)
+}
+
+func TestServer_Stats(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	_ = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	// the response of ping is sent after the size of the previous reply is accounted
+	_ = client.Ping(context.Background())
+	stats := server.Stats()["Foo.Sum"]
+	_assert(stats.Calls == 1 && stats.BytesRead > 0 && stats.BytesWritten > 0, "wrong stats %+v", stats)
+
+	server.SetSizeStats(false)
+	_ = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_ = client.Ping(context.Background())
+	got := server.Stats()["Foo.Sum"]
+	_assert(got.Calls == 2 && got.BytesRead == stats.BytesRead && got.BytesWritten == stats.BytesWritten,
+		"sizes shouldn't be accounted when disabled, got %+v", got)
+}
+
+func TestServer_Stats_latency(t *testing.T) {
+	var s Slow
+	server := NewServer()
+	_ = server.Register(&s)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	_ = client.Call(context.Background(), "Slow.Sleep", 0, &reply)
+	_ = client.Call(context.Background(), "Slow.Sleep", 30, &reply)
+	stats := server.Stats()["Slow.Sleep"]
+	buckets := LatencyBuckets()
+	_assert(len(stats.Latency) == len(buckets)+1, "expect a count for each bucket and the overflow, got %v", stats.Latency)
+	_assert(stats.Latency[0] == 1 && stats.Latency[4] == 1 && buckets[4] == 50*time.Millisecond, "wrong histogram %v", stats.Latency)
+	_assert(stats.LatencySum >= 30*time.Millisecond, "wrong latency sum %s", stats.LatencySum)
+	_assert(stats.P50 < time.Millisecond && stats.P99 >= 27*time.Millisecond && stats.P99 < 50*time.Millisecond,
+		"wrong quantiles p50 %s p99 %s", stats.P50, stats.P99)
+}
+
+func TestQuantile(t *testing.T) {
+	for _, d := range []time.Duration{time.Microsecond, 3 * time.Microsecond, time.Millisecond, 42 * time.Millisecond, 3 * time.Second} {
+		var buckets [expBuckets + 1]uint64
+		buckets[expBucket(d)]++
+		got := quantile(buckets[:], 1, 0.5)
+		_assert(math.Abs(float64(got-d)) <= 0.1*float64(d), "estimate of %s is %s, expect within 10%%", d, got)
+	}
+	var buckets [expBuckets + 1]uint64
+	for i := 1; i <= 100; i++ {
+		buckets[expBucket(time.Duration(i)*time.Millisecond)]++
+	}
+	p50, p99 := quantile(buckets[:], 100, 0.5), quantile(buckets[:], 100, 0.99)
+	_assert(p50 > 45*time.Millisecond && p50 < 55*time.Millisecond, "wrong p50 %s", p50)
+	_assert(p99 > 90*time.Millisecond && p99 < 110*time.Millisecond, "wrong p99 %s", p99)
+	_assert(quantile(buckets[:], 0, 0.5) == 0, "expect 0 without calls")
+	_assert(expBucket(time.Hour) == expBuckets && quantile([]uint64{expBuckets: 1}, 1, 0.5) == expMax, "expect the overflow bucket")
+}
+
+func TestServer_MethodStats(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	_ = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	stats, ok := server.MethodStats("Foo.Sum")
+	_assert(ok && stats.Calls == 1 && stats.Errors == 0, "wrong stats %+v", stats)
+	_assert(reflect.DeepEqual(stats, server.Stats()["Foo.Sum"]), "expect the same stats as Stats")
+	_, ok = server.MethodStats("Foo.Missing")
+	_assert(!ok, "unknown method shouldn't have stats")
+	_, ok = server.MethodStats("Missing.Sum")
+	_assert(!ok, "unknown service shouldn't have stats")
+}
+
+type Slow int
+
+func (s Slow) Sleep(ms int, reply *int) error {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	*reply = ms
+	return nil
+}
+
+// Shutdown 时已经读取的请求仍然会被处理并回复，之后连接被关闭。
+func TestServer_Shutdown(t *testing.T) {
+	var s Slow
+	server := NewServer()
+	_ = server.Register(&s)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	call := client.Go("Slow.Sleep", 200, &reply, nil)
+	time.Sleep(time.Millisecond * 50) // make sure the request is read
+	err := server.Shutdown(context.Background())
+	_assert(err == nil, "failed to shutdown: %v", err)
+	<-call.Done
+	_assert(call.Error == nil && reply == 200, "in-flight call should complete, but got %v", call.Error)
+
+	err = client.Call(context.Background(), "Slow.Sleep", 1, &reply)
+	_assert(err != nil, "expect an error after shutdown")
+}
+
+func TestServer_OrderedResponses(t *testing.T) {
+	var s Slow
+	server := NewServer()
+	_ = server.Register(&s)
+	dialer := func(network, address string) (net.Conn, error) {
+		return pipe(server), nil
+	}
+	client, _ := DialWith(dialer, "pipe", "", &Option{OrderedResponses: true})
+	defer func() { _ = client.Close() }()
+
+	done := make(chan *Call, 2)
+	var slow, fast int
+	client.Go("Slow.Sleep", 100, &slow, done)
+	client.Go("Slow.Sleep", 1, &fast, done)
+	first := <-done
+	_assert(first.Error == nil && first.Reply == &slow, "expect the slow call to be replied first")
+	<-done
+}
+
+func TestServer_InlineFastPath(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	client, _ := NewClient(pipe(server), &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, InlineFastPath: true})
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum inline: %v", err)
+	err = client.Call(context.Background(), "Foo.Nope", &Args{}, &reply)
+	_assert(errors.Is(err, ErrMethodNotFound), "expect method not found, got %v", err)
+}
+
+func TestServer_SetAuditHook(t *testing.T) {
+	var f Fail
+	var s Slow
+	server := NewServer()
+	_ = server.Register(&f)
+	_ = server.Register(&s)
+	type event struct {
+		method string
+		argv   interface{}
+		replyv interface{}
+		err    error
+	}
+	events := make(chan event, 3)
+	server.SetAuditHook(func(h *codec.Header, argv, replyv interface{}, err error, dur time.Duration) {
+		events <- event{h.ServiceMethod, argv, replyv, err}
+	})
+	client, _ := NewClient(pipe(server), &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, HandleTimeout: time.Millisecond * 50})
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	_ = client.Call(context.Background(), "Fail.Do", 3, &reply)
+	e := <-events
+	_assert(e.method == "Fail.Do" && e.argv.(int) == 3 && *e.replyv.(*int) == 3 && e.err == nil, "unexpected event %+v", e)
+	_ = client.Call(context.Background(), "Fail.Do", -1, &reply)
+	e = <-events
+	_assert(e.err != nil && e.err.Error() == "negative", "expect the error of the method, got %+v", e)
+	_ = client.Call(context.Background(), "Slow.Sleep", 100, &reply)
+	e = <-events
+	_assert(e.replyv == nil && errors.Is(e.err, ErrServerTimeout), "expect a timeout without reply, got %+v", e)
+}
+
+func BenchmarkServer_InlineFastPath(b *testing.B) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	for _, inline := range []bool{false, true} {
+		b.Run(fmt.Sprintf("inline=%v", inline), func(b *testing.B) {
+			client, _ := NewClient(pipe(server), &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, InlineFastPath: inline})
+			defer func() { _ = client.Close() }()
+			var reply int
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = client.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: i}, &reply)
+			}
+		})
+	}
+}
+
+func TestServer_SetOverloadPredicate(t *testing.T) {
+	var s Slow
+	server := NewServer()
+	_ = server.Register(&s)
+	server.SetOverloadPredicate(func() bool { return server.InflightRequests() >= 1 })
+	server.SetRetryAfter(time.Millisecond * 50)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var slow, reply int
+	call := client.Go("Slow.Sleep", 100, &slow, nil)
+	time.Sleep(time.Millisecond * 50) // make sure the slow call is being handled
+	err := client.Call(context.Background(), "Slow.Sleep", 1, &reply)
+	_assert(errors.Is(err, ErrOverloaded), "expect server overloaded, but got %v", err)
+	d, ok := RetryAfter(err)
+	_assert(ok && d == time.Millisecond*50, "expect a retry-after hint of 50ms, got %v", d)
+	<-call.Done
+	_assert(call.Error == nil, "the slow call should succeed: %v", call.Error)
+	for server.InflightRequests() != 0 {
+		time.Sleep(time.Millisecond) // the gauge is decreased after the reply is sent
+	}
+	err = client.Call(context.Background(), "Slow.Sleep", 1, &reply)
+	_assert(err == nil, "server shouldn't be overloaded now: %v", err)
+}
+
+func TestServer_ConnInflightRequests(t *testing.T) {
+	var s Slow
+	server := NewServer()
+	_ = server.Register(&s)
+	c1, c2 := NewInProcess(server), NewInProcess(server)
+	defer func() { _ = c1.Close() }()
+	defer func() { _ = c2.Close() }()
+
+	var r1, r2, r3 int
+	calls := []*Call{
+		c1.Go("Slow.Sleep", 200, &r1, nil),
+		c1.Go("Slow.Sleep", 200, &r2, nil),
+		c2.Go("Slow.Sleep", 200, &r3, nil),
+	}
+	time.Sleep(time.Millisecond * 100) // make sure the calls are being handled
+	var counts []int
+	for _, n := range server.ConnInflightRequests() {
+		counts = append(counts, n)
+	}
+	_assert(server.InflightRequests() == 3, "expect 3 inflight requests, got %d", server.InflightRequests())
+	_assert(len(counts) == 2 && counts[0]+counts[1] == 3 && counts[0]*counts[1] == 2,
+		"expect 2 and 1 inflight requests on the connections, got %v", counts)
+	for _, call := range calls {
+		<-call.Done
+	}
+}
+
+func TestServer_Inflight(t *testing.T) {
+	var s Slow
+	server := NewServer()
+	_ = server.Register(&s)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var r1, r2 int
+	call1 := client.Go("Slow.Sleep", 300, &r1, nil)
+	time.Sleep(time.Millisecond * 50)
+	call2 := client.Go("Slow.Sleep", 300, &r2, nil)
+	time.Sleep(time.Millisecond * 50) // make sure the calls are being handled
+	requests := server.Inflight()
+	_assert(len(requests) == 2, "expect 2 inflight requests, got %v", requests)
+	_assert(requests[0].Seq == call1.Seq && requests[1].Seq == call2.Seq, "expect the oldest request first, got %v", requests)
+	_assert(requests[0].ServiceMethod == "Slow.Sleep" && requests[0].Remote != "", "unexpected inflight request %v", requests[0])
+	_assert(requests[0].Elapsed >= time.Millisecond*100 && requests[0].Elapsed > requests[1].Elapsed,
+		"unexpected elapsed time %v and %v", requests[0].Elapsed, requests[1].Elapsed)
+
+	rec := httptest.NewRecorder()
+	server.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/?format=json", nil))
+	var page debugPage
+	_ = json.Unmarshal(rec.Body.Bytes(), &page)
+	_assert(len(page.Requests) == 2, "expect 2 requests on the debug page, got %s", rec.Body.String())
+
+	<-call1.Done
+	<-call2.Done
+	_assert(len(server.Inflight()) == 0, "expect no inflight requests, got %v", server.Inflight())
+}
+
+func TestServer_Gateway(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	server.DenyMethods("Foo.Sum")
+	ts := httptest.NewServer(server.Gateway())
+	defer ts.Close()
+
+	post := func(path, body string) (int, string) {
+		resp, err := http.Post(ts.URL+path, "application/json", strings.NewReader(body))
+		_assert(err == nil, "gateway post err: %v", err)
+		defer func() { _ = resp.Body.Close() }()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	status, _ := post("/rpc/Foo/Sum", `{"Num1":1,"Num2":2}`)
+	_assert(status == http.StatusForbidden, "denied method should be 403, got %d", status)
+
+	server.AllowMethods("Foo.Sum")
+	status, body := post("/rpc/Foo/Sum", `{"Num1":1,"Num2":2}`)
+	_assert(status == http.StatusOK && strings.TrimSpace(body) == "3", "expect 3, got %d %s", status, body)
+	status, _ = post("/rpc/Foo/Sum", `{"Num1":`)
+	_assert(status == http.StatusBadRequest, "bad body should be 400, got %d", status)
+	status, _ = post("/rpc/Foo/Nope", `{}`)
+	_assert(status == http.StatusNotFound, "unknown method should be 404, got %d", status)
+	status, _ = post("/rpc/Bar/Sum", `{}`)
+	_assert(status == http.StatusNotFound, "unknown service should be 404, got %d", status)
+
+	resp, err := http.Get(ts.URL + "/rpc/Foo/Sum")
+	_assert(err == nil && resp.StatusCode == http.StatusMethodNotAllowed, "GET should be 405")
+	_ = resp.Body.Close()
+}
+
+type Fail int
+
+func (f Fail) Do(n int, reply *int) error {
+	if n < 0 {
+		return errors.New("negative")
+	}
+	*reply = n
+	return nil
+}
+
+func TestServer_DebugHandler(t *testing.T) {
+	var fail Fail
+	server := NewServer()
+	_ = server.Register(&fail)
+	svc, mType, _ := server.findService("Fail.Do")
+	var reply int
+	for _, n := range []int{1, -1, -2} {
+		argv := mType.newArgV()
+		argv.SetInt(int64(n))
+		_ = svc.call(context.Background(), mType, argv, reflect.ValueOf(&reply))
+	}
+	ts := httptest.NewServer(server.DebugHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?format=json")
+	_assert(err == nil, "failed to get debug page: %v", err)
+	var page debugPage
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	_ = resp.Body.Close()
+	_assert(err == nil && len(page.Services) == 1 && len(page.Services[0].Method) == 1, "unexpected debug page: %+v, %v", page, err)
+	m := page.Services[0].Method[0]
+	_assert(m.Name == "Do" && m.Calls == 3 && m.Errors == 2, "expect 3 calls and 2 errors, got %+v", m)
+
+	resp, err = http.Get(ts.URL)
+	_assert(err == nil, "failed to get debug page: %v", err)
+	b, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	_assert(strings.Contains(string(b), "Service Fail"), "html page should list service Fail")
+}
+
+func TestServer_SetWriteTimeout(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	server.SetWriteTimeout(time.Millisecond * 100)
+	cliConn, srvConn := net.Pipe()
+	defer func() { _ = cliConn.Close() }()
+	done := make(chan struct{})
+	go func() {
+		server.ServeConn(srvConn)
+		close(done)
+	}()
+
+	// a client which sends requests but never reads the responses
+	_ = JSONOptionCodec.Encode(cliConn, DefaultOption)
+	cc := codec.NewGobCodec(cliConn)
+	for i := 0; i < 3; i++ {
+		h := &codec.Header{ServiceMethod: "Foo.Sum", Seq: uint64(i)}
+		_ = cc.Write(h, &Args{Num1: i, Num2: i})
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("server should close the connection of a client not reading responses")
+	}
+}
+
+func TestOption_WriteTimeout(t *testing.T) {
+	var s Slow
+	server := NewServer()
+	_ = server.Register(&s)
+	cliConn, srvConn := net.Pipe()
+	defer func() { _ = cliConn.Close() }()
+	done := make(chan struct{})
+	go func() {
+		server.ServeConn(srvConn)
+		close(done)
+	}()
+
+	// a stalled reader: a fast request is answered while a slow one is being handled, nobody reads either
+	_ = BinaryOptionCodec.Encode(cliConn, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, WriteTimeout: time.Millisecond * 50})
+	cc := codec.NewGobCodec(cliConn)
+	_ = cc.Write(&codec.Header{ServiceMethod: "Slow.Sleep", Seq: 1}, 100)
+	_ = cc.Write(&codec.Header{ServiceMethod: "Slow.Sleep", Seq: 2}, 0)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("server should close the connection of a stalled reader")
+	}
+	_assert(server.InflightRequests() == 0, "handlers should exit, %d are inflight", server.InflightRequests())
+}
+
+func TestServer_UnsupportedVersion(t *testing.T) {
+	server := NewServer()
+	cliConn, srvConn := net.Pipe()
+	go server.ServeConn(srvConn)
+
+	_ = JSONOptionCodec.Encode(cliConn, &Option{MagicNumber: MagicNumber, Version: ProtocolVersion + 1, CodecType: codec.GobType})
+	cc := codec.NewGobCodec(cliConn)
+	var h codec.Header
+	err := cc.ReadHeader(&h)
+	_assert(err == nil && h.Seq == 0 && ErrorCode(h.Code) == CodeUnsupportedVersion,
+		"expect an unsupported protocol version error, got %+v: %v", h, err)
+}
+
+// lifecycle 记录服务 RpcInit 和 RpcClose 的调用顺序。
+var lifecycle []string
+
+type First int
+
+func (f *First) RpcInit() error  { lifecycle = append(lifecycle, "init First"); return nil }
+func (f *First) RpcClose() error { lifecycle = append(lifecycle, "close First"); return nil }
+func (f *First) Get(_ int, reply *int) error {
+	*reply = 1
+	return nil
+}
+
+type Second struct{ Fail bool }
+
+func (s *Second) RpcInit() error {
+	if s.Fail {
+		return errors.New("init failed")
+	}
+	lifecycle = append(lifecycle, "init Second")
+	return nil
+}
+func (s *Second) RpcClose() error { lifecycle = append(lifecycle, "close Second"); return nil }
+
+func TestServer_Lifecycle(t *testing.T) {
+	lifecycle = nil
+	server := NewServer()
+	_assert(server.Register(&Second{Fail: true}) != nil, "expect an error when RpcInit fails")
+	_, _, err := server.findService("Second.Get")
+	_assert(errors.Is(err, ErrServiceNotFound), "service shouldn't be registered if RpcInit fails")
+
+	_ = server.Register(new(First))
+	_ = server.Register(new(Second))
+	_ = server.Register(new(Foo)) // services without lifecycle methods are fine
+	_assert(server.Shutdown(context.Background()) == nil, "failed to shutdown")
+	expect := []string{"init First", "init Second", "close Second", "close First"}
+	_assert(reflect.DeepEqual(lifecycle, expect), "expect %v, got %v", expect, lifecycle)
+
+	server = NewServer()
+	_ = server.Register(new(First))
+	_assert(server.Unregister("First") == nil && server.Unregister("First") != nil, "failed to unregister First")
+	_, _, err = server.findService("First.Get")
+	_assert(errors.Is(err, ErrServiceNotFound), "First should be unregistered")
+}
+
+// Event 是接口类型的入参，具体类型通过 RegisterType 登记。
+type Event interface{ Kind() string }
+
+type Created struct{ ID int }
+type Deleted struct{ ID int }
+
+func (e *Created) Kind() string { return fmt.Sprintf("created %d", e.ID) }
+func (e Deleted) Kind() string  { return fmt.Sprintf("deleted %d", e.ID) }
+
+type Bus int
+
+func (b Bus) Publish(e Event, reply *string) error {
+	*reply = e.Kind()
+	return nil
+}
+
+func TestServer_SetDefaultHandler(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	server.RegisterType(&Created{})
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	err := client.Call(context.Background(), "Legacy.Query", 1, &reply)
+	_assert(errors.Is(err, ErrServiceNotFound), "expect not found without a default handler, got %v", err)
+
+	server.SetDefaultHandler(func(h *codec.Header, argv interface{}) (interface{}, error) {
+		if h.ServiceMethod == "Legacy.Gone" {
+			return nil, errors.New("gone")
+		}
+		if e, ok := argv.(Event); ok {
+			return h.ServiceMethod + ": " + e.Kind(), nil
+		}
+		return fmt.Sprintf("%s: %v", h.ServiceMethod, argv), nil
+	})
+	err = client.Call(context.Background(), "Legacy.Query", 1, &reply)
+	_assert(err == nil && reply == "Legacy.Query: <nil>", "expect the default handler called without arg, got %v %q", err, reply)
+	err = client.Call(context.Background(), "Foo.Missing", Typed(&Created{ID: 1}), &reply)
+	_assert(err == nil && reply == "Foo.Missing: created 1", "expect the typed arg decoded, got %v %q", err, reply)
+	err = client.Call(context.Background(), "Legacy.Gone", 1, &reply)
+	_assert(err != nil && err.Error() == "gone", "expect the error of the default handler, got %v", err)
+	var sum int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "known methods shouldn't be handled by the default handler: %v", err)
+
+	server.SetDefaultHandler(nil)
+	err = client.Call(context.Background(), "Legacy.Query", 1, &reply)
+	_assert(errors.Is(err, ErrServiceNotFound), "expect not found after the default handler removed, got %v", err)
+}
+
+func TestServer_RegisterType(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Bus))
+	server.RegisterType(&Created{})
+	server.RegisterType(Deleted{})
+	for _, typ := range []codec.Type{codec.GobType, codec.MsgpackType} {
+		client, _ := NewClient(pipe(server), &Option{MagicNumber: MagicNumber, CodecType: typ})
+		var reply string
+		err := client.Call(context.Background(), "Bus.Publish", Typed(&Created{ID: 1}), &reply)
+		_assert(err == nil && reply == "created 1", "failed to publish *Created with %s: %q %v", typ, reply, err)
+		err = client.Call(context.Background(), "Bus.Publish", Typed(Deleted{ID: 2}), &reply)
+		_assert(err == nil && reply == "deleted 2", "failed to publish Deleted with %s: %q %v", typ, reply, err)
+
+		err = client.Call(context.Background(), "Bus.Publish", &Created{ID: 3}, &reply)
+		_assert(errors.Is(err, ErrCodec) && strings.Contains(err.Error(), "type tag"), "expect a missing tag error, got %v", err)
+		err = client.Call(context.Background(), "Bus.Publish", Typed(&Deleted{ID: 4}), &reply)
+		_assert(errors.Is(err, ErrCodec) && strings.Contains(err.Error(), "unregistered"), "expect an unregistered type error, got %v", err)
+		err = client.Call(context.Background(), "Bus.Publish", Typed(Deleted{ID: 5}), &reply)
+		_assert(err == nil && reply == "deleted 5", "the connection should still work with %s: %v", typ, err)
+		_ = client.Close()
+	}
+}
+
+// Ledger 的 Add 不是幂等的，用于验证按幂等键去重。
+type Ledger struct {
+	mu    sync.Mutex
+	total int
+}
+
+func (l *Ledger) Add(delta int, reply *int) error {
+	time.Sleep(time.Millisecond * 10) // let duplicated requests arrive while it's running
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total += delta
+	*reply = l.total
+	return nil
+}
+
+func (l *Ledger) Meta(ctx context.Context, key string, reply *string) error {
+	*reply = MetaFromContext(ctx)[key]
+	return nil
+}
+
+func TestServer_SetIdempotencyCache(t *testing.T) {
+	var l Ledger
+	server := NewServer()
+	_ = server.Register(&l)
+	server.SetIdempotencyCache(2, time.Millisecond*200)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var meta string
+	_ = client.Call(WithMeta(context.Background(), "user", "alice"), "Ledger.Meta", "user", &meta)
+	_assert(meta == "alice", "expect the metadata of the request, got %q", meta)
+
+	ctx := WithMeta(context.Background(), IdempotencyKey, "k1")
+	var wg sync.WaitGroup
+	replies := make([]int, 3)
+	for i := range replies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = client.Call(ctx, "Ledger.Add", 1, &replies[i])
+		}(i)
+	}
+	wg.Wait()
+	_assert(l.total == 1 && reflect.DeepEqual(replies, []int{1, 1, 1}), "duplicated requests should run once, got %v", replies)
+
+	var reply int
+	_ = client.Call(WithMeta(context.Background(), IdempotencyKey, "k2"), "Ledger.Add", 1, &reply)
+	_ = client.Call(context.Background(), "Ledger.Add", 1, &reply)
+	_assert(l.total == 3 && reply == 3, "requests without the same key should run, total %d", l.total)
+
+	time.Sleep(time.Millisecond * 250)
+	_ = client.Call(ctx, "Ledger.Add", 1, &reply)
+	_assert(l.total == 4 && reply == 4, "expired result shouldn't be replied, total %d", l.total)
+}
+
+type Flaky struct{ calls int32 }
+
+// Do fails as fail says, reply is the number of calls
+func (f *Flaky) Do(fail string, reply *int) error {
+	*reply = int(atomic.AddInt32(&f.calls, 1))
+	switch fail {
+	case "panic":
+		panic("boom")
+	case "overload":
+		return ErrOverloaded
+	case "reject":
+		return errors.New("rejected")
+	}
+	return nil
+}
+
+func TestServer_SetIdempotencyCache_transient(t *testing.T) {
+	var f Flaky
+	server := NewServer()
+	_ = server.Register(&f)
+	server.SetIdempotencyCache(10, time.Minute)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	for _, fail := range []string{"panic", "overload"} {
+		ctx := WithMeta(context.Background(), IdempotencyKey, fail)
+		calls := atomic.LoadInt32(&f.calls)
+		err := client.Call(ctx, "Flaky.Do", fail, &reply)
+		_assert(err != nil, "expect the %s error", fail)
+		err = client.Call(ctx, "Flaky.Do", "", &reply)
+		_assert(err == nil && reply == int(calls)+2, "the retry after a %s should run the method, got %d: %v", fail, reply, err)
+		err = client.Call(ctx, "Flaky.Do", fail, &reply)
+		_assert(err == nil && reply == int(calls)+2, "the success should be cached, got %d: %v", reply, err)
+	}
+
+	ctx := WithMeta(context.Background(), IdempotencyKey, "reject")
+	err := client.Call(ctx, "Flaky.Do", "reject", &reply)
+	_assert(err != nil && err.Error() == "rejected", "expect the error of the method, got %v", err)
+	calls := atomic.LoadInt32(&f.calls)
+	err = client.Call(ctx, "Flaky.Do", "", &reply)
+	_assert(err != nil && err.Error() == "rejected" && atomic.LoadInt32(&f.calls) == calls, "the error of the method should be cached, got %v", err)
+}
+
+func TestServer_SetMetadataAllowlist(t *testing.T) {
+	var l Ledger
+	server := NewServer()
+	_ = server.Register(&l)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var meta string
+	err := client.Call(WithMeta(context.Background(), "user", "alice"), "Ledger.Meta", "user", &meta)
+	_assert(err == nil && meta == "alice", "any metadata should be accepted by default: %v", err)
+
+	server.SetMetadataAllowlist([]string{"user", IdempotencyKey})
+	ctx := WithMeta(context.Background(), "user", "bob", IdempotencyKey, "k1")
+	err = client.Call(ctx, "Ledger.Meta", "user", &meta)
+	_assert(err == nil && meta == "bob", "allowed metadata should be accepted: %v", err)
+	err = client.Call(WithMeta(ctx, "role", "admin"), "Ledger.Meta", "role", &meta)
+	_assert(errors.Is(err, ErrNotPermitted) && strings.Contains(err.Error(), `"role"`), "expect unknown key rejected, got %v", err)
+	err = client.Call(context.Background(), "Ledger.Meta", "user", &meta)
+	_assert(err == nil && meta == "", "requests without metadata should be accepted: %v", err)
+
+	server.SetMetadataAllowlist(nil)
+	err = client.Call(WithMeta(ctx, "role", "admin"), "Ledger.Meta", "role", &meta)
+	_assert(err == nil && meta == "admin", "any metadata should be accepted again: %v", err)
+}
+
+func TestServer_Deprecate(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	server.Deprecate("Foo.Sum", "use Foo.Add instead")
+	warnings := make(chan string, 2)
+	opt := *DefaultOption
+	opt.OnWarning = func(serviceMethod, warning string) { warnings <- serviceMethod + ": " + warning }
+	client, _ := NewClient(pipe(server), &opt)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	call := client.Go("Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply, nil)
+	<-call.Done
+	_assert(call.Error == nil && reply == 3, "deprecated method should still work: %v", call.Error)
+	_assert(call.Warning == "use Foo.Add instead", "expect the warning in the call, got %q", call.Warning)
+	_assert(<-warnings == "Foo.Sum: use Foo.Add instead", "expect OnWarning called")
+
+	server.Deprecate("Foo.Sum", "")
+	call = client.Go("Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply, nil)
+	<-call.Done
+	_assert(call.Error == nil && call.Warning == "", "expect no warning after the mark removed, got %q", call.Warning)
+	_assert(len(warnings) == 0, "OnWarning shouldn't be called without a warning")
+
+	server.Deprecate("Foo.Sum", "going away")
+	req := httptest.NewRequest("POST", "/rpc/Foo/Sum", strings.NewReader(`{"Num1":1,"Num2":2}`))
+	w := httptest.NewRecorder()
+	server.Gateway().ServeHTTP(w, req)
+	_assert(w.Code == http.StatusOK && w.Header().Get("Warning") == `299 - "going away"`, "expect gateway warning header, got %d %q", w.Code, w.Header().Get("Warning"))
+}
+
+func TestServer_SetConnStateHook(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	var mu sync.Mutex
+	var states []ConnState
+	closed := make(chan struct{})
+	server.SetConnStateHook(func(conn net.Conn, state ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, state)
+		if state == StateClosed {
+			close(closed)
+		}
+	})
+	client := NewInProcess(server)
+	var reply int
+	_ = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_ = client.Close()
+	<-closed
+	mu.Lock()
+	defer mu.Unlock()
+	_assert(reflect.DeepEqual(states, []ConnState{StateNew, StateClosed}), "expect new and closed, got %v", states)
+}
+
+// Signup 实现了 Validator，Name 不能为空。
+type Signup struct{ Name string }
+
+func (s *Signup) Validate() error {
+	if s.Name == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+type Users int
+
+func (u *Users) Create(s Signup, reply *string) error {
+	*u++
+	*reply = "welcome " + s.Name
+	return nil
+}
+
+func TestServer_SetValidateArgs(t *testing.T) {
+	var users Users
+	server := NewServer()
+	_ = server.Register(&users)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	err := client.Call(context.Background(), "Users.Create", Signup{}, &reply)
+	_assert(err == nil && users == 1, "args shouldn't be validated by default: %v", err)
+
+	server.SetValidateArgs(true)
+	err = client.Call(context.Background(), "Users.Create", Signup{}, &reply)
+	_assert(errors.Is(err, ErrInvalidArgument) && strings.Contains(err.Error(), "name is required"), "expect invalid argument, got %v", err)
+	_assert(users == 1, "method shouldn't be executed with invalid args")
+	err = client.Call(context.Background(), "Users.Create", Signup{Name: "bob"}, &reply)
+	_assert(err == nil && reply == "welcome bob", "failed to call with valid args: %v", err)
+
+	ts := httptest.NewServer(server.Gateway())
+	defer ts.Close()
+	resp, err := http.Post(ts.URL+"/rpc/Users/Create", "application/json", strings.NewReader(`{"Name":""}`))
+	_assert(err == nil && resp.StatusCode == http.StatusBadRequest, "gateway should reject invalid args: %v", err)
+	_ = resp.Body.Close()
+}
+
+type Profile struct {
+	Tags    []string
+	Friends map[string]int
+	Avatar  *string
+}
+
+type Profiles int
+
+func (p Profiles) Get(name string, reply *Profile) error {
+	if name == "bob" {
+		avatar := "bob.png"
+		reply.Avatar = &avatar
+	}
+	return nil
+}
+
+func TestServer_SetReplyNilPolicy(t *testing.T) {
+	var p Profiles
+	server := NewServer()
+	_ = server.Register(&p)
+	ts := httptest.NewServer(server.Gateway())
+	defer ts.Close()
+	get := func(name string) (int, string) {
+		resp, err := http.Post(ts.URL+"/rpc/Profiles/Get", "application/json", strings.NewReader(`"`+name+`"`))
+		_assert(err == nil, "failed to call the gateway: %v", err)
+		defer func() { _ = resp.Body.Close() }()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(body))
+	}
+
+	_, body := get("bob")
+	_assert(body == `{"Tags":null,"Friends":null,"Avatar":"bob.png"}`, "nil collections should be preserved by default, got %s", body)
+
+	server.SetReplyNilPolicy(EmptyNilCollections)
+	_, body = get("alice")
+	_assert(body == `{"Tags":[],"Friends":{},"Avatar":null}`, "expect empty collections, got %s", body)
+
+	server.SetReplyNilPolicy(EmptyNilCollections | RejectNilPointers)
+	code, body := get("alice")
+	_assert(code == http.StatusInternalServerError && strings.Contains(body, "reply.Avatar"), "expect nil pointer error, got %d %s", code, body)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+	var reply Profile
+	err := client.Call(context.Background(), "Profiles.Get", "alice", &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "nil pointer at reply.Avatar"), "expect nil pointer error, got %v", err)
+	err = client.Call(context.Background(), "Profiles.Get", "bob", &reply)
+	_assert(err == nil && *reply.Avatar == "bob.png", "failed to call with a complete reply: %v", err)
+}
+
+// Legacy 模拟只能有限并发访问的后端，记录同时执行的最大调用数。
+type Legacy struct {
+	running, peak int32
+}
+
+func (l *Legacy) Query(ms int, reply *int) error {
+	n := atomic.AddInt32(&l.running, 1)
+	defer atomic.AddInt32(&l.running, -1)
+	for {
+		peak := atomic.LoadInt32(&l.peak)
+		if n <= peak || atomic.CompareAndSwapInt32(&l.peak, peak, n) {
+			break
+		}
+	}
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	*reply = int(n)
+	return nil
+}
+
+func TestServer_SetServiceConcurrency(t *testing.T) {
+	var legacy Legacy
+	var s Slow
+	server := NewServer()
+	_ = server.Register(&legacy)
+	_ = server.Register(&s)
+	server.SetServiceConcurrency("Legacy", 2)
+	clients := []*Client{NewInProcess(server), NewInProcess(server), NewInProcess(server)}
+	defer func() {
+		for _, client := range clients {
+			_ = client.Close()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var failed, slowPeak int32
+	for i := 0; i < 30; i++ {
+		wg.Add(2)
+		client := clients[i%len(clients)]
+		go func() {
+			defer wg.Done()
+			var reply int
+			if err := client.Call(context.Background(), "Legacy.Query", 5, &reply); err != nil {
+				atomic.AddInt32(&failed, 1)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			var reply int
+			_ = client.Call(context.Background(), "Slow.Sleep", 50, &reply)
+			if n := int32(server.InflightRequests()); n > atomic.LoadInt32(&slowPeak) {
+				atomic.StoreInt32(&slowPeak, n)
+			}
+		}()
+	}
+	wg.Wait()
+	_assert(failed == 0, "%d calls of the limited service failed", failed)
+	_assert(legacy.peak == 2, "expect at most 2 concurrent calls of Legacy, got %d", legacy.peak)
+	_assert(slowPeak > 2, "other services shouldn't be limited, peak %d", slowPeak)
+
+	// over-limit requests are shed if the worker pool sheds the load
+	server.SetWorkerPool(8, true)
+	server.SetServiceConcurrency("Legacy", 1)
+	time.Sleep(20 * time.Millisecond) // let the workers start
+	var r1, r2 int
+	busy := clients[0].Go("Legacy.Query", 100, &r1, nil)
+	time.Sleep(20 * time.Millisecond)
+	err := clients[1].Call(context.Background(), "Legacy.Query", 0, &r2)
+	_assert(errors.Is(err, ErrOverloaded), "expect overloaded over the limit, got %v", err)
+	<-busy.Done
+	_assert(busy.Error == nil, "the call holding the slot should succeed: %v", busy.Error)
+
+	server.SetServiceConcurrency("Legacy", 0)
+	busy = clients[0].Go("Legacy.Query", 100, &r1, nil)
+	time.Sleep(20 * time.Millisecond)
+	err = clients[1].Call(context.Background(), "Legacy.Query", 0, &r2)
+	_assert(err == nil, "limit should be removed: %v", err)
+	<-busy.Done
+}
+
+func TestServer_SetWorkerPool(t *testing.T) {
+	var s Slow
+	server := NewServer()
+	_ = server.Register(&s)
+	server.SetWorkerPool(1, true)
+	server.SetRetryAfter(time.Second)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var r1, r2 int
+	busy := client.Go("Slow.Sleep", 100, &r1, nil)
+	time.Sleep(20 * time.Millisecond)
+	err := client.Call(context.Background(), "Slow.Sleep", 0, &r2)
+	d, ok := RetryAfter(err)
+	_assert(errors.Is(err, ErrOverloaded) && ok && d == time.Second, "expect overloaded if all workers are busy, got %v", err)
+	<-busy.Done
+	_assert(busy.Error == nil && r1 == 100, "failed to call: %v", busy.Error)
+
+	server = NewServer()
+	_ = server.Register(&s)
+	server.SetWorkerPool(1, false)
+	client2 := NewInProcess(server)
+	defer func() { _ = client2.Close() }()
+	busy = client2.Go("Slow.Sleep", 100, &r1, nil)
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	err = client2.Call(context.Background(), "Slow.Sleep", 0, &r2)
+	_assert(err == nil && time.Since(start) >= 50*time.Millisecond, "expect waiting for the busy worker: %v", err)
+	<-busy.Done
+
+	// 替换工作池后，旧的 worker 处理完手上的请求后退出
+	old := server.workers()
+	busy = client2.Go("Slow.Sleep", 50, &r1, nil)
+	time.Sleep(20 * time.Millisecond)
+	server.SetWorkerPool(2, false)
+	exited := make(chan struct{})
+	go func() {
+		old.running.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("the workers of the replaced pool should exit")
+	}
+	<-busy.Done
+	_assert(busy.Error == nil && r1 == 50, "the request of the replaced pool should be done: %v", busy.Error)
+	err = client2.Call(context.Background(), "Slow.Sleep", 0, &r2)
+	_assert(err == nil, "failed to call with the new pool: %v", err)
+	ran := make(chan struct{})
+	_assert(old.submit(func() { close(ran) }), "a stopped pool should accept the task")
+	<-ran
+}
+
+// BenchmarkServer_WorkerPool compares the goroutines created by a burst of calls with and without the pool
+func BenchmarkServer_WorkerPool(b *testing.B) {
+	for _, size := range []int{0, 8} {
+		b.Run(fmt.Sprintf("pool=%d", size), func(b *testing.B) {
+			var foo Foo
+			server := NewServer()
+			_ = server.Register(&foo)
+			server.SetWorkerPool(size, false)
+			clients := make([]*Client, 16)
+			for i := range clients {
+				clients[i] = NewInProcess(server)
+				defer func(c *Client) { _ = c.Close() }(clients[i])
+			}
+			var peak int64
+			stop := make(chan struct{})
+			sampled := make(chan struct{})
+			go func() {
+				defer close(sampled)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if n := int64(runtime.NumGoroutine()); n > peak {
+						peak = n
+					}
+					time.Sleep(100 * time.Microsecond)
+				}
+			}()
+			b.SetParallelism(64)
+			b.ResetTimer()
+			var next uint64
+			b.RunParallel(func(pb *testing.PB) {
+				client := clients[atomic.AddUint64(&next, 1)%uint64(len(clients))]
+				var reply int
+				for pb.Next() {
+					_ = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			<-sampled
+			b.ReportMetric(float64(peak), "peak-goroutines")
+		})
+	}
+}
+
+// truncatedConn serves the bytes of r to the server and captures what it writes
+type truncatedConn struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func (c *truncatedConn) Read(p []byte) (int, error) { return c.Reader.Read(p) }
+func (c *truncatedConn) Close() error               { return nil }
+
+func TestServer_truncatedRequest(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	var frame bytes.Buffer
+	_ = BinaryOptionCodec.Encode(&frame, DefaultOption)
+	optLen := frame.Len()
+	req := &truncatedConn{Reader: &frame}
+	_ = codec.NewGobCodec(req).Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, &Args{Num1: 1, Num2: 2})
+	full := append(frame.Bytes(), req.Bytes()...)
+
+	serve := func(data []byte) []codec.Header {
+		conn := &truncatedConn{Reader: bytes.NewReader(data)}
+		server.ServeConn(conn)
+		cc := codec.NewGobCodec(&truncatedConn{Reader: &conn.Buffer})
+		var hs []codec.Header
+		for {
+			var h codec.Header
+			if err := cc.ReadHeader(&h); err != nil {
+				return hs
+			}
+			_ = cc.ReadBody(nil)
+			hs = append(hs, h)
+		}
+	}
+
+	hs := serve(full)
+	_assert(len(hs) == 1 && hs[0].Seq == 1 && hs[0].Error == "", "client hangup after a request should be silent: %+v", hs)
+
+	hs = serve(full[:optLen+10])
+	_assert(len(hs) == 1 && hs[0].Seq == 0 && hs[0].Code == int(CodeCodec) && strings.Contains(hs[0].Error, "truncated"),
+		"expect an error response for a truncated header: %+v", hs)
+
+	hs = serve(full[:len(full)-2])
+	_assert(len(hs) == 1 && hs[0].Seq == 1 && hs[0].Code == int(CodeCodec), "expect an error response for a truncated body: %+v", hs)
+}
+
+func TestServer_packedJSONOption(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	// the Option, the header and the body arrive in one read, the JSON decoder reads them all at once
+	var packed bytes.Buffer
+	_ = JSONOptionCodec.Encode(&packed, &Option{MagicNumber: MagicNumber, Version: 1, CodecType: codec.GobType})
+	req := &truncatedConn{Reader: &packed}
+	_ = codec.NewGobCodec(req).Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, &Args{Num1: 1, Num2: 2})
+	conn := &truncatedConn{Reader: bytes.NewReader(append(packed.Bytes(), req.Bytes()...))}
+	server.ServeConn(conn)
+
+	cc := codec.NewGobCodec(&truncatedConn{Reader: &conn.Buffer})
+	var h codec.Header
+	var reply int
+	err := cc.ReadHeader(&h)
+	_ = cc.ReadBody(&reply)
+	_assert(err == nil && h.Seq == 1 && h.Error == "" && reply == 3, "the first request shouldn't be truncated: %+v %v", h, err)
+}
+
+func TestServer_SetMaxHeaderSize(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	serve := func(serviceMethod string) *codec.Header {
+		var frame bytes.Buffer
+		_ = BinaryOptionCodec.Encode(&frame, DefaultOption)
+		req := &truncatedConn{Reader: &frame}
+		_ = codec.NewGobCodec(req).Write(&codec.Header{ServiceMethod: serviceMethod, Seq: 1}, &Args{Num1: 1, Num2: 2})
+		conn := &truncatedConn{Reader: io.MultiReader(&frame, &req.Buffer)}
+		server.ServeConn(conn)
+		var h codec.Header
+		_ = codec.NewGobCodec(&truncatedConn{Reader: &conn.Buffer}).ReadHeader(&h)
+		return &h
+	}
+
+	h := serve("Foo.Sum")
+	_assert(h.Seq == 1 && h.Error == "", "failed to call: %+v", h)
+	h = serve(strings.Repeat("x", DefaultMaxHeaderSize))
+	_assert(h.Seq == 0 && h.Code == int(CodeCodec) && strings.Contains(h.Error, "too large"), "expect header too large, got %+v", h)
+
+	server.SetMaxHeaderSize(0)
+	h = serve(strings.Repeat("x", DefaultMaxHeaderSize))
+	_assert(h.Seq == 1 && h.Code == int(CodeServiceNotFound), "expect no limit, got %+v", h)
+}
+
+func TestServer_Serve(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	_ = server.Register(&foo)
+	tcp, _ := net.Listen("tcp", ":0")
+	mem := NewPipeListener()
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(tcp, mem) }()
+
+	tcpClient, err := Dial("tcp", tcp.Addr().String())
+	_assert(err == nil, "failed to dial tcp: %v", err)
+	defer func() { _ = tcpClient.Close() }()
+	memClient, err := DialWith(mem.Dial, "pipe", "")
+	_assert(err == nil, "failed to dial pipe: %v", err)
+	defer func() { _ = memClient.Close() }()
+
+	var reply int
+	for _, client := range []*Client{tcpClient, memClient} {
+		err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "failed to call: %v", err)
+	}
+	_assert(server.Stats()["Foo.Sum"].Calls == 2, "stats should aggregate across listeners")
+	_assert(server.NumConns() == 2, "expect 2 connections, got %d", server.NumConns())
+
+	_assert(server.Shutdown(context.Background()) == nil, "failed to shutdown")
+	select {
+	case err = <-served:
+		_assert(err == ErrServerClosed, "expect ErrServerClosed, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("Serve should return after Shutdown")
+	}
+	_, err = DialWith(mem.Dial, "pipe", "")
+	_assert(err != nil, "listener should be closed")
+	_assert(server.Accept(NewPipeListener()) == ErrServerClosed, "Accept should fail after Shutdown")
+}
+
+func TestServer_Accept(t *testing.T) {
+	server := NewServer()
+	lis := NewPipeListener()
+	accepted := make(chan error, 1)
+	go func() { accepted <- server.Accept(lis) }()
+	_ = lis.Close()
+	select {
+	case err := <-accepted:
+		_assert(errors.Is(err, net.ErrClosed), "expect the accept error, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("Accept should return once the listener is closed")
+	}
+}
+
+func TestServer_SetIdleTimeout(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Slow))
+	server.SetIdleTimeout(50 * time.Millisecond)
+	dial := func(keepAlive time.Duration) *Client {
+		opt := *DefaultOption
+		opt.KeepAlive = keepAlive
+		client, err := NewClient(pipe(server), &opt)
+		_assert(err == nil, "failed to create client: %v", err)
+		return client
+	}
+	idle, alive := dial(0), dial(20*time.Millisecond)
+	defer func() { _ = idle.Close() }()
+	defer func() { _ = alive.Close() }()
+
+	var reply int
+	err := idle.Call(context.Background(), "Slow.Sleep", 120, &reply)
+	_assert(err == nil, "connections with requests being handled aren't idle: %v", err)
+	time.Sleep(150 * time.Millisecond)
+	_assert(!idle.IsAvailable(), "idle connection should be closed")
+	_assert(alive.IsAvailable(), "connection should be kept alive by the keep-alive frames")
+	err = alive.Call(context.Background(), "Slow.Sleep", 0, &reply)
+	_assert(err == nil, "failed to call on the kept alive connection: %v", err)
+}
+
+type Store struct {
+	mu  sync.Mutex
+	err error // returned by Read in the last Put
+}
+
+func (s *Store) Put(r io.Reader, n *int64) (err error) {
+	*n, err = io.Copy(io.Discard, r)
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	return
+}
+
+func (s *Store) Head(r io.Reader, head *string) error {
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(r, buf)
+	*head = string(buf)
+	return err
+}
+
+// failingReader returns err after the data is read
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		err = f.err
+	}
+	return n, err
+}
+
+func TestServer_streamedArg(t *testing.T) {
+	var store Store
+	server := NewServer()
+	_ = server.Register(&store)
+	_ = server.Register(new(Foo))
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	for _, typ := range []codec.Type{codec.GobType, codec.MsgpackType} {
+		client, _ := NewClient(pipe(server), &Option{MagicNumber: MagicNumber, CodecType: typ})
+		var n int64
+		err := client.Call(context.Background(), "Store.Put", Stream(bytes.NewReader(data)), &n)
+		_assert(err == nil && n == int64(len(data)), "failed to stream with %s: %v %d", typ, err, n)
+		err = client.Call(context.Background(), "Store.Put", Stream(bytes.NewReader(nil)), &n)
+		_assert(err == nil && n == 0, "failed to stream an empty body with %s: %v %d", typ, err, n)
+
+		var head string
+		err = client.Call(context.Background(), "Store.Head", Stream(bytes.NewReader(data)), &head)
+		_assert(err == nil && head == "0123", "failed to read the head with %s: %v %q", typ, err, head)
+		var sum int
+		err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &sum)
+		_assert(err == nil && sum == 3, "the rest of an unread stream should be discarded with %s: %v", typ, err)
+
+		err = client.Call(context.Background(), "Store.Put", Stream(&failingReader{bytes.NewReader(data), errors.New("disk error")}), &n)
+		_assert(err != nil && strings.Contains(err.Error(), "disk error"), "expect the read error, got %v", err)
+		err = client.Call(context.Background(), "Foo.Sum", Stream(bytes.NewReader(data)), &sum)
+		_assert(errors.Is(err, ErrCodec), "expect a streamed body rejected by a method without an io.Reader arg, got %v", err)
+		err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &sum)
+		_assert(err == nil && sum == 3, "the connection should still work with %s: %v", typ, err)
+		_ = client.Close()
+	}
+	// the reply of the aborted call is dropped, so wait for the method to return
+	var putErr error
+	for i := 0; i < 100 && putErr == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		store.mu.Lock()
+		putErr = store.err
+		store.mu.Unlock()
+	}
+	_assert(putErr != nil && strings.Contains(putErr.Error(), "disk error"), "the method should see the abort, got %v", putErr)
+
+	ts := httptest.NewServer(server.Gateway())
+	defer ts.Close()
+	resp, err := http.Post(ts.URL+"/rpc/Store/Put", "application/octet-stream", bytes.NewReader(data))
+	_assert(err == nil && resp.StatusCode == http.StatusOK, "failed to stream through the gateway: %v", err)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	_assert(strings.TrimSpace(string(body)) == "1000000", "expect the size of the body, got %s", body)
+}
+
+// Blobs keeps the blobs put, they are sent back by Get and Raw
+type Blobs struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (b *Blobs) Put(r io.Reader, n *int64) error {
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, BlobReader(r))
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.data = buf.Bytes()
+	b.mu.Unlock()
+	*n = int64(buf.Len())
+	return nil
+}
+
+func (b *Blobs) stored() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.data
+}
+
+func (b *Blobs) Get(name string, w io.Writer) error {
+	if name != "blob" {
+		return errors.New("not found")
+	}
+	_, err := SendBlob(w, bytes.NewReader(b.stored()))
+	return err
+}
+
+// Raw sends the blob without its checksum
+func (b *Blobs) Raw(name string, w io.Writer) error {
+	_, err := w.Write(b.stored())
+	return err
+}
+
+// failingWriter fails after n bytes are written
+type failingWriter struct{ n int }
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if f.n -= len(p); f.n < 0 {
+		return 0, errors.New("disk full")
+	}
+	return len(p), nil
+}
+
+func TestServer_streamedReply(t *testing.T) {
+	var blobs Blobs
+	server := NewServer()
+	_ = server.Register(&blobs)
+	_ = server.Register(new(Foo))
+	blobs.data = bytes.Repeat([]byte("0123456789"), 100000)
+	for _, typ := range []codec.Type{codec.GobType, codec.MsgpackType} {
+		client, _ := NewClient(pipe(server), &Option{MagicNumber: MagicNumber, CodecType: typ})
+		var buf bytes.Buffer
+		err := client.Call(context.Background(), "Blobs.Raw", "blob", StreamTo(&buf))
+		_assert(err == nil && bytes.Equal(buf.Bytes(), blobs.data), "failed to stream the reply with %s: %v %d", typ, err, buf.Len())
+		buf.Reset()
+		err = client.Call(context.Background(), "Blobs.Get", "nope", StreamTo(&buf))
+		_assert(err != nil && err.Error() == "not found" && buf.Len() == 0, "expect the error of the method with %s, got %v", typ, err)
+
+		var s string
+		err = client.Call(context.Background(), "Blobs.Raw", "blob", &s)
+		_assert(errors.Is(err, ErrCodec), "expect an error without StreamTo with %s, got %v", typ, err)
+		err = client.Call(context.Background(), "Blobs.Raw", "blob", StreamTo(&failingWriter{n: 100000}))
+		_assert(err != nil && err.Error() == "disk full", "expect the error of the writer with %s, got %v", typ, err)
+		var sum int
+		err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &sum)
+		_assert(err == nil && sum == 3, "the connection should still work with %s: %v", typ, err)
+		_ = client.Close()
+	}
+
+	ts := httptest.NewServer(server.Gateway())
+	defer ts.Close()
+	resp, err := http.Post(ts.URL+"/rpc/Blobs/Raw", "application/json", strings.NewReader(`"blob"`))
+	_assert(err == nil && resp.StatusCode == http.StatusOK, "failed to stream through the gateway: %v", err)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	_assert(bytes.Equal(body, blobs.data) && resp.Header.Get("Content-Type") == "application/octet-stream",
+		"expect the streamed body, got %d bytes of %s", len(body), resp.Header.Get("Content-Type"))
+	resp, err = http.Post(ts.URL+"/rpc/Blobs/Get", "application/json", strings.NewReader(`"nope"`))
+	_assert(err == nil && resp.StatusCode == http.StatusInternalServerError, "expect the error of the method through the gateway: %v", err)
+	_ = resp.Body.Close()
+}
+
+func TestBlob(t *testing.T) {
+	var blobs Blobs
+	server := NewServer()
+	_ = server.Register(&blobs)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+
+	var n int64
+	err := client.Call(context.Background(), "Blobs.Put", Blob(bytes.NewReader(data)), &n)
+	_assert(err == nil && n == int64(len(data)) && bytes.Equal(blobs.stored(), data), "failed to upload the blob: %v %d", err, n)
+	var buf bytes.Buffer
+	err = client.Call(context.Background(), "Blobs.Get", "blob", BlobTo(&buf))
+	_assert(err == nil && bytes.Equal(buf.Bytes(), data), "failed to download the blob: %v %d", err, buf.Len())
+	err = client.Call(context.Background(), "Blobs.Put", Blob(bytes.NewReader(nil)), &n)
+	_assert(err == nil && n == 0, "failed to upload an empty blob: %v", err)
+	buf.Reset()
+	err = client.Call(context.Background(), "Blobs.Get", "blob", BlobTo(&buf))
+	_assert(err == nil && buf.Len() == 0, "failed to download an empty blob: %v", err)
+
+	// the data without the checksum is rejected in both directions
+	err = client.Call(context.Background(), "Blobs.Put", Stream(bytes.NewReader(data)), &n)
+	_assert(err != nil && err.Error() == ErrBlobChecksum.Error(), "expect the checksum error of the upload, got %v", err)
+	_ = client.Call(context.Background(), "Blobs.Put", Blob(bytes.NewReader(data)), &n)
+	err = client.Call(context.Background(), "Blobs.Raw", "blob", BlobTo(io.Discard))
+	_assert(errors.Is(err, ErrBlobChecksum), "expect the checksum error of the download, got %v", err)
+}
+
+type Bomb int
+
+func (b Bomb) Explode(msg string, reply *int) error {
+	panic(msg)
+}
+
+func TestServer_SetPanicHandler(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(Bomb(0))
+	client, err := NewClient(pipe(server), DefaultOption)
+	_assert(err == nil, "failed to create client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Bomb.Explode", "secret", &reply)
+	_assert(errors.Is(err, ErrInternal), "expect the internal error, got %v", err)
+	_assert(!strings.Contains(err.Error(), "secret"), "the panic shouldn't be exposed: %v", err)
+	stats, _ := server.MethodStats("Bomb.Explode")
+	_assert(stats.Errors == 1, "the panic should be counted as an error: %+v", stats)
+	_assert(client.IsAvailable(), "the connection should survive the panic")
+
+	var methods []string
+	server.SetPanicHandler(func(h *codec.Header, recovered interface{}) error {
+		methods = append(methods, h.ServiceMethod)
+		if recovered == "fatal" {
+			return CloseConn(errors.New("fatal"))
+		}
+		return fmt.Errorf("panic: %v", recovered)
+	})
+	err = client.Call(context.Background(), "Bomb.Explode", "boom", &reply)
+	_assert(err != nil && err.Error() == "panic: boom", "expect the error of the handler, got %v", err)
+	_assert(client.IsAvailable(), "the connection should survive the panic")
+	err = client.Call(context.Background(), "Bomb.Explode", "fatal", &reply)
+	_assert(err != nil && err.Error() == "fatal", "expect the error of the handler, got %v", err)
+	_assert(len(methods) == 2 && methods[0] == "Bomb.Explode", "handler should see the header: %v", methods)
+	time.Sleep(50 * time.Millisecond)
+	_assert(!client.IsAvailable(), "the connection should be closed")
+}
+
+func TestServer_Publish(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	client, err := NewClient(pipe(server), DefaultOption)
+	_assert(err == nil, "failed to create client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	received := make(chan string, 1)
+	newBody := func() interface{} { return new(string) }
+	err = client.Subscribe(context.Background(), "config", newBody, func(body interface{}) {
+		// the handler may call the client
+		var reply int
+		err := client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		received <- fmt.Sprintf("%s %d %v", *body.(*string), reply, err)
+	})
+	_assert(err == nil, "failed to subscribe: %v", err)
+	err = client.Subscribe(context.Background(), "config", newBody, func(interface{}) {})
+	_assert(err != nil, "expect an error subscribing twice")
+
+	_assert(server.Publish("cache", "x") == 0, "no connection subscribes to cache")
+	_assert(server.Publish("config", "v2") == 1, "expect the notification sent to the client")
+	select {
+	case got := <-received:
+		_assert(got == "v2 3 <nil>", "unexpected notification: %s", got)
+	case <-time.After(time.Second):
+		t.Fatal("the notification isn't received")
+	}
+
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 1}, &reply)
+	_assert(err == nil && reply == 2, "calls should work along with notifications: %v", err)
+	err = client.Unsubscribe(context.Background(), "config")
+	_assert(err == nil, "failed to unsubscribe: %v", err)
+	_assert(server.Publish("config", "v3") == 0, "the client has unsubscribed")
+}
+
+func TestServer_Publish_wrongType(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	client, err := NewClient(pipe(server), DefaultOption)
+	_assert(err == nil, "failed to create client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	newBody := func() interface{} { return new(string) }
+	err = client.Subscribe(context.Background(), "config", nil, func(interface{}) {})
+	_assert(err != nil, "expect an error subscribing without newBody")
+	err = client.Subscribe(context.Background(), "config", newBody, nil)
+	_assert(err != nil, "expect an error subscribing without handler")
+
+	received := make(chan string, 2)
+	err = client.Subscribe(context.Background(), "config", newBody, func(body interface{}) {
+		received <- *body.(*string)
+	})
+	_assert(err == nil, "failed to subscribe: %v", err)
+	_assert(server.Publish("config", Args{Num1: 1}) == 1, "expect the notification sent to the client")
+	_assert(server.Publish("config", "v2") == 1, "expect the notification sent to the client")
+	select {
+	case got := <-received:
+		_assert(got == "v2", "the notification of the wrong type should be dropped, got %q", got)
+	case <-time.After(time.Second):
+		t.Fatal("the notification isn't received")
+	}
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 1}, &reply)
+	_assert(err == nil && reply == 2 && client.IsAvailable(), "the connection should survive the wrong notification: %v", err)
+}
+
+func TestServer_AcceptWithOption(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Foo))
+	lis := NewPipeListener()
+	defer func() { _ = lis.Close() }()
+	opt := *DefaultOption
+	opt.CodecType = codec.MsgpackType
+	go func() { _ = server.AcceptWithOption(lis, &opt) }()
+
+	opt.SkipHandshake = true
+	client, err := DialWith(lis.Dial, "pipe", "", &opt)
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call without the handshake: %v", err)
+
+	// the Option of a client which doesn't skip the handshake is taken as a request
+	client, err = DialWith(lis.Dial, "pipe", "", &Option{MagicNumber: MagicNumber, CodecType: codec.MsgpackType})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = client.Call(ctx, "Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err != nil, "expect the call to fail if only the server skips the handshake")
+}
+
+type copyNode struct {
+	Name     string
+	Tags     []string
+	Attrs    map[string][]int
+	Next     *copyNode
+	Any      interface{}
+	Callback func()
+	hidden   []int
+}
+
+func TestDeepCopyValue(t *testing.T) {
+	n := &copyNode{Name: "a", Tags: []string{"x"}, Attrs: map[string][]int{"k": {1}}, Any: []byte("b"), hidden: []int{1}}
+	n.Next = n
+	c := deepCopyValue(reflect.ValueOf(n)).Interface().(*copyNode)
+	_assert(c != n && c.Next == c, "the cycle should be kept in the copy")
+	_assert(reflect.DeepEqual(c.Tags, n.Tags) && reflect.DeepEqual(c.Attrs, n.Attrs), "the copy should equal the original")
+
+	n.Tags[0], n.Attrs["k"][0], n.Any.([]byte)[0] = "y", 2, 'c'
+	_assert(c.Tags[0] == "x" && c.Attrs["k"][0] == 1 && string(c.Any.([]byte)) == "b", "the copy shouldn't share memory: %+v", c)
+	n.hidden[0] = 2
+	_assert(c.hidden[0] == 2, "unexported fields are shared")
+
+	var empty *copyNode
+	_assert(deepCopyValue(reflect.ValueOf(empty)).IsNil(), "nil should be copied as nil")
+	_assert(deepCopyValue(reflect.ValueOf(42)).Interface() == 42, "scalars should be copied by value")
+}
+
+func TestServer_SetFlushPolicy(t *testing.T) {
+	for _, policy := range []FlushPolicy{
+		{Mode: FlushEachResponse},
+		{Mode: FlushOnIdle},
+		{Mode: FlushOnThreshold, MaxCount: 4, MaxDelay: 50 * time.Millisecond},
+		{Mode: FlushOnThreshold, MaxBytes: 1 << 20, MaxDelay: 50 * time.Millisecond},
+	} {
+		server := NewServer()
+		_ = server.Register(new(Foo))
+		server.SetFlushPolicy(policy)
+		client := NewInProcess(server)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 32; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var reply int
+				err := client.Call(context.Background(), "Foo.Sum", Args{Num1: i, Num2: i}, &reply)
+				_assert(err == nil && reply == 2*i, "policy %+v: failed to call: %v", policy, err)
+			}(i)
+		}
+		wg.Wait()
+
+		start := time.Now()
+		var reply int
+		err := client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 1}, &reply)
+		_assert(err == nil && reply == 2, "policy %+v: failed to call: %v", policy, err)
+		if elapsed := time.Since(start); policy.Mode == FlushOnThreshold {
+			_assert(elapsed >= 40*time.Millisecond, "policy %+v: a single response should wait for MaxDelay, took %s", policy, elapsed)
+		} else {
+			_assert(elapsed < 40*time.Millisecond, "policy %+v: a single response should be flushed at once, took %s", policy, elapsed)
+		}
+		_ = client.Close()
+	}
+}
+
+// unflushable buffers the responses but fails to flush them
+type unflushable struct {
+	codec.Codec
+	closed int32
+}
+
+func (u *unflushable) WriteBuffered(*codec.Header, interface{}) error { return nil }
+func (u *unflushable) Flush() error                                   { return errors.New("broken pipe") }
+func (u *unflushable) Close() error {
+	atomic.AddInt32(&u.closed, 1)
+	return nil
+}
+
+func TestServer_SetFlushPolicy_flushError(t *testing.T) {
+	server := NewServer()
+	server.SetFlushPolicy(FlushPolicy{Mode: FlushOnThreshold, MaxCount: 4, MaxDelay: 10 * time.Millisecond})
+	u := &unflushable{}
+	cc := server.withFlushPolicy(&serverConn{}, u)
+	err := cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, 2)
+	_assert(err == nil, "the response should be buffered: %v", err)
+
+	// 定时器触发的刷新失败后关闭连接，之后的写入返回该错误
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&u.closed) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	_assert(atomic.LoadInt32(&u.closed) == 1, "the connection should be closed once the flush fails")
+	err = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, 2)
+	_assert(err != nil && err.Error() == "broken pipe", "expect the flush error, got %v", err)
+	_ = cc.Close()
+	_assert(atomic.LoadInt32(&u.closed) == 1, "the connection should be closed only once")
+}
+
+// BenchmarkServer_FlushPolicy compares the flush policies under concurrent calls on one connection
+func BenchmarkServer_FlushPolicy(b *testing.B) {
+	for _, c := range []struct {
+		name   string
+		policy FlushPolicy
+	}{
+		{"each", FlushPolicy{Mode: FlushEachResponse}},
+		{"idle", FlushPolicy{Mode: FlushOnIdle}},
+		{"count=16", FlushPolicy{Mode: FlushOnThreshold, MaxCount: 16}},
+	} {
+		policy := c.policy
+		b.Run(c.name, func(b *testing.B) {
+			var foo Foo
+			server := NewServer()
+			_ = server.Register(&foo)
+			server.SetFlushPolicy(policy)
+			lis, _ := net.Listen("tcp", "127.0.0.1:0")
+			defer func() { _ = lis.Close() }()
+			go func() { _ = server.Accept(lis) }()
+			client, err := Dial("tcp", lis.Addr().String())
+			_assert(err == nil, "failed to dial: %v", err)
+			defer func() { _ = client.Close() }()
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var reply int
+				for pb.Next() {
+					_ = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+				}
+			})
+		})
+	}
+}
+
+// Identity reports the transport of the caller, see ConnFromContext and TLSFromContext
+type Identity int
+
+func (Identity) Who(ctx context.Context, _ int, reply *string) error {
+	_, network := ConnFromContext(ctx)
+	state, secure := TLSFromContext(ctx)
+	certs := 0
+	if secure {
+		certs = len(state.PeerCertificates)
+	}
+	*reply = fmt.Sprintf("conn=%v tls=%v certs=%d", network, secure, certs)
+	return nil
+}
+
+func TestServer_TLSFromContext(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Identity))
+	var reply string
+	client := NewInProcess(server)
+	err := client.Call(context.Background(), "Identity.Who", 0, &reply)
+	_ = client.Close()
+	_assert(err == nil && reply == "conn=false tls=false certs=0", "a pipe isn't a network connection: %s %v", reply, err)
+
+	// borrow the certificate of httptest for both sides
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	ts.Close()
+	cert := ts.TLS.Certificates[0]
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequireAnyClientCert})
+	_assert(err == nil, "failed to listen: %v", err)
+	defer func() { _ = lis.Close() }()
+	go func() { _ = server.Accept(lis) }()
+
+	config := ts.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.Certificates = []tls.Certificate{cert}
+	client, err = DialWith(func(network, address string) (net.Conn, error) {
+		return tls.Dial(network, address, config)
+	}, "tcp", lis.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	err = client.Call(context.Background(), "Identity.Who", 0, &reply)
+	_assert(err == nil && reply == "conn=true tls=true certs=1", "expect the certificate of the client: %s %v", reply, err)
+}
+
+func TestServer_SetMaxRequestsPerConn(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Slow))
+	server.SetMaxRequestsPerConn(3)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	_assert(client.Ping(context.Background()) == nil, "failed to ping")
+	calls := make([]*Call, 3)
+	for i := range calls {
+		calls[i] = client.Go("Slow.Sleep", 50, new(int), nil)
+	}
+	for _, call := range calls {
+		<-call.Done
+		_assert(call.Error == nil, "requests read before the limit should be replied: %v", call.Error)
+	}
+	time.Sleep(20 * time.Millisecond)
+	_assert(!client.IsAvailable(), "the connection should be closed once the limit is reached")
+	var reply int
+	err := client.Call(context.Background(), "Slow.Sleep", 0, &reply)
+	_assert(err != nil, "expect an error calling over the closed connection")
+
+	// rejected requests are counted too
+	client = NewInProcess(server)
+	defer func() { _ = client.Close() }()
+	for i := 0; i < 3; i++ {
+		err = client.Call(context.Background(), "Slow.Missing", 0, &reply)
+		_assert(errors.Is(err, ErrMethodNotFound), "expect the method not found error, got %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	_assert(!client.IsAvailable(), "the connection should be closed once invalid requests reach the limit")
+}
@@ -1,28 +1,60 @@
 package simple_rpc
 
 import (
+	"context"
+	"fmt"
 	"go/ast"
+	"io"
 	"log"
 	"reflect"
+	"sort"
 	"sync/atomic"
+	"time"
 )
 
 // 每一个 methodType 实例包含了一个方法的完整信息。包括
 // method：方法本身
 // ArgType：第一个参数的类型
 // ReplyType：第二个参数的类型
+// ReplyTypes：所有返回值参数的类型，只有一个返回值参数时即 [ReplyType]
+// replyStruct：有多个返回值参数时，用于整体序列化的复合结构体类型，只有一个时为 nil
 // numCalls：后续统计方法调用次数时会用到
+// numErrors：方法返回错误的次数
+// withCtx：方法的第一个参数是否为 context.Context
+// bytesRead、bytesWritten：请求和响应的累计字节数
+// latency、latencySum：方法执行耗时的直方图，按 latencyBuckets 分桶，以及耗时的总和（纳秒）
+// expLatency：用于估算分位数的指数分桶直方图，见 expBuckets
 type methodType struct {
-	method    reflect.Method
-	ArgType   reflect.Type
-	ReplyType reflect.Type
-	numCalls  uint64
+	method       reflect.Method
+	ArgType      reflect.Type
+	ReplyType    reflect.Type
+	ReplyTypes   []reflect.Type
+	replyStruct  reflect.Type
+	withCtx      bool
+	numCalls     uint64
+	numErrors    uint64
+	bytesRead    uint64
+	bytesWritten uint64
+	latency      [len(latencyBuckets) + 1]uint64
+	latencySum   int64
+	expLatency   [expBuckets + 1]uint64
 }
 
 func (m *methodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+func (m *methodType) NumErrors() uint64 {
+	return atomic.LoadUint64(&m.numErrors)
+}
+
+// streamsReply reports whether the reply of the method is an io.Writer streaming the response, see StreamTo
+func (m *methodType) streamsReply() bool {
+	return m.ReplyType == typeOfWriter
+}
+
+// newArgV 创建入参实例，入参可以是值类型或指针类型，也可以直接是 slice 或 map，例如 []Item、map[string]int。
+// map 类型的入参会被初始化为空 map，即使请求的 body 没有解码出任何元素，方法中也可以安全地写入。
 func (m *methodType) newArgV() reflect.Value {
 	var argv reflect.Value
 	// arg may be a pointer type, or a value type
@@ -31,21 +63,56 @@ func (m *methodType) newArgV() reflect.Value {
 	} else {
 		argv = reflect.New(m.ArgType).Elem()
 	}
+	if v := reflect.Indirect(argv); v.Kind() == reflect.Map {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
 	return argv
 }
 
+// newReplyV 创建返回值实例，map 和 slice 会被预先初始化。
+// newArgV 和 newReplyV 每次请求都会创建全新的实例，并发处理同一个方法的多个请求时互不共享，
+// 方法即使保留了 reply 的引用，也不会被后续的请求复用。
+// 有多个返回值参数时，返回指向复合结构体的指针，结构体的各个字段分别指向一个新创建的返回值。
 func (m *methodType) newReplyV() reflect.Value {
+	if m.replyStruct == nil {
+		return newReply(m.ReplyType)
+	}
+	replyV := reflect.New(m.replyStruct)
+	for i, t := range m.ReplyTypes {
+		replyV.Elem().Field(i).Set(newReply(t))
+	}
+	return replyV
+}
+
+func newReply(t reflect.Type) reflect.Value {
+	if t == typeOfWriter {
+		// the writer streaming the response is set when the request is handled, see StreamTo
+		replyV := reflect.New(typeOfWriter).Elem()
+		replyV.Set(reflect.ValueOf(io.Discard))
+		return replyV
+	}
 	// reply must be a pointer type
-	replyV := reflect.New(m.ReplyType.Elem())
-	switch m.ReplyType.Elem().Kind() {
+	replyV := reflect.New(t.Elem())
+	switch t.Elem().Kind() {
 	case reflect.Map:
-		replyV.Elem().Set(reflect.MakeMap(m.ReplyType.Elem()))
+		replyV.Elem().Set(reflect.MakeMap(t.Elem()))
 	case reflect.Slice:
-		replyV.Elem().Set(reflect.MakeSlice(m.ReplyType.Elem(), 0, 0))
+		replyV.Elem().Set(reflect.MakeSlice(t.Elem(), 0, 0))
 	}
 	return replyV
 }
 
+// replyStructOf returns the composite type of multiple replies, its fields R0, R1... are the replies in order.
+// 服务端和客户端使用相同的结构构造复合 body，字段均为指针，编码时序列化的是指针指向的值，
+// 因此客户端解码时可以直接写入调用方传入的指针。
+func replyStructOf(types []reflect.Type) reflect.Type {
+	fields := make([]reflect.StructField, len(types))
+	for i, t := range types {
+		fields[i] = reflect.StructField{Name: fmt.Sprintf("R%d", i), Type: t}
+	}
+	return reflect.StructOf(fields)
+}
+
 // service 的定义也是非常简洁的，name 即映射的结构体的名称，
 // 比如 T，比如 WaitGroup；typ 是结构体的类型；rcv 即结构体的实例本身，保留 rcv 是因为在调用时需要 rcv 作为第 0 个参数；
 // method 是 map 类型，存储映射的结构体的所有符合条件的方法。
@@ -57,51 +124,177 @@ type service struct {
 }
 
 // 构造函数 newService，入参是任意需要映射为服务的结构体实例。
+// rcv 不能作为服务时直接退出，注册时应当使用返回错误的 buildService。
 func newService(rcv interface{}) *service {
-	s := new(service)
-	s.rcv = reflect.ValueOf(rcv)
-	s.name = reflect.Indirect(s.rcv).Type().Name()
-	s.typ = reflect.TypeOf(rcv)
-	if !ast.IsExported(s.name) {
-		log.Fatalf("rpc server: %s is not a valid service name", s.name)
+	s, err := buildService(rcv)
+	if err != nil {
+		log.Fatal("rpc server: ", err)
 	}
+	return s
+}
+
+// buildService is like newService, but it returns an error if rcv can't be a service,
+// eg, rcv is nil or its type isn't exported.
+func buildService(rcv interface{}) (*service, error) {
+	v := reflect.ValueOf(rcv)
+	if !v.IsValid() || v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, fmt.Errorf("rpc: can't register nil receiver %T", rcv)
+	}
+	name := reflect.Indirect(v).Type().Name()
+	if !ast.IsExported(name) {
+		return nil, fmt.Errorf("rpc: %T is not a valid service, the type must be named and exported", rcv)
+	}
+	return newNamedService(rcv, name), nil
+}
+
+// newNamedService is like newService, but the service is named by the caller instead of the type of rcv
+func newNamedService(rcv interface{}, name string) *service {
+	s := &service{name: name, typ: reflect.TypeOf(rcv), rcv: reflect.ValueOf(rcv)}
 	s.registerMethods()
 	return s
 }
 
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
 // registerMethods 过滤出了符合条件的方法：
 // 两个导出或内置类型的入参（反射时为 3 个，第 0 个是自身，类似于 python 的 self，java 中的 this）
+// 入参前可以额外带一个 context.Context，用于获取调用方地址等请求相关的信息
+// 第二个参数之后可以有更多指针类型的返回值参数，例如 func (t *T) DivMod(args Args, quo *int, rem *int) error，
+// 因此 NumIn 至少为 3（带 context 时至少为 4），多出的每个入参都是一个返回值，它们作为一个复合 body 整体返回
 // 返回值有且只有 1 个，类型为 error
+// 方法集遵循 Go 的规则：注册 *T 时包含指针接收者的方法以及嵌入字段提升的方法，注册 T 时只包含值接收者的方法，
+// 因此注册 T 时如果存在符合条件的指针接收者方法，会打印提示，而不是静默忽略。
 func (s *service) registerMethods() {
 	s.method = make(map[string]*methodType)
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
-		mType := method.Type
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		mType := newMethodType(method)
+		if mType == nil {
 			continue
 		}
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
-			continue
+		s.method[method.Name] = mType
+		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
+	}
+	if s.typ.Kind() != reflect.Ptr {
+		ptr := reflect.PointerTo(s.typ)
+		for i := 0; i < ptr.NumMethod(); i++ {
+			method := ptr.Method(i)
+			if s.method[method.Name] == nil && newMethodType(method) != nil {
+				log.Printf("rpc server: %s.%s has pointer receiver, register a pointer to expose it\n", s.name, method.Name)
+			}
 		}
-		argType, replyType := mType.In(1), mType.In(2)
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+	}
+	if mapper, ok := s.rcv.Interface().(RpcMethodMapper); ok {
+		s.renameMethods(mapper.RpcMethods())
+	}
+}
+
+// RpcMethodMapper is implemented by services which expose methods under names
+// different from the Go method names, so renaming a Go method doesn't break clients.
+// RpcMethods 返回 Go 方法名到对外名称的映射，未出现在映射中的方法仍使用 Go 方法名。
+// 映射优先：被映射的方法只能通过新名称调用；如果新名称与另一个方法的默认名称相同，映射的方法会覆盖后者。
+type RpcMethodMapper interface {
+	RpcMethods() map[string]string
+}
+
+// renameMethods exposes the methods under the names in mapping
+func (s *service) renameMethods(mapping map[string]string) {
+	goNames := make([]string, 0, len(mapping))
+	for goName := range mapping {
+		goNames = append(goNames, goName)
+	}
+	sort.Strings(goNames)
+	methods := make(map[string]*methodType, len(s.method))
+	for name, m := range s.method {
+		if _, ok := mapping[name]; !ok {
+			methods[name] = m
+		}
+	}
+	for _, goName := range goNames {
+		wireName := mapping[goName]
+		m := s.method[goName]
+		if m == nil {
+			log.Printf("rpc server: can't rename %s.%s, no such method\n", s.name, goName)
 			continue
 		}
-		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+		if old := methods[wireName]; old != nil {
+			log.Printf("rpc server: %s.%s shadows %s.%s\n", s.name, goName, s.name, old.method.Name)
 		}
-		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
+		methods[wireName] = m
+		log.Printf("rpc server: expose %s.%s as %s.%s\n", s.name, goName, s.name, wireName)
+	}
+	s.method = methods
+}
+
+// newMethodType returns nil if method is not suitable to be an rpc method
+func newMethodType(method reflect.Method) *methodType {
+	mType := method.Type
+	if mType.NumOut() != 1 || mType.Out(0) != typeOfError {
+		return nil
 	}
+	withCtx := mType.NumIn() >= 4 && mType.In(1) == typeOfContext
+	argIndex := 1
+	if withCtx {
+		argIndex = 2
+	}
+	if mType.NumIn() < argIndex+2 {
+		return nil
+	}
+	argType := mType.In(argIndex)
+	if !isExportedOrBuiltinType(argType) {
+		return nil
+	}
+	var replyTypes []reflect.Type
+	for i := argIndex + 1; i < mType.NumIn(); i++ {
+		replyType := mType.In(i)
+		if !isExportedOrBuiltinType(replyType) {
+			return nil
+		}
+		// all replies but the only one must be pointers
+		if i > argIndex+1 && replyType.Kind() != reflect.Ptr {
+			return nil
+		}
+		replyTypes = append(replyTypes, replyType)
+	}
+	m := &methodType{
+		method:     method,
+		ArgType:    argType,
+		ReplyType:  replyTypes[0],
+		ReplyTypes: replyTypes,
+		withCtx:    withCtx,
+	}
+	if len(replyTypes) > 1 {
+		if replyTypes[0].Kind() != reflect.Ptr {
+			return nil
+		}
+		m.replyStruct = replyStructOf(replyTypes)
+	}
+	return m
 }
 
 // call 方法，即能够通过反射值调用方法。
-func (s *service) call(m *methodType, argv, reply reflect.Value) error {
+func (s *service) call(ctx context.Context, m *methodType, argv, reply reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
 	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.rcv, argv, reply})
+	in := []reflect.Value{s.rcv, argv}
+	if m.withCtx {
+		in = []reflect.Value{s.rcv, reflect.ValueOf(ctx), argv}
+	}
+	if m.replyStruct == nil {
+		in = append(in, reply)
+	} else {
+		for i := range m.ReplyTypes {
+			in = append(in, reply.Elem().Field(i))
+		}
+	}
+	start := time.Now()
+	returnValues := f.Call(in)
+	m.observeLatency(time.Since(start))
 	if errInter := returnValues[0].Interface(); errInter != nil {
+		atomic.AddUint64(&m.numErrors, 1)
 		return errInter.(error)
 	}
 	return nil
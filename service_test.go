@@ -1,8 +1,15 @@
 package simple_rpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"reflect"
+	"simple_rpc/codec"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -44,6 +51,334 @@ func TestMethodType_Call(t *testing.T) {
 	argv := mType.newArgV()
 	replyV := mType.newReplyV()
 	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 3}))
-	err := s.call(mType, argv, replyV)
+	err := s.call(context.Background(), mType, argv, replyV)
 	_assert(err == nil && *replyV.Interface().(*int) == 4 && mType.NumCalls() == 1, "failed to call Foo.Sum")
 }
+
+// Peer 的第一个参数为 context.Context，通过 PeerFromContext 获取调用方地址。
+type Peer int
+
+func (p Peer) Addr(ctx context.Context, args int, reply *string) error {
+	if addr, ok := PeerFromContext(ctx); ok {
+		*reply = addr.String()
+	}
+	return nil
+}
+
+func TestMethodType_CallWithContext(t *testing.T) {
+	var p Peer
+	s := newService(&p)
+	mType := s.method["Addr"]
+	_assert(mType != nil && mType.withCtx, "wrong Method, Addr should take a context")
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9999}
+	argv := mType.newArgV()
+	replyV := mType.newReplyV()
+	err := s.call(withPeer(context.Background(), addr), mType, argv, replyV)
+	_assert(err == nil && *replyV.Interface().(*string) == addr.String(), "failed to call Peer.Addr")
+}
+
+func (p Peer) Request(ctx context.Context, args int, reply *string) error {
+	*reply = fmt.Sprintf("%s#%d", MethodFromContext(ctx), SeqFromContext(ctx))
+	return nil
+}
+
+func TestServer_requestContext(t *testing.T) {
+	var p Peer
+	server := NewServer()
+	_ = server.Register(&p)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	for seq := 1; seq <= 2; seq++ {
+		err := client.Call(context.Background(), "Peer.Request", 0, &reply)
+		_assert(err == nil && reply == fmt.Sprintf("Peer.Request#%d", seq), "expect the request in the context, got %q: %v", reply, err)
+	}
+	_assert(SeqFromContext(context.Background()) == 0 && MethodFromContext(context.Background()) == "", "expect zero values without a request")
+}
+
+// Coll 的方法直接以 slice 和 map 作为入参。
+type Coll int
+
+type Item struct {
+	Name  string
+	Count int
+}
+
+func (c Coll) SumSlice(items []Item, reply *int) error {
+	for _, item := range items {
+		*reply += item.Count
+	}
+	return nil
+}
+
+func (c Coll) SumMap(counts map[string]int, reply *int) error {
+	for _, n := range counts {
+		*reply += n
+	}
+	counts["visited"] = 1 // arg map must be writable
+	return nil
+}
+
+func TestMethodType_CompositeArg(t *testing.T) {
+	var c Coll
+	s := newService(&c)
+	argv := s.method["SumMap"].newArgV()
+	_assert(!argv.IsNil(), "map arg should be initialized")
+
+	server := NewServer()
+	_ = server.Register(&c)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err := client.Call(context.Background(), "Coll.SumSlice", []Item{{"a", 1}, {"b", 2}}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Coll.SumSlice: %v", err)
+	reply = 0
+	err = client.Call(context.Background(), "Coll.SumMap", map[string]int{"a": 3, "b": 4}, &reply)
+	_assert(err == nil && reply == 7, "failed to call Coll.SumMap: %v", err)
+	reply = 0
+	err = client.Call(context.Background(), "Coll.SumMap", map[string]int{}, &reply)
+	_assert(err == nil && reply == 0, "failed to call Coll.SumMap with an empty map: %v", err)
+}
+
+// Counts 返回 map 类型的结果，用于并发调用时检查 reply 之间是否存在共享，需配合 -race 运行。
+func (c Coll) Counts(n int, reply *map[string]int) error {
+	for i := 0; i < n; i++ {
+		(*reply)[strconv.Itoa(i)] = i
+	}
+	return nil
+}
+
+func TestMethodType_ConcurrentMapReply(t *testing.T) {
+	var c Coll
+	server := NewServer()
+	_ = server.Register(&c)
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			var reply map[string]int
+			err := client.Call(context.Background(), "Coll.Counts", n, &reply)
+			if err != nil || len(reply) != n {
+				t.Errorf("expect %d entries, but got %d: %v", n, len(reply), err)
+			}
+		}(i % 10)
+	}
+	wg.Wait()
+}
+
+// 嵌入字段的方法会被提升，指针接收者的方法只有注册指针时才会暴露。
+type Base struct{ n int }
+
+func (b *Base) Incr(delta int, reply *int) error {
+	b.n += delta
+	*reply = b.n
+	return nil
+}
+
+func (b Base) Get(_ int, reply *int) error {
+	*reply = b.n
+	return nil
+}
+
+type Embed struct{ Base }
+
+type EmbedPtr struct{ *Base }
+
+func TestNewService_Embedded(t *testing.T) {
+	s := newService(&Embed{})
+	_assert(s.name == "Embed" && s.method["Incr"] != nil && s.method["Get"] != nil, "*Embed should have Incr and Get")
+	s = newService(Embed{})
+	_assert(s.method["Incr"] == nil && s.method["Get"] != nil, "Embed shouldn't expose pointer receiver method Incr")
+	s = newService(EmbedPtr{Base: &Base{}})
+	_assert(s.method["Incr"] != nil && s.method["Get"] != nil, "EmbedPtr should have Incr and Get")
+
+	s = newService(&Embed{})
+	var reply int
+	argv, replyV := s.method["Incr"].newArgV(), reflect.ValueOf(&reply)
+	argv.SetInt(2)
+	_ = s.call(context.Background(), s.method["Incr"], argv, replyV)
+	_ = s.call(context.Background(), s.method["Incr"], argv, replyV)
+	_assert(reply == 4, "pointer receiver should mutate the registered value, got %d", reply)
+}
+
+// Renamed 通过 RpcMethods 将 Go 方法名映射为对外的名称。
+type Renamed int
+
+func (r Renamed) RpcMethods() map[string]string {
+	return map[string]string{"AddV2": "Add", "Legacy": "Old", "Missing": "Nope"}
+}
+
+func (r Renamed) AddV2(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func (r Renamed) Add(args Args, reply *int) error {
+	*reply = -1
+	return nil
+}
+
+func (r Renamed) Legacy(_ int, reply *int) error { return nil }
+
+func (r Renamed) Same(_ int, reply *int) error { return nil }
+
+func TestNewService_RpcMethods(t *testing.T) {
+	s := newService(Renamed(0))
+	_assert(len(s.method) == 3, "expect 3 methods, got %d", len(s.method))
+	_assert(s.method["Add"] != nil && s.method["Add"].method.Name == "AddV2", "Add should be AddV2, which shadows the Go method Add")
+	_assert(s.method["Old"] != nil && s.method["Legacy"] == nil, "Legacy should only be exposed as Old")
+	_assert(s.method["Same"] != nil && s.method["AddV2"] == nil, "unmapped methods keep their names")
+}
+
+// Calc 的方法有多个返回值参数。
+type Calc int
+
+func (c Calc) DivMod(args Args, quo *int, rem *int) error {
+	if args.Num2 == 0 {
+		return errors.New("divide by zero")
+	}
+	*quo, *rem = args.Num1/args.Num2, args.Num1%args.Num2
+	return nil
+}
+
+func (c Calc) Split(ctx context.Context, s string, n *int, words *[]string) error {
+	*words = strings.Fields(s)
+	*n = len(*words)
+	return nil
+}
+
+// not an rpc method, the extra reply isn't a pointer
+func (c Calc) Bad(args Args, quo *int, rem int) error { return nil }
+
+func TestMethodType_MultipleReplies(t *testing.T) {
+	var c Calc
+	s := newService(&c)
+	_assert(len(s.method) == 2 && s.method["Bad"] == nil, "expect DivMod and Split, got %d methods", len(s.method))
+	mType := s.method["DivMod"]
+	_assert(len(mType.ReplyTypes) == 2 && mType.ReplyType == mType.ReplyTypes[0], "wrong reply types %v", mType.ReplyTypes)
+
+	argv := mType.newArgV()
+	argv.Set(reflect.ValueOf(Args{Num1: 7, Num2: 2}))
+	replyV := mType.newReplyV()
+	err := s.call(context.Background(), mType, argv, replyV)
+	_assert(err == nil && *replyV.Elem().Field(0).Interface().(*int) == 3 &&
+		*replyV.Elem().Field(1).Interface().(*int) == 1, "failed to call Calc.DivMod: %v", err)
+
+	server := NewServer()
+	_ = server.Register(&c)
+	for _, typ := range []codec.Type{codec.GobType, codec.MsgpackType} {
+		client, _ := NewClient(pipe(server), &Option{MagicNumber: MagicNumber, CodecType: typ})
+		var quo, rem, n int
+		var words []string
+		err = client.Call(context.Background(), "Calc.DivMod", Args{Num1: 7, Num2: 2}, Replies{&quo, &rem})
+		_assert(err == nil && quo == 3 && rem == 1, "failed to call Calc.DivMod with %s: %v", typ, err)
+		err = client.Call(context.Background(), "Calc.Split", "a b c", Replies{&n, &words})
+		_assert(err == nil && n == 3 && reflect.DeepEqual(words, []string{"a", "b", "c"}), "failed to call Calc.Split with %s: %v", typ, err)
+		err = client.Call(context.Background(), "Calc.DivMod", Args{Num1: 1}, Replies{&quo, &rem})
+		_assert(err != nil && err.Error() == "divide by zero", "expect the error of the method, got %v", err)
+		_ = client.Close()
+	}
+}
+
+type UserService struct{ version string }
+
+func (u *UserService) Get(id int, reply *string) error {
+	*reply = fmt.Sprintf("%s user %d", u.version, id)
+	return nil
+}
+
+func TestServer_RegisterVersion(t *testing.T) {
+	server := NewServer()
+	_assert(server.RegisterVersion(&UserService{version: "v1"}, "V1") == nil, "failed to register V1")
+	_assert(server.RegisterVersion(&UserService{version: "v2"}, "V2") == nil, "failed to register V2")
+	_assert(server.RegisterVersion(&UserService{}, "V2") != nil, "duplicated version should be rejected")
+	_assert(server.RegisterVersion(&UserService{}, "v.2") != nil, "invalid version should be rejected")
+
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+	var reply string
+	for _, v := range []string{"v1", "v2"} {
+		err := client.Call(context.Background(), "UserService.Get"+strings.ToUpper(v), 7, &reply)
+		_assert(err == nil && reply == v+" user 7", "failed to call %s: %v %q", v, err, reply)
+	}
+	err := client.Call(context.Background(), "UserService.Get", 7, &reply)
+	_assert(errors.Is(err, ErrMethodNotFound), "unversioned method shouldn't exist: %v", err)
+
+	_assert(server.Register(&UserService{version: "v0"}) == nil, "failed to register the unversioned service")
+	err = client.Call(context.Background(), "UserService.Get", 7, &reply)
+	_assert(err == nil && reply == "v0 user 7", "failed to call the unversioned service: %v", err)
+
+	_assert(server.Unregister("UserService@V1") == nil, "failed to unregister V1")
+	err = client.Call(context.Background(), "UserService.GetV1", 7, &reply)
+	_assert(errors.Is(err, ErrMethodNotFound), "V1 should be unregistered: %v", err)
+}
+
+func TestServer_RegisterExtend(t *testing.T) {
+	server := NewServer()
+	_assert(server.RegisterName("Math", new(Foo)) == nil, "failed to register Math")
+	_assert(server.RegisterName("Ma.th", new(Foo)) != nil, "invalid service name should be rejected")
+	_assert(server.RegisterExtend("Math", Calc(0)) == nil, "failed to extend Math with Calc")
+	_assert(server.RegisterExtend("Math", &UserService{version: "v1"}) == nil, "failed to extend Math with UserService")
+	err := server.RegisterExtend("Math", Base{})
+	_assert(err != nil && strings.Contains(err.Error(), "Math.Get"), "duplicated method should be rejected, got %v", err)
+	_assert(server.RegisterExtend("Missing", Calc(0)) != nil, "extending an unknown service should be rejected")
+
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+	var sum, quo, rem int
+	var user string
+	_assert(client.Call(context.Background(), "Math.Sum", Args{Num1: 1, Num2: 2}, &sum) == nil && sum == 3, "failed to call Math.Sum")
+	_assert(client.Call(context.Background(), "Math.DivMod", Args{Num1: 7, Num2: 2}, Replies{&quo, &rem}) == nil && quo == 3 && rem == 1, "failed to call Math.DivMod")
+	_assert(client.Call(context.Background(), "Math.Get", 7, &user) == nil && user == "v1 user 7", "failed to call Math.Get")
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &sum)
+	_assert(errors.Is(err, ErrServiceNotFound), "Foo shouldn't be registered under its type name: %v", err)
+
+	_assert(server.Unregister("Math@Calc") == nil, "failed to unregister the extension")
+	err = client.Call(context.Background(), "Math.DivMod", Args{Num1: 7, Num2: 2}, Replies{&quo, &rem})
+	_assert(errors.Is(err, ErrMethodNotFound), "DivMod should be unregistered: %v", err)
+}
+
+func TestServer_RegisterWithMethods(t *testing.T) {
+	server := NewServer()
+	_assert(server.RegisterWithMethods(new(Base), "Missing") != nil, "unknown method should be rejected")
+	_assert(server.RegisterWithMethods(new(Base), "Get") == nil, "failed to register Base")
+	client := NewInProcess(server)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err := client.Call(context.Background(), "Base.Get", 0, &reply)
+	_assert(err == nil, "failed to call the exposed method: %v", err)
+	err = client.Call(context.Background(), "Base.Incr", 1, &reply)
+	_assert(errors.Is(err, ErrMethodNotFound), "expect the excluded method not found, got %v", err)
+
+	server = NewServer()
+	_assert(server.RegisterWithMethods(new(Base)) == nil, "failed to register Base")
+	_, _, err = server.findService("Base.Incr")
+	_assert(err == nil, "all eligible methods should be exposed without names: %v", err)
+}
+
+type unexported int
+
+func (u unexported) Get(_ int, reply *int) error { return nil }
+
+func TestServer_RegisterAll(t *testing.T) {
+	server := NewServer()
+	var nilFoo *Foo
+	err := server.RegisterAll(new(Foo), new(Foo), nilFoo, unexported(0), new(Base))
+	var re *RegisterError
+	_assert(errors.As(err, &re) && len(re.Errors) == 3, "expect 3 errors, got %v", err)
+	for i, want := range []string{"#1 (*simple_rpc.Foo)", "#2 (*simple_rpc.Foo)", "#3 (simple_rpc.unexported)"} {
+		_assert(strings.Contains(re.Errors[i].Error(), want), "error %d should name the receiver %s: %v", i, want, re.Errors[i])
+	}
+	_assert(strings.Contains(err.Error(), "already defined"), "the cause should be reported: %v", err)
+	_, _, err = server.findService("Base.Get")
+	_assert(err == nil, "receivers after the failed ones should be registered: %v", err)
+	_assert(server.RegisterAll(new(Calc)) == nil, "expect nil if all receivers are registered")
+}
@@ -0,0 +1,120 @@
+package simple_rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"simple_rpc/codec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serverConn is a connection being served.
+// Shutdown 通过 drain 通知连接停止读取新的请求：设置已读取的截止时间唤醒阻塞在 ReadHeader 上的读循环，
+// 读循环退出后 wg.Wait() 仍会等待已读取的请求处理完成并回复，最后关闭连接，客户端看到的是干净的 EOF。
+// 不支持 SetReadDeadline 的连接只能在读取到下一个请求后退出。
+// name 用于在统计中区分连接，通常是客户端的地址；inflight 是该连接上正在处理的请求数。
+type serverConn struct {
+	rwc      io.ReadWriteCloser
+	ctx      context.Context
+	name     string
+	draining int32
+	inflight int64
+	active   int64 // unix nano of the last activity, see SetIdleTimeout
+	cc       codec.Codec
+	sending  *sync.Mutex
+	topics   sync.Map // topic -> struct{}, see Publish
+}
+
+func (c *serverConn) drain() {
+	atomic.StoreInt32(&c.draining, 1)
+	if d, ok := c.rwc.(interface{ SetReadDeadline(time.Time) error }); ok {
+		_ = d.SetReadDeadline(time.Now())
+	}
+}
+
+func (c *serverConn) isDraining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// trackConn adds or removes c from the active connections,
+// it returns false if the server is shutting down and c can't be added.
+func (server *Server) trackConn(c *serverConn, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.activeConns, c)
+		return true
+	}
+	if server.shuttingDown() {
+		return false
+	}
+	if server.activeConns == nil {
+		server.activeConns = make(map[*serverConn]struct{})
+	}
+	server.activeConns[c] = struct{}{}
+	return true
+}
+
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.listeners, lis)
+		return true
+	}
+	if server.shuttingDown() {
+		return false
+	}
+	if server.listeners == nil {
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	server.listeners[lis] = struct{}{}
+	return true
+}
+
+func (server *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&server.inShutdown) == 1
+}
+
+// ErrServerClosed is returned by Accept and Serve after Shutdown.
+var ErrServerClosed = errors.New("rpc server: server closed")
+
+const shutdownPollInterval = time.Millisecond * 50
+
+// Shutdown gracefully shuts down the server: it closes all listeners,
+// stops reading new requests on every connection, and waits until the requests
+// already read are replied and the connections are closed, or ctx is done.
+// Once all connections are closed, services are unregistered in the reverse order
+// of registration, and the first error returned by RpcClose is returned.
+// Services are not closed if ctx is done first, since requests may still be handled.
+func (server *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&server.inShutdown, 1)
+	server.mu.Lock()
+	for lis := range server.listeners {
+		_ = lis.Close()
+		delete(server.listeners, lis)
+	}
+	for c := range server.activeConns {
+		c.drain()
+	}
+	server.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		server.mu.Lock()
+		n := len(server.activeConns)
+		server.mu.Unlock()
+		if n == 0 {
+			return server.unregisterAll()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
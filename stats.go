@@ -0,0 +1,175 @@
+package simple_rpc
+
+import (
+	"math"
+	"simple_rpc/codec"
+	"sync/atomic"
+	"time"
+)
+
+// MethodStats is a snapshot of the statistics of a method.
+// Errors 是方法返回错误的次数，不包括超时等由服务端产生的错误。
+// BytesRead 和 BytesWritten 分别是请求 body 和响应报文的累计字节数，需要 Codec 实现 codec.Counter。
+// 字节统计的开销是每个请求两次原子加法，以及 Codec 读写时的一次整数加法，可以通过 SetSizeStats(false) 关闭。
+// Latency 是方法执行耗时的直方图，Latency[i] 是耗时不超过 LatencyBuckets()[i] 的调用次数（不累加），
+// 最后一个元素是超过所有上限的调用次数；LatencySum 是所有调用耗时的总和。
+// P50、P90 和 P99 是根据指数直方图估算的耗时分位数，没有调用时为 0，分桶方式和精度见 expBuckets。
+type MethodStats struct {
+	Calls        uint64
+	Errors       uint64
+	BytesRead    uint64
+	BytesWritten uint64
+	Latency      []uint64
+	LatencySum   time.Duration
+	P50          time.Duration
+	P90          time.Duration
+	P99          time.Duration
+}
+
+// latencyBuckets are the upper bounds of the latency histogram of methods
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// 为了估算分位数，每个方法另外维护一个指数分桶的直方图，上限从 expMin（1µs）开始，每 expSteps 个桶翻一倍，
+// 即第 i 个桶统计耗时在 (expMin·2^((i-1)/4), expMin·2^(i/4)] 之间的调用，第 0 个桶统计不超过 1µs 的调用，
+// 共 expBuckets 个桶覆盖到约 1 min，更长的耗时计入最后的溢出桶。分位数取所在桶上下限的几何中点，
+// 因此相对误差不超过 2^(1/8)-1，约 9%；落在溢出桶中的分位数只能报告为 expMax。
+// 每个方法固定占用 (expBuckets+1)*8 字节，与调用量无关，记录一次耗时只需一次原子加法。
+const (
+	expMin     = time.Microsecond
+	expSteps   = 4   // buckets per doubling
+	expBuckets = 104 // expMin·2^(104/4) ≈ 67s
+)
+
+var expMax = expBound(expBuckets)
+
+// expBound returns the upper bound of the i-th exponential bucket
+func expBound(i int) time.Duration {
+	return time.Duration(float64(expMin) * math.Exp2(float64(i)/expSteps))
+}
+
+// expBucket returns the index of the exponential bucket of d
+func expBucket(d time.Duration) int {
+	if d <= expMin {
+		return 0
+	}
+	i := int(math.Ceil(math.Log2(float64(d)/float64(expMin)) * expSteps))
+	if i > expBuckets {
+		return expBuckets
+	}
+	return i
+}
+
+// quantile estimates the q-quantile of the calls counted in the exponential buckets, total is their sum
+func quantile(buckets []uint64, total uint64, q float64) time.Duration {
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	var count uint64
+	for i, n := range buckets {
+		if count += n; count >= rank {
+			switch i {
+			case 0:
+				return expMin
+			case expBuckets:
+				return expMax
+			}
+			return time.Duration(float64(expMin) * math.Exp2((float64(i)-0.5)/expSteps))
+		}
+	}
+	return expMax
+}
+
+// LatencyBuckets returns the upper bounds of the buckets of MethodStats.Latency
+func LatencyBuckets() []time.Duration {
+	return append([]time.Duration(nil), latencyBuckets[:]...)
+}
+
+func (m *methodType) observeLatency(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&m.latency[i], 1)
+	atomic.AddInt64(&m.latencySum, int64(d))
+	atomic.AddUint64(&m.expLatency[expBucket(d)], 1)
+}
+
+// SetSizeStats enables or disables the request/response size accounting, it's enabled by default.
+func (server *Server) SetSizeStats(enabled bool) {
+	var v int32
+	if !enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&server.noSizeStats, v)
+}
+
+func (server *Server) sizeStats() bool {
+	return atomic.LoadInt32(&server.noSizeStats) == 0
+}
+
+// Stats returns the statistics of all methods, keyed by "Service.Method" as called by clients
+func (server *Server) Stats() map[string]MethodStats {
+	stats := make(map[string]MethodStats)
+	server.serviceMap.Range(func(_, sci interface{}) bool {
+		svc := sci.(*service)
+		for name, m := range svc.method {
+			stats[baseName(svc.name)+"."+name] = m.stats()
+		}
+		return true
+	})
+	return stats
+}
+
+// MethodStats returns the statistics of serviceMethod like Stats, ok is false if the method isn't registered.
+// 只读取这一个方法的计数器，不需要构造 Stats 返回的整个 map，适合高频的监控采集。
+func (server *Server) MethodStats(serviceMethod string) (stats MethodStats, ok bool) {
+	_, mType, err := server.lookupMethod(serviceMethod)
+	if err != nil {
+		return MethodStats{}, false
+	}
+	return mType.stats(), true
+}
+
+func (m *methodType) stats() MethodStats {
+	latency := make([]uint64, len(m.latency))
+	for i := range m.latency {
+		latency[i] = atomic.LoadUint64(&m.latency[i])
+	}
+	var exp [expBuckets + 1]uint64
+	var total uint64
+	for i := range m.expLatency {
+		exp[i] = atomic.LoadUint64(&m.expLatency[i])
+		total += exp[i]
+	}
+	return MethodStats{
+		Calls:        m.NumCalls(),
+		Errors:       m.NumErrors(),
+		BytesRead:    atomic.LoadUint64(&m.bytesRead),
+		BytesWritten: atomic.LoadUint64(&m.bytesWritten),
+		Latency:      latency,
+		LatencySum:   time.Duration(atomic.LoadInt64(&m.latencySum)),
+		P50:          quantile(exp[:], total, 0.5),
+		P90:          quantile(exp[:], total, 0.9),
+		P99:          quantile(exp[:], total, 0.99),
+	}
+}
+
+// bytesRead returns the bytes read by cc, or 0 if cc doesn't count them
+func bytesRead(cc codec.Codec) int64 {
+	if c, ok := unwrapCodec(cc).(codec.Counter); ok {
+		return c.BytesRead()
+	}
+	return 0
+}
+
+func bytesWritten(cc codec.Codec) int64 {
+	if c, ok := unwrapCodec(cc).(codec.Counter); ok {
+		return c.BytesWritten()
+	}
+	return 0
+}
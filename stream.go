@@ -0,0 +1,328 @@
+package simple_rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"simple_rpc/codec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 大文件上传等场景下，不希望 ReadBody 先把整个入参读入内存再执行方法。入参类型为 io.Reader 的方法，
+// 例如 func (s *Store) Put(r io.Reader, n *int64) error，可以在数据到达的同时边读边处理，内存占用与上传的大小无关。
+// 客户端用 Stream 包装入参，请求的 body 按块发送，同一个调用的所有帧使用相同的 Seq，帧格式如下：
+//
+//	| Header{Seq, Stream: true} | []byte chunk | ... | Header{Seq, Stream: true} | empty chunk |
+//
+// 第一帧的 Header 就是请求本身的 Header，此后每一帧的 body 都是一个非空的数据块（最大 streamChunkSize），
+// 空的数据块表示数据已经发送完毕，方法读到 io.EOF；如果最后一帧的 Header.Error 不为空，表示客户端中止了上传，
+// 方法读到以该信息为内容的错误。
+// 服务端在连接的读循环中把数据块依次写入一个 io.Pipe，方法读取多少，读循环才继续读取多少，因此在上传结束之前，
+// 同一个连接上的其他请求需要等待；客户端同样在上传期间占用连接的发送，其他调用等待上传完成。
+// 方法返回即表示处理结束，不需要读完所有数据：没有读取的数据块会被服务端丢弃，
+// 客户端收到响应后也不再发送剩余的数据，而是发送中止帧。流式请求总是在独立的 goroutine 中执行，
+// 不受 OrderedResponses、InlineFastPath 和工作池的影响。HTTP 网关直接把请求的 body 作为 io.Reader 传给方法。
+// Batch 和 Notify 不支持 Stream。
+//
+// 反方向同样可以流式传输：返回值类型为 io.Writer 的方法，例如 func (s *Store) Get(name string, w io.Writer) error，
+// 写入 w 的数据按块（最大 streamChunkSize）作为响应的帧发送，帧格式与上传相同：
+//
+//	| Header{Seq, Stream: true} | []byte chunk | ... | Header{Seq} | 响应 body |
+//
+// 方法返回后服务端发送普通的响应帧，表示数据已经发送完毕，Header.Error 不为空表示方法失败，此后方法写入 w 会返回错误。
+// 客户端用 StreamTo 包装返回值，读循环把每个数据块写入调用方的 io.Writer 后才读取下一帧，
+// 写得慢时服务端的写入会在连接的缓冲区写满后阻塞，这就是下载的背压，代价是同一个连接上的其他响应需要等待。
+// io.Writer 返回错误或者调用被放弃时，调用立即失败，服务端之后发送的数据块被丢弃。
+// HTTP 网关把方法写入的数据直接作为响应的 body，Content-Type 为 application/octet-stream。
+
+// streamChunkSize is the max size of a chunk of a streamed body
+const streamChunkSize = 32 << 10
+
+var (
+	typeOfReader = reflect.TypeOf((*io.Reader)(nil)).Elem()
+	typeOfWriter = reflect.TypeOf((*io.Writer)(nil)).Elem()
+)
+
+// streamArgs is the body of a call streamed from r, see Stream
+type streamArgs struct {
+	r   io.Reader
+	ctx context.Context // the stream is abandoned once it's done, nil means never
+}
+
+// Stream wraps r sent to a method whose arg is an io.Reader, the body is read from r and sent in chunks
+// as the server consumes it, eg, client.Call(ctx, "Store.Put", Stream(f), &n).
+func Stream(r io.Reader) interface{} {
+	return streamArgs{r: r}
+}
+
+// sendStream sends the body of call in chunks read from r, client.sending must be held
+func (client *Client) sendStream(call *Call, seq uint64, s streamArgs) {
+	client.header.Stream = true
+	client.header.ArgType = ""
+	defer func() {
+		client.header.Stream = false
+		client.header.Error = ""
+	}()
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := s.r.Read(buf)
+		if n > 0 && !client.writeChunk(seq, buf[:n]) {
+			return
+		}
+		switch {
+		case err == io.EOF:
+			client.writeChunk(seq, nil)
+			return
+		case err != nil:
+			client.header.Error = "rpc client: read stream: " + err.Error()
+			if client.writeChunk(seq, nil) {
+				client.failCall(seq, errors.New(client.header.Error))
+			}
+			return
+		case !client.isPending(seq, call) || s.ctx != nil && s.ctx.Err() != nil:
+			// the reply has arrived or the call is abandoned, the rest isn't needed
+			client.header.Error = "rpc client: stream abandoned"
+			client.writeChunk(seq, nil)
+			return
+		}
+	}
+}
+
+// writeChunk writes a frame of the stream seq, empty chunk ends the stream,
+// it returns false if the call fails because of the write.
+func (client *Client) writeChunk(seq uint64, chunk []byte) bool {
+	if chunk == nil {
+		chunk = []byte{}
+	}
+	atomic.StoreInt64(&client.lastSend, time.Now().UnixNano())
+	if err := client.cc.Write(&client.header, chunk); err != nil {
+		client.failCall(seq, err)
+		return false
+	}
+	client.header.Meta = nil // only sent with the first frame
+	return true
+}
+
+// isPending reports whether call is still waiting for the reply
+func (client *Client) isPending(seq uint64, call *Call) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.pending[seq] == call
+}
+
+// argStream feeds the chunks of a streamed body to the method
+type argStream struct {
+	r     *io.PipeReader
+	w     *io.PipeWriter
+	first []byte // chunk of the request frame
+	abort string // error of the request frame, if the stream is aborted right away
+}
+
+// readStream prepares req whose body is streamed, the first chunk is read
+func (server *Server) readStream(cc codec.Codec, req *request) error {
+	if req.mType.ArgType != typeOfReader {
+		_ = discardBody(cc, req.h)
+		return newError(CodeCodec, "rpc server: streamed body requires an io.Reader arg, got "+req.mType.ArgType.String())
+	}
+	s := new(argStream)
+	if err := cc.ReadBody(&s.first); err != nil {
+		return err
+	}
+	// the abort message isn't echoed in the response
+	s.abort, req.h.Error = req.h.Error, ""
+	s.r, s.w = io.Pipe()
+	req.stream = s
+	req.argV = reflect.New(typeOfReader).Elem()
+	req.argV.Set(reflect.ValueOf(s.r))
+	req.replyV = req.mType.newReplyV()
+	return nil
+}
+
+// serveStream starts handling req whose body is streamed, and feeds the rest of the chunks to it,
+// it returns an error if the stream is broken and the connection can't be used anymore.
+func (server *Server) serveStream(c *serverConn, cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, opt *Option) error {
+	if server.isOverloaded() {
+		server.rejectOverloaded(cc, req, sending)
+		_ = req.stream.r.Close()
+	} else {
+		wg.Add(1)
+		go server.handleRequest(c, cc, req, sending, wg, opt.HandleTimeout)
+	}
+	n := bytesRead(cc)
+	err := req.stream.feed(cc, req.h.Seq)
+	if server.sizeStats() {
+		atomic.AddUint64(&req.mType.bytesRead, uint64(bytesRead(cc)-n))
+	}
+	return err
+}
+
+// feed writes the chunks to the pipe until the stream ends, once the method stops reading,
+// the rest of the chunks are discarded.
+func (s *argStream) feed(cc codec.Codec, seq uint64) error {
+	chunk, abort := s.first, s.abort
+	for len(chunk) > 0 {
+		// it fails once the reader is closed, keep reading to discard the rest
+		_, _ = s.w.Write(chunk)
+		h, err := readFrame(cc, seq)
+		if err == nil {
+			chunk = nil
+			err = cc.ReadBody(&chunk)
+		}
+		if err != nil {
+			_ = s.w.CloseWithError(err)
+			return err
+		}
+		abort = h.Error
+	}
+	if abort != "" {
+		return s.w.CloseWithError(errors.New(abort))
+	}
+	return s.w.Close()
+}
+
+// close stops feeding the method, it's called once the method returns
+func (s *argStream) close() {
+	_ = s.r.Close()
+}
+
+// readFrame reads the header of the next frame of the stream seq
+func readFrame(cc codec.Codec, seq uint64) (*codec.Header, error) {
+	var h codec.Header
+	if err := cc.ReadHeader(&h); err != nil {
+		return nil, err
+	}
+	if !h.Stream || h.Seq != seq {
+		return nil, errors.New("rpc server: unexpected frame in the stream")
+	}
+	return &h, nil
+}
+
+// discardBody discards the body of h, including all the chunks if it's streamed
+func discardBody(cc codec.Codec, h *codec.Header) error {
+	if !h.Stream {
+		return cc.ReadBody(nil)
+	}
+	for {
+		var chunk []byte
+		if err := cc.ReadBody(&chunk); err != nil || len(chunk) == 0 {
+			return err
+		}
+		if _, err := readFrame(cc, h.Seq); err != nil {
+			return err
+		}
+	}
+}
+
+// errStreamEnded is returned by the io.Writer of a method once its response is sent
+var errStreamEnded = errors.New("rpc server: the streamed reply has ended")
+
+// replyStream sends the bytes written by a method whose reply is an io.Writer as the chunks of its response
+type replyStream struct {
+	server  *Server
+	cc      codec.Codec
+	req     *request
+	sending *sync.Mutex
+	ended   int32 // set once the response is sent, the chunks written after are refused
+}
+
+func (s *replyStream) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > streamChunkSize {
+			chunk = chunk[:streamChunkSize]
+		}
+		if err := s.writeChunk(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (s *replyStream) writeChunk(chunk []byte) error {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+	if atomic.LoadInt32(&s.ended) != 0 {
+		return errStreamEnded
+	}
+	n := bytesWritten(s.cc)
+	err := s.cc.Write(&codec.Header{ServiceMethod: s.req.h.ServiceMethod, Seq: s.req.h.Seq, Stream: true}, chunk)
+	if s.server.sizeStats() {
+		atomic.AddUint64(&s.req.mType.bytesWritten, uint64(bytesWritten(s.cc)-n))
+	}
+	return err
+}
+
+// end refuses the chunks written after, it's called before the response is sent
+func (s *replyStream) end() {
+	atomic.StoreInt32(&s.ended, 1)
+}
+
+// streamReply is the reply of a call whose response is streamed, see StreamTo
+type streamReply struct {
+	mu     sync.Mutex // protect following
+	w      io.Writer
+	closed bool         // the call is abandoned, w isn't written any more
+	finish func() error // checks the whole stream once the response arrives, nil means no check
+}
+
+// StreamTo wraps w as the reply of a method whose reply is an io.Writer, the chunks written by the method
+// are written to w as they arrive, eg, client.Call(ctx, "Store.Get", name, StreamTo(f)).
+// w isn't written once the call returns.
+func StreamTo(w io.Writer) interface{} {
+	return &streamReply{w: w}
+}
+
+func (r *streamReply) write(chunk []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	_, err := r.w.Write(chunk)
+	return err
+}
+
+// close stops writing w, it's called once the call is abandoned
+func (r *streamReply) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+}
+
+// isStreamed reports whether the arg or the reply of a call is streamed, such a call can only be sent once
+func isStreamed(args, reply interface{}) bool {
+	_, in := args.(streamArgs)
+	_, out := reply.(*streamReply)
+	return in || out
+}
+
+// readChunk reads a chunk of the streamed response of h and writes it to the reply of the call,
+// the call fails if the reply isn't streamed or it can't be written.
+func (client *Client) readChunk(h *codec.Header) error {
+	var chunk []byte
+	if err := client.cc.ReadBody(&chunk); err != nil {
+		return err
+	}
+	client.mu.Lock()
+	call := client.pending[h.Seq]
+	client.mu.Unlock()
+	if call == nil {
+		// the call is abandoned or failed already
+		return nil
+	}
+	r, ok := call.Reply.(*streamReply)
+	if !ok {
+		client.failCall(h.Seq, newError(CodeCodec, "rpc client: the reply of "+call.ServiceMethod+" is streamed, see StreamTo"))
+		return nil
+	}
+	if err := r.write(chunk); err != nil {
+		client.failCall(h.Seq, err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package simple_rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Bind fills the function fields of stub, a pointer to struct, with closures calling the remote methods,
+// so that the calls are checked by the compiler instead of passing "Service.Method" and interface{} around.
+// 默认以结构体的类型名作为服务名、字段名作为方法名，字段的 rpc tag 可以指定完整的 "Service.Method"。
+// 支持以下两种函数签名，A 和 R 为任意可编码的类型：
+//
+//	func(ctx context.Context, args A, reply *R) error  与 Call 相同，返回值写入 reply
+//	func(ctx context.Context, args A) (R, error)       返回新创建的 R
+//
+// 例如：
+//
+//	type UserService struct {
+//		GetUser func(ctx context.Context, id int, user *User) error
+//		List    func(ctx context.Context, q Query) ([]User, error) `rpc:"UserService.ListUsers"`
+//	}
+//	var users UserService
+//	_ = client.Bind(&users)
+//	err := users.GetUser(ctx, 42, &user)
+//
+// 非函数类型的字段和未导出的字段会被忽略，签名不受支持的函数字段会导致 Bind 返回错误。
+// Bind 只检查签名，不会向服务端确认方法是否存在，方法名或类型与服务端不一致时在调用时返回错误。
+func (client *Client) Bind(stub interface{}) error {
+	v := reflect.ValueOf(stub)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return errors.New("rpc client: stub must be a pointer to struct")
+	}
+	v = v.Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Type.Kind() != reflect.Func || !field.IsExported() {
+			continue
+		}
+		serviceMethod := t.Name() + "." + field.Name
+		if tag := field.Tag.Get("rpc"); tag != "" {
+			serviceMethod = tag
+		}
+		f, err := client.stubFunc(serviceMethod, field.Type)
+		if err != nil {
+			return fmt.Errorf("rpc client: can't bind %s.%s: %w", t.Name(), field.Name, err)
+		}
+		v.Field(i).Set(f)
+	}
+	return nil
+}
+
+var errStubSignature = errors.New("expect func(context.Context, A, *R) error or func(context.Context, A) (R, error)")
+
+// stubFunc returns a function of type ft calling serviceMethod
+func (client *Client) stubFunc(serviceMethod string, ft reflect.Type) (reflect.Value, error) {
+	if ft.NumIn() < 2 || ft.NumOut() == 0 || ft.In(0) != typeOfContext || ft.Out(ft.NumOut()-1) != typeOfError {
+		return reflect.Value{}, errStubSignature
+	}
+	switch {
+	case ft.NumIn() == 3 && ft.NumOut() == 1 && ft.In(2).Kind() == reflect.Ptr:
+		return reflect.MakeFunc(ft, func(in []reflect.Value) []reflect.Value {
+			err := client.Call(contextOf(in[0]), serviceMethod, in[1].Interface(), in[2].Interface())
+			return []reflect.Value{errorValue(err)}
+		}), nil
+	case ft.NumIn() == 2 && ft.NumOut() == 2:
+		return reflect.MakeFunc(ft, func(in []reflect.Value) []reflect.Value {
+			reply := reflect.New(ft.Out(0))
+			err := client.Call(contextOf(in[0]), serviceMethod, in[1].Interface(), reply.Interface())
+			return []reflect.Value{reply.Elem(), errorValue(err)}
+		}), nil
+	}
+	return reflect.Value{}, errStubSignature
+}
+
+// contextOf returns the context passed to a stub function, nil is replaced by context.Background
+func contextOf(v reflect.Value) context.Context {
+	if ctx, ok := v.Interface().(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+// errorValue returns err as a reflect.Value of type error, which is valid even if err is nil
+func errorValue(err error) reflect.Value {
+	v := reflect.New(typeOfError).Elem()
+	if err != nil {
+		v.Set(reflect.ValueOf(err))
+	}
+	return v
+}
@@ -0,0 +1,48 @@
+package simple_rpc
+
+import (
+	"context"
+	"simple_rpc/codec"
+	"time"
+)
+
+// 调试模式用于排查单个请求慢在哪里：客户端在请求头中设置 Debug，服务端分别测量解码入参、执行方法和编码返回值的耗时，
+// 并通过响应头的 Trace 带回。响应头先于返回值写出，无法携带本次编码的耗时，
+// 因此编码耗时是在写出之前额外序列化一次返回值测得的，只有实现了 codec.BodyMarshaler 的 Codec 才会报告。
+// 没有设置 Debug 的请求不会读取时钟，也不会分配 Trace。
+
+type traceKey struct{}
+
+// WithTrace returns a copy of ctx which makes the calls made with it ask the server for its timing,
+// t is filled when a call completes. Batch calls set Call.Debug instead.
+func WithTrace(ctx context.Context, t *codec.Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// traceFromContext returns the trace attached to ctx by WithTrace, nil if there is none
+func traceFromContext(ctx context.Context) *codec.Trace {
+	t, _ := ctx.Value(traceKey{}).(*codec.Trace)
+	return t
+}
+
+// encodeTime returns how long it takes cc to encode body, 0 if cc can't marshal a body on its own
+func encodeTime(cc codec.Codec, body interface{}) time.Duration {
+	m, ok := unwrapCodec(cc).(codec.BodyMarshaler)
+	if !ok {
+		return 0
+	}
+	start := time.Now()
+	_, _ = m.MarshalBody(body)
+	return time.Since(start)
+}
+
+// traceCall is like call, but it measures the execution if the client asks for the timing
+func (server *Server) traceCall(ctx context.Context, req *request) error {
+	if req.trace == nil {
+		return server.call(ctx, req)
+	}
+	start := time.Now()
+	err := server.call(ctx, req)
+	req.trace.Handle = time.Since(start)
+	return err
+}
@@ -0,0 +1,59 @@
+package simple_rpc
+
+import (
+	"reflect"
+	"sync/atomic"
+)
+
+// Validator is implemented by args which can check their own fields.
+// 客户端开启 Option.ValidateReplies 后，同样会对实现了 Validator 的 reply 调用 Validate，
+// 在有缺陷甚至被篡改的服务端返回的数据扩散之前拦截它们。
+type Validator interface {
+	Validate() error
+}
+
+// SetValidateArgs enables the validation of args: after the body is decoded,
+// if the arg implements Validator, Validate is called before the method,
+// and the method isn't executed if it returns an error, which is replied with CodeInvalidArgument.
+// 这样方法中不再需要重复检查请求字段的样板代码。值接收者和指针接收者的 Validate 都会被识别。
+func (server *Server) SetValidateArgs(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&server.validateArgs, v)
+}
+
+// validate calls Validate of argv if it's enabled and argv implements Validator
+func (server *Server) validate(argv reflect.Value) error {
+	if atomic.LoadInt32(&server.validateArgs) == 0 {
+		return nil
+	}
+	v, ok := argv.Interface().(Validator)
+	if !ok && argv.CanAddr() {
+		v, ok = argv.Addr().Interface().(Validator)
+	}
+	if !ok {
+		return nil
+	}
+	if err := v.Validate(); err != nil {
+		return newError(CodeInvalidArgument, "rpc server: invalid argument: "+err.Error())
+	}
+	return nil
+}
+
+// validateReply calls Validate of reply, or each of Replies, if it implements Validator
+func validateReply(reply interface{}) error {
+	replies, ok := reply.(Replies)
+	if !ok {
+		replies = Replies{reply}
+	}
+	for _, r := range replies {
+		if v, ok := r.(Validator); ok {
+			if err := v.Validate(); err != nil {
+				return newError(CodeInvalidReply, "rpc client: invalid reply: "+err.Error())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package simple_rpc
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// 灰度发布时同一个逻辑服务的多个 API 版本需要同时在线，例如 UserService.GetV1 和 UserService.GetV2 分别由新旧两个实现提供。
+// RegisterVersion 把 rcv 的每个方法以“方法名 + version”的名称注册到 rcv 的服务名下，
+// 它在 serviceMap 中的键是 "<服务名>@<version>"，因此与同名的服务（即未带版本注册的实现）以及其他版本互不冲突，
+// 各自拥有独立的接收者和生命周期，Unregister 时使用同样的键，例如 Unregister("UserService@V2")。
+// findService 解析 "UserService.GetV2" 时，先在未带版本的 UserService 中查找方法 GetV2，
+// 找不到时再按版本名的顺序在 UserService 的各个版本中查找，版本中的方法已经带有后缀，因此直接按完整的方法名匹配。
+// 注册时拒绝与同名服务的其他版本或未带版本的服务重名的方法，因此任意一个方法名至多属于一个实现。
+//
+// RegisterExtend 复用同样的机制，把拆分到多个结构体中的方法合并到同一个服务名下，
+// 它在 serviceMap 中的键是 "<服务名>@<rcv 的类型名>"，方法名保持不变，findService 同样能解析到正确的接收者。
+// 方法名与该服务已有的方法（包括其他扩展和版本）冲突时返回错误，不会覆盖已有的方法，
+// 需要通过 RpcMethodMapper 为其中一个改名后再注册。扩展同样需要单独注销，例如 Unregister("BigService@PartB")。
+
+const versionSep = "@"
+
+// RegisterVersion publishes the methods of rcv under the name of its type like Register,
+// but each method is exposed with version appended, eg, Get of UserService registered
+// with version "V2" is called as "UserService.GetV2".
+func (server *Server) RegisterVersion(rcv interface{}, version string) error {
+	if version == "" || !ast.IsExported("X"+version) || strings.Contains(version, ".") {
+		return errors.New("rpc: invalid service version: " + version)
+	}
+	s, err := buildService(rcv)
+	if err != nil {
+		return err
+	}
+	base := s.name
+	s.name = base + versionSep + version
+	methods := make(map[string]*methodType, len(s.method))
+	for name, m := range s.method {
+		methods[name+version] = m
+	}
+	s.method = methods
+	return server.register(base, s, false)
+}
+
+// RegisterVersion publishes the versioned methods of rcv in the DefaultServer.
+func RegisterVersion(rcv interface{}, version string) error {
+	return DefaultServer.RegisterVersion(rcv, version)
+}
+
+// RegisterExtend merges the methods of rcv into the service name registered before,
+// eg, by RegisterName or Register, so a service can be split across several receivers.
+// It returns an error if any method of rcv is already defined by the service.
+func (server *Server) RegisterExtend(name string, rcv interface{}) error {
+	s := newNamedService(rcv, name+versionSep+reflect.Indirect(reflect.ValueOf(rcv)).Type().Name())
+	return server.register(name, s, true)
+}
+
+// RegisterExtend merges the methods of rcv into the service name in the DefaultServer.
+func RegisterExtend(name string, rcv interface{}) error {
+	return DefaultServer.RegisterExtend(name, rcv)
+}
+
+// checkVersionConflict returns an error if a method of s is already exposed by the service base
+// or one of its versions, server.svcMu must be held
+func (server *Server) checkVersionConflict(base string, s *service) error {
+	others := server.versionsOf(base)
+	if sci, ok := server.serviceMap.Load(base); ok {
+		others = append(others, sci.(*service))
+	}
+	for _, other := range others {
+		for name := range s.method {
+			if other.method[name] != nil {
+				return fmt.Errorf("rpc: method %s.%s is already defined by %s", base, name, other.name)
+			}
+		}
+	}
+	return nil
+}
+
+// baseName returns the service name of a service registered by RegisterVersion, or name itself
+func baseName(name string) string {
+	if i := strings.Index(name, versionSep); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// versionsOf returns the services registered by RegisterVersion under the name base, sorted by version
+func (server *Server) versionsOf(base string) []*service {
+	var versions []*service
+	prefix := base + versionSep
+	server.serviceMap.Range(func(name, sci interface{}) bool {
+		if strings.HasPrefix(name.(string), prefix) {
+			versions = append(versions, sci.(*service))
+		}
+		return true
+	})
+	sort.Slice(versions, func(i, j int) bool { return versions[i].name < versions[j].name })
+	return versions
+}
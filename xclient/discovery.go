@@ -1,16 +1,20 @@
 package xclient
 
 import (
+	"context"
 	"errors"
+	"hash/crc32"
 	"math"
 	"math/rand"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
 
 // 负载均衡的前提是有多个服务实例，那我们首先实现一个最基础的服务发现模块 Discovery。为了与通信部分解耦，这部分的代码统一放置在 xclient 子目录下。
 // 定义 2 个类型：
-// SelectMode 代表不同的负载均衡策略，简单起见，Simple RPC 仅实现 Random 和 RoundRobin 两种策略。
+// SelectMode 代表不同的负载均衡策略，简单起见，Simple RPC 仅内置 Random、RoundRobin、WeightedRoundRobin、LocalityAware 和 ConsistentHash 五种策略，其他策略可以通过 Balancer 接口自行实现。
 // Discovery 是一个接口类型，包含了服务发现所需要的最基本的接口。
 //  Refresh() 从注册中心更新服务列表
 //  Update(servers []string) 手动更新服务列表
@@ -20,8 +24,11 @@ import (
 type SelectMode int
 
 const (
-	RandomSelect     SelectMode = iota // select randomly
-	RoundRobinSelect                   // select using Robbin algorithm
+	RandomSelect             SelectMode = iota // select randomly
+	RoundRobinSelect                           // select using Robbin algorithm
+	WeightedRoundRobinSelect                   // select using smooth weighted round robin algorithm
+	LocalityAwareSelect                        // prefer servers in the local zone, see SetLocalZone
+	ConsistentHashSelect                       // route the same key to the same server, see GetForKey
 )
 
 type Discovery interface {
@@ -31,15 +38,208 @@ type Discovery interface {
 	GetAll() ([]string, error)
 }
 
-var _ Discovery = (*MultiServersDiscovery)(nil)
+// KeyedDiscovery is implemented by discoveries which can select a server by a routing key,
+// XClient uses it for the calls made with WithRouteKey.
+type KeyedDiscovery interface {
+	GetForKey(mode SelectMode, key string) (string, error)
+}
+
+// ContextDiscovery is implemented by discoveries which refresh from a remote registry,
+// XClient uses it so a slow or hung registry can't block a call beyond the deadline of its ctx.
+type ContextDiscovery interface {
+	RefreshContext(ctx context.Context) error
+	GetWithContext(ctx context.Context, mode SelectMode) (string, error)
+}
+
+// Evicter is implemented by discoveries which can remove a server from the selection,
+// the server is added back only when Update or Refresh reports it again.
+type Evicter interface {
+	Evict(server string)
+}
+
+// Balancer selects a server from servers, it makes the selection policy pluggable,
+// eg, locality-aware or tenant-pinned selection.
+// Pick is called with the discovery locked, so it must not call back into the discovery.
+// Snapshot.Pick calls it without any lock, so a balancer picking from snapshots in several goroutines
+// must be safe for concurrent use, the built-in ones are.
+type Balancer interface {
+	Pick(servers []string) (string, error)
+}
+
+// WeightedBalancer is a Balancer which takes the weights of servers into account,
+// the discovery calls PickWeighted instead of Pick if the balancer implements it.
+type WeightedBalancer interface {
+	Balancer
+	PickWeighted(servers []string, weights map[string]int) (string, error)
+}
+
+// KeyedBalancer is a Balancer which selects the same server for the same key,
+// the discovery calls PickForKey instead of Pick in GetForKey if the balancer implements it.
+type KeyedBalancer interface {
+	Balancer
+	PickForKey(servers []string, key string) (string, error)
+}
+
+// randomBalancer 和 roundRobinBalancer 是内置的两种负载均衡策略，SelectMode 即是它们的简写。
+// r 是一个产生随机数的实例，初始化时使用时间戳设定随机数种子，避免每次产生相同的随机数序列。
+// index 记录 Round Robin 算法已经轮询到的位置，为了避免每次从 0 开始，初始化时随机设定一个值。
+// 内置的策略都带有一把锁，因此同一个实例可以在多个快照上并发地选择，见 Snapshot.Pick。
+type randomBalancer struct {
+	mu sync.Mutex
+	r  *rand.Rand // generate random number
+}
+
+func (b *randomBalancer) Pick(servers []string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return servers[b.r.Intn(len(servers))], nil
+}
+
+type roundRobinBalancer struct {
+	mu    sync.Mutex
+	index int // record the selected position for robin algorithm
+}
+
+func (b *roundRobinBalancer) Pick(servers []string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(servers)
+	s := servers[b.index%n] // servers could be updated, so mode n to ensure safety
+	b.index = (b.index + 1) % n
+	return s, nil
+}
+
+// weightedRoundRobinBalancer 使用 Nginx 的平滑加权轮询算法：每次选择时，所有服务的当前权重加上各自的权重，
+// 选出当前权重最大的服务，并将其当前权重减去权重总和。这样权重为 3 的服务获得 3 倍的流量，且不会被连续选中。
+// 权重缺失或不大于 0 的服务按 1 处理。
+type weightedRoundRobinBalancer struct {
+	mu      sync.Mutex
+	current map[string]int
+}
+
+func (b *weightedRoundRobinBalancer) Pick(servers []string) (string, error) {
+	return b.PickWeighted(servers, nil)
+}
+
+func (b *weightedRoundRobinBalancer) PickWeighted(servers []string, weights map[string]int) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	current := make(map[string]int, len(servers)) // forget servers which are gone
+	total, best := 0, ""
+	for _, s := range servers {
+		w := weights[s]
+		if w <= 0 {
+			w = 1
+		}
+		total += w
+		current[s] = b.current[s] + w
+		if best == "" || current[s] > current[best] {
+			best = s
+		}
+	}
+	current[best] -= total
+	b.current = current
+	return best, nil
+}
+
+// consistentHashBalancer 把每个服务映射为哈希环上的 replicas 个虚拟节点，key 落在环上顺时针方向的第一个虚拟节点所属的服务。
+// 服务列表变化时只有被增删服务上的 key 会改变归属，其余 key 仍然路由到原来的服务。
+// 没有 key 的选择（Pick）退化为随机选择。
+type consistentHashBalancer struct {
+	mu      sync.Mutex
+	r       *rand.Rand
+	servers []string          // servers the ring is built from
+	ring    []uint32          // sorted hashes of virtual nodes
+	nodes   map[uint32]string // hash of virtual node -> server
+}
+
+const consistentHashReplicas = 100
+
+func (b *consistentHashBalancer) Pick(servers []string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return servers[b.r.Intn(len(servers))], nil
+}
+
+func (b *consistentHashBalancer) PickForKey(servers []string, key string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !sameServers(b.servers, servers) {
+		b.build(servers)
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= h })
+	if i == len(b.ring) {
+		i = 0
+	}
+	return b.nodes[b.ring[i]], nil
+}
+
+// build rebuilds the ring from servers
+func (b *consistentHashBalancer) build(servers []string) {
+	b.servers = append([]string(nil), servers...)
+	b.ring = make([]uint32, 0, len(servers)*consistentHashReplicas)
+	b.nodes = make(map[uint32]string, len(servers)*consistentHashReplicas)
+	for _, s := range servers {
+		for i := 0; i < consistentHashReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + s))
+			b.ring = append(b.ring, h)
+			b.nodes[h] = s
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i] < b.ring[j] })
+}
+
+func sameServers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// NewBalancer returns a new built-in balancer of mode
+func NewBalancer(mode SelectMode) (Balancer, error) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	switch mode {
+	case RandomSelect:
+		return &randomBalancer{r: r}, nil
+	case RoundRobinSelect:
+		return &roundRobinBalancer{index: r.Intn(math.MaxInt32 - 1)}, nil
+	case WeightedRoundRobinSelect:
+		return &weightedRoundRobinBalancer{}, nil
+	case LocalityAwareSelect:
+		// servers are filtered by zone before picking, see MultiServersDiscovery.localServers
+		return &roundRobinBalancer{index: r.Intn(math.MaxInt32 - 1)}, nil
+	case ConsistentHashSelect:
+		return &consistentHashBalancer{r: r}, nil
+	default:
+		return nil, errors.New("rpc discovery: not supported select mode")
+	}
+}
+
+var (
+	_ Discovery      = (*MultiServersDiscovery)(nil)
+	_ KeyedDiscovery = (*MultiServersDiscovery)(nil)
+)
 
 // MultiServersDiscovery is a discovery for multi servers without a registry center
 // user provides the server addresses explicitly instead
+// balancers 是 SelectMode 对应的内置策略，balancer 是用户通过 SetBalancer 设置的策略，设置后将忽略 SelectMode。
+// weights 是服务的权重，由 SetWeights 设置或从注册中心获取，供 WeightedBalancer 使用。
+// zones 是服务所在的可用区，由 SetZones 设置或从注册中心获取，localZone 是客户端所在的可用区，供 LocalityAwareSelect 使用。
 type MultiServersDiscovery struct {
-	r       *rand.Rand   // generate random number
-	mu      sync.RWMutex // protect following
-	servers []string
-	index   int // record the selected position for robin algorithm
+	mu        sync.RWMutex // protect following
+	servers   []string
+	weights   map[string]int
+	zones     map[string]string
+	localZone string
+	balancers map[SelectMode]Balancer
+	balancer  Balancer
 }
 
 // Refresh doesn't make sense for MultiServersDiscovery, so ignore it
@@ -55,44 +255,178 @@ func (d *MultiServersDiscovery) Update(servers []string) error {
 	return nil
 }
 
+// Evict removes server from the servers until Update or Refresh reports it again
+func (d *MultiServersDiscovery) Evict(server string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// d.servers may be shared with the caller of Update or a Snapshot, so don't modify it in place
+	servers := make([]string, 0, len(d.servers))
+	for _, s := range d.servers {
+		if s != server {
+			servers = append(servers, s)
+		}
+	}
+	d.servers = servers
+}
+
+// SetWeights sets the weights of servers, servers missing in weights have weight 1
+func (d *MultiServersDiscovery) SetWeights(weights map[string]int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.weights = weights
+}
+
+// SetZones sets the zones of servers, servers missing in zones belong to no zone
+func (d *MultiServersDiscovery) SetZones(zones map[string]string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.zones = zones
+}
+
+// SetLocalZone sets the zone of the client, LocalityAwareSelect prefers servers in it.
+// LocalityAwareSelect 的选择顺序如下：
+// 1. 与客户端同一可用区的服务，在它们之间轮询；
+// 2. 同一可用区没有可用的服务时（未注册、心跳超时或未通过 WithHealthCheck 的健康检查而被注册中心剔除），在所有服务之间轮询。
+// 未设置 localZone 时等同于 RoundRobinSelect。GetAll 同样把同一可用区的服务排在前面。
+func (d *MultiServersDiscovery) SetLocalZone(zone string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.localZone = zone
+}
+
+// localServers returns the servers in the local zone, or all servers if there is none, d.mu must be held
+func (d *MultiServersDiscovery) localServers() []string {
+	if d.localZone == "" {
+		return d.servers
+	}
+	var local []string
+	for _, s := range d.servers {
+		if d.zones[s] == d.localZone {
+			local = append(local, s)
+		}
+	}
+	if len(local) == 0 {
+		return d.servers
+	}
+	return local
+}
+
+// SetBalancer makes Get select servers by b regardless of the mode, nil restores the built-in ones
+func (d *MultiServersDiscovery) SetBalancer(b Balancer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.balancer = b
+}
+
 // Get a server according to mode
 func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
+	return d.GetForKey(mode, "")
+}
+
+// GetForKey gets a server according to mode, the same key selects the same server as long as
+// the servers don't change if the balancer is a KeyedBalancer, eg, ConsistentHashSelect.
+// Empty key or other balancers make it the same as Get.
+// key 所在的服务下线（心跳超时、未通过健康检查或被 EvictServer 剔除）后，它的 key 顺延到哈希环上的下一个服务，
+// 即重新固定到该服务上，其他 key 不受影响；服务重新上线后，这些 key 再回到原来的服务。
+func (d *MultiServersDiscovery) GetForKey(mode SelectMode, key string) (string, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	n := len(d.servers)
 	if n == 0 {
 		return "", errors.New("rpc discovery: no available servers")
 	}
-	switch mode {
-	case RandomSelect:
-		return d.servers[d.r.Intn(n)], nil
-	case RoundRobinSelect:
-		s := d.servers[d.index%n] // servers could be updated, so mode n to ensure safety
-		d.index = (d.index + 1) % n
-		return s, nil
-	default:
+	b := d.balancer
+	if b == nil {
+		b = d.balancers[mode]
+	}
+	if b == nil {
 		return "", errors.New("rpc discovery: not supported select mode")
 	}
+	servers := d.servers
+	if mode == LocalityAwareSelect && d.balancer == nil {
+		servers = d.localServers()
+	}
+	if kb, ok := b.(KeyedBalancer); ok && key != "" {
+		return kb.PickForKey(servers, key)
+	}
+	if wb, ok := b.(WeightedBalancer); ok {
+		return wb.PickWeighted(servers, d.weights)
+	}
+	return b.Pick(servers)
 }
 
 // GetAll returns all servers in discovery
 func (d *MultiServersDiscovery) GetAll() ([]string, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
-	// return a copy of d.servers
+	// return a copy of d.servers, servers in the local zone come first
 	servers := make([]string, len(d.servers), len(d.servers))
 	copy(servers, d.servers)
+	if d.localZone != "" {
+		sort.SliceStable(servers, func(i, j int) bool {
+			return d.zones[servers[i]] == d.localZone && d.zones[servers[j]] != d.localZone
+		})
+	}
 	return servers, nil
 }
 
+// Snapshot is an immutable view of the servers and weights of a discovery.
+// 快照在获取时一次性复制服务列表和权重，之后的 Update 或 Refresh 不会影响它，
+// 因此在一次广播或对冲请求中可以基于同一组服务多次选择。快照可能已经过期，但其内部总是一致的。
+type Snapshot struct {
+	servers []string
+	weights map[string]int
+}
+
+// Servers returns the servers of the snapshot
+func (s *Snapshot) Servers() []string {
+	servers := make([]string, len(s.servers))
+	copy(servers, s.servers)
+	return servers
+}
+
+// Weight returns the weight of server, 1 if it's not set
+func (s *Snapshot) Weight(server string) int {
+	if w := s.weights[server]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// Pick selects a server of the snapshot by b, b must be safe for concurrent use if it's shared, see Balancer
+func (s *Snapshot) Pick(b Balancer) (string, error) {
+	if len(s.servers) == 0 {
+		return "", errors.New("rpc discovery: no available servers")
+	}
+	if wb, ok := b.(WeightedBalancer); ok {
+		return wb.PickWeighted(s.servers, s.weights)
+	}
+	return b.Pick(s.servers)
+}
+
+// Snapshot returns a consistent view of the current servers and weights
+func (d *MultiServersDiscovery) Snapshot() (*Snapshot, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	s := &Snapshot{
+		servers: make([]string, len(d.servers)),
+		weights: make(map[string]int, len(d.weights)),
+	}
+	copy(s.servers, d.servers)
+	for server, w := range d.weights {
+		s.weights[server] = w
+	}
+	return s, nil
+}
+
 // NewMultiServerDiscovery creates a MultiServersDiscovery instance
-// r 是一个产生随机数的实例，初始化时使用时间戳设定随机数种子，避免每次产生相同的随机数序列。
-// index 记录 Round Robin 算法已经轮询到的位置，为了避免每次从 0 开始，初始化时随机设定一个值。
 func NewMultiServerDiscovery(servers []string) *MultiServersDiscovery {
 	d := &MultiServersDiscovery{
-		servers: servers,
-		r:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		servers:   servers,
+		balancers: make(map[SelectMode]Balancer),
+	}
+	for _, mode := range []SelectMode{RandomSelect, RoundRobinSelect, WeightedRoundRobinSelect, LocalityAwareSelect, ConsistentHashSelect} {
+		d.balancers[mode], _ = NewBalancer(mode)
 	}
-	d.index = d.r.Intn(math.MaxInt32 - 1)
 	return d
 }
@@ -0,0 +1,177 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"log"
+	"simple_rpc/registry"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MultiRegistryDiscovery 从多个注册中心获取服务列表并取并集，避免单个注册中心故障导致服务发现失效。
+// Refresh 时并发请求所有注册中心，只要有一个可达，就使用可达注册中心返回的结果；
+// 所有注册中心都不可达时，继续使用上一次获取到的服务列表，而不是返回空列表。
+type MultiRegistryDiscovery struct {
+	*MultiServersDiscovery
+	registries     []string
+	timeout        time.Duration
+	refreshTimeout time.Duration
+	headers        registry.Headers
+	lastUpdate     time.Time
+	refreshing     chan struct{} // closed once the ongoing refresh is done
+}
+
+var (
+	_ Discovery        = (*MultiRegistryDiscovery)(nil)
+	_ ContextDiscovery = (*MultiRegistryDiscovery)(nil)
+)
+
+func (d *MultiRegistryDiscovery) Update(servers []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers = servers
+	d.lastUpdate = time.Now()
+	return nil
+}
+
+func (d *MultiRegistryDiscovery) Refresh() error {
+	return d.RefreshContext(context.Background())
+}
+
+// RefreshContext is like Refresh, but the requests to the registries are abandoned once ctx is done
+// or the refresh timeout expires, see RPCRegistryDiscovery.RefreshContext.
+func (d *MultiRegistryDiscovery) RefreshContext(ctx context.Context) error {
+	d.mu.Lock()
+	if d.lastUpdate.Add(d.timeout).After(time.Now()) {
+		d.mu.Unlock()
+		return nil
+	}
+	if refreshing := d.refreshing; refreshing != nil {
+		d.mu.Unlock()
+		return d.waitRefresh(ctx, refreshing)
+	}
+	refreshing := make(chan struct{})
+	d.refreshing = refreshing
+	registries, timeout, headers := d.registries, d.refreshTimeout, d.headers
+	d.mu.Unlock()
+
+	log.Println("rpc registry: refresh servers from registries", registries)
+	var wg sync.WaitGroup
+	var mu sync.Mutex // protect following
+	seen := make(map[string]bool)
+	weights := make(map[string]int)
+	zones := make(map[string]string)
+	reachable := 0
+	for _, addr := range registries {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			servers, ws, zs, err := fetchServers(ctx, addr, "", timeout, headers)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Println("rpc registry refresh err:", addr, err)
+				return
+			}
+			reachable++
+			for _, server := range servers {
+				seen[server] = true
+			}
+			for server, w := range ws {
+				if w > weights[server] {
+					weights[server] = w
+				}
+			}
+			for server, zone := range zs {
+				zones[server] = zone
+			}
+		}(addr)
+	}
+	wg.Wait()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refreshing = nil
+	close(refreshing)
+	if reachable == 0 {
+		if len(d.servers) == 0 {
+			return errors.New("rpc registry: all registries are unreachable")
+		}
+		// keep serving the last known servers, and don't retry until they expire again
+		d.lastUpdate = time.Now()
+		return nil
+	}
+	d.servers = make([]string, 0, len(seen))
+	for server := range seen {
+		d.servers = append(d.servers, server)
+	}
+	sort.Strings(d.servers)
+	d.weights = weights
+	d.zones = zones
+	d.lastUpdate = time.Now()
+	return nil
+}
+
+func (d *MultiRegistryDiscovery) Get(mode SelectMode) (string, error) {
+	return d.GetWithContext(context.Background(), mode)
+}
+
+// GetWithContext is like Get, but the refresh is abandoned once ctx is done, see RefreshContext
+func (d *MultiRegistryDiscovery) GetWithContext(ctx context.Context, mode SelectMode) (string, error) {
+	if err := d.RefreshContext(ctx); err != nil {
+		return "", err
+	}
+	return d.MultiServersDiscovery.Get(mode)
+}
+
+// SetRefreshTimeout limits the time of getting the servers from each registry, 0 means no limit.
+func (d *MultiRegistryDiscovery) SetRefreshTimeout(timeout time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refreshTimeout = timeout
+}
+
+// SetHeaders sets the names of the headers the registries return the servers in, see RPCRegistryDiscovery.SetHeaders
+func (d *MultiRegistryDiscovery) SetHeaders(h registry.Headers) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.headers = h.WithDefaults()
+}
+
+// GetForKey refreshes the servers if needed and gets the server for key, see MultiServersDiscovery.GetForKey
+func (d *MultiRegistryDiscovery) GetForKey(mode SelectMode, key string) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServersDiscovery.GetForKey(mode, key)
+}
+
+func (d *MultiRegistryDiscovery) GetAll() ([]string, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.MultiServersDiscovery.GetAll()
+}
+
+// Snapshot refreshes the servers if needed and returns a consistent view of them
+func (d *MultiRegistryDiscovery) Snapshot() (*Snapshot, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.MultiServersDiscovery.Snapshot()
+}
+
+// NewMultiRegistryDiscovery creates a discovery which merges the servers of registries
+func NewMultiRegistryDiscovery(registries []string, timeout time.Duration) *MultiRegistryDiscovery {
+	if timeout == 0 {
+		timeout = defaultUpdateTimeout
+	}
+	return &MultiRegistryDiscovery{
+		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		registries:            registries,
+		timeout:               timeout,
+		refreshTimeout:        defaultRefreshTimeout,
+		headers:               registry.DefaultHeaders,
+	}
+}
@@ -1,8 +1,15 @@
 package xclient
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"simple_rpc/registry"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -11,14 +18,26 @@ import (
 // registry 即注册中心的地址
 // timeout 服务列表的过期时间
 // lastUpdate 是代表最后从注册中心更新服务列表的时间，默认 10s 过期，即 10s 之后，需要从注册中心更新新的列表。
+// service 不为空时只从注册中心获取提供该服务的地址，见 SetService。
+// refreshTimeout 限制每次从注册中心获取服务列表的时间，默认 5s，见 SetRefreshTimeout。
+// headers 是注册中心返回服务列表使用的 Header 名称，需要和注册中心的配置一致，见 SetHeaders。
 type RPCRegistryDiscovery struct {
 	*MultiServersDiscovery
-	registry   string
-	timeout    time.Duration
-	lastUpdate time.Time
+	registry       string
+	service        string
+	timeout        time.Duration
+	refreshTimeout time.Duration
+	headers        registry.Headers
+	lastUpdate     time.Time
+	refreshing     chan struct{} // closed once the ongoing refresh is done
 }
 
-const defaultUpdateTimeout = time.Second * 10
+var _ ContextDiscovery = (*RPCRegistryDiscovery)(nil)
+
+const (
+	defaultUpdateTimeout  = time.Second * 10
+	defaultRefreshTimeout = time.Second * 5
+)
 
 // Update 和 Refresh 方法，超时重新获取的逻辑在 Refresh 中实现：
 func (d *RPCRegistryDiscovery) Update(servers []string) error {
@@ -30,36 +49,202 @@ func (d *RPCRegistryDiscovery) Update(servers []string) error {
 }
 
 func (d *RPCRegistryDiscovery) Refresh() error {
+	return d.RefreshContext(context.Background())
+}
+
+// RefreshContext is like Refresh, but the request to the registry is abandoned once ctx is done
+// or the refresh timeout expires. If it fails, the last known servers are kept and served
+// until the list expires again, so an outage of the registry doesn't block every call,
+// it only returns the error if there are no servers known.
+// 请求注册中心时不持有锁，同一时刻只有一个调用方刷新，其他调用方在各自 ctx 的期限内等待本次刷新完成，
+// 期限先到时直接使用已知的服务列表，因此一次卡住的刷新不会让其他调用阻塞超过它们自己的期限。
+func (d *RPCRegistryDiscovery) RefreshContext(ctx context.Context) error {
 	d.mu.Lock()
-	defer d.mu.Unlock()
 	if d.lastUpdate.Add(d.timeout).After(time.Now()) {
+		d.mu.Unlock()
+		return nil
+	}
+	if refreshing := d.refreshing; refreshing != nil {
+		d.mu.Unlock()
+		return d.waitRefresh(ctx, refreshing)
+	}
+	refreshing := make(chan struct{})
+	d.refreshing = refreshing
+	registryAddr, service, timeout, headers := d.registry, d.service, d.refreshTimeout, d.headers
+	d.mu.Unlock()
+
+	log.Println("rpc registry: refresh servers from registry", registryAddr)
+	servers, weights, zones, err := fetchServers(ctx, registryAddr, service, timeout, headers)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refreshing = nil
+	close(refreshing)
+	if service != d.service {
+		// SetService is called meanwhile, the servers of the new service are refreshed on the next Get
 		return nil
 	}
-	log.Println("rpc registry: refresh servers from registry", d.registry)
-	resp, err := http.Get(d.registry)
 	if err != nil {
 		log.Println("rpc registry refresh err:", err)
+		if len(d.servers) == 0 {
+			return err
+		}
+		// keep serving the last known servers, and don't retry until they expire again
+		d.lastUpdate = time.Now()
+		return nil
+	}
+	d.servers = servers
+	d.weights = weights
+	d.zones = zones
+	d.lastUpdate = time.Now()
+	return nil
+}
+
+// waitRefresh waits for the refresh started by another caller until ctx is done,
+// it only fails if there are still no servers known.
+func (d *MultiServersDiscovery) waitRefresh(ctx context.Context, refreshing <-chan struct{}) error {
+	select {
+	case <-refreshing:
+	case <-ctx.Done():
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.servers) > 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	servers := strings.Split(resp.Header.Get("X-SimpleRpc-Servers"), ",")
-	d.servers = make([]string, 0, len(servers))
-	for _, server := range servers {
+	return errors.New("rpc discovery: no available servers")
+}
+
+// SetService makes the discovery only get the servers hosting service from the registry,
+// so calls aren't routed to servers which can't find it. The servers must report the services
+// they host, see registry.WithServices. Empty service means all servers.
+func (d *RPCRegistryDiscovery) SetService(service string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.service = service
+	d.lastUpdate = time.Time{} // refresh on the next Get
+}
+
+// SetRefreshTimeout limits the time of getting the servers from the registry, 0 means no limit.
+func (d *RPCRegistryDiscovery) SetRefreshTimeout(timeout time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refreshTimeout = timeout
+}
+
+// SetHeaders sets the names of the headers the registry returns the servers in,
+// they must be the same as the ones of the registry, see registry.SimpleRegistry.SetHeaders.
+func (d *RPCRegistryDiscovery) SetHeaders(h registry.Headers) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.headers = h.WithDefaults()
+}
+
+// fetchServers gets the alive servers hosting service and their weights and zones from the registry,
+// empty service means all servers. The request is abandoned once ctx is done or timeout expires, 0 means no limit.
+// A reply without a 2xx status is an error.
+func fetchServers(ctx context.Context, registryAddr, service string, timeout time.Duration, headers registry.Headers) ([]string, map[string]int, map[string]string, error) {
+	if service != "" {
+		u, err := url.Parse(registryAddr)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		q := u.Query()
+		q.Set("service", service)
+		u.RawQuery = q.Encode()
+		registryAddr = u.String()
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, registryAddr, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// prefer the JSON format, an old registry ignores Accept and replies with the headers
+	req.Header.Set("Accept", registry.ContentTypeJSON)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	// 401、404 或者代理返回的 502 既没有服务列表的 header 也没有 JSON body，不能当作空列表，否则会清空所有已知的服务
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, nil, errors.New("rpc registry: unexpected status " + resp.Status)
+	}
+	if registry.IsJSON(resp.Header.Get("Content-Type")) {
+		return decodeServers(resp.Body)
+	}
+	parts := strings.Split(resp.Header.Get(headers.Servers), ",")
+	servers := make([]string, 0, len(parts))
+	for _, server := range parts {
 		if strings.TrimSpace(server) != "" {
-			d.servers = append(d.servers, strings.TrimSpace(server))
+			servers = append(servers, strings.TrimSpace(server))
 		}
 	}
-	d.lastUpdate = time.Now()
-	return nil
+	weights := make(map[string]int)
+	zones := make(map[string]string)
+	for _, v := range resp.Header.Values(headers.Meta) {
+		meta, err := url.ParseQuery(v)
+		if err != nil {
+			continue
+		}
+		if w, err := strconv.Atoi(meta.Get("weight")); err == nil {
+			weights[meta.Get("addr")] = w
+		}
+		if zone := meta.Get("zone"); zone != "" {
+			zones[meta.Get("addr")] = zone
+		}
+	}
+	return servers, weights, zones, nil
+}
+
+// decodeServers decodes the servers and their weights and zones from the JSON body returned by the registry
+func decodeServers(body io.Reader) ([]string, map[string]int, map[string]string, error) {
+	var info registry.ServersInfo
+	if err := json.NewDecoder(body).Decode(&info); err != nil {
+		return nil, nil, nil, err
+	}
+	servers := make([]string, 0, len(info.Servers))
+	weights := make(map[string]int)
+	zones := make(map[string]string)
+	for _, s := range info.Servers {
+		servers = append(servers, s.Addr)
+		if s.Weight != 0 {
+			weights[s.Addr] = s.Weight
+		}
+		if s.Zone != "" {
+			zones[s.Addr] = s.Zone
+		}
+	}
+	return servers, weights, zones, nil
 }
 
 // Get 和 GetAll 与 MultiServersDiscovery 相似，唯一的不同在于，GeeRegistryDiscovery 需要先调用 Refresh 确保服务列表没有过期。
 func (d *RPCRegistryDiscovery) Get(mode SelectMode) (string, error) {
-	if err := d.Refresh(); err != nil {
+	return d.GetWithContext(context.Background(), mode)
+}
+
+// GetWithContext is like Get, but the refresh is abandoned once ctx is done, see RefreshContext
+func (d *RPCRegistryDiscovery) GetWithContext(ctx context.Context, mode SelectMode) (string, error) {
+	if err := d.RefreshContext(ctx); err != nil {
 		return "", err
 	}
 	return d.MultiServersDiscovery.Get(mode)
 }
 
+// GetForKey refreshes the servers if needed and gets the server for key, see MultiServersDiscovery.GetForKey
+func (d *RPCRegistryDiscovery) GetForKey(mode SelectMode, key string) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServersDiscovery.GetForKey(mode, key)
+}
+
 func (d *RPCRegistryDiscovery) GetAll() ([]string, error) {
 	if err := d.Refresh(); err != nil {
 		return nil, err
@@ -67,6 +252,14 @@ func (d *RPCRegistryDiscovery) GetAll() ([]string, error) {
 	return d.MultiServersDiscovery.GetAll()
 }
 
+// Snapshot refreshes the servers if needed and returns a consistent view of them
+func (d *RPCRegistryDiscovery) Snapshot() (*Snapshot, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.MultiServersDiscovery.Snapshot()
+}
+
 func NewRPCRegistryDiscovery(registerAddr string, timeout time.Duration) *RPCRegistryDiscovery {
 	if timeout == 0 {
 		timeout = defaultUpdateTimeout
@@ -75,6 +268,8 @@ func NewRPCRegistryDiscovery(registerAddr string, timeout time.Duration) *RPCReg
 		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
 		registry:              registerAddr,
 		timeout:               timeout,
+		refreshTimeout:        defaultRefreshTimeout,
+		headers:               registry.DefaultHeaders,
 	}
 	return d
 }
@@ -0,0 +1,312 @@
+package xclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"simple_rpc/registry"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// registryDiscovery is a discovery refreshing from registries
+type registryDiscovery interface {
+	Discovery
+	ContextDiscovery
+	SetRefreshTimeout(timeout time.Duration)
+}
+
+func TestRefreshContext_hungRegistry(t *testing.T) {
+	requested, release := make(chan struct{}, 1), make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	for _, newDiscovery := range []func() registryDiscovery{
+		func() registryDiscovery { return NewRPCRegistryDiscovery(ts.URL, time.Nanosecond) },
+		func() registryDiscovery { return NewMultiRegistryDiscovery([]string{ts.URL}, time.Nanosecond) },
+	} {
+		for _, known := range []bool{false, true} {
+			d := newDiscovery()
+			d.SetRefreshTimeout(0) // the refresh waits for the registry as long as its ctx allows
+			if known {
+				_ = d.Update([]string{"tcp@a"})
+			}
+			go func() { _ = d.Refresh() }()
+			<-requested
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+			start := time.Now()
+			server, err := d.GetWithContext(ctx, RandomSelect)
+			cancel()
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("%T: the call is blocked by the hung refresh for %s", d, elapsed)
+			}
+			if known && (err != nil || server != "tcp@a") {
+				t.Fatalf("%T: expect the last known server, got %q: %v", d, server, err)
+			}
+			if !known && err == nil {
+				t.Fatalf("%T: expect an error without servers, got %q", d, server)
+			}
+		}
+	}
+}
+
+// newRegistry starts a registry with addrs registered, each one with the metadata in metas if any
+func newRegistry(t *testing.T, addrs []string, metas ...url.Values) (*registry.SimpleRegistry, *httptest.Server) {
+	r := registry.New(0, 0)
+	for i, addr := range addrs {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set(registry.DefaultHeaders.Server, addr)
+		if i < len(metas) {
+			req.Header.Set(registry.DefaultHeaders.Meta, metas[i].Encode())
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+	return r, ts
+}
+
+func TestMultiRegistryDiscovery(t *testing.T) {
+	_, ts1 := newRegistry(t, []string{"tcp@a", "tcp@b"})
+	_, ts2 := newRegistry(t, []string{"tcp@b", "tcp@c"})
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	for _, c := range []struct {
+		registries []string
+		want       string
+	}{
+		{[]string{ts1.URL, ts2.URL}, "tcp@a,tcp@b,tcp@c"},
+		{[]string{ts1.URL, ts2.URL, down.URL}, "tcp@a,tcp@b,tcp@c"},
+		{[]string{down.URL, ts2.URL}, "tcp@b,tcp@c"},
+	} {
+		servers, err := NewMultiRegistryDiscovery(c.registries, time.Nanosecond).GetAll()
+		if got := strings.Join(servers, ","); err != nil || got != c.want {
+			t.Fatalf("registries %v: expect %s, got %s: %v", c.registries, c.want, got, err)
+		}
+	}
+
+	// the last known servers are kept once all registries are down
+	_, ts3 := newRegistry(t, []string{"tcp@d"})
+	d := NewMultiRegistryDiscovery([]string{ts3.URL, down.URL}, time.Nanosecond)
+	if servers, err := d.GetAll(); err != nil || strings.Join(servers, ",") != "tcp@d" {
+		t.Fatalf("expect tcp@d, got %v: %v", servers, err)
+	}
+	ts3.Close()
+	if servers, err := d.GetAll(); err != nil || strings.Join(servers, ",") != "tcp@d" {
+		t.Fatalf("expect the last known servers once all registries are down, got %v: %v", servers, err)
+	}
+	if _, err := NewMultiRegistryDiscovery([]string{down.URL}, 0).Get(RandomSelect); err == nil {
+		t.Fatal("expect an error if no registry is ever reachable")
+	}
+}
+
+func TestFetchServers(t *testing.T) {
+	r, ts := newRegistry(t, []string{"tcp@a", "tcp@b"}, url.Values{"weight": {"3"}, "zone": {"z1"}})
+	// an old registry only replies in the header format
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Header.Del("Accept")
+		r.ServeHTTP(w, req)
+	}))
+	defer old.Close()
+
+	for _, addr := range []string{ts.URL, old.URL} {
+		servers, weights, zones, err := fetchServers(context.Background(), addr, "", time.Second, registry.DefaultHeaders)
+		if err != nil || strings.Join(servers, ",") != "tcp@a,tcp@b" {
+			t.Fatalf("%s: expect both servers, got %v: %v", addr, servers, err)
+		}
+		if len(weights) != 1 || weights["tcp@a"] != 3 || len(zones) != 1 || zones["tcp@a"] != "z1" {
+			t.Fatalf("%s: unexpected weights %v or zones %v", addr, weights, zones)
+		}
+	}
+}
+
+func TestFetchServers_badStatus(t *testing.T) {
+	r, _ := newRegistry(t, []string{"tcp@a"})
+	var bad atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if bad.Load() {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		r.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	for _, newDiscovery := range []func() registryDiscovery{
+		func() registryDiscovery { return NewRPCRegistryDiscovery(ts.URL, time.Nanosecond) },
+		func() registryDiscovery { return NewMultiRegistryDiscovery([]string{ts.URL}, time.Nanosecond) },
+	} {
+		bad.Store(false)
+		d := newDiscovery()
+		if servers, err := d.GetAll(); err != nil || strings.Join(servers, ",") != "tcp@a" {
+			t.Fatalf("%T: expect tcp@a, got %v: %v", d, servers, err)
+		}
+		bad.Store(true)
+		if _, _, _, err := fetchServers(context.Background(), ts.URL, "", time.Second, registry.DefaultHeaders); err == nil {
+			t.Fatal("expect an error for a 502 reply")
+		}
+		time.Sleep(time.Millisecond) // the servers expire
+		if servers, err := d.GetAll(); err != nil || strings.Join(servers, ",") != "tcp@a" {
+			t.Fatalf("%T: expect the last good servers after a 502 reply, got %v: %v", d, servers, err)
+		}
+	}
+}
+
+func TestRPCRegistryDiscovery_SetHeaders(t *testing.T) {
+	h := registry.Headers{Server: "X-Node", Servers: "X-Nodes", Meta: "X-Node-Meta"}
+	r := registry.New(0, 0)
+	r.SetHeaders(h)
+	// only the header format carries the header names
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Header.Del("Accept")
+		req.Header.Del("Content-Type")
+		r.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := registry.HeartbeatContext(ctx, ts.URL, "tcp@a", time.Hour, registry.WithHeaders(h), registry.WithWeight(2))
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	d := NewRPCRegistryDiscovery(ts.URL, 0)
+	d.SetHeaders(h)
+	servers, err := d.GetAll()
+	if err != nil || strings.Join(servers, ",") != "tcp@a" || d.weights["tcp@a"] != 2 {
+		t.Fatalf("expect tcp@a with weight 2, got %v %v: %v", servers, d.weights, err)
+	}
+	if servers, _ := NewRPCRegistryDiscovery(ts.URL, 0).GetAll(); len(servers) != 0 {
+		t.Fatalf("the default header names shouldn't find the servers, got %v", servers)
+	}
+}
+
+func TestWeightedRoundRobinSelect(t *testing.T) {
+	for _, c := range []struct {
+		weights map[string]int // no weight is reported for the servers of -1
+		want    map[string]int // picks of each server in 600 picks
+	}{
+		{map[string]int{"tcp@a": 3, "tcp@b": 1}, map[string]int{"tcp@a": 450, "tcp@b": 150}},
+		{map[string]int{"tcp@a": 3, "tcp@b": 0, "tcp@c": -2, "tcp@d": -1}, map[string]int{"tcp@a": 300, "tcp@b": 100, "tcp@c": 100, "tcp@d": 100}},
+	} {
+		ts := httptest.NewServer(registry.New(0, 0))
+		ctx, cancel := context.WithCancel(context.Background())
+		var stopped []<-chan struct{}
+		for addr, w := range c.weights {
+			var opts []registry.HeartbeatOption
+			if w != -1 {
+				opts = append(opts, registry.WithWeight(w))
+			}
+			stopped = append(stopped, registry.HeartbeatContext(ctx, ts.URL, addr, time.Hour, opts...))
+		}
+
+		d := NewRPCRegistryDiscovery(ts.URL, 0)
+		picks := make(map[string]int)
+		for i := 0; i < 600; i++ {
+			server, err := d.Get(WeightedRoundRobinSelect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			picks[server]++
+		}
+		for server, n := range c.want {
+			if picks[server] != n {
+				t.Fatalf("weights %v: expect %v picks, got %v", c.weights, c.want, picks)
+			}
+		}
+		cancel()
+		for _, done := range stopped {
+			<-done
+		}
+		ts.Close()
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"tcp@a", "tcp@b"})
+	d.SetWeights(map[string]int{"tcp@a": 3})
+	s, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// later updates and changes of the returned servers don't affect the snapshot
+	_ = d.Update([]string{"tcp@c"})
+	d.SetWeights(nil)
+	s.Servers()[0] = "tcp@x"
+	if servers := strings.Join(s.Servers(), ","); servers != "tcp@a,tcp@b" || s.Weight("tcp@a") != 3 || s.Weight("tcp@b") != 1 {
+		t.Fatalf("unexpected snapshot %s with weights %d, %d", servers, s.Weight("tcp@a"), s.Weight("tcp@b"))
+	}
+
+	// the built-in balancers can be shared by the picks in several goroutines
+	for _, mode := range []SelectMode{RandomSelect, RoundRobinSelect, WeightedRoundRobinSelect, LocalityAwareSelect, ConsistentHashSelect} {
+		b, _ := NewBalancer(mode)
+		var mu sync.Mutex
+		picks := make(map[string]int)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					server, err := s.Pick(b)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					picks[server]++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if mode == WeightedRoundRobinSelect && (picks["tcp@a"] != 300 || picks["tcp@b"] != 100) {
+			t.Fatalf("expect the weights of the snapshot to be used, got %v", picks)
+		}
+		if picks["tcp@a"]+picks["tcp@b"] != 400 {
+			t.Fatalf("mode %d: only the servers of the snapshot should be picked, got %v", mode, picks)
+		}
+	}
+}
+
+func TestLocalityAwareSelect(t *testing.T) {
+	_, ts := newRegistry(t, []string{"tcp@a", "tcp@b", "tcp@c"},
+		url.Values{"zone": {"z1"}}, url.Values{"zone": {"z2"}}, url.Values{"zone": {"z1"}})
+	d := NewRPCRegistryDiscovery(ts.URL, 0)
+	d.SetLocalZone("z1")
+
+	picks := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		server, err := d.Get(LocalityAwareSelect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[server]++
+	}
+	if picks["tcp@a"] != 5 || picks["tcp@c"] != 5 {
+		t.Fatalf("expect the servers in the local zone in turn, got %v", picks)
+	}
+	if servers, _ := d.GetAll(); strings.Join(servers, ",") != "tcp@a,tcp@c,tcp@b" {
+		t.Fatalf("expect the servers in the local zone first, got %v", servers)
+	}
+
+	// fall back to the other zones once no server in the local zone is available
+	d.Evict("tcp@a")
+	d.Evict("tcp@c")
+	if server, err := d.Get(LocalityAwareSelect); err != nil || server != "tcp@b" {
+		t.Fatalf("expect the server in the other zone, got %q: %v", server, err)
+	}
+}
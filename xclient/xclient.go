@@ -2,18 +2,25 @@ package xclient
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"reflect"
 	. "simple_rpc"
+	"strings"
 	"sync"
+	"time"
 )
 
 type XClient struct {
-	d       Discovery
-	mode    SelectMode
-	opt     *Option
-	mu      sync.Mutex // protect following
-	clients map[string]*Client
+	d           Discovery
+	mode        SelectMode
+	opt         *Option
+	dialer      Dialer     // nil means XDial, see SetDialer
+	retryBroken bool       // see SetRetryBrokenCalls
+	mu          sync.Mutex // protect following
+	clients     map[string]*Client
 }
 
 var _ io.Closer = (*XClient)(nil)
@@ -24,6 +31,33 @@ func NewXClient(d Discovery, mode SelectMode, opt *Option) *XClient {
 	return &XClient{d: d, mode: mode, opt: opt, clients: make(map[string]*Client)}
 }
 
+// SetDialer makes the XClient connect to the servers through dialer instead of the network,
+// eg, PipeListener.Dial for servers in the same process. The protocol and address of the server
+// are passed to dialer, it should be called before the first call.
+func (xc *XClient) SetDialer(dialer Dialer) {
+	xc.dialer = dialer
+}
+
+// SetRetryBrokenCalls makes Call retry the routed calls whose connection breaks after the request is sent,
+// the same way as the ones whose server can't be dialed, see Call. It should be called before the first call.
+// 这类请求可能已经被服务端执行，只有方法是幂等的，或者调用携带了幂等键（见 simple_rpc.IdempotencyKey）
+// 并且服务端开启了 SetIdempotencyCache 时，才应该开启。
+func (xc *XClient) SetRetryBrokenCalls(enabled bool) {
+	xc.retryBroken = enabled
+}
+
+// xdial connects to the server at rpcAddr with the format protocol@addr
+func (xc *XClient) xdial(rpcAddr string) (*Client, error) {
+	if xc.dialer == nil {
+		return XDial(rpcAddr, xc.opt)
+	}
+	parts := strings.Split(rpcAddr, "@")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("rpc client err: wrong format '%s', expect protocol@addr", rpcAddr)
+	}
+	return DialWith(xc.dialer, parts[0], parts[1], xc.opt)
+}
+
 func (xc *XClient) Close() error {
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
@@ -49,7 +83,7 @@ func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 	}
 	if client == nil {
 		var err error
-		client, err = XDial(rpcAddr, xc.opt)
+		client, err = xc.xdial(rpcAddr)
 		if err != nil {
 			return nil, err
 		}
@@ -58,6 +92,82 @@ func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 	return client, nil
 }
 
+// Warmup dials all servers of the discovery ahead of the calls, so the first call to each server
+// doesn't pay for the connection and the Option handshake.
+// 每个服务实例并发拨号，遵循 Option 的 ConnectTimeout；已有可用连接的实例会被跳过。
+// 个别实例不可达不会影响其他实例的预热，返回的错误汇总了失败的实例，成功建立的连接仍会被缓存。
+// ctx 结束时 Warmup 立即返回，尚未完成的拨号在后台继续，完成后同样会被缓存。
+// 服务列表更新后（例如 Refresh 之后）调用 Warmup，可以提前消化新实例的冷启动开销。
+func (xc *XClient) Warmup(ctx context.Context) error {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return err
+	}
+	errs := make(chan error, len(servers))
+	for _, rpcAddr := range servers {
+		go func(rpcAddr string) {
+			errs <- xc.warmup(rpcAddr)
+		}(rpcAddr)
+	}
+	var failed []string
+	for range servers {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			if err != nil {
+				failed = append(failed, err.Error())
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("rpc xclient: warmup failed for %d of %d servers: %s", len(failed), len(servers), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// warmup is like dial, but it doesn't hold the lock while dialing, so servers are dialed concurrently
+func (xc *XClient) warmup(rpcAddr string) error {
+	xc.mu.Lock()
+	client, ok := xc.clients[rpcAddr]
+	xc.mu.Unlock()
+	if ok && client.IsAvailable() {
+		return nil
+	}
+	client, err := xc.xdial(rpcAddr)
+	if err != nil {
+		return fmt.Errorf("%s: %w", rpcAddr, err)
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if old, ok := xc.clients[rpcAddr]; ok {
+		if old.IsAvailable() {
+			// dialed by a call meanwhile
+			_ = client.Close()
+			return nil
+		}
+		_ = old.Close()
+	}
+	xc.clients[rpcAddr] = client
+	return nil
+}
+
+// EvictServer stops using the server at rpcAddr immediately, eg, when the node is deprovisioned.
+// 服务会从 Discovery 的服务列表中移除（需要 Discovery 实现 Evicter），直到下一次 Update 或 Refresh 再次报告它；
+// 同时关闭到该服务的连接，进行中的调用立即以 ErrTransport 失败，上层可以据此重试其他服务。
+func (xc *XClient) EvictServer(rpcAddr string) {
+	if e, ok := xc.d.(Evicter); ok {
+		e.Evict(rpcAddr)
+	}
+	xc.mu.Lock()
+	client, ok := xc.clients[rpcAddr]
+	delete(xc.clients, rpcAddr)
+	xc.mu.Unlock()
+	if ok {
+		_ = client.Close()
+	}
+}
+
 func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
 	client, err := xc.dial(rpcAddr)
 	if err != nil {
@@ -66,15 +176,99 @@ func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod strin
 	return client.Call(ctx, serviceMethod, args, reply)
 }
 
+// tryCall is like call, but also reports whether the server is down: unsent is true if it can't be dialed,
+// so the request is never sent; broken is true if the connection is broken during the call,
+// the request may have been handled by the server.
+func (xc *XClient) tryCall(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) (unsent, broken bool, err error) {
+	client, err := xc.dial(rpcAddr)
+	if err != nil {
+		return true, false, err
+	}
+	err = client.Call(ctx, serviceMethod, args, reply)
+	if err == nil {
+		return false, false, nil
+	}
+	var ne net.Error
+	broken = errors.Is(err, ErrTransport) || errors.Is(err, ErrShutdown) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.As(err, &ne) && !ne.Timeout() || !client.IsAvailable()
+	return false, broken, err
+}
+
+type routeKey struct{}
+
+// WithRouteKey returns a copy of ctx which makes XClient.Call route the calls made with it by key,
+// with ConsistentHashSelect calls of the same key, eg, a session id, go to the same server,
+// while different keys are spread across the servers. It has no effect if the discovery isn't a KeyedDiscovery.
+func WithRouteKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, routeKey{}, key)
+}
+
+// get selects a server for a call made with ctx, the discovery is refreshed with ctx if it's a ContextDiscovery
+func (xc *XClient) get(ctx context.Context) (string, error) {
+	cd, ok := xc.d.(ContextDiscovery)
+	if key, _ := ctx.Value(routeKey{}).(string); key != "" {
+		if kd, keyed := xc.d.(KeyedDiscovery); keyed {
+			if ok {
+				if err := cd.RefreshContext(ctx); err != nil {
+					return "", err
+				}
+			}
+			return kd.GetForKey(xc.mode, key)
+		}
+	}
+	if ok {
+		return cd.GetWithContext(ctx, xc.mode)
+	}
+	return xc.d.Get(xc.mode)
+}
+
 // Call invokes the named function, waits for it to complete,
 // and returns its error status.
 // xc will choose a proper server.
+// 如果服务端因过载拒绝了请求并给出了 RetryAfter 建议，Call 会等待建议的时间后重新选择服务实例重试一次，
+// 没有建议时直接返回错误，由调用方决定如何处理。通过 WithRouteKey 指定了 key 的调用，重试时仍然选择同一个服务。
+// key 固定的服务无法连接时，请求还没有发出，Call 会先剔除该服务（见 EvictServer），
+// 再在哈希环上的下一个服务重试一次，此后 key 固定到新的服务，直到原服务被 Refresh 重新报告；
+// 连接在请求发出之后断开时，请求可能已经被执行，默认不重试，见 SetRetryBrokenCalls。
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	rpcAddr, err := xc.d.Get(xc.mode)
+	_, err := xc.CallWithServer(ctx, serviceMethod, args, reply)
+	return err
+}
+
+// CallWithServer is like Call, but also returns the address of the server the call is sent to,
+// if the call is retried, it's the server of the last attempt. addr is empty if no server is selected.
+// If no server can be selected for the retry, the error of the first attempt is returned with its server.
+// 便于在日志中定位表现异常的服务实例，或者在调用方实现自己的路由策略。
+func (xc *XClient) CallWithServer(ctx context.Context, serviceMethod string, args, reply interface{}) (addr string, err error) {
+	rpcAddr, err := xc.get(ctx)
 	if err != nil {
-		return err
+		return "", err
+	}
+	unsent, broken, err := xc.tryCall(rpcAddr, ctx, serviceMethod, args, reply)
+	if key, _ := ctx.Value(routeKey{}).(string); key != "" && (unsent || broken && xc.retryBroken) {
+		// the pinned server is down, evict it so the key is pinned to the next server on the ring
+		xc.EvictServer(rpcAddr)
+		next, e := xc.get(ctx)
+		if e != nil || next == rpcAddr {
+			return rpcAddr, err
+		}
+		return next, xc.call(next, ctx, serviceMethod, args, reply)
+	}
+	d, ok := RetryAfter(err)
+	if !ok || !errors.Is(err, ErrOverloaded) {
+		return rpcAddr, err
+	}
+	select {
+	case <-ctx.Done():
+		return rpcAddr, err
+	case <-time.After(d):
+	}
+	next, e := xc.get(ctx)
+	if e != nil {
+		// no server to retry, report the attempt made
+		return rpcAddr, err
 	}
-	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+	return next, xc.call(next, ctx, serviceMethod, args, reply)
 }
 
 // Broadcast invokes the named function for every server registered in discovery
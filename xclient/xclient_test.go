@@ -0,0 +1,298 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	. "simple_rpc"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Who replies the name of the server it's registered to
+type Who string
+
+func (w Who) Name(_ int, reply *string) error {
+	*reply = string(w)
+	return nil
+}
+
+// testServers are in-memory servers, the one named name is at "pipe@<name>"
+type testServers struct {
+	mu        sync.Mutex // protect following
+	listeners map[string]*PipeListener
+	servers   map[string]*Server
+	dials     map[string]int
+}
+
+// startServers starts a server for each name, they are stopped once the test ends
+func startServers(t *testing.T, names ...string) *testServers {
+	ts := &testServers{
+		listeners: make(map[string]*PipeListener),
+		servers:   make(map[string]*Server),
+		dials:     make(map[string]int),
+	}
+	for _, name := range names {
+		server := NewServer()
+		_ = server.Register(Who(name))
+		lis := NewPipeListener()
+		go func() { _ = server.Accept(lis) }()
+		ts.listeners[name], ts.servers[name] = lis, server
+	}
+	t.Cleanup(func() {
+		for _, name := range names {
+			ts.stop(name)
+		}
+	})
+	return ts
+}
+
+// dial connects to the server named address, it's a Dialer
+func (ts *testServers) dial(network, address string) (net.Conn, error) {
+	ts.mu.Lock()
+	lis := ts.listeners[address]
+	ts.dials[address]++
+	ts.mu.Unlock()
+	if lis == nil {
+		return nil, errors.New("unknown server " + address)
+	}
+	return lis.Dial(network, address)
+}
+
+// stop shuts the server named name down, it can't be dialed any more
+func (ts *testServers) stop(name string) {
+	ts.mu.Lock()
+	lis, server := ts.listeners[name], ts.servers[name]
+	delete(ts.servers, name)
+	ts.mu.Unlock()
+	if server == nil {
+		return
+	}
+	_ = lis.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = server.Shutdown(ctx)
+}
+
+// seqDiscovery returns its servers one by one, then it fails
+type seqDiscovery struct {
+	servers []string
+}
+
+func (d *seqDiscovery) Refresh() error { return nil }
+
+func (d *seqDiscovery) Update(servers []string) error {
+	d.servers = servers
+	return nil
+}
+
+func (d *seqDiscovery) Get(mode SelectMode) (string, error) {
+	if len(d.servers) == 0 {
+		return "", errors.New("rpc discovery: no available servers")
+	}
+	server := d.servers[0]
+	d.servers = d.servers[1:]
+	return server, nil
+}
+
+func (d *seqDiscovery) GetAll() ([]string, error) {
+	return d.servers, nil
+}
+
+func TestXClient_CallWithServer(t *testing.T) {
+	servers := startServers(t, "a", "b", "busy")
+	servers.servers["busy"].SetOverloadPredicate(func() bool { return true })
+	servers.servers["busy"].SetRetryAfter(time.Millisecond)
+
+	for _, c := range []struct {
+		servers []string
+		addr    string
+		name    string
+		err     error
+	}{
+		{[]string{"pipe@a"}, "pipe@a", "a", nil},
+		{[]string{"pipe@busy", "pipe@b"}, "pipe@b", "b", nil},   // retried on another server
+		{[]string{"pipe@busy"}, "pipe@busy", "", ErrOverloaded}, // no server to retry
+	} {
+		xc := NewXClient(&seqDiscovery{servers: c.servers}, RandomSelect, nil)
+		xc.SetDialer(servers.dial)
+		var name string
+		addr, err := xc.CallWithServer(context.Background(), "Who.Name", 0, &name)
+		if addr != c.addr || name != c.name || !errors.Is(err, c.err) {
+			t.Fatalf("servers %v: expect %s replying %q with %v, got %s replying %q with %v", c.servers, c.addr, c.name, c.err, addr, name, err)
+		}
+		_ = xc.Close()
+	}
+}
+
+func TestXClient_WithRouteKey(t *testing.T) {
+	servers := startServers(t, "a", "b", "c")
+	xc := NewXClient(NewMultiServerDiscovery([]string{"pipe@a", "pipe@b", "pipe@c"}), ConsistentHashSelect, nil)
+	xc.SetDialer(servers.dial)
+	defer func() { _ = xc.Close() }()
+	call := func(key string) string {
+		var name string
+		addr, err := xc.CallWithServer(WithRouteKey(context.Background(), key), "Who.Name", 0, &name)
+		if err != nil || addr != "pipe@"+name {
+			t.Fatalf("key %s: failed to call %s: %v", key, addr, err)
+		}
+		return name
+	}
+
+	// the same key goes to the same server, different keys are spread
+	pinned := make(map[string]string)
+	used := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		key := "session-" + strconv.Itoa(i)
+		pinned[key] = call(key)
+		used[pinned[key]] = true
+		for j := 0; j < 3; j++ {
+			if name := call(key); name != pinned[key] {
+				t.Fatalf("key %s moves from %s to %s", key, pinned[key], name)
+			}
+		}
+	}
+	if len(used) < 2 {
+		t.Fatalf("keys should be spread across the servers, only %v is used", used)
+	}
+
+	// the keys of a server which can't be dialed are re-pinned, the others stay
+	servers.stop(pinned["session-0"])
+	for xc.clients["pipe@"+pinned["session-0"]].IsAvailable() {
+		time.Sleep(time.Millisecond) // the connection is closed by the shutdown
+	}
+	for key, name := range pinned {
+		got := call(key)
+		if name == pinned["session-0"] && got == name || name != pinned["session-0"] && got != name {
+			t.Fatalf("key %s pinned to %s goes to %s once %s is down", key, name, got, pinned["session-0"])
+		}
+		if again := call(key); again != got {
+			t.Fatalf("key %s should be re-pinned to %s, got %s", key, got, again)
+		}
+	}
+}
+
+func TestXClient_SetRetryBrokenCalls(t *testing.T) {
+	for _, retry := range []bool{false, true} {
+		names := []string{"a", "b", "c"}
+		servers := startServers(t, names...)
+		holds := make(map[string]Hold)
+		for _, name := range names {
+			holds[name] = make(Hold)
+			_ = servers.servers[name].Register(holds[name])
+		}
+		xc := NewXClient(NewMultiServerDiscovery([]string{"pipe@a", "pipe@b", "pipe@c"}), ConsistentHashSelect, nil)
+		xc.SetDialer(servers.dial)
+		xc.SetRetryBrokenCalls(retry)
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := xc.CallWithServer(WithRouteKey(context.Background(), "k"), "Hold.Wait", 0, new(int))
+			done <- err
+		}()
+		pinned := ""
+		for pinned == "" {
+			for _, name := range names {
+				if servers.servers[name].InflightRequests() > 0 {
+					pinned = name
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+		for _, name := range names {
+			if name != pinned {
+				close(holds[name])
+			}
+		}
+		// the connection breaks after the request is sent
+		xc.mu.Lock()
+		_ = xc.clients["pipe@"+pinned].Close()
+		xc.mu.Unlock()
+		if err := <-done; retry != (err == nil) {
+			t.Fatalf("retry %v: unexpected result of the broken call: %v", retry, err)
+		}
+		close(holds[pinned])
+		_ = xc.Close()
+	}
+}
+
+func TestXClient_Warmup(t *testing.T) {
+	servers := startServers(t, "a", "b")
+	xc := NewXClient(NewMultiServerDiscovery([]string{"pipe@a", "pipe@b", "pipe@gone"}), RoundRobinSelect, nil)
+	xc.SetDialer(servers.dial)
+	defer func() { _ = xc.Close() }()
+
+	err := xc.Warmup(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "1 of 3") || !strings.Contains(err.Error(), "pipe@gone") {
+		t.Fatalf("expect the unreachable server in the error, got %v", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		var reply string
+		if err := xc.call("pipe@"+name, context.Background(), "Who.Name", 0, &reply); err != nil || reply != name {
+			t.Fatalf("failed to call %s: %v", name, err)
+		}
+	}
+	// the connections are cached, and a warmup again only dials the unreachable server
+	_ = xc.Warmup(context.Background())
+	servers.mu.Lock()
+	defer servers.mu.Unlock()
+	if servers.dials["a"] != 1 || servers.dials["b"] != 1 || servers.dials["gone"] != 2 {
+		t.Fatalf("expect the servers dialed once by the warmup, got %v", servers.dials)
+	}
+}
+
+// Hold blocks the calls until it's closed
+type Hold chan struct{}
+
+func (h Hold) Wait(_ int, reply *int) error {
+	<-h
+	return nil
+}
+
+func TestXClient_EvictServer(t *testing.T) {
+	servers := startServers(t, "a", "b")
+	hold := make(Hold)
+	defer close(hold)
+	_ = servers.servers["a"].Register(hold)
+	d := NewMultiServerDiscovery([]string{"pipe@a", "pipe@b"})
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	xc.SetDialer(servers.dial)
+	defer func() { _ = xc.Close() }()
+
+	done := make(chan error, 1)
+	go func() { done <- xc.call("pipe@a", context.Background(), "Hold.Wait", 0, new(int)) }()
+	for servers.servers["a"].InflightRequests() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	xc.EvictServer("pipe@a")
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrTransport) {
+			t.Fatalf("expect the call in flight to fail with ErrTransport, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the call in flight should be aborted")
+	}
+
+	picks := func() map[string]int {
+		names := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			var name string
+			if err := xc.Call(context.Background(), "Who.Name", 0, &name); err != nil {
+				t.Fatal(err)
+			}
+			names[name]++
+		}
+		return names
+	}
+	if names := picks(); names["b"] != 4 {
+		t.Fatalf("the evicted server shouldn't be selected, got %v", names)
+	}
+	_ = d.Update([]string{"pipe@a", "pipe@b"})
+	if names := picks(); names["a"] != 2 || names["b"] != 2 {
+		t.Fatalf("the server should be selected again once it's reported, got %v", names)
+	}
+}